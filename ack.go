@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AckEscalation re-notifies about received SMS that stay unacknowledged
+type AckEscalation struct {
+	After time.Duration // time between re-notifications
+	Limit int           // re-notifications per message
+}
+
+// AckRequest represents the acknowledgment of a received SMS
+type AckRequest struct {
+	By string `json:"by"` // acknowledging system or user, defaults to the API key
+}
+
+// LoadAckEscalation reads escalation settings from environment variables.
+// It returns nil if ACK_ESCALATE_AFTER is not set.
+func LoadAckEscalation() (*AckEscalation, error) {
+	afterStr := os.Getenv("ACK_ESCALATE_AFTER")
+	if afterStr == "" {
+		return nil, nil
+	}
+
+	after, err := time.ParseDuration(afterStr)
+	if err != nil || after < time.Minute {
+		return nil, fmt.Errorf("ACK_ESCALATE_AFTER: invalid duration %q (minimum 1m)", afterStr)
+	}
+
+	limit := 3
+	if limitStr := os.Getenv("ACK_ESCALATE_LIMIT"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("ACK_ESCALATE_LIMIT: invalid count %q", limitStr)
+		}
+	}
+
+	return &AckEscalation{After: after, Limit: limit}, nil
+}
+
+// GetReceivedSMSByID retrieves a received SMS, returning nil if it does not exist
+func (d *Database) GetReceivedSMSByID(id int) (*ReceivedSMS, error) {
+	msg, err := scanReceivedSMS(d.db.QueryRow(`SELECT `+d.receivedSMSColumns()+` FROM received_sms WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SMS: %w", err)
+	}
+
+	return &msg, nil
+}
+
+// AckReceivedSMS acknowledges a received SMS, reporting whether it was unacknowledged
+func (d *Database) AckReceivedSMS(id int, by string) (bool, error) {
+	res, err := d.db.Exec(`UPDATE received_sms SET acked_at = ?, acked_by = ? WHERE id = ? AND acked_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), by, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to acknowledge SMS: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GetUnackedSMS retrieves unacknowledged received SMS, oldest first
+func (d *Database) GetUnackedSMS(limit, offset int) ([]ReceivedSMS, error) {
+	rows, err := d.db.Query(`
+		SELECT `+d.receivedSMSColumns()+`
+		FROM received_sms
+		WHERE acked_at IS NULL
+		ORDER BY timestamp ASC
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SMS: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []ReceivedSMS{}
+	for rows.Next() {
+		msg, err := scanReceivedSMS(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return messages, nil
+}
+
+// GetSMSToEscalate retrieves unacknowledged SMS due for their next
+// re-notification. Messages older than the whole escalation period, such as
+// those received before escalation was enabled, are skipped.
+func (d *Database) GetSMSToEscalate(esc *AckEscalation, now time.Time) ([]ReceivedSMS, error) {
+	rows, err := d.db.Query(`
+		SELECT `+d.receivedSMSColumns()+`
+		FROM received_sms
+		WHERE acked_at IS NULL AND escalations < ? AND created_at >= ?
+		ORDER BY id
+	`, esc.Limit, now.Add(-esc.After*time.Duration(esc.Limit+1)).UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SMS: %w", err)
+	}
+	defer rows.Close()
+
+	var due []ReceivedSMS
+	for rows.Next() {
+		msg, err := scanReceivedSMS(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if !now.Before(msg.CreatedAt.Add(esc.After * time.Duration(msg.Escalations+1))) {
+			due = append(due, msg)
+		}
+	}
+
+	return due, rows.Err()
+}
+
+// IncrementEscalations counts a re-notification of a received SMS
+func (d *Database) IncrementEscalations(id int) error {
+	_, err := d.db.Exec(`UPDATE received_sms SET escalations = escalations + 1 WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to update SMS: %w", err)
+	}
+
+	return nil
+}
+
+// runAckEscalationJob re-notifies about unacknowledged SMS every minute
+func (app *App) runAckEscalationJob() {
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		due, err := app.db.GetSMSToEscalate(app.ackEscalation, clock.Now())
+		if err != nil {
+			log.Printf("Escalation: %v", err)
+			continue
+		}
+
+		for _, msg := range due {
+			app.escalate(msg)
+		}
+	}
+}
+
+// escalate re-notifies about an unacknowledged SMS through WebSocket,
+// webhooks and the fallback channels by publishing message.escalated. Muted
+// numbers are only counted.
+func (app *App) escalate(msg ReceivedSMS) {
+	if err := app.db.IncrementEscalations(msg.ID); err != nil {
+		log.Printf("Escalation: %v", err)
+		return
+	}
+	msg.Escalations++
+
+	if muted, err := app.db.IsMuted(msg.Number); err == nil && muted {
+		return
+	}
+
+	log.Printf("Escalating unacknowledged SMS %d from %s (%d/%d)", msg.ID, msg.Number, msg.Escalations, app.ackEscalation.Limit)
+
+	app.events.Publish(EventMessageEscalated, msg)
+}
+
+// escalatedEvent is the WebSocket and webhook payload of a message.escalated event
+func escalatedEvent(msg ReceivedSMS) gin.H {
+	event := receivedEvent(msg)
+	event["escalations"] = msg.Escalations
+	return event
+}
+
+// ackReceivedSMS acknowledges a received SMS
+func (app *App) ackReceivedSMS(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	var req AckRequest
+	if c.Request.ContentLength != 0 && !bindStrictJSON(c, &req) {
+		return
+	}
+	if req.By == "" {
+		req.By = keyIDFromContext(c)
+	}
+
+	acked, err := app.db.AckReceivedSMS(id, req.By)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to acknowledge message: %v", err))
+		return
+	}
+
+	msg, err := app.db.GetReceivedSMSByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+	if msg == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+	if !acked {
+		resp := errorResponse(c, CodeConflict, "Message %d was already acknowledged by %s", id, msg.AckedBy)
+		resp.Details = gin.H{"acked_at": msg.AckedAt, "acked_by": msg.AckedBy}
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+
+	log.Printf("SMS %d acknowledged by %s", id, req.By)
+	app.events.Publish(EventMessageAcked, AckEvent{ID: id, AckedBy: req.By, AckedAt: msg.AckedAt})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": msg,
+	})
+}
+
+// getUnackedSMS lists unacknowledged received SMS, oldest first
+func (app *App) getUnackedSMS(c *gin.Context) {
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	messages, err := app.db.GetUnackedSMS(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	app.loadMessageLabels().receivedList(messages)
+	c.JSON(http.StatusOK, SMSListResponse{
+		Status:   "success",
+		Total:    len(messages),
+		Count:    len(messages),
+		Messages: messages,
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in the code field of error responses
+const (
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeInvalidNumber        = "INVALID_NUMBER"
+	CodeInvalidContent       = "INVALID_CONTENT"
+	CodeInvalidSenderID      = "INVALID_SENDER_ID"
+	CodeNumberBlocked        = "NUMBER_BLOCKED"
+	CodeConfirmationRequired = "CONFIRMATION_REQUIRED"
+	CodeTemplateNotApproved  = "TEMPLATE_NOT_APPROVED"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeNotFound             = "NOT_FOUND"
+	CodeConflict             = "CONFLICT"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeQuotaExceeded        = "QUOTA_EXCEEDED"
+	CodeQueueFull            = "QUEUE_FULL"
+	CodeDeviceNotConnected   = "DEVICE_NOT_CONNECTED"
+	CodeGSMNotReady          = "GSM_NOT_READY"
+	CodeSendFailed           = "SEND_FAILED"
+	CodeSendCancelled        = "SEND_CANCELLED"
+	CodeMaintenanceMode      = "MAINTENANCE_MODE"
+	CodeReadOnlyMode         = "READ_ONLY_MODE"
+	CodeNotConfigured        = "NOT_CONFIGURED"
+	CodeUpstreamError        = "UPSTREAM_ERROR"
+	CodeInternalError        = "INTERNAL_ERROR"
+)
+
+// requestIDContextKey is the gin context key holding the request ID
+const requestIDContextKey = "request_id"
+
+// APIError is an error with a machine-readable code, e.g. a validation failure
+type APIError struct {
+	Code   string
+	format string
+	args   []any
+}
+
+// Error returns the English message
+func (e *APIError) Error() string {
+	return fmt.Sprintf(e.format, e.args...)
+}
+
+// Localize returns the message in locale
+func (e *APIError) Localize(locale string) string {
+	return T(locale, e.format, e.args...)
+}
+
+// apiErrorf creates an APIError with a formatted message
+func apiErrorf(code, format string, args ...any) *APIError {
+	return &APIError{Code: code, format: format, args: args}
+}
+
+// errorMessage returns the message of err in locale: the translation of the
+// APIError in its chain, or its untranslated text
+func errorMessage(err error, locale string) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Localize(locale)
+	}
+	return err.Error()
+}
+
+// errorCode returns the code of the APIError in err's chain, or fallback
+func errorCode(err error, fallback string) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return fallback
+}
+
+// errorResponse builds an error response carrying the request's ID, with the
+// message translated to the request's locale
+func errorResponse(c *gin.Context, code, format string, args ...any) SMSResponse {
+	return SMSResponse{
+		Status:    "error",
+		Code:      code,
+		Message:   T(localeFromContext(c), format, args...),
+		RequestID: c.GetString(requestIDContextKey),
+	}
+}
+
+// sendErrorCode returns the error code of a failed send
+func sendErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrNotConnected):
+		return CodeDeviceNotConnected
+	case errors.Is(err, ErrSendCancelled):
+		return CodeSendCancelled
+	}
+
+	switch ClassifyError(err) {
+	case ErrorClassNoNetwork:
+		return CodeGSMNotReady
+	case ErrorClassInvalidNumber:
+		return CodeInvalidNumber
+	}
+	return CodeSendFailed
+}
+
+// apiErrorStatus returns the HTTP status of an APIError's code
+func apiErrorStatus(code string) int {
+	switch code {
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeConflict:
+		return http.StatusConflict
+	case CodeMaintenanceMode, CodeReadOnlyMode:
+		return http.StatusServiceUnavailable
+	case CodeInternalError:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// sendErrorResponse returns the HTTP status and error response of a failed
+// send, or of a send request rejected with an APIError
+func sendErrorResponse(c *gin.Context, err error) (int, SMSResponse) {
+	var apiErr *APIError
+	var throttleErr *ThrottleError
+	switch {
+	case errors.Is(err, ErrNotConnected):
+		return http.StatusServiceUnavailable, errorResponse(c, CodeDeviceNotConnected, "Not connected to Arduino device")
+	case errors.Is(err, ErrSendCancelled):
+		return http.StatusConflict, errorResponse(c, CodeSendCancelled, "%v", err)
+	case errors.As(err, &throttleErr):
+		return throttledResponse(c, throttleErr)
+	case errors.As(err, &apiErr):
+		return apiErrorStatus(apiErr.Code), errorResponse(c, apiErr.Code, apiErr.format, apiErr.args...)
+	}
+
+	resp := errorResponse(c, sendErrorCode(err), "Failed to send SMS: %v", err)
+	resp.Details = gin.H{"error_class": ClassifyError(err)}
+	return http.StatusInternalServerError, resp
+}
+
+// runModeErrorCode returns the error code of requests rejected in a runtime mode
+func runModeErrorCode(mode string) string {
+	if mode == RunModeMaintenance {
+		return CodeMaintenanceMode
+	}
+	return CodeReadOnlyMode
+}
+
+// requestIDMiddleware assigns every request an ID, taken from a valid
+// X-Request-ID header or generated, and echoes it in the response
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID(id) {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+
+		c.Set(requestIDContextKey, id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// validRequestID reports whether a client supplied request ID is safe to echo and log
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
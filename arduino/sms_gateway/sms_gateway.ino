@@ -7,17 +7,51 @@
   Protocol:
   - Commands are sent as JSON objects terminated with newline
   - Send SMS: {"cmd":"send","number":"+1234567890","content":"message"}
+  - Optional "class" (0-3) sets the SMS message class; class 0 is a flash SMS:
+    {"cmd":"send","number":"+1234567890","content":"message","class":0}
+  - Optional "sender" carries an alphanumeric sender ID (see handleSendSMS)
+  - Optional "seq" is echoed in the send result so several sends can be in flight.
+    Up to 4 sends are queued while one is submitted; beyond that the result is
+    {"event":"sent","status":"busy","message":"Send queue full","seq":N}
   - Response: {"status":"ok","message":"SMS sent"} or {"status":"error","message":"error details"}
+  - The ready message reports the protocol version:
+    {"status":"ready","message":"SMS Gateway ready","version":1}
+  - Version: {"cmd":"version"} replies with {"event":"version","version":1}
+  - Send result: {"event":"sent","status":"ok","message":"SMS sent to ..."} or
+    {"event":"sent","status":"error","message":"Failed to send SMS","code":"+CMS ERROR: 332"}
+    ("code" carries the modem's result code when there is one)
   - Incoming SMS: {"event":"received","number":"+1234567890","content":"message","timestamp":"YYYY-MM-DD HH:MM:SS"}
+  - USSD request: {"cmd":"ussd","code":"*100#"}
+  - USSD reply: {"event":"ussd","status":"ok","message":"network reply"} (status "error" on failure)
+  - Modem status: {"cmd":"modem"} replies with
+    {"event":"modem","rssi":-83,"registration":"home","sim":"ready","number":"+1234567890"}
+    (signal in dBm; "number" is the SIM's own number, if stored on the SIM; only
+    read while GSM is connected, so the modem isn't woken up)
+  - Network time: {"cmd":"time"} replies with
+    {"event":"time","status":"ok","message":"24/01/17,10:30:00+04"}
+    (modem clock as yy/MM/dd,hh:mm:ss and the zone in quarter hours, set from the network)
+
+  Binary protocol:
+  - {"cmd":"hello","protocol":"cbor"} switches output to CBOR, confirmed with
+    {"event":"hello","protocol":"cbor"} (the last message sent as JSON)
+  - CBOR messages are maps with the same keys as the JSON messages, framed as
+    0xC0, the payload length (2 bytes, big endian) and the payload. 0xC0 never
+    occurs in UTF-8 text, so commands are accepted in either format at any time
+  - The sketch restarts in JSON mode
 
   Power management:
   - GSM connects on boot, then auto-disconnects after 60 seconds of inactivity
   - "wakeup" command reconnects GSM; "send" auto-connects if disconnected
+  - {"cmd":"power","mode":"always_on"} keeps GSM connected, reconnecting it
+    when the connection drops; "on_demand" restores the inactivity timeout
   - Every response includes "gsm" field ("connected" or "disconnected")
 */
 
 #include <MKRGSM.h>
 
+// Serial protocol version reported when ready; the backend checks it after flashing
+const int PROTOCOL_VERSION = 1;
+
 // PIN Number if required (leave empty if not needed)
 #define PIN_NUMBER ""
 
@@ -29,6 +63,56 @@ GSM_SMS sms;
 String serialBuffer = "";
 const int MAX_BUFFER_SIZE = 512;
 
+// CBOR frames (see "Binary protocol" above)
+const uint8_t FRAME_START = 0xC0;
+const uint8_t CBOR_UNSIGNED = 0; // CBOR major types used by the protocol
+const uint8_t CBOR_NEGATIVE = 1;
+const uint8_t CBOR_TEXT = 3;
+const uint8_t CBOR_MAP = 5;
+const unsigned long FRAME_TIMEOUT = 1000; // drop frames not complete within 1 second
+enum FrameState { FRAME_NONE, FRAME_LENGTH_HIGH, FRAME_LENGTH_LOW, FRAME_PAYLOAD };
+FrameState frameState = FRAME_NONE;
+uint8_t frameBuffer[MAX_BUFFER_SIZE];
+int frameLength = 0;
+int frameReceived = 0;
+unsigned long frameStartTime = 0;
+
+// Whether responses and events are sent as CBOR frames instead of JSON lines
+bool cborOutput = false;
+
+// A command decoded from a JSON line or a CBOR frame
+struct Command {
+  String cmd;
+  String number;
+  String content;
+  String sender;
+  String code;
+  String mode;
+  String protocol;
+  int messageClass = -1; // -1 when not given
+  int seq = 0;
+};
+
+// A response or event, sent as a JSON line or a CBOR frame depending on the
+// negotiated protocol. The gsm field is added by send().
+class Message {
+public:
+  Message& text(const char* key, String value);
+  Message& number(const char* key, long value);
+  void send();
+
+private:
+  static const int MAX_FIELDS = 8;
+  const char* keys[MAX_FIELDS];
+  String values[MAX_FIELDS];
+  bool numeric[MAX_FIELDS];
+  int count = 0;
+
+  void add(const char* key, String value, bool isNumber);
+  void sendJSON();
+  void sendCBOR();
+};
+
 // Last check time for incoming SMS
 unsigned long lastSMSCheck = 0;
 const unsigned long SMS_CHECK_INTERVAL = 5000; // Check every 5 seconds
@@ -36,10 +120,51 @@ const unsigned long SMS_CHECK_INTERVAL = 5000; // Check every 5 seconds
 // Connection state
 bool gsmConnected = false;
 
+// How long the modem may take to submit an SMS to the network
+const unsigned long SMS_SUBMIT_TIMEOUT = 180000; // 3 minutes
+
+// Send commands waiting while another SMS is submitted
+const int SEND_QUEUE_SIZE = 4;
+Command sendQueue[SEND_QUEUE_SIZE];
+int sendQueueHead = 0;
+int sendQueueLength = 0;
+
+// Sequence number of the send being processed, echoed in its result
+int currentSendSeq = 0;
+
+// USSD session state, filled in by the +CUSD URC handler
+const unsigned long USSD_TIMEOUT = 20000; // 20 seconds
+
+class USSDHandler : public ModemUrcHandler {
+public:
+  bool done = false;
+  int result = -1;
+  String reply = "";
+
+  void handleUrc(const String& urc) {
+    // +CUSD: <m>[,"<str>"[,<dcs>]]
+    if (!urc.startsWith("+CUSD: ")) {
+      return;
+    }
+    result = urc.substring(7, 8).toInt();
+    int start = urc.indexOf('"');
+    int end = urc.lastIndexOf('"');
+    reply = (start != -1 && end > start) ? urc.substring(start + 1, end) : "";
+    done = true;
+  }
+};
+
+USSDHandler ussdHandler;
+
 // Inactivity timer
 unsigned long lastActivityTime = 0;
 const unsigned long INACTIVITY_TIMEOUT = 60000; // 60 seconds
 
+// Always-on mode keeps GSM connected for mains powered installations
+bool alwaysOn = false;
+unsigned long lastConnectAttempt = 0;
+const unsigned long RECONNECT_INTERVAL = 30000; // 30 seconds
+
 void setup() {
   // Initialize serial communications
   Serial.begin(115200);
@@ -58,14 +183,21 @@ void setup() {
 void loop() {
   // Always read serial commands (even when GSM disconnected, so wakeup works)
   while (Serial.available() > 0) {
-    char c = Serial.read();
+    uint8_t c = Serial.read();
 
-    if (c == '\n') {
+    if (frameState != FRAME_NONE) {
+      readFrameByte(c);
+    } else if (c == FRAME_START) {
+      // A frame also ends a partial line, which can't be valid
+      serialBuffer = "";
+      frameState = FRAME_LENGTH_HIGH;
+      frameStartTime = millis();
+    } else if (c == '\n') {
       // Process complete command
-      processCommand(serialBuffer);
+      processLine(serialBuffer);
       serialBuffer = "";
     } else if (serialBuffer.length() < MAX_BUFFER_SIZE) {
-      serialBuffer += c;
+      serialBuffer += (char)c;
     } else {
       // Buffer overflow, clear it
       serialBuffer = "";
@@ -73,6 +205,20 @@ void loop() {
     }
   }
 
+  if (frameState != FRAME_NONE && millis() - frameStartTime > FRAME_TIMEOUT) {
+    frameState = FRAME_NONE;
+    sendError("Incomplete frame");
+  }
+
+  // Submit one queued SMS, then read serial again so new commands are queued
+  if (sendQueueLength > 0) {
+    Command command = sendQueue[sendQueueHead];
+    sendQueue[sendQueueHead] = Command();
+    sendQueueHead = (sendQueueHead + 1) % SEND_QUEUE_SIZE;
+    sendQueueLength--;
+    handleSendSMS(command);
+  }
+
   // Only check incoming SMS when GSM connected
   if (gsmConnected) {
     if (millis() - lastSMSCheck > SMS_CHECK_INTERVAL) {
@@ -81,9 +227,12 @@ void loop() {
     }
 
     // Check inactivity timeout
-    if (millis() - lastActivityTime > INACTIVITY_TIMEOUT) {
+    if (!alwaysOn && millis() - lastActivityTime > INACTIVITY_TIMEOUT) {
       disconnectGSM();
     }
+  } else if (alwaysOn && millis() - lastConnectAttempt > RECONNECT_INTERVAL) {
+    lastConnectAttempt = millis();
+    connectGSM();
   }
 
   delay(100);
@@ -95,6 +244,15 @@ bool connectGSM() {
   // Start GSM connection
   if (gsmAccess.begin(PIN_NUMBER) == GSM_READY) {
     gsmConnected = true;
+
+    // Report numeric +CME ERROR codes instead of a bare ERROR
+    MODEM.send("AT+CMEE=1");
+    MODEM.waitForResponse(1000);
+
+    // Set the modem clock from network time (NITZ) when the network sends it
+    MODEM.send("AT+CTZU=1");
+    MODEM.waitForResponse(1000);
+
     resetActivityTimer();
     sendGSMState();
     sendInfo("Connected to GSM network");
@@ -118,75 +276,377 @@ void resetActivityTimer() {
   lastActivityTime = millis();
 }
 
-void processCommand(String command) {
+void processLine(String line) {
   // Simple JSON parsing (basic implementation)
-  command.trim();
+  line.trim();
 
-  if (command.length() == 0) {
+  if (line.length() == 0) {
     return;
   }
 
-  // Extract command type
-  int cmdStart = command.indexOf("\"cmd\"");
-  if (cmdStart == -1) {
+  Command command;
+  command.cmd = extractJSONValue(line, "cmd");
+  if (command.cmd.length() == 0) {
     sendError("Invalid command format");
     return;
   }
 
-  // Check command type
-  if (command.indexOf("\"send\"") != -1) {
-    handleSendSMS(command);
-  } else if (command.indexOf("\"ping\"") != -1) {
+  command.number = extractJSONValue(line, "number");
+  command.content = extractJSONValue(line, "content");
+  command.sender = extractJSONValue(line, "sender");
+  command.code = extractJSONValue(line, "code");
+  command.mode = extractJSONValue(line, "mode");
+  command.protocol = extractJSONValue(line, "protocol");
+  command.messageClass = extractJSONInt(line, "class", -1);
+  command.seq = extractJSONInt(line, "seq", 0);
+
+  processCommand(command);
+}
+
+void readFrameByte(uint8_t c) {
+  switch (frameState) {
+    case FRAME_LENGTH_HIGH:
+      frameLength = c << 8;
+      frameState = FRAME_LENGTH_LOW;
+      break;
+
+    case FRAME_LENGTH_LOW:
+      frameLength |= c;
+      frameReceived = 0;
+      if (frameLength == 0 || frameLength > MAX_BUFFER_SIZE) {
+        frameState = FRAME_NONE;
+        sendError("Invalid frame length");
+      } else {
+        frameState = FRAME_PAYLOAD;
+      }
+      break;
+
+    case FRAME_PAYLOAD:
+      frameBuffer[frameReceived++] = c;
+      if (frameReceived == frameLength) {
+        frameState = FRAME_NONE;
+        Command command;
+        if (parseCBORCommand(frameBuffer, frameLength, command)) {
+          processCommand(command);
+        } else {
+          sendError("Invalid command format");
+        }
+      }
+      break;
+
+    default:
+      frameState = FRAME_NONE;
+  }
+}
+
+void processCommand(const Command& command) {
+  if (command.cmd == "send") {
+    queueSendSMS(command);
+  } else if (command.cmd == "ussd") {
+    handleUSSD(command);
+  } else if (command.cmd == "modem") {
+    handleModemStatus();
+  } else if (command.cmd == "time") {
+    handleNetworkTime();
+  } else if (command.cmd == "ping") {
     resetActivityTimer();
     sendResponse("ok", "pong");
-  } else if (command.indexOf("\"wakeup\"") != -1) {
+  } else if (command.cmd == "wakeup") {
     if (!gsmConnected) {
       connectGSM();
     } else {
       resetActivityTimer();
     }
     sendResponse("ok", "wakeup acknowledged");
-  } else if (command.indexOf("\"status\"") != -1) {
+  } else if (command.cmd == "power") {
+    handlePowerMode(command);
+  } else if (command.cmd == "version") {
+    Message().text("event", "version").number("version", PROTOCOL_VERSION).send();
+  } else if (command.cmd == "hello") {
+    handleHello(command);
+  } else if (command.cmd == "status") {
     sendResponse("ok", gsmConnected ? "gsm connected" : "gsm disconnected");
   } else {
     sendError("Unknown command");
   }
 }
 
-void handleSendSMS(String command) {
-  // Extract number
-  String number = extractJSONValue(command, "number");
+void handleHello(const Command& command) {
+  bool cbor = command.protocol == "cbor";
+
+  // Confirm in the current protocol, then switch
+  Message()
+    .text("event", "hello")
+    .text("protocol", cbor ? "cbor" : "json")
+    .send();
+  cborOutput = cbor;
+}
+
+void queueSendSMS(const Command& command) {
+  if (sendQueueLength == SEND_QUEUE_SIZE) {
+    currentSendSeq = command.seq;
+    sendSendResult("busy", "Send queue full", "");
+    return;
+  }
+
+  sendQueue[(sendQueueHead + sendQueueLength) % SEND_QUEUE_SIZE] = command;
+  sendQueueLength++;
+}
+
+void handleSendSMS(const Command& command) {
+  currentSendSeq = command.seq;
+
+  String number = command.number;
   if (number.length() == 0) {
-    sendError("Missing phone number");
+    sendSendResult("error", "Missing phone number", "");
     return;
   }
 
-  // Extract content
-  String content = extractJSONValue(command, "content");
+  String content = command.content;
   if (content.length() == 0) {
-    sendError("Missing message content");
+    sendSendResult("error", "Missing message content", "");
     return;
   }
 
   // Auto-connect GSM if disconnected
   if (!gsmConnected) {
     if (!connectGSM()) {
-      sendError("Failed to connect GSM for sending");
+      sendSendResult("error", "Failed to connect GSM for sending", "");
       return;
     }
   }
 
   resetActivityTimer();
 
+  // Optional message class (-1 when not given)
+  int messageClass = command.messageClass;
+  if (messageClass > 3) {
+    sendSendResult("error", "Invalid message class", "");
+    return;
+  }
+
+  if (messageClass >= 0 && !setMessageClass(messageClass)) {
+    sendSendResult("error", "Failed to set message class", "");
+    return;
+  }
+
+  // The SMS-SUBMIT PDU sent by the modem has no originator field; the network
+  // always uses the SIM's number, so a requested sender ID can't be applied here
+  if (command.sender.length() > 0) {
+    sendInfo("Sender ID not supported by modem, sending from SIM number");
+  }
+
   // Send SMS
-  sms.beginSMS(number.c_str());
-  sms.print(content);
+  String code = "";
+  bool sent = submitSMS(number, content, code);
 
-  if (sms.endSMS()) {
-    sendResponse("ok", "SMS sent to " + number);
+  // Restore the default data coding scheme for following messages
+  if (messageClass >= 0) {
+    setMessageClass(-1);
+  }
+
+  if (sent) {
+    sendSendResult("ok", "SMS sent to " + number, "");
   } else {
-    sendError("Failed to send SMS");
+    sendSendResult("error", "Failed to send SMS", code);
+  }
+}
+
+// submitSMS sends a text mode SMS with AT+CMGS. On failure, code is set to the
+// modem's result code (e.g. "+CMS ERROR: 332") so the backend can classify it.
+bool submitSMS(String number, String content, String& code) {
+  MODEM.sendf("AT+CMGS=\"%s\"", number.c_str());
+  if (MODEM.waitForPrompt(20000) != 1) {
+    code = readResultCode(1000);
+    return false;
+  }
+
+  MODEM.write((const uint8_t*)content.c_str(), content.length());
+  MODEM.write(26); // Ctrl-Z submits the message
+
+  code = readResultCode(SMS_SUBMIT_TIMEOUT);
+  return code == "OK";
+}
+
+// readResultCode reads modem lines until a final result code arrives. The
+// MKRGSM response parser drops the number of "+CMS ERROR: <n>", so the
+// result is read from the modem UART directly.
+String readResultCode(unsigned long timeout) {
+  String line = "";
+  unsigned long start = millis();
+
+  while (millis() - start < timeout) {
+    if (!SerialGSM.available()) {
+      delay(10);
+      continue;
+    }
+
+    char c = SerialGSM.read();
+    if (c != '\n') {
+      line += c;
+      continue;
+    }
+
+    line.trim();
+    if (line == "OK" || line == "ERROR" || line.startsWith("+CMS ERROR") || line.startsWith("+CME ERROR")) {
+      return line;
+    }
+    line = "";
+  }
+
+  return "";
+}
+
+void handleUSSD(const Command& command) {
+  String code = command.code;
+  if (code.length() == 0) {
+    sendUSSDResult("error", "Missing USSD code");
+    return;
+  }
+
+  // Auto-connect GSM if disconnected
+  if (!gsmConnected) {
+    if (!connectGSM()) {
+      sendUSSDResult("error", "Failed to connect GSM for USSD");
+      return;
+    }
+  }
+
+  resetActivityTimer();
+
+  ussdHandler.done = false;
+  ussdHandler.reply = "";
+  MODEM.addUrcHandler(&ussdHandler);
+
+  MODEM.sendf("AT+CUSD=1,\"%s\",15", code.c_str());
+  if (MODEM.waitForResponse(5000) != 1) {
+    MODEM.removeUrcHandler(&ussdHandler);
+    sendUSSDResult("error", "USSD request rejected by modem");
+    return;
+  }
+
+  // The reply arrives later as a +CUSD URC
+  unsigned long start = millis();
+  while (!ussdHandler.done && millis() - start < USSD_TIMEOUT) {
+    MODEM.poll();
+    delay(100);
+  }
+  MODEM.removeUrcHandler(&ussdHandler);
+
+  if (!ussdHandler.done) {
+    sendUSSDResult("error", "USSD timeout");
+  } else if (ussdHandler.result == 4) {
+    sendUSSDResult("error", "USSD not supported by network");
+  } else {
+    // Close the session if the network is waiting for input
+    if (ussdHandler.result == 1) {
+      MODEM.send("AT+CUSD=2");
+      MODEM.waitForResponse(1000);
+    }
+    sendUSSDResult("ok", ussdHandler.reply);
+  }
+}
+
+void handlePowerMode(const Command& command) {
+  String mode = command.mode;
+  if (mode == "always_on") {
+    alwaysOn = true;
+    if (!gsmConnected) {
+      lastConnectAttempt = millis();
+      connectGSM();
+    }
+  } else if (mode == "on_demand") {
+    alwaysOn = false;
+    resetActivityTimer();
+  } else {
+    sendError("Invalid power mode");
+    return;
+  }
+  sendResponse("ok", "power mode " + mode);
+}
+
+void handleModemStatus() {
+  // The modem is powered down while GSM is disconnected; don't reset the
+  // inactivity timer so status polling doesn't keep it awake
+  if (!gsmConnected) {
+    sendModemStatus(0, false, "unknown", "unknown", "");
+    return;
+  }
+
+  String response;
+
+  // +CSQ: <rssi>,<ber> with rssi 0-31 (-113 to -51 dBm), 99 = unknown
+  int rssi = 99;
+  MODEM.send("AT+CSQ");
+  if (MODEM.waitForResponse(1000, &response) == 1 && response.startsWith("+CSQ: ")) {
+    rssi = response.substring(6).toInt();
+  }
+
+  // +CREG: <n>,<stat>
+  String registration = "unknown";
+  MODEM.send("AT+CREG?");
+  if (MODEM.waitForResponse(1000, &response) == 1 && response.startsWith("+CREG: ")) {
+    int comma = response.indexOf(',');
+    switch (response.substring(comma + 1).toInt()) {
+      case 0: registration = "not_registered"; break;
+      case 1: registration = "home"; break;
+      case 2: registration = "searching"; break;
+      case 3: registration = "denied"; break;
+      case 5: registration = "roaming"; break;
+    }
+  }
+
+  // +CPIN: READY, or an error when no SIM is inserted
+  String sim = "absent";
+  MODEM.send("AT+CPIN?");
+  if (MODEM.waitForResponse(1000, &response) == 1 && response.startsWith("+CPIN: ")) {
+    sim = response.endsWith("READY") ? "ready" : "locked";
+  }
+
+  // +CNUM: "<name>","<number>",<type>; only answered when the number is stored on the SIM
+  String number = "";
+  MODEM.send("AT+CNUM");
+  if (MODEM.waitForResponse(1000, &response) == 1 && response.startsWith("+CNUM: ")) {
+    int start = response.indexOf(",\"");
+    int end = start == -1 ? -1 : response.indexOf('"', start + 2);
+    if (end != -1) {
+      number = response.substring(start + 2, end);
+    }
   }
+
+  sendModemStatus(-113 + 2 * rssi, rssi != 99, registration, sim, number);
+}
+
+void handleNetworkTime() {
+  // The modem clock is only set from the network while registered
+  if (!gsmConnected) {
+    if (!connectGSM()) {
+      sendTimeResult("error", "Failed to connect GSM for network time");
+      return;
+    }
+  }
+
+  resetActivityTimer();
+
+  // +CCLK: "yy/MM/dd,hh:mm:ss+zz"
+  String response;
+  MODEM.send("AT+CCLK?");
+  if (MODEM.waitForResponse(1000, &response) != 1 || !response.startsWith("+CCLK: ")) {
+    sendTimeResult("error", "Failed to read modem clock");
+    return;
+  }
+
+  String clock = response.substring(7);
+  clock.replace("\"", "");
+  sendTimeResult("ok", clock);
+}
+
+bool setMessageClass(int messageClass) {
+  // Text mode parameters: the 4th value is the PDU data coding scheme.
+  // 0x10 | class marks a GSM 7-bit message with a message class; 0 is the default (no class).
+  int dcs = messageClass >= 0 ? (0x10 | messageClass) : 0;
+  MODEM.sendf("AT+CSMP=17,167,0,%d", dcs);
+  return MODEM.waitForResponse(1000) == 1;
 }
 
 void checkIncomingSMS() {
@@ -221,34 +681,53 @@ void checkIncomingSMS() {
 }
 
 void sendReceivedSMS(String number, String content) {
-  // Get timestamp (basic format)
-  String timestamp = getTimestamp();
+  Message()
+    .text("event", "received")
+    .text("number", number)
+    .text("content", content)
+    .text("timestamp", getTimestamp())
+    .send();
+}
+
+void sendSendResult(String status, String message, String code) {
+  Message result;
+  result.text("event", "sent").text("status", status).text("message", message);
+  if (code.length() > 0) {
+    result.text("code", code);
+  }
+  if (currentSendSeq > 0) {
+    result.number("seq", currentSendSeq);
+  }
+  result.send();
+}
+
+void sendModemStatus(int rssi, bool rssiKnown, String registration, String sim, String number) {
+  Message status;
+  status.text("event", "modem");
+  if (rssiKnown) {
+    status.number("rssi", rssi);
+  }
+  status.text("registration", registration).text("sim", sim);
+  if (number.length() > 0) {
+    status.text("number", number);
+  }
+  status.send();
+}
+
+void sendUSSDResult(String status, String message) {
+  Message().text("event", "ussd").text("status", status).text("message", message).send();
+}
 
-  Serial.print("{\"event\":\"received\",\"number\":\"");
-  Serial.print(escapeJSON(number));
-  Serial.print("\",\"content\":\"");
-  Serial.print(escapeJSON(content));
-  Serial.print("\",\"timestamp\":\"");
-  Serial.print(timestamp);
-  Serial.print("\",\"gsm\":\"");
-  Serial.print(gsmConnected ? "connected" : "disconnected");
-  Serial.println("\"}");
+void sendTimeResult(String status, String message) {
+  Message().text("event", "time").text("status", status).text("message", message).send();
 }
 
 void sendGSMState() {
-  Serial.print("{\"event\":\"gsm_state\",\"gsm\":\"");
-  Serial.print(gsmConnected ? "connected" : "disconnected");
-  Serial.println("\"}");
+  Message().text("event", "gsm_state").send();
 }
 
 void sendResponse(String status, String message) {
-  Serial.print("{\"status\":\"");
-  Serial.print(status);
-  Serial.print("\",\"message\":\"");
-  Serial.print(escapeJSON(message));
-  Serial.print("\",\"gsm\":\"");
-  Serial.print(gsmConnected ? "connected" : "disconnected");
-  Serial.println("\"}");
+  Message().text("status", status).text("message", message).send();
 }
 
 void sendError(String message) {
@@ -256,19 +735,240 @@ void sendError(String message) {
 }
 
 void sendInfo(String message) {
-  Serial.print("{\"status\":\"info\",\"message\":\"");
-  Serial.print(escapeJSON(message));
-  Serial.print("\",\"gsm\":\"");
-  Serial.print(gsmConnected ? "connected" : "disconnected");
-  Serial.println("\"}");
+  sendResponse("info", message);
 }
 
 void sendReady(String message) {
-  Serial.print("{\"status\":\"ready\",\"message\":\"");
-  Serial.print(escapeJSON(message));
-  Serial.print("\",\"gsm\":\"");
-  Serial.print(gsmConnected ? "connected" : "disconnected");
-  Serial.println("\"}");
+  Message()
+    .text("status", "ready")
+    .text("message", message)
+    .number("version", PROTOCOL_VERSION)
+    .send();
+}
+
+Message& Message::text(const char* key, String value) {
+  add(key, value, false);
+  return *this;
+}
+
+Message& Message::number(const char* key, long value) {
+  add(key, String(value), true);
+  return *this;
+}
+
+void Message::add(const char* key, String value, bool isNumber) {
+  if (count == MAX_FIELDS) {
+    return;
+  }
+  keys[count] = key;
+  values[count] = value;
+  numeric[count] = isNumber;
+  count++;
+}
+
+void Message::send() {
+  text("gsm", gsmConnected ? "connected" : "disconnected");
+  if (cborOutput) {
+    sendCBOR();
+  } else {
+    sendJSON();
+  }
+}
+
+void Message::sendJSON() {
+  Serial.print("{");
+  for (int i = 0; i < count; i++) {
+    if (i > 0) {
+      Serial.print(",");
+    }
+    Serial.print("\"");
+    Serial.print(keys[i]);
+    Serial.print("\":");
+    if (numeric[i]) {
+      Serial.print(values[i]);
+    } else {
+      Serial.print("\"");
+      Serial.print(escapeJSON(values[i]));
+      Serial.print("\"");
+    }
+  }
+  Serial.println("}");
+}
+
+void Message::sendCBOR() {
+  // Measure the payload first, so the frame is written without buffering it
+  unsigned long length = cborHeadSize(count);
+  for (int i = 0; i < count; i++) {
+    length += cborHeadSize(strlen(keys[i])) + strlen(keys[i]);
+    if (numeric[i]) {
+      long n = values[i].toInt();
+      length += cborHeadSize(n < 0 ? -1 - n : n);
+    } else {
+      length += cborHeadSize(values[i].length()) + values[i].length();
+    }
+  }
+  if (length > 0xFFFF) {
+    return;
+  }
+
+  Serial.write(FRAME_START);
+  Serial.write((uint8_t)(length >> 8));
+  Serial.write((uint8_t)(length & 0xFF));
+
+  writeCBORHead(CBOR_MAP, count);
+  for (int i = 0; i < count; i++) {
+    writeCBORHead(CBOR_TEXT, strlen(keys[i]));
+    Serial.print(keys[i]);
+    if (numeric[i]) {
+      long n = values[i].toInt();
+      if (n < 0) {
+        writeCBORHead(CBOR_NEGATIVE, -1 - n);
+      } else {
+        writeCBORHead(CBOR_UNSIGNED, n);
+      }
+    } else {
+      writeCBORHead(CBOR_TEXT, values[i].length());
+      Serial.print(values[i]);
+    }
+  }
+}
+
+int cborHeadSize(unsigned long arg) {
+  if (arg < 24) {
+    return 1;
+  } else if (arg <= 0xFF) {
+    return 2;
+  } else if (arg <= 0xFFFF) {
+    return 3;
+  }
+  return 5;
+}
+
+void writeCBORHead(uint8_t major, unsigned long arg) {
+  major <<= 5;
+  if (arg < 24) {
+    Serial.write(major | (uint8_t)arg);
+  } else if (arg <= 0xFF) {
+    Serial.write(major | 24);
+    Serial.write((uint8_t)arg);
+  } else if (arg <= 0xFFFF) {
+    Serial.write(major | 25);
+    Serial.write((uint8_t)(arg >> 8));
+    Serial.write((uint8_t)(arg & 0xFF));
+  } else {
+    Serial.write(major | 26);
+    for (int shift = 24; shift >= 0; shift -= 8) {
+      Serial.write((uint8_t)((arg >> shift) & 0xFF));
+    }
+  }
+}
+
+// readCBORHead reads the major type and argument of the item at pos
+bool readCBORHead(const uint8_t* data, int length, int& pos, uint8_t& major, unsigned long& arg) {
+  if (pos >= length) {
+    return false;
+  }
+  major = data[pos] >> 5;
+  uint8_t info = data[pos] & 0x1F;
+  pos++;
+
+  int size;
+  if (info < 24) {
+    arg = info;
+    return true;
+  } else if (info == 24) {
+    size = 1;
+  } else if (info == 25) {
+    size = 2;
+  } else if (info == 26) {
+    size = 4;
+  } else {
+    return false;
+  }
+
+  if (pos + size > length) {
+    return false;
+  }
+  arg = 0;
+  for (int i = 0; i < size; i++) {
+    arg = (arg << 8) | data[pos++];
+  }
+  return true;
+}
+
+// readCBORText reads a text item at pos
+bool readCBORText(const uint8_t* data, int length, int& pos, String& text) {
+  uint8_t major;
+  unsigned long size;
+  if (!readCBORHead(data, length, pos, major, size) || major != CBOR_TEXT || pos + (long)size > length) {
+    return false;
+  }
+  text = "";
+  text.reserve(size);
+  for (unsigned long i = 0; i < size; i++) {
+    text += (char)data[pos++];
+  }
+  return true;
+}
+
+// parseCBORCommand decodes a command map with text and integer values
+bool parseCBORCommand(const uint8_t* data, int length, Command& command) {
+  int pos = 0;
+  uint8_t major;
+  unsigned long fields;
+  if (!readCBORHead(data, length, pos, major, fields) || major != CBOR_MAP) {
+    return false;
+  }
+
+  for (unsigned long i = 0; i < fields; i++) {
+    String key;
+    if (!readCBORText(data, length, pos, key)) {
+      return false;
+    }
+
+    if (key == "class" || key == "seq") {
+      unsigned long arg;
+      if (!readCBORHead(data, length, pos, major, arg)) {
+        return false;
+      }
+      long value;
+      if (major == CBOR_UNSIGNED) {
+        value = arg;
+      } else if (major == CBOR_NEGATIVE) {
+        value = -1 - (long)arg;
+      } else {
+        return false;
+      }
+      if (key == "class") {
+        command.messageClass = value;
+      } else {
+        command.seq = value;
+      }
+      continue;
+    }
+
+    String value;
+    if (!readCBORText(data, length, pos, value)) {
+      return false;
+    }
+    if (key == "cmd") {
+      command.cmd = value;
+    } else if (key == "number") {
+      command.number = value;
+    } else if (key == "content") {
+      command.content = value;
+    } else if (key == "sender") {
+      command.sender = value;
+    } else if (key == "code") {
+      command.code = value;
+    } else if (key == "mode") {
+      command.mode = value;
+    } else if (key == "protocol") {
+      command.protocol = value;
+    }
+  }
+
+  return pos == length && command.cmd.length() > 0;
 }
 
 String extractJSONValue(String json, String key) {
@@ -289,14 +989,43 @@ String extractJSONValue(String json, String key) {
   return json.substring(startIndex, endIndex);
 }
 
+int extractJSONInt(String json, String key, int defaultValue) {
+  String searchKey = "\"" + key + "\":";
+  int startIndex = json.indexOf(searchKey);
+
+  if (startIndex == -1) {
+    return defaultValue;
+  }
+
+  startIndex += searchKey.length();
+  int endIndex = startIndex;
+  while (endIndex < (int)json.length() && isDigit(json[endIndex])) {
+    endIndex++;
+  }
+
+  if (endIndex == startIndex) {
+    return defaultValue;
+  }
+
+  return json.substring(startIndex, endIndex).toInt();
+}
+
 String escapeJSON(String str) {
   String result = "";
   for (unsigned int i = 0; i < str.length(); i++) {
     char c = str[i];
     if (c == '"' || c == '\\') {
       result += '\\';
+      result += c;
+    } else if (c == '\n') {
+      result += "\\n";
+    } else if (c == '\r') {
+      result += "\\r";
+    } else if (c == '\t') {
+      result += "\\t";
+    } else {
+      result += c;
     }
-    result += c;
   }
   return result;
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// acceptSMS saves an SMS as queued and sends it in the background, answering
+// 202 with the ID of its sent_sms record right away. The record moves from
+// queued to sending and then to its outcome, see GET /sent/id/:id.
+func (app *App) acceptSMS(c *gin.Context, number, content string, opts SendOptions) {
+	if !app.smsConn.IsConnected() && (app.routing == nil || !app.routing.IsConnected()) && app.testMode.Allows(number) {
+		c.JSON(sendErrorResponse(c, ErrNotConnected))
+		return
+	}
+
+	// Not journaled: the client needs the ID to follow the send
+	id, err := app.db.insertSentSMS(number, content, "queued", "", "", opts, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to queue SMS: %v", err))
+		return
+	}
+
+	opts.SentID = id
+	go app.deliverAccepted(keyIDFromContext(c), number, content, opts)
+
+	c.Header("Location", apiPath(c, fmt.Sprintf("/sent/id/%d", id)))
+	c.JSON(http.StatusAccepted, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("SMS to %s queued", number),
+		ID:      id,
+		Warning: app.specialNumbers.Warning(localeFromContext(c), number),
+	})
+}
+
+// deliverAccepted sends an SMS accepted by acceptSMS. Outcomes that
+// deliverSMS records elsewhere, like a duplicate collapsed into an earlier
+// send or a failure before queuing, are recorded on the accepted record.
+func (app *App) deliverAccepted(keyID, number, content string, opts SendOptions) {
+	id, err := app.deliverSMS(context.Background(), keyID, number, content, opts)
+	if id == opts.SentID {
+		return
+	}
+
+	var saveErr error
+	if err != nil {
+		log.Printf("Async SMS %d to %s failed: %v", opts.SentID, number, err)
+		saveErr = app.db.FinishSentSMS(opts.SentID, "error", err.Error(), ClassifyError(err))
+	} else {
+		saveErr = app.db.FinishSentSMS(opts.SentID, "duplicate", fmt.Sprintf("Collapsed into sent SMS %d", id), "")
+	}
+	if saveErr != nil {
+		log.Printf("Failed to save sent SMS to database: %v", saveErr)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles carried in JWT claims
+const (
+	RoleSend  = "sms:send"
+	RoleRead  = "sms:read"
+	RoleAdmin = "admin"
+)
+
+// claimsContextKey is the gin context key holding the verified JWT claims
+const claimsContextKey = "claims"
+
+// JWTConfig holds the keys and expectations for verifying bearer tokens
+type JWTConfig struct {
+	Secret    []byte         // HS256 shared secret
+	PublicKey *rsa.PublicKey // RS256 public key
+	Issuer    string
+	Audience  string
+}
+
+// Claims represents the verified contents of a JWT
+type Claims struct {
+	Subject string
+	Roles   []string
+}
+
+// jwtHeader represents the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// jwtPayload represents the registered and role claims read from a JWT
+type jwtPayload struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Roles     []string        `json:"roles"`
+	Scope     string          `json:"scope"`
+}
+
+// LoadJWTConfig reads JWT settings from environment variables.
+// It returns nil when no key is configured, which disables authentication.
+func LoadJWTConfig() (*JWTConfig, error) {
+	secret, err := GetSecret("JWT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeyPEM, err := GetSecret("JWT_PUBLIC_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == "" && publicKeyPEM == "" {
+		return nil, nil
+	}
+
+	config := &JWTConfig{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+	}
+
+	if secret != "" {
+		config.Secret = []byte(secret)
+	}
+
+	if publicKeyPEM != "" {
+		key, err := parseRSAPublicKey(publicKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_PUBLIC_KEY: %w", err)
+		}
+		config.PublicKey = key
+	}
+
+	return config, nil
+}
+
+// parseRSAPublicKey decodes a PEM encoded RSA public key (PKIX or PKCS#1)
+func parseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// Verify checks the token signature and registered claims and returns its claims
+func (j *JWTConfig) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		if j.Secret == nil {
+			return nil, fmt.Errorf("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, j.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+
+	case "RS256":
+		if j.PublicKey == nil {
+			return nil, fmt.Errorf("RS256 tokens are not accepted")
+		}
+		hash := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(j.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+
+	var payload jwtPayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+
+	now := time.Now().Unix()
+	if payload.ExpiresAt != nil && now >= *payload.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+	if payload.NotBefore != nil && now < *payload.NotBefore {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if j.Issuer != "" && payload.Issuer != j.Issuer {
+		return nil, fmt.Errorf("unexpected token issuer")
+	}
+	if j.Audience != "" && !audienceContains(payload.Audience, j.Audience) {
+		return nil, fmt.Errorf("unexpected token audience")
+	}
+
+	claims := &Claims{
+		Subject: payload.Subject,
+		Roles:   payload.Roles,
+	}
+	// Also accept OAuth-style space separated scopes
+	if payload.Scope != "" {
+		claims.Roles = append(claims.Roles, strings.Fields(payload.Scope)...)
+	}
+
+	return claims, nil
+}
+
+// audienceContains checks a string or array "aud" claim for the expected audience
+func audienceContains(raw json.RawMessage, audience string) bool {
+	if len(raw) == 0 {
+		return false
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == audience
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		for _, a := range list {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// HasRole reports whether the claims grant the role. The admin role grants every role.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole returns middleware that enforces a bearer token carrying the given role.
+// When JWT authentication is not configured every request is allowed.
+func (app *App) requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := app.authenticate(c)
+		if !ok {
+			return
+		}
+
+		if claims != nil && !claims.HasRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, errorResponse(c, CodeForbidden, "Token lacks required role %s", role))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requireAuth returns middleware that only verifies the bearer token, leaving
+// role checks to the handler (e.g. per JSON-RPC method)
+func (app *App) requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := app.authenticate(c); ok {
+			c.Next()
+		}
+	}
+}
+
+// authenticate verifies the bearer token and stores its claims in the context.
+// It returns nil claims when authentication is disabled, and aborts the request
+// with 401 and returns false when the token is missing or invalid.
+func (app *App) authenticate(c *gin.Context) (*Claims, bool) {
+	if app.auth == nil {
+		return nil, true
+	}
+
+	authHeader := c.GetHeader("Authorization")
+	token, found := strings.CutPrefix(authHeader, "Bearer ")
+	if !found || token == "" {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(c, CodeUnauthorized, "Missing bearer token"))
+		return nil, false
+	}
+
+	claims, err := app.auth.Verify(token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(c, CodeUnauthorized, "Invalid token: %v", err))
+		return nil, false
+	}
+
+	c.Set(claimsContextKey, claims)
+	return claims, true
+}
+
+// hasRole reports whether the caller of the request has a role.
+// Every role is granted when authentication is disabled.
+func (app *App) hasRole(c *gin.Context, role string) bool {
+	if app.auth == nil {
+		return true
+	}
+	if value, ok := c.Get(claimsContextKey); ok {
+		if claims, ok := value.(*Claims); ok {
+			return claims.HasRole(role)
+		}
+	}
+	return false
+}
+
+// keyIDFromContext returns the identity (token subject) of the authenticated caller,
+// or "anonymous" when authentication is disabled or the token has no subject
+func keyIDFromContext(c *gin.Context) string {
+	if value, ok := c.Get(claimsContextKey); ok {
+		if claims, ok := value.(*Claims); ok && claims.Subject != "" {
+			return claims.Subject
+		}
+	}
+	return "anonymous"
+}
+
+// tokenFromQuery lets clients that can't set headers, such as browsers opening a
+// WebSocket or legacy alert scripts, pass the bearer token as ?access_token=
+func tokenFromQuery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			if token := c.Query("access_token"); token != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		c.Next()
+	}
+}
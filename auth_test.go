@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestWritesRequireSendRole checks that a token with only the sms:read role
+// can't change messages, notes or saved searches
+func TestWritesRequireSendRole(t *testing.T) {
+	const secret = "test-secret"
+	server := newTestServer(t, func(app *App) {
+		app.auth = &JWTConfig{Secret: []byte(secret)}
+	})
+	reader := signTestToken(t, secret, RoleRead)
+
+	tests := []struct {
+		method, path string
+	}{
+		{http.MethodPost, "/v1/received/1/ack"},
+		{http.MethodPost, "/v1/received/1/notes"},
+		{http.MethodDelete, "/v1/received/1/notes/1"},
+		{http.MethodPost, "/v1/searches"},
+		{http.MethodDelete, "/v1/searches/billing"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+reader)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s got %d, want 403", tt.method, tt.path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthHistoryRetention is how long health snapshots are kept, the longest
+// availability window
+const healthHistoryRetention = 30 * 24 * time.Hour
+
+// availabilityWindows are the windows GET /stats/availability reports, by name
+var availabilityWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// HealthHistory records the gateway's health at an interval for availability
+// reporting
+type HealthHistory struct {
+	Interval time.Duration
+}
+
+// LoadHealthHistory reads HEALTH_SNAPSHOT_INTERVAL (default 1m, minimum 10s)
+func LoadHealthHistory() (*HealthHistory, error) {
+	h := &HealthHistory{Interval: time.Minute}
+	if value := os.Getenv("HEALTH_SNAPSHOT_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 10*time.Second {
+			return nil, fmt.Errorf("HEALTH_SNAPSHOT_INTERVAL: invalid duration %q (minimum 10s)", value)
+		}
+		h.Interval = interval
+	}
+	return h, nil
+}
+
+// HealthSnapshot is the health of the gateway at one point in time
+type HealthSnapshot struct {
+	At         time.Time
+	Connected  bool
+	GSMReady   bool
+	QueueDepth int
+}
+
+// Availability summarizes the health snapshots of a window. The gateway is up
+// when it is connected to the device and the modem is registered. Time the
+// server was not running has no snapshots and counts as down.
+type Availability struct {
+	Window        string   `json:"window"`
+	Samples       int      `json:"samples"`
+	Expected      int      `json:"expected"`        // snapshots the window should have, since the first snapshot
+	Uptime        *float64 `json:"uptime"`          // percentage of expected snapshots that were up, null without snapshots
+	Connected     *float64 `json:"connected"`       // percentage of snapshots connected to the device
+	GSMReady      *float64 `json:"gsm_ready"`       // percentage of snapshots with the modem registered
+	AvgQueueDepth float64  `json:"avg_queue_depth"` // messages waiting to be sent
+	MaxQueueDepth int      `json:"max_queue_depth"` // most messages waiting at a snapshot
+	Since         string   `json:"since,omitempty"` // first snapshot, if after the window start
+}
+
+// SaveHealthSnapshot stores a health snapshot and deletes the ones older than
+// the retention
+func (d *Database) SaveHealthSnapshot(s HealthSnapshot) error {
+	if _, err := d.db.Exec(`INSERT INTO health_snapshots (at, connected, gsm_ready, queue_depth) VALUES (?, ?, ?, ?)`,
+		s.At.UTC().Format(sqliteTimeFormat), s.Connected, s.GSMReady, s.QueueDepth); err != nil {
+		return fmt.Errorf("failed to save health snapshot: %w", err)
+	}
+
+	if _, err := d.db.Exec(`DELETE FROM health_snapshots WHERE at < ?`,
+		s.At.Add(-healthHistoryRetention).UTC().Format(sqliteTimeFormat)); err != nil {
+		return fmt.Errorf("failed to prune health snapshots: %w", err)
+	}
+	return nil
+}
+
+// GetAvailability summarizes the health snapshots taken at interval since
+// now - window
+func (d *Database) GetAvailability(name string, window, interval time.Duration, now time.Time) (Availability, error) {
+	a := Availability{Window: name}
+
+	var firstStr string
+	if err := d.db.QueryRow(`SELECT COALESCE(MIN(at), '') FROM health_snapshots`).Scan(&firstStr); err != nil {
+		return a, fmt.Errorf("failed to query health snapshots: %w", err)
+	}
+	if firstStr == "" {
+		return a, nil
+	}
+
+	start := now.Add(-window)
+	if first := parseTimestamp(firstStr); first.After(start) {
+		start = first
+		a.Since = first.UTC().Format(time.RFC3339)
+	}
+
+	var up, connected, gsmReady int
+	err := d.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(connected * gsm_ready), 0), COALESCE(SUM(connected), 0), COALESCE(SUM(gsm_ready), 0),
+			COALESCE(AVG(queue_depth), 0), COALESCE(MAX(queue_depth), 0)
+		FROM health_snapshots
+		WHERE at >= ?
+	`, start.UTC().Format(sqliteTimeFormat)).Scan(&a.Samples, &up, &connected, &gsmReady, &a.AvgQueueDepth, &a.MaxQueueDepth)
+	if err != nil {
+		return a, fmt.Errorf("failed to query health snapshots: %w", err)
+	}
+
+	// The first snapshot is taken at start, then one per interval
+	a.Expected = max(a.Samples, int(now.Sub(start)/interval)+1)
+	percentage := func(n, of int) *float64 {
+		if of == 0 {
+			return nil
+		}
+		p := float64(n) * 100 / float64(of)
+		return &p
+	}
+	a.Uptime = percentage(up, a.Expected)
+	a.Connected = percentage(connected, a.Samples)
+	a.GSMReady = percentage(gsmReady, a.Samples)
+
+	return a, nil
+}
+
+// runHealthSnapshotJob records the gateway's health every interval
+func (app *App) runHealthSnapshotJob() {
+	ticker := clock.NewTicker(app.healthHistory.Interval)
+	defer ticker.Stop()
+
+	for {
+		snapshot := HealthSnapshot{
+			At:         clock.Now(),
+			Connected:  app.smsConn.IsConnected(),
+			GSMReady:   app.smsConn.IsGSMReady(),
+			QueueDepth: len(app.queue.Pending()),
+		}
+		if err := app.db.SaveHealthSnapshot(snapshot); err != nil {
+			log.Printf("Health history: %v", err)
+		}
+
+		<-ticker.C()
+	}
+}
+
+// getAvailability reports the gateway's uptime over the last 24 hours, 7 and
+// 30 days
+func (app *App) getAvailability(c *gin.Context) {
+	now := clock.Now()
+	windows := make([]Availability, 0, len(availabilityWindows))
+	for _, w := range availabilityWindows {
+		a, err := app.db.GetAvailability(w.Name, w.Duration, app.healthHistory.Interval, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to compute availability: %v", err))
+			return
+		}
+		windows = append(windows, a)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"interval": app.healthHistory.Interval.String(),
+		"windows":  windows,
+	})
+}
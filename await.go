@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Await-reply timeouts. Replies are typed by people, so they are allowed to
+// take longer than a long-poll for any new message.
+const (
+	defaultAwaitTimeout = 2 * time.Minute
+	maxAwaitTimeout     = 10 * time.Minute
+)
+
+// GetReplyAfter returns the first SMS from a number with an ID greater than
+// afterID, or nil if there is none. Numbers are matched by conversation ID.
+func (d *Database) GetReplyAfter(number string, afterID int) (*ReceivedSMS, error) {
+	msg, err := scanReceivedSMS(d.db.QueryRow(`
+		SELECT `+d.receivedSMSColumns()+`
+		FROM received_sms
+		WHERE conversation_id = ? AND id > ?
+		ORDER BY id LIMIT 1
+	`, ConversationID(number), afterID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query replies: %w", err)
+	}
+
+	return &msg, nil
+}
+
+// sendAndAwaitReply sends an SMS and holds the request open until the
+// recipient replies or the timeout elapses. A timeout is not an error: the
+// SMS was sent, so the response has "reply": null instead of a reply.
+func (app *App) sendAndAwaitReply(c *gin.Context) {
+	timeout, err := parseTimeout(c.Query("timeout"), defaultAwaitTimeout, maxAwaitTimeout)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid 'timeout' parameter: %v", err))
+		return
+	}
+
+	var req SMSRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	opts := SendOptions{Class: req.Class, SenderID: req.SenderID, Template: req.Template, Campaign: req.Campaign, Group: req.Group,
+		TemplateVersion: req.TemplateVersion, ConfirmSpecial: req.ConfirmSpecial}
+	number, err := app.requestNumber(req)
+	if err != nil {
+		c.JSON(sendErrorResponse(c, err))
+		return
+	}
+
+	if err := app.validateSMS(number, req.Content, opts); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
+		return
+	}
+	req.Content = app.localizeTemplate(number, req.Content, opts)
+
+	// Only messages received after this point count as replies
+	version, err := app.db.GetTableVersion("received_sms")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	sentID, err := app.deliverSMS(c.Request.Context(), keyIDFromContext(c), number, req.Content, opts)
+	if err != nil {
+		c.JSON(sendErrorResponse(c, err))
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Subscribe before querying so a reply saved in between is not missed
+		wait := app.receivedNotifier.Wait()
+
+		reply, err := app.db.GetReplyAfter(number, version.MaxID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+			return
+		}
+
+		if reply != nil {
+			log.Printf("Received reply %d from %s to SMS %d", reply.ID, number, sentID)
+			c.JSON(http.StatusOK, gin.H{
+				"status":      "success",
+				"number":      number,
+				"sent_sms_id": sentID,
+				"reply":       reply,
+			})
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-timer.C:
+			c.JSON(http.StatusOK, gin.H{
+				"status":      "success",
+				"number":      number,
+				"sent_sms_id": sentID,
+				"reply":       nil,
+			})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Backup file layout: magic, PBKDF2 salt, AES-GCM nonce, then the encrypted,
+// gzip compressed SQLite database
+const (
+	backupMagic      = "SMSBAK1\n"
+	backupSaltSize   = 16
+	backupIterations = 200000
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// BackupSettings holds configuration for remote database backups
+type BackupSettings struct {
+	S3         *S3Client
+	Prefix     string
+	Passphrase string
+	Interval   time.Duration
+	Keep       int           // number of backups to keep
+	MaxAge     time.Duration // backups older than this are deleted, 0 keeps them
+}
+
+// LoadBackupSettings reads backup settings from environment variables.
+// It returns nil if BACKUP_S3_BUCKET is not set.
+func LoadBackupSettings() (*BackupSettings, error) {
+	bucket := os.Getenv("BACKUP_S3_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	if isPostgresURL(DatabasePath()) {
+		return nil, fmt.Errorf("BACKUP_S3_BUCKET: backups copy the SQLite file; back up PostgreSQL with pg_dump")
+	}
+
+	secretKey, err := GetSecret("BACKUP_S3_SECRET_KEY")
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := GetSecret("BACKUP_PASSPHRASE")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("BACKUP_PASSPHRASE is required for backups")
+	}
+
+	region := os.Getenv("BACKUP_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	s3, err := NewS3Client(os.Getenv("BACKUP_S3_ENDPOINT"), region, bucket, os.Getenv("BACKUP_S3_ACCESS_KEY"), secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("BACKUP_S3_ENDPOINT: %w", err)
+	}
+
+	settings := &BackupSettings{
+		S3:         s3,
+		Prefix:     "sms-backups/",
+		Passphrase: passphrase,
+		Interval:   24 * time.Hour,
+		Keep:       14,
+	}
+
+	if prefix, ok := os.LookupEnv("BACKUP_S3_PREFIX"); ok {
+		settings.Prefix = prefix
+	}
+	if value := os.Getenv("BACKUP_INTERVAL"); value != "" {
+		if settings.Interval, err = parseInterval(value); err != nil {
+			return nil, fmt.Errorf("BACKUP_INTERVAL: %w", err)
+		}
+	}
+	if value := os.Getenv("BACKUP_KEEP"); value != "" {
+		if settings.Keep, err = strconv.Atoi(value); err != nil || settings.Keep < 1 {
+			return nil, fmt.Errorf("BACKUP_KEEP must be a positive number")
+		}
+	}
+	if value := os.Getenv("BACKUP_MAX_AGE"); value != "" {
+		if settings.MaxAge, err = parseInterval(value); err != nil {
+			return nil, fmt.Errorf("BACKUP_MAX_AGE: %w", err)
+		}
+	}
+
+	return settings, nil
+}
+
+// backupKey returns the derived AES-256 key for a passphrase and salt
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, backupIterations, 32)
+}
+
+// encryptBackup compresses and encrypts a database file with AES-256-GCM
+func encryptBackup(data []byte, passphrase string) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(backupMagic), salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, compressed.Bytes(), []byte(backupMagic)), nil
+}
+
+// decryptBackup reverses encryptBackup
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(backupMagic)) {
+		return nil, fmt.Errorf("not an SMS server backup")
+	}
+	data = data[len(backupMagic):]
+	if len(data) < backupSaltSize {
+		return nil, fmt.Errorf("backup is truncated")
+	}
+
+	key, err := backupKey(passphrase, data[:backupSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[backupSaltSize:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("backup is truncated")
+	}
+
+	compressed, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(backupMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup (wrong passphrase?)")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress backup: %w", err)
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// Snapshot writes a consistent copy of the database to path
+func (d *Database) Snapshot(path string) error {
+	if _, err := d.db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	return nil
+}
+
+// listBackups returns the stored backups, newest first
+func (s *BackupSettings) listBackups() ([]S3Object, error) {
+	objects, err := s.S3.ListObjects(s.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys embed the backup time, so they sort chronologically
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key > objects[j].Key
+	})
+	return objects, nil
+}
+
+// applyRetention deletes backups beyond Keep or older than MaxAge. The newest
+// backup is always kept.
+func (s *BackupSettings) applyRetention() error {
+	backups, err := s.listBackups()
+	if err != nil {
+		return err
+	}
+
+	for i, backup := range backups {
+		expired := s.MaxAge > 0 && time.Since(backup.LastModified) > s.MaxAge
+		if i == 0 || (i < s.Keep && !expired) {
+			continue
+		}
+		if err := s.S3.DeleteObject(backup.Key); err != nil {
+			return err
+		}
+		log.Printf("Deleted old backup %s", backup.Key)
+	}
+
+	return nil
+}
+
+// runBackup uploads an encrypted snapshot of the database and applies the retention rules
+func (app *App) runBackup() (*S3Object, error) {
+	settings := app.backup
+
+	tmp, err := os.CreateTemp("", "sms-backup-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp.Close()
+	// VACUUM INTO requires that the target does not exist
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+
+	if err := app.db.Snapshot(tmp.Name()); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	encrypted, err := encryptBackup(data, settings.Passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+
+	now := time.Now().UTC()
+	backup := &S3Object{
+		Key:          settings.Prefix + "sms-" + now.Format(backupTimeFormat) + ".db.enc",
+		LastModified: now,
+		Size:         int64(len(encrypted)),
+	}
+	if err := settings.S3.PutObject(backup.Key, encrypted); err != nil {
+		return nil, err
+	}
+	log.Printf("Uploaded backup %s (%d bytes)", backup.Key, backup.Size)
+
+	if err := settings.applyRetention(); err != nil {
+		log.Printf("Backup retention: %v", err)
+	}
+
+	return backup, nil
+}
+
+// runBackupJob uploads a backup whenever the newest one is older than the interval
+func (app *App) runBackupJob() {
+	for {
+		wait := app.backup.Interval
+
+		backups, err := app.backup.listBackups()
+		if err != nil {
+			log.Printf("Backup job: %v", err)
+			wait = time.Hour
+		} else if len(backups) > 0 && clock.Now().Sub(backups[0].LastModified) < app.backup.Interval {
+			wait = app.backup.Interval - clock.Now().Sub(backups[0].LastModified)
+		} else if _, err := app.runBackup(); err != nil {
+			log.Printf("Backup job: %v", err)
+			wait = time.Hour
+		}
+
+		<-clock.After(wait)
+	}
+}
+
+// RestoreBackup downloads a backup ("latest" or an object key) and replaces the
+// database at dbPath with it. The current database is kept as a .before-restore copy.
+func RestoreBackup(name, dbPath string) error {
+	settings, err := LoadBackupSettings()
+	if err != nil {
+		return err
+	}
+	if settings == nil {
+		return fmt.Errorf("backups are not configured (BACKUP_S3_BUCKET is not set)")
+	}
+	if isPostgresURL(dbPath) {
+		return fmt.Errorf("backups hold an SQLite database; restore PostgreSQL with pg_restore")
+	}
+
+	key := name
+	if name == "latest" {
+		backups, err := settings.listBackups()
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backups found under %s", settings.Prefix)
+		}
+		key = backups[0].Key
+	}
+
+	encrypted, err := settings.S3.GetObject(key)
+	if err != nil {
+		return err
+	}
+	data, err := decryptBackup(encrypted, settings.Passphrase)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		return fmt.Errorf("backup %s does not contain an SQLite database", key)
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		previous := dbPath + ".before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		if err := os.Rename(dbPath, previous); err != nil {
+			return fmt.Errorf("failed to move current database: %w", err)
+		}
+		log.Printf("Moved current database to %s", previous)
+	}
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+
+	tmp := filepath.Join(filepath.Dir(dbPath), "."+filepath.Base(dbPath)+".restore")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write database: %w", err)
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return fmt.Errorf("failed to write database: %w", err)
+	}
+
+	log.Printf("Restored %s from backup %s", dbPath, key)
+	return nil
+}
+
+// listBackupsHandler lists the stored backups
+func (app *App) listBackupsHandler(c *gin.Context) {
+	if app.backup == nil {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "Backups are not configured"))
+		return
+	}
+
+	backups, err := app.backup.listBackups()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorResponse(c, CodeUpstreamError, "Failed to list backups: %v", err))
+		return
+	}
+	if backups == nil {
+		backups = []S3Object{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"count":   len(backups),
+		"backups": backups,
+	})
+}
+
+// backupNow uploads a backup immediately
+func (app *App) backupNow(c *gin.Context) {
+	if app.backup == nil {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "Backups are not configured"))
+		return
+	}
+
+	backup, err := app.runBackup()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorResponse(c, CodeUpstreamError, "Backup failed: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"backup": backup,
+	})
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Number filter actions. Manual entries can allow a number a feed blocks.
+const (
+	FilterBlock = "block"
+	FilterAllow = "allow"
+)
+
+// filterSourceManual is the source of entries made through the API, which
+// take precedence over feed entries
+const filterSourceManual = "manual"
+
+// maxFeedBytes limits the size of a downloaded block list
+const maxFeedBytes = 10 << 20
+
+// NumberFilterEntry blocks or allows a number
+type NumberFilterEntry struct {
+	Number    string    `json:"number"`
+	Source    string    `json:"source"` // "manual" or the feed name
+	Action    string    `json:"action"` // block or allow
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NumberFilterRequest represents a request to block or allow a number
+type NumberFilterRequest struct {
+	Number string `json:"number" binding:"required"`
+	Action string `json:"action"` // default: block
+	Reason string `json:"reason"`
+}
+
+// BlocklistFeed is an external block list of known spam senders or premium
+// numbers, one number per line
+type BlocklistFeed struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // http(s) URL or file path
+}
+
+// FeedImport reports what an import of a feed changed
+type FeedImport struct {
+	Feed       string    `json:"feed"`
+	Time       time.Time `json:"time"`
+	DryRun     bool      `json:"dry_run,omitempty"`
+	Added      []string  `json:"added"`
+	Removed    []string  `json:"removed"`
+	Unchanged  int       `json:"unchanged"`
+	Skipped    int       `json:"skipped"`    // lines that are not valid numbers
+	Overridden int       `json:"overridden"` // feed numbers allowed by a manual entry
+	Error      string    `json:"error,omitempty"`
+}
+
+// Blocklist filters numbers that may not be sent to and whose messages are
+// not passed on, from manual entries and periodically imported feeds
+type Blocklist struct {
+	Feeds   []BlocklistFeed
+	Refresh time.Duration // how often feeds are imported
+
+	client *http.Client
+
+	mu      sync.Mutex
+	imports map[string]*FeedImport // last import of each feed
+}
+
+// LoadBlocklist reads block list feeds from environment variables.
+// BLOCKLIST_FEEDS lists feeds as name=source pairs, e.g.
+// "spam=https://example.com/spam.txt,premium=/etc/sms/premium.txt".
+// Without feeds the block list only holds manual entries.
+func LoadBlocklist() (*Blocklist, error) {
+	b := &Blocklist{
+		Refresh: 24 * time.Hour,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		imports: make(map[string]*FeedImport),
+	}
+
+	for _, entry := range splitList(os.Getenv("BLOCKLIST_FEEDS")) {
+		name, source, ok := strings.Cut(entry, "=")
+		name, source = strings.TrimSpace(name), strings.TrimSpace(source)
+		if !ok || name == "" || source == "" {
+			return nil, fmt.Errorf("BLOCKLIST_FEEDS: invalid feed %q (expected name=url or name=path)", entry)
+		}
+		if name == filterSourceManual {
+			return nil, fmt.Errorf("BLOCKLIST_FEEDS: feed name %q is reserved", name)
+		}
+		if _, found := b.feed(name); found {
+			return nil, fmt.Errorf("BLOCKLIST_FEEDS: duplicate feed %q", name)
+		}
+		b.Feeds = append(b.Feeds, BlocklistFeed{Name: name, Source: source})
+	}
+
+	if value := os.Getenv("BLOCKLIST_REFRESH"); value != "" {
+		refresh, err := time.ParseDuration(value)
+		if err != nil || refresh < time.Minute {
+			return nil, fmt.Errorf("BLOCKLIST_REFRESH: invalid duration %q (minimum 1m)", value)
+		}
+		b.Refresh = refresh
+	}
+
+	return b, nil
+}
+
+// feed returns the feed with the given name
+func (b *Blocklist) feed(name string) (BlocklistFeed, bool) {
+	for _, feed := range b.Feeds {
+		if feed.Name == name {
+			return feed, true
+		}
+	}
+	return BlocklistFeed{}, false
+}
+
+// Check returns the entry blocking a number, or nil if it isn't blocked. A
+// manual entry decides over feed entries. It returns nil on a nil block list.
+func (b *Blocklist) Check(db *Database, number string) (*NumberFilterEntry, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	entry, err := db.GetNumberFilter(number)
+	if err != nil || entry == nil || entry.Action != FilterBlock {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// IsBlocked reports whether messages from a number should not be passed on,
+// logging lookup failures
+func (b *Blocklist) IsBlocked(db *Database, number string) bool {
+	entry, err := b.Check(db, number)
+	if err != nil {
+		log.Printf("Failed to check block list for %s: %v", number, err)
+		return false
+	}
+	return entry != nil
+}
+
+// fetch reads the numbers of a feed. Lines may contain a number followed by
+// other fields; empty lines and "#" comments are skipped.
+func (b *Blocklist) fetch(feed BlocklistFeed) (numbers []string, skipped int, err error) {
+	var body io.Reader
+	if strings.HasPrefix(feed.Source, "http://") || strings.HasPrefix(feed.Source, "https://") {
+		resp, err := b.client.Get(feed.Source)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to download feed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("failed to download feed: HTTP %d", resp.StatusCode)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(feed.Source)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open feed: %w", err)
+		}
+		defer f.Close()
+		body = f
+	}
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(io.LimitReader(body, maxFeedBytes))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ';' || r == '\t' })
+		if len(fields) == 0 || strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+		number, err := NormalizeNumber(fields[0])
+		if err != nil {
+			skipped++
+			continue
+		}
+		if !seen[number] {
+			seen[number] = true
+			numbers = append(numbers, number)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read feed: %w", err)
+	}
+
+	return numbers, skipped, nil
+}
+
+// Import downloads a feed and replaces its entries, reporting the numbers
+// added and removed. With dryRun the entries are left unchanged. An empty
+// feed doesn't remove existing entries, as it is more likely broken than cleared.
+func (b *Blocklist) Import(db *Database, feed BlocklistFeed, dryRun bool) *FeedImport {
+	result := &FeedImport{Feed: feed.Name, Time: time.Now().UTC(), DryRun: dryRun, Added: []string{}, Removed: []string{}}
+	if err := b.importFeed(db, feed, result); err != nil {
+		result.Error = err.Error()
+	}
+
+	if !dryRun {
+		b.mu.Lock()
+		b.imports[feed.Name] = result
+		b.mu.Unlock()
+	}
+	return result
+}
+
+// importFeed fills result with the changes of an import
+func (b *Blocklist) importFeed(db *Database, feed BlocklistFeed, result *FeedImport) error {
+	numbers, skipped, err := b.fetch(feed)
+	if err != nil {
+		return err
+	}
+	result.Skipped = skipped
+
+	current, err := db.ListNumberFilters(feed.Name)
+	if err != nil {
+		return err
+	}
+	if len(numbers) == 0 && len(current) > 0 {
+		return fmt.Errorf("feed is empty, keeping its %d entries", len(current))
+	}
+
+	existing := make(map[string]bool, len(current))
+	for _, entry := range current {
+		existing[entry.Number] = true
+	}
+	listed := make(map[string]bool, len(numbers))
+	for _, number := range numbers {
+		listed[ConversationID(number)] = true
+		if existing[number] {
+			result.Unchanged++
+		} else {
+			result.Added = append(result.Added, number)
+		}
+	}
+	for _, entry := range current {
+		if !listed[ConversationID(entry.Number)] {
+			result.Removed = append(result.Removed, entry.Number)
+		}
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+
+	allowed, err := db.ListNumberFilters(filterSourceManual)
+	if err != nil {
+		return err
+	}
+	for _, entry := range allowed {
+		if entry.Action == FilterAllow && listed[ConversationID(entry.Number)] {
+			result.Overridden++
+		}
+	}
+
+	if result.DryRun {
+		return nil
+	}
+	return db.ReplaceFeedEntries(feed.Name, result.Added, result.Removed)
+}
+
+// LastImport returns the last import of a feed, or nil if it wasn't imported yet
+func (b *Blocklist) LastImport(name string) *FeedImport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.imports[name]
+}
+
+// SetNumberFilter adds or replaces an entry of a source. Numbers are matched
+// by conversation ID, so all spellings of a number are covered.
+func (d *Database) SetNumberFilter(entry NumberFilterEntry) error {
+	_, err := d.db.Exec(`
+		INSERT INTO number_filter (conversation_id, number, source, action, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(conversation_id, source) DO UPDATE SET
+			number = excluded.number, action = excluded.action, reason = excluded.reason, created_at = excluded.created_at
+	`, ConversationID(entry.Number), entry.Number, entry.Source, entry.Action, entry.Reason, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to save number filter: %w", err)
+	}
+	return nil
+}
+
+// DeleteNumberFilter removes the entry of a source for a number, reporting whether it existed
+func (d *Database) DeleteNumberFilter(number, source string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM number_filter WHERE conversation_id = ? AND source = ?`, ConversationID(number), source)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete number filter: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GetNumberFilter returns the entry deciding about a number: its manual entry
+// if there is one, otherwise a feed entry. It returns nil if the number isn't listed.
+func (d *Database) GetNumberFilter(number string) (*NumberFilterEntry, error) {
+	entry, err := scanNumberFilter(d.db.QueryRow(`
+		SELECT number, source, action, COALESCE(reason, ''), created_at
+		FROM number_filter
+		WHERE conversation_id = ?
+		ORDER BY source = ? DESC, created_at
+		LIMIT 1
+	`, ConversationID(number), filterSourceManual))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query number filter: %w", err)
+	}
+	return &entry, nil
+}
+
+// ListNumberFilters returns the entries of a source, or of all sources if
+// source is empty
+func (d *Database) ListNumberFilters(source string) ([]NumberFilterEntry, error) {
+	query := `SELECT number, source, action, COALESCE(reason, ''), created_at FROM number_filter`
+	var args []interface{}
+	if source != "" {
+		query += ` WHERE source = ?`
+		args = append(args, source)
+	}
+	query += ` ORDER BY source, number`
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query number filter: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []NumberFilterEntry{}
+	for rows.Next() {
+		entry, err := scanNumberFilter(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return entries, nil
+}
+
+// ReplaceFeedEntries adds and removes block entries of a feed in one transaction
+func (d *Database) ReplaceFeedEntries(feed string, added, removed []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, number := range added {
+		if _, err := tx.Exec(`
+			INSERT INTO number_filter (conversation_id, number, source, action, created_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(conversation_id, source) DO UPDATE SET
+				number = excluded.number, action = excluded.action, reason = NULL, created_at = excluded.created_at
+		`, ConversationID(number), number, feed, FilterBlock, now); err != nil {
+			return fmt.Errorf("failed to add feed entry: %w", err)
+		}
+	}
+	for _, number := range removed {
+		if _, err := tx.Exec(`DELETE FROM number_filter WHERE conversation_id = ? AND source = ?`, ConversationID(number), feed); err != nil {
+			return fmt.Errorf("failed to remove feed entry: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit feed entries: %w", err)
+	}
+	return nil
+}
+
+// scanNumberFilter reads a number filter entry
+func scanNumberFilter(row interface{ Scan(...any) error }) (NumberFilterEntry, error) {
+	var entry NumberFilterEntry
+	var createdAtStr string
+	if err := row.Scan(&entry.Number, &entry.Source, &entry.Action, &entry.Reason, &createdAtStr); err != nil {
+		return entry, err
+	}
+	entry.CreatedAt = parseTimestamp(createdAtStr)
+	return entry, nil
+}
+
+// runBlocklistJob imports the block list feeds on startup and then periodically
+func (app *App) runBlocklistJob() {
+	for {
+		for _, feed := range app.blocklist.Feeds {
+			result := app.blocklist.Import(app.db, feed, false)
+			if result.Error != "" {
+				log.Printf("Block list feed %s: %s", feed.Name, result.Error)
+				continue
+			}
+			log.Printf("Block list feed %s: %d added, %d removed, %d unchanged, %d invalid lines",
+				feed.Name, len(result.Added), len(result.Removed), result.Unchanged, result.Skipped)
+		}
+		<-clock.After(app.blocklist.Refresh)
+	}
+}
+
+// listNumberFilters returns the block list entries, optionally of one source
+func (app *App) listNumberFilters(c *gin.Context) {
+	entries, err := app.db.ListNumberFilters(c.Query("source"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list block list: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+// setNumberFilter blocks a number, or allows it despite the feeds listing it
+func (app *App) setNumberFilter(c *gin.Context) {
+	var req NumberFilterRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	if req.Action == "" {
+		req.Action = FilterBlock
+	}
+	if req.Action != FilterBlock && req.Action != FilterAllow {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid action %q (must be block or allow)", req.Action))
+		return
+	}
+
+	entry := NumberFilterEntry{Number: req.Number, Source: filterSourceManual, Action: req.Action, Reason: req.Reason}
+	if err := app.db.SetNumberFilter(entry); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to update block list: %v", err))
+		return
+	}
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	log.Printf("Block list: %s %s", req.Action, req.Number)
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"entry":  entry,
+	})
+}
+
+// deleteNumberFilter removes the manual entry of a number, leaving feed entries in place
+func (app *App) deleteNumberFilter(c *gin.Context) {
+	number := c.Param("number")
+
+	deleted, err := app.db.DeleteNumberFilter(number, filterSourceManual)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to update block list: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Number %s has no manual block list entry", number))
+		return
+	}
+
+	log.Printf("Block list: removed manual entry for %s", number)
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// listBlocklistFeeds returns the configured feeds and their last import
+func (app *App) listBlocklistFeeds(c *gin.Context) {
+	feeds := make([]gin.H, 0, len(app.blocklist.Feeds))
+	for _, feed := range app.blocklist.Feeds {
+		feeds = append(feeds, gin.H{
+			"name":        feed.Name,
+			"source":      feed.Source,
+			"last_import": app.blocklist.LastImport(feed.Name),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"refresh": app.blocklist.Refresh.String(),
+		"feeds":   feeds,
+	})
+}
+
+// importBlocklistFeed imports a feed now and returns the changes, or only
+// previews them with ?dry_run=true
+func (app *App) importBlocklistFeed(c *gin.Context) {
+	feed, ok := app.blocklist.feed(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Block list feed %s not found", c.Param("name")))
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	result := app.blocklist.Import(app.db, feed, dryRun)
+	if result.Error != "" {
+		resp := errorResponse(c, CodeUpstreamError, "Failed to import block list feed %s: %s", feed.Name, result.Error)
+		resp.Details = gin.H{"import": result}
+		c.JSON(http.StatusBadGateway, resp)
+		return
+	}
+
+	if !dryRun {
+		log.Printf("Block list feed %s: %d added, %d removed", feed.Name, len(result.Added), len(result.Removed))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"import": result,
+	})
+}
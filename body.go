@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// defaultMaxBodyBytes is the default limit of request bodies
+const defaultMaxBodyBytes = 64 * 1024
+
+// GetMaxBodyBytes returns the maximum request body size from environment variable
+func GetMaxBodyBytes() int64 {
+	if value := os.Getenv("MAX_BODY_BYTES"); value != "" {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid MAX_BODY_BYTES %q, using %d", value, defaultMaxBodyBytes)
+	}
+	return defaultMaxBodyBytes
+}
+
+// jsonBodyMiddleware rejects request bodies that are not JSON with 415 and
+// bodies larger than maxBytes with 413. Requests without a body pass through.
+func jsonBodyMiddleware(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// ContentLength is -1 for chunked bodies of unknown size
+		if c.Request.Body == nil || c.Request.Body == http.NoBody || c.Request.ContentLength == 0 {
+			c.Next()
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, errorResponse(c, CodeUnsupportedMediaType, "Content-Type must be application/json"))
+			return
+		}
+
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errorResponse(c, CodePayloadTooLarge, "Request body must not exceed %d bytes", maxBytes))
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// bindStrictJSON decodes the request body into obj, rejecting unknown fields
+// and trailing data, and validates its binding tags. On failure it writes a
+// 400 (or 413 for oversized chunked bodies) response and returns false.
+func bindStrictJSON(c *gin.Context, obj any) bool {
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(obj)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected data after JSON object")
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("request body is empty")
+	}
+	if err == nil {
+		err = binding.Validator.ValidateStruct(obj)
+	}
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, errorResponse(c, CodePayloadTooLarge, "Request body must not exceed %d bytes", maxBytesErr.Limit))
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid request: %v", err))
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TableVersion summarizes the state of a message table for cache validation
+type TableVersion struct {
+	MaxID        int
+	Count        int
+	Queued       int // sent SMS waiting for a dispatcher, then sending
+	Sending      int // sent SMS waiting for their outcome, which is updated in place
+	Unread       int // received SMS not marked read, see unread.go
+	LastModified string
+	Labels       string // device labels and contact names, which are part of the lists, see messagelabels.go
+}
+
+// GetTableVersion returns the latest ID, row count and newest created_at of a
+// message table, for sent SMS the number still queued and sending, and for
+// received SMS the number unread
+func (d *Database) GetTableVersion(table string) (TableVersion, error) {
+	var pending string
+	switch table {
+	case "received_sms":
+		pending = "0, 0, COALESCE(SUM(CASE WHEN read = 0 THEN 1 ELSE 0 END), 0)"
+	case "sent_sms":
+		pending = "COALESCE(SUM(CASE WHEN status = 'queued' THEN 1 ELSE 0 END), 0), COALESCE(SUM(CASE WHEN status = 'sending' THEN 1 ELSE 0 END), 0), 0"
+	default:
+		return TableVersion{}, fmt.Errorf("unknown table %q", table)
+	}
+
+	var v TableVersion
+	query := fmt.Sprintf("SELECT COALESCE(MAX(id), 0), COUNT(*), %s, COALESCE(MAX(created_at), '') FROM %s", pending, table)
+	err := d.db.QueryRow(query).Scan(&v.MaxID, &v.Count, &v.Queued, &v.Sending, &v.Unread, &v.LastModified)
+	if err != nil {
+		return TableVersion{}, fmt.Errorf("failed to query table version: %w", err)
+	}
+	if v.Labels, err = d.messageLabelsVersion(); err != nil {
+		return TableVersion{}, fmt.Errorf("failed to query table version: %w", err)
+	}
+
+	return v, nil
+}
+
+// notModified sets ETag and Last-Modified headers for a list endpoint backed by
+// table and reports whether the client's If-None-Match matched, in which case a
+// 304 response has already been sent
+func (app *App) notModified(c *gin.Context, table string) bool {
+	version, err := app.db.GetTableVersion(table)
+	if err != nil {
+		// Serve the full response if the version can't be determined
+		return false
+	}
+
+	// The query string is part of the tag since limit/offset change the content,
+	// and so are the device labels and contact names
+	h := fnv.New32a()
+	h.Write([]byte(c.Request.URL.RawQuery))
+	h.Write([]byte(version.Labels))
+	etag := fmt.Sprintf(`W/"%d-%d-%d-%d-%d-%x"`, version.MaxID, version.Count, version.Queued, version.Sending, version.Unread, h.Sum32())
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if lastModified := parseTimestamp(version.LastModified); !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	for _, candidate := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		// Weak comparison: ignore the W/ prefix
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == strings.TrimPrefix(etag, "W/") || candidate == "*" {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+)
+
+// maxLabelLength limits the template and campaign names of a send
+const maxLabelLength = 64
+
+// LabelStats are the send outcomes of one template or campaign
+type LabelStats struct {
+	Name         string         `json:"name"`
+	Total        int            `json:"total"`
+	Success      int            `json:"success"`
+	Failed       int            `json:"failed"`
+	FailureRate  float64        `json:"failure_rate"`            // failed / (success + failed)
+	ErrorClasses map[string]int `json:"error_classes,omitempty"` // failures per error class
+}
+
+// validateLabels checks the template and campaign names of a send
+func validateLabels(opts SendOptions) error {
+	if len(opts.Template) > maxLabelLength {
+		return apiErrorf(CodeInvalidRequest, "Template name is too long (maximum %d characters)", maxLabelLength)
+	}
+	if len(opts.Campaign) > maxLabelLength {
+		return apiErrorf(CodeInvalidRequest, "Campaign name is too long (maximum %d characters)", maxLabelLength)
+	}
+	return nil
+}
+
+// CountSentSMSByLabel returns the send outcomes per value of a label column
+// (template or campaign), most used first. Unlabelled sends are left out.
+func (d *Database) CountSentSMSByLabel(column string) ([]LabelStats, error) {
+	if column != "template" && column != "campaign" {
+		return nil, fmt.Errorf("unknown label %q", column)
+	}
+
+	rows, err := d.db.Query(fmt.Sprintf(`
+		SELECT %[1]s, COUNT(*), SUM(CASE WHEN status = 'success' THEN 1 ELSE 0 END), SUM(CASE WHEN status = 'error' THEN 1 ELSE 0 END)
+		FROM sent_sms
+		WHERE %[1]s IS NOT NULL AND %[1]s != ''
+		GROUP BY %[1]s
+		ORDER BY 2 DESC, 1
+	`, column))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count sent SMS by %s: %w", column, err)
+	}
+	defer rows.Close()
+
+	stats := []LabelStats{}
+	index := make(map[string]int)
+	for rows.Next() {
+		var s LabelStats
+		if err := rows.Scan(&s.Name, &s.Total, &s.Success, &s.Failed); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if attempted := s.Success + s.Failed; attempted > 0 {
+			s.FailureRate = float64(s.Failed) / float64(attempted)
+		}
+		index[s.Name] = len(stats)
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	rows.Close()
+
+	// Break failures down by error class
+	rows, err = d.db.Query(fmt.Sprintf(`
+		SELECT %[1]s, COALESCE(error_class, ''), COUNT(*)
+		FROM sent_sms
+		WHERE status = 'error' AND %[1]s IS NOT NULL AND %[1]s != ''
+		GROUP BY 1, 2
+	`, column))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count failures by %s: %w", column, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, class string
+		var count int
+		if err := rows.Scan(&name, &class, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if class == "" {
+			class = string(ErrorClassUnknown)
+		}
+		s := &stats[index[name]]
+		if s.ErrorClasses == nil {
+			s.ErrorClasses = make(map[string]int)
+		}
+		s.ErrorClasses[class] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return stats, nil
+}
+
+// nullIfEmpty stores an unset label as NULL so it is left out of the breakdowns
+func nullIfEmpty(label string) any {
+	if label == "" {
+		return nil
+	}
+	return label
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Serial protocols
+const (
+	SerialProtocolJSON = "json" // newline terminated JSON lines
+	SerialProtocolCBOR = "cbor" // CBOR maps in length prefixed frames
+)
+
+// cborFrameStart starts a CBOR frame, followed by the payload length as two
+// bytes big endian. The byte never occurs in UTF-8 text, so frames and JSON
+// lines can be told apart on the same stream.
+const cborFrameStart = 0xC0
+
+// CBOR major types
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborSimple   = 7
+)
+
+// encodeCBORFrame encodes a serial command as a CBOR map in a frame. Only the
+// value types of serial commands are supported: strings, integers and booleans.
+func encodeCBORFrame(cmd SerialCommand) ([]byte, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	payload := cborHead(nil, cborMap, uint64(len(keys)))
+	for _, key := range keys {
+		payload = cborHead(payload, cborText, uint64(len(key)))
+		payload = append(payload, key...)
+
+		switch value := fields[key].(type) {
+		case string:
+			payload = cborHead(payload, cborText, uint64(len(value)))
+			payload = append(payload, value...)
+		case json.Number:
+			n, err := value.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("unsupported number %s in field %s", value, key)
+			}
+			if n < 0 {
+				payload = cborHead(payload, cborNegative, uint64(-1-n))
+			} else {
+				payload = cborHead(payload, cborUnsigned, uint64(n))
+			}
+		case bool:
+			if value {
+				payload = append(payload, cborSimple<<5|21)
+			} else {
+				payload = append(payload, cborSimple<<5|20)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported value in field %s", key)
+		}
+	}
+
+	if len(payload) > math.MaxUint16 {
+		return nil, fmt.Errorf("command too long for a frame")
+	}
+
+	frame := []byte{cborFrameStart, 0, 0}
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	return append(frame, payload...), nil
+}
+
+// cborHead appends the head of a CBOR item
+func cborHead(b []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(b, major<<5|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(b, major<<5|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major<<5|27), arg)
+	}
+}
+
+// cborToJSON converts a CBOR frame payload to the equivalent JSON, so
+// responses in either protocol are handled the same way
+func cborToJSON(payload []byte) ([]byte, error) {
+	d := cborDecoder{data: payload}
+	value, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%d trailing bytes after CBOR item", len(d.data)-d.pos)
+	}
+
+	return json.Marshal(value)
+}
+
+// cborDecoder decodes the CBOR subset sent by the sketch
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads the major type and argument of the next item
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, fmt.Errorf("unexpected end of CBOR data")
+	}
+	initial := d.data[d.pos]
+	d.pos++
+
+	major, info := initial>>5, initial&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported CBOR item 0x%02x", initial)
+	}
+
+	if d.pos+size > len(d.data) {
+		return 0, 0, fmt.Errorf("unexpected end of CBOR data")
+	}
+	var arg uint64
+	for _, b := range d.data[d.pos : d.pos+size] {
+		arg = arg<<8 | uint64(b)
+	}
+	d.pos += size
+
+	return major, arg, nil
+}
+
+// value decodes the next item
+func (d *cborDecoder) value(depth int) (any, error) {
+	if depth > 8 {
+		return nil, fmt.Errorf("CBOR data nested too deeply")
+	}
+
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		return arg, nil
+	case cborNegative:
+		return -1 - int64(arg), nil
+	case cborText:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("unexpected end of CBOR data")
+		}
+		text := string(d.data[d.pos : d.pos+int(arg)])
+		d.pos += int(arg)
+		return text, nil
+	case cborArray:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("unexpected end of CBOR data")
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case cborMap:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("unexpected end of CBOR data")
+		}
+		fields := make(map[string]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("CBOR map key is not text")
+			}
+			if fields[name], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	case cborSimple:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported CBOR major type %d", major)
+}
+
+// serialFrameTimeout is how long the rest of a frame may take to arrive
+// before its start is treated as noise
+const serialFrameTimeout = time.Second
+
+// handleFrame processes a CBOR frame from the Arduino
+func (a *ArduinoConnection) handleFrame(payload []byte) {
+	data, err := cborToJSON(payload)
+	if err != nil {
+		log.Printf("Failed to decode Arduino frame %x (error: %v)", payload, err)
+		a.monitor.RecordParseFailure()
+		return
+	}
+
+	a.handleResponse(string(data))
+}
+
+// negotiateProtocol asks the Arduino to switch to the configured protocol.
+// Sketches that don't support it reject the command and stay on JSON. The
+// sketch confirms with a hello event, after which commands are sent as
+// CBOR; it accepts both until then.
+func (a *ArduinoConnection) negotiateProtocol() {
+	if a.gsm.Protocol != SerialProtocolCBOR {
+		return
+	}
+
+	if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: "hello", Protocol: a.gsm.Protocol}); err != nil {
+		log.Printf("Failed to negotiate serial protocol: %v", err)
+	}
+}
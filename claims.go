@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errStandby is returned by device operations on an instance that doesn't
+// hold the device claim
+var errStandby = fmt.Errorf("%w: the device is driven by another instance", ErrNotConnected)
+
+// DeviceClaimSettings configures coordination of instances sharing a database,
+// so that only one of them drives the device
+type DeviceClaimSettings struct {
+	Device   string        // name of the claimed device, the same on every instance
+	Instance string        // this instance's ID
+	TTL      time.Duration // how long a claim lasts without being renewed
+}
+
+// DeviceClaim records which instance drives a device
+type DeviceClaim struct {
+	Device    string    `json:"device"`
+	Instance  string    `json:"instance"`
+	ClaimedAt time.Time `json:"claimed_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoadDeviceClaimSettings reads device claim settings from environment
+// variables. It returns nil if DEVICE_CLAIM is not set.
+func LoadDeviceClaimSettings() (*DeviceClaimSettings, error) {
+	device := os.Getenv("DEVICE_CLAIM")
+	if device == "" {
+		return nil, nil
+	}
+
+	settings := &DeviceClaimSettings{
+		Device:   device,
+		Instance: os.Getenv("INSTANCE_ID"),
+		TTL:      30 * time.Second,
+	}
+
+	if settings.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("INSTANCE_ID not set and failed to get hostname: %w", err)
+		}
+		settings.Instance = hostname
+	}
+
+	if value := os.Getenv("DEVICE_CLAIM_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 5*time.Second || ttl > 5*time.Minute {
+			return nil, fmt.Errorf("DEVICE_CLAIM_TTL: invalid duration %q (5s to 5m)", value)
+		}
+		settings.TTL = ttl
+	}
+
+	return settings, nil
+}
+
+// ClaimDevice takes or renews the claim on a device for instance, unless
+// another instance holds an unexpired claim, and returns the current claim
+func (d *Database) ClaimDevice(device, instance string, ttl time.Duration) (DeviceClaim, error) {
+	_, err := d.db.Exec(`
+		INSERT INTO device_claims (device, instance, claimed_at, expires_at)
+		VALUES (?, ?, `+d.dialect().now()+`, `+d.dialect().timeAfter()+`)
+		ON CONFLICT(device) DO UPDATE SET
+			claimed_at = CASE WHEN device_claims.instance = excluded.instance THEN device_claims.claimed_at ELSE excluded.claimed_at END,
+			instance = excluded.instance,
+			expires_at = excluded.expires_at
+		WHERE device_claims.instance = excluded.instance OR device_claims.expires_at < `+d.dialect().now()+`
+	`, device, instance, fmt.Sprintf("+%d seconds", int(ttl.Seconds())))
+	if err != nil {
+		return DeviceClaim{}, fmt.Errorf("failed to claim device: %w", err)
+	}
+
+	claim, err := d.GetDeviceClaim(device)
+	if err != nil {
+		return DeviceClaim{}, err
+	}
+	if claim == nil {
+		return DeviceClaim{}, fmt.Errorf("device claim of %s disappeared", device)
+	}
+	return *claim, nil
+}
+
+// GetDeviceClaim returns the claim on a device, or nil if it is unclaimed
+func (d *Database) GetDeviceClaim(device string) (*DeviceClaim, error) {
+	var claim DeviceClaim
+	var claimedAtStr, expiresAtStr string
+
+	err := d.db.QueryRow(`SELECT device, instance, claimed_at, expires_at FROM device_claims WHERE device = ?`, device).
+		Scan(&claim.Device, &claim.Instance, &claimedAtStr, &expiresAtStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device claim: %w", err)
+	}
+
+	claim.ClaimedAt = parseTimestamp(claimedAtStr)
+	claim.ExpiresAt = parseTimestamp(expiresAtStr)
+	return &claim, nil
+}
+
+// ReleaseDevice gives up instance's claim on a device
+func (d *Database) ReleaseDevice(device, instance string) error {
+	if _, err := d.db.Exec(`DELETE FROM device_claims WHERE device = ? AND instance = ?`, device, instance); err != nil {
+		return fmt.Errorf("failed to release device claim: %w", err)
+	}
+	return nil
+}
+
+// ClaimedConnection drives the device only while this instance holds its
+// claim. It opens the connection when the claim is taken and closes it when
+// the claim is lost; in between, device operations fail as not connected.
+type ClaimedConnection struct {
+	settings *DeviceClaimSettings
+	db       *Database
+	open     func() (SMSConnection, error)
+
+	mu    sync.RWMutex
+	conn  SMSConnection // nil on standby
+	claim DeviceClaim   // last seen claim
+
+	held     chan struct{} // closed once the claim is first held
+	heldOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewClaimedConnection starts claiming the device, opening it with open while
+// the claim is held
+func NewClaimedConnection(settings *DeviceClaimSettings, db *Database, open func() (SMSConnection, error)) *ClaimedConnection {
+	c := &ClaimedConnection{
+		settings: settings,
+		db:       db,
+		open:     open,
+		held:     make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// run renews the claim every third of its TTL and opens or closes the device
+// as the claim is taken or lost
+func (c *ClaimedConnection) run() {
+	defer close(c.done)
+
+	ticker := clock.NewTicker(c.settings.TTL / 3)
+	defer ticker.Stop()
+
+	var retryAt time.Time // after failing to open the device, let another instance try first
+	for {
+		if clock.Now().After(retryAt) {
+			if err := c.renew(); err != nil {
+				log.Printf("Device claim: %v", err)
+				retryAt = clock.Now().Add(c.settings.TTL * 2)
+			}
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// renew takes or renews the claim and opens or closes the device accordingly.
+// It returns an error if the device can't be opened while the claim is held.
+func (c *ClaimedConnection) renew() error {
+	claim, err := c.db.ClaimDevice(c.settings.Device, c.settings.Instance, c.settings.TTL)
+	if err != nil {
+		// Without the database the claim can't be renewed and another
+		// instance may take it once it expires
+		if c.current() != nil && time.Now().After(c.lastClaim().ExpiresAt) {
+			c.drop("claim expired without renewal")
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	c.claim = claim
+	c.mu.Unlock()
+
+	ours := claim.Instance == c.settings.Instance
+	conn := c.current()
+
+	switch {
+	case ours && conn == nil:
+		log.Printf("Device claim: %s claimed by this instance (%s), connecting", c.settings.Device, c.settings.Instance)
+		opened, err := c.open()
+		if err != nil {
+			c.db.ReleaseDevice(c.settings.Device, c.settings.Instance)
+			return fmt.Errorf("failed to open %s, released the claim: %w", c.settings.Device, err)
+		}
+		c.mu.Lock()
+		c.conn = opened
+		c.mu.Unlock()
+		c.heldOnce.Do(func() { close(c.held) })
+
+	case !ours && conn != nil:
+		c.drop(fmt.Sprintf("claimed by %s", claim.Instance))
+	}
+
+	return nil
+}
+
+// drop closes the device after the claim was lost
+func (c *ClaimedConnection) drop(reason string) {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn != nil {
+		log.Printf("Device claim: lost %s (%s), standing by", c.settings.Device, reason)
+		conn.Close()
+	}
+}
+
+// current returns the device connection, or nil on standby
+func (c *ClaimedConnection) current() SMSConnection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+// lastClaim returns the claim as last seen in the database
+func (c *ClaimedConnection) lastClaim() DeviceClaim {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.claim
+}
+
+// Held is closed once this instance first holds the claim
+func (c *ClaimedConnection) Held() <-chan struct{} {
+	return c.held
+}
+
+// Status describes the claim for the health check
+func (c *ClaimedConnection) Status() gin.H {
+	claim := c.lastClaim()
+	status := gin.H{
+		"device":   c.settings.Device,
+		"instance": c.settings.Instance,
+		"held":     c.current() != nil,
+	}
+	if claim.Instance != "" {
+		status["holder"] = claim.Instance
+		status["expires_at"] = claim.ExpiresAt
+	}
+	return status
+}
+
+// SendSMS sends through the device while the claim is held
+func (c *ClaimedConnection) SendSMS(number, content string, opts SendOptions) error {
+	if conn := c.current(); conn != nil {
+		return conn.SendSMS(number, content, opts)
+	}
+	return errStandby
+}
+
+// Close stops claiming, closes the device and releases the claim so another
+// instance can take over right away
+func (c *ClaimedConnection) Close() error {
+	close(c.stop)
+	<-c.done
+
+	var err error
+	if conn := c.current(); conn != nil {
+		err = conn.Close()
+		if releaseErr := c.db.ReleaseDevice(c.settings.Device, c.settings.Instance); releaseErr != nil {
+			log.Printf("Device claim: %v", releaseErr)
+		}
+	}
+	return err
+}
+
+// IsConnected reports whether the claim is held and the device connected
+func (c *ClaimedConnection) IsConnected() bool {
+	conn := c.current()
+	return conn != nil && conn.IsConnected()
+}
+
+// IsGSMReady reports whether the claim is held and GSM is ready
+func (c *ClaimedConnection) IsGSMReady() bool {
+	conn := c.current()
+	return conn != nil && conn.IsGSMReady()
+}
+
+// Wakeup wakes GSM while the claim is held
+func (c *ClaimedConnection) Wakeup() error {
+	if conn := c.current(); conn != nil {
+		return conn.Wakeup()
+	}
+	return errStandby
+}
+
+// EnsureGSMReady waits for GSM while the claim is held
+func (c *ClaimedConnection) EnsureGSMReady(timeout time.Duration) error {
+	if conn := c.current(); conn != nil {
+		return conn.EnsureGSMReady(timeout)
+	}
+	return errStandby
+}
+
+// USSD runs a USSD request while the claim is held
+func (c *ClaimedConnection) USSD(code string, timeout time.Duration) (string, error) {
+	if conn := c.current(); conn != nil {
+		return conn.USSD(code, timeout)
+	}
+	return "", errStandby
+}
+
+// ModemStatus returns the modem status, empty on standby
+func (c *ClaimedConnection) ModemStatus() ModemStatus {
+	if conn := c.current(); conn != nil {
+		return conn.ModemStatus()
+	}
+	return ModemStatus{}
+}
+
+// OwnNumber returns the SIM's own number, empty on standby
+func (c *ClaimedConnection) OwnNumber() (string, string) {
+	if conn := c.current(); conn != nil {
+		return conn.OwnNumber()
+	}
+	return "", ""
+}
+
+// NetworkTime reads the network time while the claim is held
+func (c *ClaimedConnection) NetworkTime(timeout time.Duration) (time.Time, error) {
+	if conn := c.current(); conn != nil {
+		return conn.NetworkTime(timeout)
+	}
+	return time.Time{}, errStandby
+}
+
+// SerialStats returns the serial line counters, empty on standby
+func (c *ClaimedConnection) SerialStats() SerialStats {
+	if conn := c.current(); conn != nil {
+		return conn.SerialStats()
+	}
+	return SerialStats{}
+}
+
+// Flash flashes the device while the claim is held
+func (c *ClaimedConnection) Flash(ctx context.Context, settings FlashSettings) (FlashResult, error) {
+	if conn := c.current(); conn != nil {
+		return conn.Flash(ctx, settings)
+	}
+	return FlashResult{}, errStandby
+}
+
+// PowerCycle power cycles the device while the claim is held
+func (c *ClaimedConnection) PowerCycle(reason string) error {
+	if conn := c.current(); conn != nil {
+		return conn.PowerCycle(reason)
+	}
+	return errStandby
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clock sync modes
+const (
+	ClockSyncLog    = "log"    // log drift from network time
+	ClockSyncOffset = "offset" // also correct application timestamps by the drift
+)
+
+// modemClockLayout is the layout of the modem clock (AT+CCLK?) without its zone
+const modemClockLayout = "06/01/02,15:04:05"
+
+// clockOffset is the correction applied by clockNow, in nanoseconds
+var clockOffset atomic.Int64
+
+// clockNow returns the current time of the clock corrected by the network
+// clock offset. It is used to timestamp received messages.
+func clockNow() time.Time {
+	return clock.Now().Add(time.Duration(clockOffset.Load()))
+}
+
+// ClockSyncSettings holds configuration for comparing the local clock with network time
+type ClockSyncSettings struct {
+	Mode      string // log or offset
+	Interval  time.Duration
+	Threshold time.Duration // drift below this is ignored
+
+	mu   sync.Mutex
+	last *ClockCheck
+}
+
+// ClockCheck is the result of one comparison with network time
+type ClockCheck struct {
+	NetworkTime   *time.Time `json:"network_time,omitempty"`
+	LocalTime     time.Time  `json:"local_time"`
+	DriftSeconds  float64    `json:"drift_seconds"`  // network time minus local time
+	OffsetSeconds float64    `json:"offset_seconds"` // correction applied to timestamps
+	Error         string     `json:"error,omitempty"`
+}
+
+// LoadClockSyncSettings reads clock sync settings from environment variables.
+// It returns nil if CLOCK_SYNC is not set.
+func LoadClockSyncSettings() (*ClockSyncSettings, error) {
+	mode := os.Getenv("CLOCK_SYNC")
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != ClockSyncLog && mode != ClockSyncOffset {
+		return nil, fmt.Errorf("CLOCK_SYNC: invalid mode %q (use log or offset)", mode)
+	}
+
+	settings := &ClockSyncSettings{Mode: mode, Interval: 6 * time.Hour, Threshold: 10 * time.Second}
+
+	if value := os.Getenv("CLOCK_SYNC_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 10*time.Minute {
+			return nil, fmt.Errorf("CLOCK_SYNC_INTERVAL: invalid interval %q (minimum 10m)", value)
+		}
+		settings.Interval = interval
+	}
+
+	if value := os.Getenv("CLOCK_DRIFT_THRESHOLD"); value != "" {
+		threshold, err := time.ParseDuration(value)
+		if err != nil || threshold < time.Second {
+			return nil, fmt.Errorf("CLOCK_DRIFT_THRESHOLD: invalid duration %q (minimum 1s)", value)
+		}
+		settings.Threshold = threshold
+	}
+
+	return settings, nil
+}
+
+// parseModemClock parses the modem clock, e.g. "24/01/17,10:30:00+04", where
+// the zone is given in quarter hours. Modems that never received network time
+// report a default date, which is rejected.
+func parseModemClock(value string) (time.Time, error) {
+	if len(value) < len(modemClockLayout)+2 {
+		return time.Time{}, fmt.Errorf("invalid modem clock %q", value)
+	}
+
+	local, zone := value[:len(modemClockLayout)], value[len(modemClockLayout):]
+	quarters, err := strconv.Atoi(zone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid modem clock zone %q", zone)
+	}
+
+	t, err := time.ParseInLocation(modemClockLayout, local, time.FixedZone("", quarters*15*60))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid modem clock %q", value)
+	}
+	if t.Year() < 2020 {
+		return time.Time{}, fmt.Errorf("modem clock %q was not set from the network", value)
+	}
+
+	return t, nil
+}
+
+// runClockCheck compares the local clock with network time, logs the drift
+// and, in offset mode, corrects application timestamps by it
+func (app *App) runClockCheck() *ClockCheck {
+	settings := app.clockSync
+
+	networkTime, err := app.smsConn.NetworkTime(time.Minute)
+	check := &ClockCheck{LocalTime: clock.Now().UTC()}
+
+	if err != nil {
+		check.Error = err.Error()
+		check.OffsetSeconds = time.Duration(clockOffset.Load()).Seconds()
+		log.Printf("Clock sync: %v", err)
+	} else {
+		// The modem clock has a resolution of one second
+		drift := networkTime.Sub(check.LocalTime).Round(time.Second)
+		utc := networkTime.UTC()
+		check.NetworkTime = &utc
+		check.DriftSeconds = drift.Seconds()
+
+		exceeded := drift >= settings.Threshold || -drift >= settings.Threshold
+		if settings.Mode == ClockSyncOffset {
+			offset := time.Duration(0)
+			if exceeded {
+				offset = drift
+			}
+			clockOffset.Store(int64(offset))
+		}
+		check.OffsetSeconds = time.Duration(clockOffset.Load()).Seconds()
+
+		if exceeded {
+			log.Printf("Clock sync: network time differs from the local clock by %s (offset %s)", drift, time.Duration(clockOffset.Load()))
+			app.events.Publish(EventClockDrift, check)
+		} else {
+			log.Printf("Clock sync: drift from network time %s", drift)
+		}
+	}
+
+	settings.mu.Lock()
+	settings.last = check
+	settings.mu.Unlock()
+
+	return check
+}
+
+// runClockSyncJob compares the local clock with network time at the configured interval
+func (app *App) runClockSyncJob() {
+	ticker := clock.NewTicker(app.clockSync.Interval)
+	defer ticker.Stop()
+
+	for {
+		app.runClockCheck()
+		<-ticker.C()
+	}
+}
+
+// getClock returns the clock sync configuration and the last check
+func (app *App) getClock(c *gin.Context) {
+	if app.clockSync == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"enabled": false,
+		})
+		return
+	}
+
+	app.clockSync.mu.Lock()
+	last := app.clockSync.last
+	app.clockSync.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"enabled":   true,
+		"mode":      app.clockSync.Mode,
+		"interval":  app.clockSync.Interval.String(),
+		"threshold": app.clockSync.Threshold.String(),
+		"last":      last,
+	})
+}
+
+// syncClockNow compares the local clock with network time immediately
+func (app *App) syncClockNow(c *gin.Context) {
+	if app.clockSync == nil {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "Clock sync is not configured"))
+		return
+	}
+
+	check := app.runClockCheck()
+
+	if check.Error != "" {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status": "error",
+			"check":  check,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"check":  check,
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// languagePattern matches the language tags of contacts and template
+// translations, e.g. "de" or "pt-br", after lowercasing
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+// normalizeLanguage lowercases a language tag and checks it
+func normalizeLanguage(language string) (string, error) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if !languagePattern.MatchString(language) {
+		return "", fmt.Errorf("invalid language %q (expected a tag such as de or pt-br)", language)
+	}
+	return language, nil
+}
+
+// Limits of contact fields
+const (
+	maxContactNameLength  = 64
+	maxContactNotesLength = 1000
+)
+
+// errContactNameTaken is returned when saving a contact under the name of
+// another one, since sends address contacts by name
+var errContactNameTaken = errors.New("another contact has this name")
+
+// Contact is an entry of the contacts directory: the name the team knows a
+// peer by, notes and the peer's preferred language. It is found by any
+// spelling of the number, like a conversation.
+type Contact struct {
+	Number    string    `json:"number"`
+	Name      string    `json:"name,omitempty"`     // unique, case-insensitively; POST /send accepts it as contact
+	Notes     string    `json:"notes,omitempty"`    // free text for the team
+	Language  string    `json:"language,omitempty"` // translation picked for template sends, see templates.go
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ContactRequest represents a request to create or replace a contact. The
+// number is only read when creating one with POST /contacts.
+type ContactRequest struct {
+	Number   string `json:"number,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Notes    string `json:"notes,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// normalize trims and checks the fields of a contact request
+func (r *ContactRequest) normalize() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Notes = strings.TrimSpace(r.Notes)
+	if r.Name == "" && r.Language == "" {
+		return fmt.Errorf("name or language is required")
+	}
+	if utf8.RuneCountInString(r.Name) > maxContactNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxContactNameLength)
+	}
+	if utf8.RuneCountInString(r.Notes) > maxContactNotesLength {
+		return fmt.Errorf("notes are longer than %d characters", maxContactNotesLength)
+	}
+	if r.Language != "" {
+		language, err := normalizeLanguage(r.Language)
+		if err != nil {
+			return err
+		}
+		r.Language = language
+	}
+	return nil
+}
+
+// contactColumns are the contacts columns read by scanContact
+const contactColumns = `number, name, notes, language, updated_at`
+
+// scanContact reads a contact selected with contactColumns
+func scanContact(row interface{ Scan(...any) error }) (Contact, error) {
+	var contact Contact
+	var updatedAtStr string
+	if err := row.Scan(&contact.Number, &contact.Name, &contact.Notes, &contact.Language, &updatedAtStr); err != nil {
+		return contact, err
+	}
+	contact.UpdatedAt = parseTimestamp(updatedAtStr)
+	return contact, nil
+}
+
+// SetContact saves a contact, replacing the one with the same conversation ID,
+// i.e. of the same number in another spelling. It returns errContactNameTaken
+// if another contact has the name.
+func (d *Database) SetContact(number string, req ContactRequest) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	conversationID := ConversationID(number)
+	if req.Name != "" {
+		var taken int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM contacts WHERE lower(name) = lower(?) AND conversation_id != ?`,
+			req.Name, conversationID).Scan(&taken)
+		if err != nil {
+			return fmt.Errorf("failed to query contacts: %w", err)
+		}
+		if taken > 0 {
+			return errContactNameTaken
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO contacts (conversation_id, number, name, notes, language, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(conversation_id) DO UPDATE SET number = excluded.number, name = excluded.name, notes = excluded.notes,
+			language = excluded.language, updated_at = excluded.updated_at
+	`, conversationID, number, req.Name, req.Notes, req.Language, time.Now().UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to save contact: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save contact: %w", err)
+	}
+	return nil
+}
+
+// GetContact retrieves the contact of a number in any spelling, returning nil
+// if there is none
+func (d *Database) GetContact(number string) (*Contact, error) {
+	contact, err := scanContact(d.db.QueryRow(`SELECT `+contactColumns+` FROM contacts WHERE conversation_id = ?`, ConversationID(number)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contact: %w", err)
+	}
+	return &contact, nil
+}
+
+// GetContactByName retrieves the contact with a name, ignoring case, returning
+// nil if there is none
+func (d *Database) GetContactByName(name string) (*Contact, error) {
+	contact, err := scanContact(d.db.QueryRow(`SELECT `+contactColumns+` FROM contacts WHERE lower(name) = lower(?)`, strings.TrimSpace(name)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contact: %w", err)
+	}
+	return &contact, nil
+}
+
+// ListContacts retrieves all contacts ordered by name, then the ones without
+// a name by number
+func (d *Database) ListContacts() ([]Contact, error) {
+	rows, err := d.db.Query(`SELECT ` + contactColumns + ` FROM contacts ORDER BY CASE WHEN name = '' THEN 1 ELSE 0 END, lower(name), number`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contacts: %w", err)
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		contact, err := scanContact(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return contacts, nil
+}
+
+// GetContactNames retrieves the names of the named contacts by conversation ID
+func (d *Database) GetContactNames() (map[string]string, error) {
+	rows, err := d.db.Query(`SELECT conversation_id, name FROM contacts WHERE name != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contacts: %w", err)
+	}
+	defer rows.Close()
+
+	names := make(map[string]string)
+	for rows.Next() {
+		var conversationID, name string
+		if err := rows.Scan(&conversationID, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		names[conversationID] = name
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return names, nil
+}
+
+// DeleteContact removes the contact of a number in any spelling, reporting
+// whether it existed
+func (d *Database) DeleteContact(number string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM contacts WHERE conversation_id = ?`, ConversationID(number))
+	if err != nil {
+		return false, fmt.Errorf("failed to delete contact: %w", err)
+	}
+
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// requestNumber returns the recipient of a send request: its number, which
+// may name an on-call schedule, or the number of its contact
+func (app *App) requestNumber(req SMSRequest) (string, error) {
+	switch {
+	case req.Contact != "" && req.Number != "":
+		return "", apiErrorf(CodeInvalidRequest, "Set either number or contact, not both")
+	case req.Contact != "":
+		contact, err := app.db.GetContactByName(req.Contact)
+		if err != nil {
+			return "", apiErrorf(CodeInternalError, "Failed to get contact: %v", err)
+		}
+		if contact == nil {
+			return "", apiErrorf(CodeNotFound, "Contact %s not found", req.Contact)
+		}
+		return contact.Number, nil
+	case req.Number == "":
+		return "", apiErrorf(CodeInvalidRequest, "Missing number or contact")
+	}
+	return app.resolveTarget(req.Number), nil
+}
+
+// listContacts returns all contacts
+func (app *App) listContacts(c *gin.Context) {
+	contacts, err := app.db.ListContacts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list contacts: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"contacts": contacts,
+	})
+}
+
+// getContact returns the contact of a number
+func (app *App) getContact(c *gin.Context) {
+	number := c.Param("number")
+
+	contact, err := app.db.GetContact(number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get contact: %v", err))
+		return
+	}
+	if contact == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Contact %s not found", number))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"contact": contact,
+	})
+}
+
+// createContact adds a contact, failing if the number already has one
+func (app *App) createContact(c *gin.Context) {
+	var req ContactRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+	if req.Number == "" {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Missing required field: number"))
+		return
+	}
+
+	existing, err := app.db.GetContact(req.Number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get contact: %v", err))
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Contact %s already exists", existing.Number))
+		return
+	}
+
+	app.saveContact(c, http.StatusCreated, req.Number, req)
+}
+
+// setContact creates or replaces the contact of a number
+func (app *App) setContact(c *gin.Context) {
+	var req ContactRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+	app.saveContact(c, http.StatusOK, c.Param("number"), req)
+}
+
+// saveContact validates and saves a contact, answering with status
+func (app *App) saveContact(c *gin.Context, status int, number string, req ContactRequest) {
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid contact: %v", err))
+		return
+	}
+
+	if normalized, err := NormalizeNumber(number); err == nil {
+		number = normalized
+	}
+
+	err := app.db.SetContact(number, req)
+	if errors.Is(err, errContactNameTaken) {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Another contact is named %s", req.Name))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to save contact: %v", err))
+		return
+	}
+
+	log.Printf("Saved contact %s", number)
+	c.JSON(status, gin.H{
+		"status": "success",
+		"contact": Contact{Number: number, Name: req.Name, Notes: req.Notes, Language: req.Language,
+			UpdatedAt: time.Now().UTC()},
+	})
+}
+
+// deleteContact removes the contact of a number
+func (app *App) deleteContact(c *gin.Context) {
+	number := c.Param("number")
+
+	deleted, err := app.db.DeleteContact(number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete contact: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Contact %s not found", number))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
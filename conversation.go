@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConversationID returns the identifier shared by all messages exchanged with
+// a peer. It is derived from the normalized number, so "040 123 456" and
+// "+38640123456" belong to the same conversation. Short codes and alphanumeric
+// senders that cannot be normalized are used as they are.
+func ConversationID(number string) string {
+	peer, err := NormalizeNumber(number)
+	if err != nil {
+		peer = strings.ToLower(strings.TrimSpace(number))
+	}
+
+	sum := sha256.Sum256([]byte(peer))
+	return hex.EncodeToString(sum[:8])
+}
+
+// backfillConversationIDs sets the conversation ID of messages stored before
+// the column existed
+func (d *Database) backfillConversationIDs() error {
+	for _, table := range []string{"received_sms", "sent_sms"} {
+		rows, err := d.db.Query(fmt.Sprintf("SELECT DISTINCT number FROM %s WHERE conversation_id IS NULL", table))
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %w", table, err)
+		}
+
+		var numbers []string
+		for rows.Next() {
+			var number string
+			if err := rows.Scan(&number); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			numbers = append(numbers, number)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+
+		for _, number := range numbers {
+			query := fmt.Sprintf("UPDATE %s SET conversation_id = ? WHERE number = ? AND conversation_id IS NULL", table)
+			if _, err := d.db.Exec(query, ConversationID(number), number); err != nil {
+				return fmt.Errorf("failed to update %s: %w", table, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetConversationMessages retrieves the received and sent messages of a
+// conversation, newest first
+func (d *Database) GetConversationMessages(conversationID string, limit, offset int) ([]ThreadMessage, error) {
+	rows, err := d.db.Query(`
+		SELECT id, 'in', content, '', created_at FROM received_sms WHERE conversation_id = ?
+		UNION ALL
+		SELECT id, 'out', content, status, created_at FROM sent_sms WHERE conversation_id = ?
+		ORDER BY 5 DESC, 2
+		LIMIT ? OFFSET ?
+	`, conversationID, conversationID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversation messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []ThreadMessage{}
+	for rows.Next() {
+		var msg ThreadMessage
+		var createdAtStr string
+
+		if err := rows.Scan(&msg.ID, &msg.Direction, &msg.Content, &msg.Status, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		msg.CreatedAt = parseTimestamp(createdAtStr)
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return messages, nil
+}
+
+// conversationPreviewLength is the number of characters of the last message
+// shown in the conversation list
+const conversationPreviewLength = 100
+
+// conversationIDPattern matches conversation IDs as returned by ConversationID
+var conversationIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// ConversationSummary is a conversation in the conversation list
+type ConversationSummary struct {
+	ConversationID string               `json:"conversation_id"`
+	Number         string               `json:"number"` // of the latest message, normalized if possible
+	LastMessage    ConversationActivity `json:"last_message"`
+	MessageCount   int                  `json:"message_count"`
+	Unread         int                  `json:"unread"` // received since the last message sent to the conversation
+}
+
+// ConversationActivity is the latest message of a conversation
+type ConversationActivity struct {
+	Direction string    `json:"direction"` // in or out
+	Preview   string    `json:"preview"`   // start of the content
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// conversationMessagesQuery selects the received and sent messages of all
+// conversations for the conversation list
+const conversationMessagesQuery = `
+	WITH messages AS (
+		SELECT conversation_id, number, content, 'in' AS direction, created_at, id FROM received_sms WHERE conversation_id IS NOT NULL
+		UNION ALL
+		SELECT conversation_id, number, content, 'out', created_at, id FROM sent_sms WHERE conversation_id IS NOT NULL
+	)`
+
+// GetConversations lists conversations with their latest message, most
+// recently active first
+func (d *Database) GetConversations(limit, offset int) ([]ConversationSummary, error) {
+	rows, err := d.db.Query(conversationMessagesQuery+`,
+	ranked AS (
+		SELECT *, ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY created_at DESC, direction, id DESC) AS rank,
+			COUNT(*) OVER (PARTITION BY conversation_id) AS message_count
+		FROM messages
+	),
+	last_sent AS (
+		SELECT conversation_id, MAX(created_at) AS created_at FROM sent_sms GROUP BY conversation_id
+	)
+	SELECT r.conversation_id, r.number, r.content, r.direction, r.created_at, r.message_count,
+		(SELECT COUNT(*) FROM received_sms x WHERE x.conversation_id = r.conversation_id AND x.created_at > COALESCE(s.created_at, ''))
+	FROM ranked r
+	LEFT JOIN last_sent s ON s.conversation_id = r.conversation_id
+	WHERE r.rank = 1
+	ORDER BY r.created_at DESC, r.conversation_id
+	LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversations := []ConversationSummary{}
+	for rows.Next() {
+		var conv ConversationSummary
+		var content, createdAtStr string
+
+		if err := rows.Scan(&conv.ConversationID, &conv.Number, &content, &conv.LastMessage.Direction, &createdAtStr,
+			&conv.MessageCount, &conv.Unread); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if number, err := NormalizeNumber(conv.Number); err == nil {
+			conv.Number = number
+		}
+		conv.LastMessage.Preview = truncateRunes(content, conversationPreviewLength)
+		conv.LastMessage.CreatedAt = parseTimestamp(createdAtStr)
+		conversations = append(conversations, conv)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return conversations, nil
+}
+
+// CountConversations returns the number of conversations with at least one message
+func (d *Database) CountConversations() (int, error) {
+	var count int
+	err := d.db.QueryRow(conversationMessagesQuery + ` SELECT COUNT(DISTINCT conversation_id) FROM messages`).Scan(&count)
+	return count, err
+}
+
+// truncateRunes shortens s to at most n characters, marking the cut with an ellipsis
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// conversationParam returns the conversation ID of the :id path parameter,
+// which is either a conversation ID or a number of the conversation
+func conversationParam(c *gin.Context) string {
+	param := c.Param("id")
+	if conversationIDPattern.MatchString(param) {
+		return param
+	}
+	return ConversationID(param)
+}
+
+// getConversations lists conversations with their latest message and unread count
+func (app *App) getConversations(c *gin.Context) {
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	conversations, err := app.db.GetConversations(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve conversations: %v", err))
+		return
+	}
+
+	total, err := app.db.CountConversations()
+	if err != nil {
+		total = 0
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":        "success",
+		"total":         total,
+		"count":         len(conversations),
+		"conversations": conversations,
+	})
+}
+
+// getConversation returns the received and sent messages of a conversation
+func (app *App) getConversation(c *gin.Context) {
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	conversationID := conversationParam(c)
+	messages, err := app.db.GetConversationMessages(conversationID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":          "success",
+		"conversation_id": conversationID,
+		"count":           len(messages),
+		"messages":        messages,
+	})
+}
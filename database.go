@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -15,26 +17,127 @@ type ReceivedSMS struct {
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
 	CreatedAt time.Time `json:"created_at"`
+
+	ConversationID string `json:"conversation_id"`         // Shared by all messages with the same peer, see conversation.go
+	DeviceNumber   string `json:"device_number,omitempty"` // Own number of the SIM that received the message
+	Device         string `json:"device,omitempty"`        // Device of that SIM, see devices.go
+	ContactName    string `json:"contact_name,omitempty"`  // Name of the sender's contact, see contacts.go
+	Country        string `json:"country,omitempty"`       // Sender's country from the number prefix, see origin.go
+	Operator       string `json:"operator,omitempty"`      // Operator the sender's prefix was allocated to
+	NumberClass    string `json:"number_class,omitempty"`  // short_code or premium, see specialnumbers.go
+	Encoding       string `json:"encoding,omitempty"`      // GSM-7 or UCS-2, detected from the decoded content
+
+	Read        bool       `json:"read"`                  // Marked processed by a consumer, see unread.go
+	AckedAt     *time.Time `json:"acked_at,omitempty"`    // When the message was acknowledged, see ack.go
+	AckedBy     string     `json:"acked_by,omitempty"`    // System or user that acknowledged it
+	Escalations int        `json:"escalations,omitempty"` // Re-notifications sent while unacknowledged
+
+	Notes []MessageNote `json:"notes,omitempty"` // Operator notes, see notes.go
+
+	DeviceLabel *DeviceLabel `json:"device_label,omitempty"` // Name, location and metadata assigned to the device
+
+	Raw string `json:"-"` // Serial line the message was parsed from, only set on receipt
+}
+
+// receivedSMSColumns returns the received_sms columns read by scanReceivedSMS
+func (d *Database) receivedSMSColumns() string {
+	return `id, number, content, timestamp, created_at, COALESCE(conversation_id, ''),
+	COALESCE(device_number, ''), COALESCE(country, ''), COALESCE(operator, ''), COALESCE(number_class, ''),
+	COALESCE(encoding, ''), read, COALESCE(acked_at, ''), COALESCE(acked_by, ''), escalations, ` + d.dialect().notesColumn()
+}
+
+// scanReceivedSMS reads a received SMS selected with receivedSMSColumns
+func scanReceivedSMS(row interface{ Scan(...any) error }) (ReceivedSMS, error) {
+	var msg ReceivedSMS
+	var timestampStr, createdAtStr, ackedAtStr, notesJSON string
+
+	err := row.Scan(&msg.ID, &msg.Number, &msg.Content, &timestampStr, &createdAtStr, &msg.ConversationID,
+		&msg.DeviceNumber, &msg.Country, &msg.Operator, &msg.NumberClass, &msg.Encoding, &msg.Read, &ackedAtStr, &msg.AckedBy, &msg.Escalations, &notesJSON)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Timestamp = parseTimestamp(timestampStr)
+	msg.CreatedAt = parseTimestamp(createdAtStr)
+	if ackedAtStr != "" {
+		ackedAt := parseTimestamp(ackedAtStr)
+		msg.AckedAt = &ackedAt
+	}
+	msg.Notes = parseNotes(notesJSON)
+
+	return msg, nil
 }
 
 // SentSMS represents an SMS message sent via the Arduino
 type SentSMS struct {
-	ID        int       `json:"id"`
-	Number    string    `json:"number"`
-	Content   string    `json:"content"`
-	Status    string    `json:"status"` // success, error
-	Error     string    `json:"error,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         int        `json:"id"`
+	Number     string     `json:"number"`
+	Content    string     `json:"content"`
+	Status     string     `json:"status"` // success, error
+	Error      string     `json:"error,omitempty"`
+	ErrorClass ErrorClass `json:"error_class,omitempty"` // Category of the failure, see errorclass.go
+	Fallback   string     `json:"fallback,omitempty"`    // Fallback notification outcome for failed sends
+	Duplicates int        `json:"duplicates,omitempty"`  // Identical messages collapsed into this send
+	DigestID   *int64     `json:"digest_id,omitempty"`   // Alert storm digest an aggregated message was sent in
+	RetryOf    *int64     `json:"retry_of,omitempty"`    // Failed sent SMS this one retries, see sentretry.go
+	CreatedAt  time.Time  `json:"created_at"`
+
+	ConversationID string `json:"conversation_id"`        // Shared by all messages with the same peer, see conversation.go
+	NumberClass    string `json:"number_class,omitempty"` // short_code or premium, see specialnumbers.go
+
+	Encoding string `json:"encoding,omitempty"` // GSM-7 or UCS-2, see encoding.go
+	Segments int    `json:"segments,omitempty"` // Segments the content is sent in, as billed by the operator
+
+	Template        string `json:"template,omitempty"`         // Template the content was produced from, see campaigns.go
+	TemplateVersion int    `json:"template_version,omitempty"` // Approved template version the content is, see templates.go
+	Campaign        string `json:"campaign,omitempty"`         // Campaign the send belongs to
+
+	Device      string       `json:"device,omitempty"`       // Device that sent the message, see devices.go
+	DeviceLabel *DeviceLabel `json:"device_label,omitempty"` // Name, location and metadata assigned to the device
+	ContactName string       `json:"contact_name,omitempty"` // Name of the recipient's contact, see contacts.go
+}
+
+// sentSMSColumns are the sent_sms columns read by scanSentSMS
+const sentSMSColumns = `id, number, content, status, COALESCE(error, ''), COALESCE(error_class, ''), COALESCE(fallback, ''),
+	duplicates, digest_id, retry_of, created_at, COALESCE(conversation_id, ''), COALESCE(number_class, ''),
+	COALESCE(encoding, ''), COALESCE(segments, 0), COALESCE(template, ''), COALESCE(template_version, 0), COALESCE(campaign, ''),
+	COALESCE(device, '')`
+
+// scanSentSMS reads a sent SMS selected with sentSMSColumns
+func scanSentSMS(row interface{ Scan(...any) error }) (SentSMS, error) {
+	var msg SentSMS
+	var createdAtStr string
+
+	err := row.Scan(&msg.ID, &msg.Number, &msg.Content, &msg.Status, &msg.Error, &msg.ErrorClass, &msg.Fallback,
+		&msg.Duplicates, &msg.DigestID, &msg.RetryOf, &createdAtStr, &msg.ConversationID, &msg.NumberClass,
+		&msg.Encoding, &msg.Segments, &msg.Template, &msg.TemplateVersion, &msg.Campaign,
+		&msg.Device)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.CreatedAt = parseTimestamp(createdAtStr)
+	return msg, nil
 }
 
-// Database handles SQLite operations
+// Database handles SQLite or PostgreSQL operations
 type Database struct {
-	db *sql.DB
+	db      *sqlDB
+	path    string   // SQLite file or PostgreSQL URL
+	journal *Journal // messages waiting for the database to be writable, nil if disabled
 }
 
-// NewDatabase creates a new database connection and initializes tables
+// NewDatabase creates a new database connection and initializes tables.
+// dbPath is a SQLite file or a postgres:// URL.
 func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	var db *sql.DB
+	var err error
+	if isPostgresURL(dbPath) {
+		db, err = sql.Open("postgres", dbPath)
+	} else {
+		// Wait for locks instead of failing when another instance shares the file
+		db, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -44,7 +147,11 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	database := &Database{db: db}
+	var sqlDialect dialect = sqliteDialect{}
+	if isPostgresURL(dbPath) {
+		sqlDialect = postgresDialect{}
+	}
+	database := &Database{db: &sqlDB{db: db, dialect: sqlDialect}, path: dbPath}
 
 	// Initialize tables
 	if err := database.initTables(); err != nil {
@@ -58,96 +165,553 @@ func NewDatabase(dbPath string) (*Database, error) {
 func (d *Database) initTables() error {
 	query := `
 	CREATE TABLE IF NOT EXISTS received_sms (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id {{.ID}},
 		number TEXT NOT NULL,
 		content TEXT NOT NULL,
-		timestamp DATETIME NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		timestamp {{.Time}} NOT NULL,
+		created_at {{.Time}} DEFAULT {{.Now}}
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_received_sms_timestamp ON received_sms(timestamp DESC);
 	CREATE INDEX IF NOT EXISTS idx_received_sms_number ON received_sms(number);
 
 	CREATE TABLE IF NOT EXISTS sent_sms (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id {{.ID}},
 		number TEXT NOT NULL,
 		content TEXT NOT NULL,
 		status TEXT NOT NULL,
 		error TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		created_at {{.Time}} DEFAULT {{.Now}}
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_sent_sms_created_at ON sent_sms(created_at DESC);
 	CREATE INDEX IF NOT EXISTS idx_sent_sms_number ON sent_sms(number);
 	CREATE INDEX IF NOT EXISTS idx_sent_sms_status ON sent_sms(status);
+
+	CREATE TABLE IF NOT EXISTS key_usage (
+		key_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		sent {{.Int}} NOT NULL DEFAULT 0,
+		failed {{.Int}} NOT NULL DEFAULT 0,
+		segments {{.Int}} NOT NULL DEFAULT 0,
+		PRIMARY KEY (key_id, day)
+	);
+
+	CREATE TABLE IF NOT EXISTS throttle_rejections (
+		day TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		count {{.Int}} NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, reason)
+	);
+
+	CREATE TABLE IF NOT EXISTS usage_reports (
+		month TEXT PRIMARY KEY,
+		data TEXT NOT NULL,
+		generated_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id {{.ID}},
+		url TEXT NOT NULL,
+		format TEXT NOT NULL DEFAULT 'default',
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS threads (
+		id {{.ID}},
+		number TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open',
+		created_at {{.Time}} DEFAULT {{.Now}},
+		updated_at {{.Time}} DEFAULT {{.Now}},
+		closed_at {{.Time}}
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_threads_number_status ON threads(number, status);
+
+	CREATE TABLE IF NOT EXISTS email_digests (
+		period_end TEXT PRIMARY KEY,
+		sent_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS number_mutes (
+		conversation_id TEXT PRIMARY KEY,
+		number TEXT NOT NULL,
+		until {{.Time}},
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS escalations (
+		id {{.ID}},
+		policy TEXT,
+		content TEXT NOT NULL,
+		numbers TEXT NOT NULL,
+		timeout_seconds {{.Int}} NOT NULL,
+		status TEXT NOT NULL,
+		current_step {{.Int}} NOT NULL DEFAULT 0,
+		acked_by TEXT,
+		acked_at {{.Time}},
+		created_by TEXT NOT NULL,
+		created_at {{.Time}} DEFAULT {{.Now}},
+		updated_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_escalations_status ON escalations(status);
+
+	CREATE TABLE IF NOT EXISTS escalation_steps (
+		escalation_id {{.Int}} NOT NULL,
+		step {{.Int}} NOT NULL,
+		number TEXT NOT NULL,
+		status TEXT NOT NULL,
+		sent_sms_id {{.Int}},
+		reply_sms_id {{.Int}},
+		error TEXT,
+		sent_at {{.Time}} NOT NULL,
+		PRIMARY KEY (escalation_id, step)
+	);
+
+	CREATE TABLE IF NOT EXISTS surveys (
+		id {{.ID}},
+		name TEXT NOT NULL,
+		intro TEXT NOT NULL DEFAULT '',
+		outro TEXT NOT NULL DEFAULT '',
+		questions TEXT NOT NULL,
+		timeout_seconds {{.Int}} NOT NULL,
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS survey_runs (
+		id {{.ID}},
+		survey_id {{.Int}} NOT NULL,
+		number TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		current_question {{.Int}} NOT NULL DEFAULT 0,
+		error TEXT,
+		last_received_id {{.Int}} NOT NULL,
+		started_by TEXT NOT NULL,
+		created_at {{.Time}} DEFAULT {{.Now}},
+		updated_at {{.Time}} DEFAULT {{.Now}},
+		completed_at {{.Time}}
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_survey_runs_survey ON survey_runs(survey_id, status);
+	CREATE INDEX IF NOT EXISTS idx_survey_runs_status ON survey_runs(status, conversation_id);
+
+	CREATE TABLE IF NOT EXISTS survey_answers (
+		run_id {{.Int}} NOT NULL,
+		question {{.Int}} NOT NULL,
+		answer TEXT NOT NULL,
+		received_sms_id {{.Int}} NOT NULL,
+		created_at {{.Time}} DEFAULT {{.Now}},
+		PRIMARY KEY (run_id, question)
+	);
+
+	CREATE TABLE IF NOT EXISTS serial_payloads (
+		id {{.ID}},
+		received_sms_id {{.Int}},
+		sent_sms_id {{.Int}},
+		command TEXT NOT NULL DEFAULT '',
+		response TEXT NOT NULL DEFAULT '',
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_serial_payloads_received ON serial_payloads(received_sms_id);
+	CREATE INDEX IF NOT EXISTS idx_serial_payloads_sent ON serial_payloads(sent_sms_id);
+
+	CREATE TABLE IF NOT EXISTS loopback_checks (
+		id {{.ID}},
+		number TEXT NOT NULL,
+		token TEXT NOT NULL,
+		success {{.Bool}} NOT NULL,
+		latency_ms {{.Int}} NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS device_events (
+		id {{.ID}},
+		port TEXT NOT NULL,
+		event TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS inbound_rules (
+		id {{.ID}},
+		name TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT '',
+		stop {{.Int}} NOT NULL DEFAULT 0,
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS device_claims (
+		device TEXT PRIMARY KEY,
+		instance TEXT NOT NULL,
+		claimed_at {{.Time}} NOT NULL,
+		expires_at {{.Time}} NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS number_filter (
+		conversation_id TEXT NOT NULL,
+		number TEXT NOT NULL,
+		source TEXT NOT NULL,
+		action TEXT NOT NULL,
+		reason TEXT,
+		created_at {{.Time}} NOT NULL,
+		PRIMARY KEY (conversation_id, source)
+	);
+
+	CREATE TABLE IF NOT EXISTS received_notes (
+		id {{.ID}},
+		received_id {{.Int}} NOT NULL,
+		text TEXT NOT NULL,
+		author TEXT NOT NULL,
+		created_at {{.Time}} NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_received_notes_received ON received_notes(received_id);
+
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		name TEXT PRIMARY KEY,
+		definition TEXT NOT NULL,
+		created_at {{.Time}} NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS conversation_devices (
+		group_name TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		device TEXT NOT NULL,
+		updated_at {{.Time}} NOT NULL,
+		PRIMARY KEY (group_name, conversation_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS outbound_queue (
+		id {{.Int}} PRIMARY KEY,
+		sent_sms_id {{.Int}},
+		key_id TEXT NOT NULL DEFAULT '',
+		number TEXT NOT NULL,
+		content TEXT NOT NULL,
+		options TEXT NOT NULL,
+		retries {{.Int}} NOT NULL DEFAULT 0,
+		retry_at {{.Time}},
+		last_error TEXT,
+		enqueued_at {{.Time}} NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS keepalive_checks (
+		id {{.ID}},
+		method TEXT NOT NULL,
+		target TEXT NOT NULL,
+		success {{.Bool}} NOT NULL,
+		response TEXT,
+		created_at {{.Time}} DEFAULT {{.Now}}
+	);
+
+	CREATE TABLE IF NOT EXISTS template_versions (
+		template TEXT NOT NULL,
+		version {{.Int}} NOT NULL,
+		content TEXT NOT NULL,
+		approved_by TEXT,
+		approved_at {{.Time}},
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at {{.Time}} NOT NULL,
+		PRIMARY KEY (template, version)
+	);
+
+	CREATE TABLE IF NOT EXISTS template_translations (
+		template TEXT NOT NULL,
+		version {{.Int}} NOT NULL,
+		language TEXT NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (template, version, language)
+	);
+
+	CREATE TABLE IF NOT EXISTS health_snapshots (
+		id {{.ID}},
+		at {{.Time}} NOT NULL,
+		connected {{.Bool}} NOT NULL,
+		gsm_ready {{.Bool}} NOT NULL,
+		queue_depth {{.Int}} NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_health_snapshots_at ON health_snapshots(at);
+
+	CREATE TABLE IF NOT EXISTS contacts (
+		conversation_id TEXT PRIMARY KEY,
+		number TEXT NOT NULL,
+		language TEXT NOT NULL,
+		updated_at {{.Time}} NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS device_labels (
+		device TEXT PRIMARY KEY,
+		label TEXT NOT NULL,
+		location TEXT NOT NULL,
+		metadata TEXT NOT NULL,
+		updated_at {{.Time}} NOT NULL
+	);
 	`
 
-	_, err := d.db.Exec(query)
-	return err
+	if _, err := d.db.Exec(schemaSQL(d.dialect(), query)); err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	columns := []struct{ table, column, definition string }{
+		{"sent_sms", "fallback", "TEXT"},
+		{"received_sms", "thread_id", "{{.Int}}"},
+		{"sent_sms", "thread_id", "{{.Int}}"},
+		{"sent_sms", "error_class", "TEXT"},
+		{"sent_sms", "duplicates", "{{.Int}} NOT NULL DEFAULT 0"},
+		{"sent_sms", "digest_id", "{{.Int}}"},
+		{"received_sms", "conversation_id", "TEXT"},
+		{"sent_sms", "conversation_id", "TEXT"},
+		{"received_sms", "acked_at", "{{.Time}}"},
+		{"received_sms", "acked_by", "TEXT"},
+		{"received_sms", "escalations", "{{.Int}} NOT NULL DEFAULT 0"},
+		{"received_sms", "device_number", "TEXT"},
+		{"received_sms", "country", "TEXT"},
+		{"received_sms", "operator", "TEXT"},
+		{"sent_sms", "template", "TEXT"},
+		{"sent_sms", "campaign", "TEXT"},
+		{"received_sms", "number_class", "TEXT"},
+		{"sent_sms", "number_class", "TEXT"},
+		{"received_sms", "encoding", "TEXT"},
+		{"sent_sms", "encoding", "TEXT"},
+		{"sent_sms", "segments", "{{.Int}}"},
+		{"sent_sms", "retry_of", "{{.Int}}"},
+		{"sent_sms", "template_version", "{{.Int}}"},
+		{"received_sms", "read", "{{.Int}} NOT NULL DEFAULT 0"},
+		{"sent_sms", "device", "TEXT"},
+		{"contacts", "name", "TEXT NOT NULL DEFAULT ''"},
+		{"contacts", "notes", "TEXT NOT NULL DEFAULT ''"},
+		{"webhooks", "key_id", "TEXT"},
+	}
+	for _, col := range columns {
+		if err := d.addColumn(col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// Indexes on added columns
+	if _, err := d.db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_received_sms_conversation ON received_sms(conversation_id, timestamp DESC);
+		CREATE INDEX IF NOT EXISTS idx_sent_sms_conversation ON sent_sms(conversation_id, created_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_received_sms_country ON received_sms(country, timestamp DESC);
+		DROP INDEX IF EXISTS idx_contacts_name;
+		CREATE INDEX IF NOT EXISTS idx_contacts_name_lower ON contacts(lower(name));
+	`); err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	if err := d.backfillConversationIDs(); err != nil {
+		return err
+	}
+
+	if err := d.backfillReceivedOrigins(); err != nil {
+		return err
+	}
+
+	if err := d.backfillNumberClasses(); err != nil {
+		return err
+	}
+
+	if err := d.backfillEncodings(); err != nil {
+		return err
+	}
+
+	return nil
 }
 
-// SaveReceivedSMS stores a received SMS in the database
-func (d *Database) SaveReceivedSMS(number, content string, timestamp time.Time) error {
-	query := `INSERT INTO received_sms (number, content, timestamp) VALUES (?, ?, ?)`
+// addColumn adds a column to an existing table unless it is already present
+func (d *Database) addColumn(table, column, definition string) error {
+	definition = schemaSQL(d.dialect(), definition)
+	if d.postgres() {
+		if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition)); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+		}
+		return nil
+	}
 
-	_, err := d.db.Exec(query, number, content, timestamp)
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return fmt.Errorf("failed to save SMS: %w", err)
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s schema: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating %s schema: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %w", table, column, err)
 	}
 
 	return nil
 }
 
+// SaveReceivedSMS stores a received SMS in the database and returns its ID.
+// deviceNumber is the own number of the receiving SIM, empty if unknown.
+// If the database can't be written the message is journaled and ErrJournaled returned.
+func (d *Database) SaveReceivedSMS(number, content, deviceNumber string, timestamp time.Time) (int64, error) {
+	createdAt := time.Now()
+	id, err := d.insertReceivedSMS(number, content, deviceNumber, timestamp, createdAt)
+	if err != nil {
+		entry := journalEntry{Number: number, Content: content, CreatedAt: createdAt, DeviceNumber: deviceNumber, Timestamp: timestamp}
+		if d.journal.keep(entry, err) {
+			return 0, fmt.Errorf("%w: %v", ErrJournaled, err)
+		}
+		return 0, err
+	}
+
+	d.journal.written()
+	return id, nil
+}
+
+// insertReceivedSMS writes a received SMS to the database
+func (d *Database) insertReceivedSMS(number, content, deviceNumber string, timestamp, createdAt time.Time) (int64, error) {
+	query := `INSERT INTO received_sms (number, content, timestamp, conversation_id, device_number, country, operator, number_class, encoding, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`
+
+	var device any
+	if deviceNumber != "" {
+		device = deviceNumber
+	}
+
+	country, operator := LookupNumberOrigin(number)
+	var id int64
+	err := d.db.QueryRow(query, number, content, timestamp, ConversationID(number), device, country, operator,
+		ClassifyNumber(number), DetectEncoding(content), createdAt.UTC().Format(sqliteTimeFormat)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save SMS: %w", err)
+	}
+
+	return id, nil
+}
+
 // GetReceivedSMS retrieves all received SMS messages with pagination
 func (d *Database) GetReceivedSMS(limit, offset int) ([]ReceivedSMS, error) {
+	var messages []ReceivedSMS
+
+	err := d.EachReceivedSMS(ReceivedSMSFilter{}, limit, offset, func(msg ReceivedSMS) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// ReceivedSMSFilter restricts which received SMS are listed. Empty fields match every message.
+type ReceivedSMSFilter struct {
+	Country string     // ISO country code of the sender
+	From    *time.Time // received at or after
+	To      *time.Time // received before
+	Unread  bool       // only messages not marked read, see unread.go
+	Order   ListOrder  // by timestamp unless chosen, see listorder.go
+}
+
+// conditions returns the SQL conditions and their arguments for the filter
+func (f ReceivedSMSFilter) conditions(sql dialect) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if f.Country != "" {
+		conditions = append(conditions, "country = ?")
+		args = append(args, strings.ToUpper(f.Country))
+	}
+	// Timestamps are stored with the zone they were received in
+	if f.From != nil {
+		conditions = append(conditions, sql.utcTime("timestamp")+" >= ?")
+		args = append(args, f.From.UTC().Format(sqliteTimeFormat))
+	}
+	if f.To != nil {
+		conditions = append(conditions, sql.utcTime("timestamp")+" < ?")
+		args = append(args, f.To.UTC().Format(sqliteTimeFormat))
+	}
+	if f.Unread {
+		conditions = append(conditions, "read = 0")
+	}
+	return conditions, args
+}
+
+// where returns the WHERE clause and its arguments for the filter
+func (f ReceivedSMSFilter) where(sql dialect) (string, []interface{}) {
+	return whereClause(f.conditions(sql))
+}
+
+// whereClause joins conditions into a WHERE clause, or returns an empty
+// clause if there are none
+func whereClause(conditions []string, args []interface{}) (string, []interface{}) {
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// EachReceivedSMS calls fn for each received SMS matching filter with pagination, reading rows one at a time
+func (d *Database) EachReceivedSMS(filter ReceivedSMSFilter, limit, offset int, fn func(ReceivedSMS) error) error {
+	where, args := filter.where(d.dialect())
 	query := `
-		SELECT id, number, content, timestamp, created_at
+		SELECT ` + d.receivedSMSColumns() + `
 		FROM received_sms
-		ORDER BY timestamp DESC
+		` + where + `
+		` + filter.Order.clause("timestamp") + `
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := d.db.Query(query, limit, offset)
+	rows, err := d.db.Query(query, append(args, limit, offset)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query SMS: %w", err)
+		return fmt.Errorf("failed to query SMS: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []ReceivedSMS
-
 	for rows.Next() {
-		var msg ReceivedSMS
-		var timestampStr, createdAtStr string
-
-		err := rows.Scan(&msg.ID, &msg.Number, &msg.Content, &timestampStr, &createdAtStr)
+		msg, err := scanReceivedSMS(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+			return fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		msg.Timestamp = parseTimestamp(timestampStr)
-		msg.CreatedAt = parseTimestamp(createdAtStr)
-
-		messages = append(messages, msg)
+		if err := fn(msg); err != nil {
+			return err
+		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+		return fmt.Errorf("error iterating rows: %w", err)
 	}
 
-	return messages, nil
+	return nil
 }
 
-// GetReceivedSMSByNumber retrieves SMS messages from a specific number
-func (d *Database) GetReceivedSMSByNumber(number string, limit, offset int) ([]ReceivedSMS, error) {
+// GetReceivedSMSByNumber retrieves SMS messages from a specific number matching filter
+func (d *Database) GetReceivedSMSByNumber(number string, filter ReceivedSMSFilter, limit, offset int) ([]ReceivedSMS, error) {
+	conditions, args := filter.conditions(d.dialect())
+	where, args := whereClause(append([]string{"number = ?"}, conditions...), append([]interface{}{number}, args...))
 	query := `
-		SELECT id, number, content, timestamp, created_at
+		SELECT ` + d.receivedSMSColumns() + `
 		FROM received_sms
-		WHERE number = ?
-		ORDER BY timestamp DESC
+		` + where + `
+		` + filter.Order.clause("timestamp") + `
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := d.db.Query(query, number, limit, offset)
+	rows, err := d.db.Query(query, append(args, limit, offset)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query SMS: %w", err)
 	}
@@ -156,17 +720,11 @@ func (d *Database) GetReceivedSMSByNumber(number string, limit, offset int) ([]R
 	var messages []ReceivedSMS
 
 	for rows.Next() {
-		var msg ReceivedSMS
-		var timestampStr, createdAtStr string
-
-		err := rows.Scan(&msg.ID, &msg.Number, &msg.Content, &timestampStr, &createdAtStr)
+		msg, err := scanReceivedSMS(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		msg.Timestamp = parseTimestamp(timestampStr)
-		msg.CreatedAt = parseTimestamp(createdAtStr)
-
 		messages = append(messages, msg)
 	}
 
@@ -185,28 +743,25 @@ func (d *Database) FindReceivedSMS(search string, after time.Time) (*ReceivedSMS
 
 	if after.IsZero() {
 		query = `
-			SELECT id, number, content, timestamp, created_at
+			SELECT ` + d.receivedSMSColumns() + `
 			FROM received_sms
-			WHERE content LIKE '%' || ? || '%'
+			WHERE content ` + d.dialect().like() + ` '%' || ? || '%'
 			ORDER BY timestamp DESC
 			LIMIT 1
 		`
 		args = []interface{}{search}
 	} else {
 		query = `
-			SELECT id, number, content, timestamp, created_at
+			SELECT ` + d.receivedSMSColumns() + `
 			FROM received_sms
-			WHERE content LIKE '%' || ? || '%' AND timestamp > ?
+			WHERE content ` + d.dialect().like() + ` '%' || ? || '%' AND timestamp > ?
 			ORDER BY timestamp DESC
 			LIMIT 1
 		`
 		args = []interface{}{search, after.Format(time.RFC3339)}
 	}
 
-	var msg ReceivedSMS
-	var timestampStr, createdAtStr string
-
-	err := d.db.QueryRow(query, args...).Scan(&msg.ID, &msg.Number, &msg.Content, &timestampStr, &createdAtStr)
+	msg, err := scanReceivedSMS(d.db.QueryRow(query, args...))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -214,26 +769,111 @@ func (d *Database) FindReceivedSMS(search string, after time.Time) (*ReceivedSMS
 		return nil, fmt.Errorf("failed to search SMS: %w", err)
 	}
 
-	msg.Timestamp = parseTimestamp(timestampStr)
-	msg.CreatedAt = parseTimestamp(createdAtStr)
-
 	return &msg, nil
 }
 
 // CountReceivedSMS returns the total count of received SMS
 func (d *Database) CountReceivedSMS() (int, error) {
+	return d.CountFilteredReceivedSMS(ReceivedSMSFilter{})
+}
+
+// CountFilteredReceivedSMS returns the count of received SMS matching filter
+func (d *Database) CountFilteredReceivedSMS(filter ReceivedSMSFilter) (int, error) {
+	where, args := filter.where(d.dialect())
 	var count int
-	err := d.db.QueryRow("SELECT COUNT(*) FROM received_sms").Scan(&count)
+	err := d.db.QueryRow("SELECT COUNT(*) FROM received_sms "+where, args...).Scan(&count)
 	return count, err
 }
 
-// SaveSentSMS stores a sent SMS in the database
-func (d *Database) SaveSentSMS(number, content, status, errorMsg string) error {
-	query := `INSERT INTO sent_sms (number, content, status, error) VALUES (?, ?, ?, ?)`
+// SaveSentSMS stores a sent SMS with the template and campaign of its send
+// options in the database and returns its ID. If the database can't be
+// written the message is journaled and ErrJournaled returned.
+func (d *Database) SaveSentSMS(number, content, status, errorMsg string, errorClass ErrorClass, opts SendOptions) (int64, error) {
+	createdAt := time.Now()
+	id, err := d.insertSentSMS(number, content, status, errorMsg, errorClass, opts, createdAt)
+	if err != nil {
+		entry := journalEntry{Sent: true, Number: number, Content: content, CreatedAt: createdAt,
+			Status: status, Error: errorMsg, ErrorClass: errorClass, Opts: opts}
+		if d.journal.keep(entry, err) {
+			return 0, fmt.Errorf("%w: %v", ErrJournaled, err)
+		}
+		return 0, err
+	}
+
+	d.journal.written()
+	return id, nil
+}
+
+// insertSentSMS writes a sent SMS to the database
+func (d *Database) insertSentSMS(number, content, status, errorMsg string, errorClass ErrorClass, opts SendOptions, createdAt time.Time) (int64, error) {
+	query := `INSERT INTO sent_sms (number, content, status, error, error_class, conversation_id, number_class, encoding, segments,
+		template, template_version, campaign, retry_of, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`
+
+	var templateVersion, retryOf any
+	if opts.TemplateVersion != 0 {
+		templateVersion = opts.TemplateVersion
+	}
+	if opts.RetryOf != 0 {
+		retryOf = opts.RetryOf
+	}
+
+	var id int64
+	err := d.db.QueryRow(query, number, content, status, errorMsg, errorClass, ConversationID(number),
+		ClassifyNumber(number), DetectEncoding(content), CountSegments(content), nullIfEmpty(opts.Template), templateVersion,
+		nullIfEmpty(opts.Campaign), retryOf, createdAt.UTC().Format(sqliteTimeFormat)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save sent SMS: %w", err)
+	}
+
+	return id, nil
+}
+
+// recordSentSMS saves the outcome of a send, updating the record saved when
+// it was queued if there is one (sentID > 0)
+func (d *Database) recordSentSMS(sentID int64, number, content, status, errorMsg string, errorClass ErrorClass, opts SendOptions) (int64, error) {
+	if sentID == 0 {
+		return d.SaveSentSMS(number, content, status, errorMsg, errorClass, opts)
+	}
+	return sentID, d.FinishSentSMS(sentID, status, errorMsg, errorClass)
+}
 
-	_, err := d.db.Exec(query, number, content, status, errorMsg)
+// MarkSentSMSSending records that a queued send was handed to the modem
+func (d *Database) MarkSentSMSSending(id int64) error {
+	_, err := d.db.Exec(`UPDATE sent_sms SET status = 'sending' WHERE id = ? AND status = 'queued'`, id)
 	if err != nil {
-		return fmt.Errorf("failed to save sent SMS: %w", err)
+		return fmt.Errorf("failed to update sent SMS: %w", err)
+	}
+
+	return nil
+}
+
+// FinishSentSMS records the outcome of a send saved before it was sent
+func (d *Database) FinishSentSMS(id int64, status, errorMsg string, errorClass ErrorClass) error {
+	_, err := d.db.Exec(`UPDATE sent_sms SET status = ?, error = ?, error_class = ? WHERE id = ?`,
+		status, errorMsg, errorClass, id)
+	if err != nil {
+		return fmt.Errorf("failed to update sent SMS: %w", err)
+	}
+
+	return nil
+}
+
+// SetSentSMSFallback records the outcome of the fallback notification for a failed SMS
+func (d *Database) SetSentSMSFallback(id int64, fallback string) error {
+	_, err := d.db.Exec(`UPDATE sent_sms SET fallback = ? WHERE id = ?`, fallback, id)
+	if err != nil {
+		return fmt.Errorf("failed to update sent SMS: %w", err)
+	}
+
+	return nil
+}
+
+// IncrementSentSMSDuplicates counts an identical message collapsed into a sent SMS
+func (d *Database) IncrementSentSMSDuplicates(id int64) error {
+	_, err := d.db.Exec(`UPDATE sent_sms SET duplicates = duplicates + 1 WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to update sent SMS: %w", err)
 	}
 
 	return nil
@@ -241,53 +881,94 @@ func (d *Database) SaveSentSMS(number, content, status, errorMsg string) error {
 
 // GetSentSMS retrieves all sent SMS messages with pagination
 func (d *Database) GetSentSMS(limit, offset int) ([]SentSMS, error) {
+	var messages []SentSMS
+
+	err := d.EachSentSMS(SentSMSFilter{}, limit, offset, func(msg SentSMS) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// SentSMSFilter restricts which sent SMS are listed. Empty fields match every message.
+type SentSMSFilter struct {
+	From  *time.Time // stored at or after
+	To    *time.Time // stored before
+	Order ListOrder  // by created_at unless chosen, see listorder.go
+}
+
+// conditions returns the SQL conditions and their arguments for the filter
+func (f SentSMSFilter) conditions() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if f.From != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.From.UTC().Format(sqliteTimeFormat))
+	}
+	if f.To != nil {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, f.To.UTC().Format(sqliteTimeFormat))
+	}
+	return conditions, args
+}
+
+// where returns the WHERE clause and its arguments for the filter
+func (f SentSMSFilter) where() (string, []interface{}) {
+	return whereClause(f.conditions())
+}
+
+// EachSentSMS calls fn for each sent SMS matching filter with pagination, reading rows one at a time
+func (d *Database) EachSentSMS(filter SentSMSFilter, limit, offset int, fn func(SentSMS) error) error {
+	where, args := filter.where()
 	query := `
-		SELECT id, number, content, status, COALESCE(error, ''), created_at
+		SELECT ` + sentSMSColumns + `
 		FROM sent_sms
-		ORDER BY created_at DESC
+		` + where + `
+		` + filter.Order.clause("created_at") + `
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := d.db.Query(query, limit, offset)
+	rows, err := d.db.Query(query, append(args, limit, offset)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query sent SMS: %w", err)
+		return fmt.Errorf("failed to query sent SMS: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []SentSMS
-
 	for rows.Next() {
-		var msg SentSMS
-		var createdAtStr string
-
-		err := rows.Scan(&msg.ID, &msg.Number, &msg.Content, &msg.Status, &msg.Error, &createdAtStr)
+		msg, err := scanSentSMS(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+			return fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		msg.CreatedAt = parseTimestamp(createdAtStr)
-
-		messages = append(messages, msg)
+		if err := fn(msg); err != nil {
+			return err
+		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+		return fmt.Errorf("error iterating rows: %w", err)
 	}
 
-	return messages, nil
+	return nil
 }
 
-// GetSentSMSByNumber retrieves sent SMS messages to a specific number
-func (d *Database) GetSentSMSByNumber(number string, limit, offset int) ([]SentSMS, error) {
+// GetSentSMSByNumber retrieves sent SMS messages to a specific number matching filter
+func (d *Database) GetSentSMSByNumber(number string, filter SentSMSFilter, limit, offset int) ([]SentSMS, error) {
+	conditions, args := filter.conditions()
+	where, args := whereClause(append([]string{"number = ?"}, conditions...), append([]interface{}{number}, args...))
 	query := `
-		SELECT id, number, content, status, COALESCE(error, ''), created_at
+		SELECT ` + sentSMSColumns + `
 		FROM sent_sms
-		WHERE number = ?
-		ORDER BY created_at DESC
+		` + where + `
+		` + filter.Order.clause("created_at") + `
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := d.db.Query(query, number, limit, offset)
+	rows, err := d.db.Query(query, append(args, limit, offset)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query sent SMS: %w", err)
 	}
@@ -296,16 +977,11 @@ func (d *Database) GetSentSMSByNumber(number string, limit, offset int) ([]SentS
 	var messages []SentSMS
 
 	for rows.Next() {
-		var msg SentSMS
-		var createdAtStr string
-
-		err := rows.Scan(&msg.ID, &msg.Number, &msg.Content, &msg.Status, &msg.Error, &createdAtStr)
+		msg, err := scanSentSMS(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		msg.CreatedAt = parseTimestamp(createdAtStr)
-
 		messages = append(messages, msg)
 	}
 
@@ -318,8 +994,14 @@ func (d *Database) GetSentSMSByNumber(number string, limit, offset int) ([]SentS
 
 // CountSentSMS returns the total count of sent SMS
 func (d *Database) CountSentSMS() (int, error) {
+	return d.CountFilteredSentSMS(SentSMSFilter{})
+}
+
+// CountFilteredSentSMS returns the count of sent SMS matching filter
+func (d *Database) CountFilteredSentSMS(filter SentSMSFilter) (int, error) {
+	where, args := filter.where()
 	var count int
-	err := d.db.QueryRow("SELECT COUNT(*) FROM sent_sms").Scan(&count)
+	err := d.db.QueryRow("SELECT COUNT(*) FROM sent_sms "+where, args...).Scan(&count)
 	return count, err
 }
 
@@ -330,6 +1012,229 @@ func (d *Database) CountSentSMSByStatus(status string) (int, error) {
 	return count, err
 }
 
+// ErasureReport summarizes the rows removed by EraseNumberData
+type ErasureReport struct {
+	Number          string           `json:"number"`
+	ReceivedDeleted int64            `json:"received_deleted"`
+	SentDeleted     int64            `json:"sent_deleted"`
+	ThreadsDeleted  int64            `json:"threads_deleted"`
+	Tables          map[string]int64 `json:"tables"`           // rows deleted or redacted by table
+	Memory          map[string]int64 `json:"memory,omitempty"` // entries dropped from the journal, dedup and storm state
+}
+
+// erasedPlaceholder replaces an erased number in free text
+const erasedPlaceholder = "[erased]"
+
+// numberColumns are the columns holding a peer's number, by table. Every
+// spelling of an erased number found in them is erased.
+var numberColumns = map[string]string{
+	"received_sms":     "number",
+	"sent_sms":         "number",
+	"threads":          "number",
+	"number_mutes":     "number",
+	"number_filter":    "number",
+	"escalation_steps": "number",
+	"survey_runs":      "number",
+	"outbound_queue":   "number",
+	"loopback_checks":  "number",
+	"keepalive_checks": "target",
+	"contacts":         "number",
+}
+
+// hasConversationID are the tables of numberColumns that also have a
+// conversation_id column
+var hasConversationID = map[string]bool{
+	"received_sms": true, "sent_sms": true, "number_mutes": true, "number_filter": true, "survey_runs": true, "contacts": true,
+}
+
+// numberSpellings returns the spellings of the number with the given
+// conversation ID stored in any table, e.g. "040 123 456" and "+38640123456"
+func numberSpellings(tx *sqlTx, number, conversationID string) ([]string, error) {
+	spellings := []string{number}
+	seen := map[string]bool{number: true}
+	for table, column := range numberColumns {
+		rows, err := tx.Query(fmt.Sprintf("SELECT DISTINCT %s FROM %s", column, table))
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s: %w", table, err)
+		}
+		for rows.Next() {
+			var spelling string
+			if err := rows.Scan(&spelling); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan row: %w", err)
+			}
+			if !seen[spelling] && ConversationID(spelling) == conversationID {
+				seen[spelling] = true
+				spellings = append(spellings, spelling)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating rows: %w", err)
+		}
+	}
+	return spellings, nil
+}
+
+// EraseNumberData deletes everything stored about a number in a single
+// transaction: its messages with their notes and serial payloads, threads,
+// mutes, filter entries, contact, survey runs and answers, escalations,
+// queued messages, loopback and keep-alive checks and the usage of an API key
+// named after it. The number is redacted from other escalations and device
+// events, and journaled messages to or from it are dropped. Rows are matched
+// by conversation ID and by every spelling of the number.
+func (d *Database) EraseNumberData(number string) (*ErasureReport, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	conversationID := ConversationID(number)
+	spellings, err := numberSpellings(tx, number, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	in := "(?" + strings.Repeat(", ?", len(spellings)-1) + ")"
+	byNumber := func(column string) (string, []any) {
+		args := make([]any, len(spellings))
+		for i, spelling := range spellings {
+			args[i] = spelling
+		}
+		return column + " IN " + in, args
+	}
+	byConversation := func(column string) (string, []any) {
+		where, args := byNumber(column)
+		return "conversation_id = ? OR " + where, append([]any{conversationID}, args...)
+	}
+
+	receivedWhere, receivedArgs := byConversation("number")
+	received := "SELECT id FROM received_sms WHERE " + receivedWhere
+	sentWhere, sentArgs := byConversation("number")
+	sent := "SELECT id FROM sent_sms WHERE " + sentWhere
+	runsWhere, runsArgs := byConversation("number")
+	runs := "SELECT id FROM survey_runs WHERE " + runsWhere
+
+	type erasure struct {
+		table, where string
+		args         []any
+	}
+
+	// Rows referring to messages and survey runs go before them
+	deletes := []erasure{
+		{"received_notes", "received_id IN (" + received + ")", receivedArgs},
+		{"serial_payloads", "received_sms_id IN (" + received + ") OR sent_sms_id IN (" + sent + ")", append(slices.Clone(receivedArgs), sentArgs...)},
+		{"survey_answers", "run_id IN (" + runs + ") OR received_sms_id IN (" + received + ")", append(slices.Clone(runsArgs), receivedArgs...)},
+		{"outbound_queue", "sent_sms_id IN (" + sent + ")", sentArgs},
+		{"escalation_steps", "sent_sms_id IN (" + sent + ") OR reply_sms_id IN (" + received + ")", append(slices.Clone(sentArgs), receivedArgs...)},
+		{"conversation_devices", "conversation_id = ?", []any{conversationID}},
+	}
+	for table, column := range numberColumns {
+		if table == "received_sms" || table == "sent_sms" {
+			continue
+		}
+		where, args := byNumber(column)
+		if hasConversationID[table] {
+			where, args = byConversation(column)
+		}
+		deletes = append(deletes, erasure{table, where, args})
+	}
+	deletes = append(deletes, erasure{"received_sms", receivedWhere, receivedArgs}, erasure{"sent_sms", sentWhere, sentArgs})
+	keyWhere, keyArgs := byNumber("key_id")
+	deletes = append(deletes, erasure{"key_usage", keyWhere, keyArgs})
+
+	report := &ErasureReport{Number: number, Tables: map[string]int64{}}
+	escalations, err := eraseEscalations(tx, spellings, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	report.Tables["escalations"] = escalations
+
+	for _, del := range deletes {
+		res, err := tx.Exec("DELETE FROM "+del.table+" WHERE "+del.where, del.args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete from %s: %w", del.table, err)
+		}
+		affected, _ := res.RowsAffected()
+		report.Tables[del.table] += affected
+	}
+	report.ReceivedDeleted = report.Tables["received_sms"]
+	report.SentDeleted = report.Tables["sent_sms"]
+	report.ThreadsDeleted = report.Tables["threads"]
+
+	// Device errors may quote the number, e.g. in a failed AT command
+	for _, spelling := range spellings {
+		res, err := tx.Exec(`UPDATE device_events SET detail = REPLACE(detail, ?, ?) WHERE `+d.dialect().position("detail", "?")+` > 0`,
+			spelling, erasedPlaceholder, spelling)
+		if err != nil {
+			return nil, fmt.Errorf("failed to redact device events: %w", err)
+		}
+		affected, _ := res.RowsAffected()
+		report.Tables["device_events"] += affected
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit erasure: %w", err)
+	}
+
+	// Dropped after the commit, so a failed erasure keeps them
+	report.Memory = map[string]int64{"journal": int64(d.journal.erase(conversationID))}
+
+	return report, nil
+}
+
+// eraseEscalations deletes the escalations alerting one of the spellings of a
+// number with all their steps, and redacts the number from the content of the
+// others. It returns the number of escalations deleted or redacted.
+func eraseEscalations(tx *sqlTx, spellings []string, conversationID string) (int64, error) {
+	rows, err := tx.Query(`SELECT id, numbers, content FROM escalations`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query escalations: %w", err)
+	}
+
+	deleted := []int64{}
+	redacted := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var numbers, content string
+		if err := rows.Scan(&id, &numbers, &content); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan escalation: %w", err)
+		}
+		if slices.ContainsFunc(splitList(numbers), func(n string) bool { return ConversationID(n) == conversationID }) {
+			deleted = append(deleted, id)
+			continue
+		}
+		for _, spelling := range spellings {
+			if strings.Contains(content, spelling) {
+				content = strings.ReplaceAll(content, spelling, erasedPlaceholder)
+				redacted[id] = content
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query escalations: %w", err)
+	}
+
+	for _, id := range deleted {
+		if _, err := tx.Exec(`DELETE FROM escalation_steps WHERE escalation_id = ?`, id); err != nil {
+			return 0, fmt.Errorf("failed to delete escalation steps: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM escalations WHERE id = ?`, id); err != nil {
+			return 0, fmt.Errorf("failed to delete escalation: %w", err)
+		}
+	}
+	for id, content := range redacted {
+		if _, err := tx.Exec(`UPDATE escalations SET content = ? WHERE id = ?`, content, id); err != nil {
+			return 0, fmt.Errorf("failed to redact escalation: %w", err)
+		}
+	}
+
+	return int64(len(deleted) + len(redacted)), nil
+}
+
 // parseTimestamp tries multiple formats to parse a SQLite timestamp string
 func parseTimestamp(s string) time.Time {
 	formats := []string{
@@ -337,6 +1242,7 @@ func parseTimestamp(s string) time.Time {
 		time.RFC3339,
 		"2006-01-02T15:04:05",
 		"2006-01-02 15:04:05",
+		sqliteDriverTimeFormat,
 	}
 	for _, f := range formats {
 		if t, err := time.Parse(f, s); err == nil {
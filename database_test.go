@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEraseNumberData(t *testing.T) {
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "sms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The number is stored in several spellings; +38641999888 must be kept
+	const erased, kept = "+38640123456", "+38641999888"
+	now := time.Now().UTC().Format(sqliteTimeFormat)
+	for _, number := range []string{"+386 40 123 456", "0038640123456", erased, kept} {
+		conversationID := ConversationID(number)
+		statements := []struct {
+			query string
+			args  []any
+		}{
+			{`INSERT INTO received_sms (number, content, timestamp, conversation_id) VALUES (?, 'hi', ?, ?)`, []any{number, now, conversationID}},
+			{`INSERT INTO sent_sms (number, content, status, conversation_id) VALUES (?, 'hi', 'success', ?)`, []any{number, conversationID}},
+			{`INSERT INTO received_notes (received_id, text, author, created_at) VALUES ((SELECT MAX(id) FROM received_sms), 'note', 'me', ?)`, []any{now}},
+			{`INSERT INTO serial_payloads (received_sms_id, command) VALUES ((SELECT MAX(id) FROM received_sms), ?)`, []any{number}},
+			{`INSERT INTO serial_payloads (sent_sms_id, command) VALUES ((SELECT MAX(id) FROM sent_sms), ?)`, []any{number}},
+			{`INSERT INTO threads (number) VALUES (?)`, []any{number}},
+			{`INSERT OR REPLACE INTO number_mutes (conversation_id, number) VALUES (?, ?)`, []any{conversationID, number}},
+			{`INSERT OR REPLACE INTO number_filter (conversation_id, number, source, action, created_at) VALUES (?, ?, 'manual', 'block', ?)`, []any{conversationID, number, now}},
+			{`INSERT OR REPLACE INTO contacts (conversation_id, number, language, updated_at) VALUES (?, ?, 'sl', ?)`, []any{conversationID, number, now}},
+			{`INSERT OR REPLACE INTO conversation_devices (group_name, conversation_id, device, updated_at) VALUES ('bulk', ?, 'a1', ?)`, []any{conversationID, now}},
+			{`INSERT INTO survey_runs (survey_id, number, conversation_id, status, last_received_id, started_by) VALUES (1, ?, ?, 'active', 0, 'me')`, []any{number, conversationID}},
+			{`INSERT INTO survey_answers (run_id, question, answer, received_sms_id) VALUES ((SELECT MAX(id) FROM survey_runs), 0, 'yes', 0)`, nil},
+			{`INSERT INTO escalations (content, numbers, timeout_seconds, status, created_by) VALUES ('hi', ?, 60, 'active', 'me')`, []any{number}},
+			{`INSERT INTO escalation_steps (escalation_id, step, number, status, sent_at) VALUES ((SELECT MAX(id) FROM escalations), 0, ?, 'sent', ?)`, []any{number, now}},
+			{`INSERT INTO outbound_queue (number, content, options, enqueued_at) VALUES (?, 'hi', '{}', ?)`, []any{number, now}},
+			{`INSERT INTO loopback_checks (number, token, success) VALUES (?, 'abc', 1)`, []any{number}},
+			{`INSERT INTO keepalive_checks (method, target, success) VALUES ('sms', ?, 1)`, []any{number}},
+			{`INSERT INTO key_usage (key_id, day, sent) VALUES (?, '2026-01-01', 1)`, []any{number}},
+			{`INSERT INTO device_events (port, event, detail) VALUES ('/dev/ttyUSB0', 'disconnected', ?)`, []any{"AT+CMGS=\"" + number + "\" failed"}},
+		}
+		for _, statement := range statements {
+			if _, err := db.db.Exec(statement.query, statement.args...); err != nil {
+				t.Fatalf("%s: %v", statement.query, err)
+			}
+		}
+	}
+
+	// An escalation to other numbers only mentions it
+	if _, err := db.db.Exec(`INSERT INTO escalations (content, numbers, timeout_seconds, status, created_by) VALUES ('call +386 40 123 456', ?, 60, 'active', 'me')`, kept); err != nil {
+		t.Fatal(err)
+	}
+
+	// Journaled messages would be written back by the next flush
+	db.journal = &Journal{Size: 10}
+	for _, number := range []string{erased, kept} {
+		db.journal.keep(journalEntry{Sent: true, Number: number, Content: "hi"}, errors.New("database or disk is full"))
+	}
+
+	report, err := db.EraseNumberData("+386 40 123 456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ReceivedDeleted != 3 || report.SentDeleted != 3 || report.ThreadsDeleted != 3 {
+		t.Errorf("report = %+v, want 3 received, sent and threads deleted", report)
+	}
+
+	tables := []string{
+		"received_sms", "sent_sms", "received_notes", "serial_payloads", "threads", "number_mutes", "number_filter",
+		"contacts", "conversation_devices", "survey_runs", "survey_answers", "escalation_steps", "outbound_queue",
+		"loopback_checks", "keepalive_checks", "key_usage",
+	}
+	for _, table := range tables {
+		var count int
+		if err := db.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+		// Only the rows of the kept number are left: two serial payloads, one row elsewhere
+		want := 1
+		if table == "serial_payloads" {
+			want = 2
+		}
+		if count != want {
+			t.Errorf("%s has %d rows after erasure, want %d", table, count, want)
+		}
+	}
+
+	var escalations int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM escalations WHERE numbers = ?`, kept).Scan(&escalations); err != nil {
+		t.Fatal(err)
+	}
+	var content string
+	if err := db.db.QueryRow(`SELECT content FROM escalations WHERE id = (SELECT MAX(id) FROM escalations)`).Scan(&content); err != nil {
+		t.Fatal(err)
+	}
+	if escalations != 2 || content != "call [erased]" {
+		t.Errorf("%d escalations of the kept number left, one with content %q; want 2 and %q", escalations, content, "call [erased]")
+	}
+	if report.Tables["escalations"] != 4 {
+		t.Errorf("%d escalations erased, want 3 deleted and 1 redacted", report.Tables["escalations"])
+	}
+
+	var mentions int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM device_events WHERE detail NOT LIKE '%[erased]%'`).Scan(&mentions); err != nil {
+		t.Fatal(err)
+	}
+	if mentions != 1 || report.Tables["device_events"] != 3 {
+		t.Errorf("%d device events left unredacted, %d redacted; want only the kept number's left", mentions, report.Tables["device_events"])
+	}
+
+	if pending := db.journal.Status().Pending; pending != 1 || report.Memory["journal"] != 1 {
+		t.Errorf("%d journal entries left, %d dropped; want 1 and 1", pending, report.Memory["journal"])
+	}
+
+	conversationID := ConversationID(erased)
+	dedup := &Deduplicator{Window: time.Minute, entries: map[string]*dedupEntry{}}
+	dedup.claim(erased, "hi")
+	dedup.claim(kept, "hi")
+	if n := dedup.erase(conversationID); n != 1 || len(dedup.entries) != 1 {
+		t.Errorf("dedup erased %d messages leaving %d, want 1 and 1", n, len(dedup.entries))
+	}
+
+	storm := &StormAggregator{Threshold: 1, Window: time.Minute, recent: map[string][]time.Time{}, batches: map[string]*stormBatch{}}
+	for _, number := range []string{erased, erased, kept} {
+		if _, batch := storm.record(number); batch != nil {
+			batch.contents = append(batch.contents, "hi")
+		}
+	}
+	if n := storm.erase(conversationID); n != 1 || len(storm.recent) != 1 || len(storm.batches) != 0 {
+		t.Errorf("storm erased %d digested messages leaving %d numbers and %d digests, want 1, 1 and 0", n, len(storm.recent), len(storm.batches))
+	}
+}
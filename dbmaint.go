@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DBStats describes the size of the database
+type DBStats struct {
+	Path      string         `json:"path"`
+	FileSize  int64          `json:"file_size"`
+	WALSize   int64          `json:"wal_size"`
+	PageSize  int            `json:"page_size"`
+	PageCount int            `json:"page_count"`
+	FreePages int            `json:"free_pages"`
+	Tables    map[string]int `json:"tables"` // row count per table
+}
+
+// MaintenanceWindow is a recurring time at which the database is analyzed and vacuumed
+type MaintenanceWindow struct {
+	Weekday *time.Weekday // nil for daily maintenance
+	Hour    int
+	Minute  int
+}
+
+// fileSize returns the size of a file, or 0 if it doesn't exist
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Size returns the size of the database file, or of the database on
+// PostgreSQL. The SQLite write-ahead log is not included.
+func (d *Database) Size() int64 {
+	if !d.postgres() {
+		return fileSize(d.path)
+	}
+
+	var size int64
+	if err := d.db.QueryRow(`SELECT pg_database_size(current_database())`).Scan(&size); err != nil {
+		log.Printf("Failed to read database size: %v", err)
+	}
+	return size
+}
+
+// Stats returns file sizes, page usage and row counts per table. On
+// PostgreSQL there are no pages and the size is that of the database.
+func (d *Database) Stats() (*DBStats, error) {
+	stats := &DBStats{
+		Path:     d.path,
+		FileSize: d.Size(),
+		Tables:   make(map[string]int),
+	}
+
+	tablesQuery := `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()`
+	if d.postgres() {
+		if u, err := url.Parse(d.path); err == nil {
+			stats.Path = u.Redacted()
+		}
+	} else {
+		stats.WALSize = fileSize(d.path + "-wal")
+		for pragma, dest := range map[string]*int{
+			"page_size":      &stats.PageSize,
+			"page_count":     &stats.PageCount,
+			"freelist_count": &stats.FreePages,
+		} {
+			if err := d.db.QueryRow("PRAGMA " + pragma).Scan(dest); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", pragma, err)
+			}
+		}
+		tablesQuery = `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`
+	}
+
+	rows, err := d.db.Query(tablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for _, table := range tables {
+		var count int
+		if err := d.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, table)).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", table, err)
+		}
+		stats.Tables[table] = count
+	}
+
+	return stats, nil
+}
+
+// Vacuum rebuilds the database file, reclaiming free pages
+func (d *Database) Vacuum() error {
+	if _, err := d.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// Analyze updates the statistics used by the query planner
+func (d *Database) Analyze() error {
+	if _, err := d.db.Exec("ANALYZE"); err != nil {
+		return fmt.Errorf("failed to analyze database: %w", err)
+	}
+	return nil
+}
+
+// LoadMaintenanceWindow reads the maintenance window from DB_MAINTENANCE_WINDOW,
+// either "HH:MM" (daily) or "Sun HH:MM" (weekly). It returns nil if not set.
+func LoadMaintenanceWindow() (*MaintenanceWindow, error) {
+	value := strings.TrimSpace(os.Getenv("DB_MAINTENANCE_WINDOW"))
+	if value == "" {
+		return nil, nil
+	}
+
+	window := &MaintenanceWindow{}
+	clock := value
+	if day, rest, found := strings.Cut(value, " "); found {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			return nil, fmt.Errorf("DB_MAINTENANCE_WINDOW: %w", err)
+		}
+		window.Weekday = &weekday
+		clock = strings.TrimSpace(rest)
+	}
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return nil, fmt.Errorf("DB_MAINTENANCE_WINDOW: invalid time %q (expected HH:MM)", clock)
+	}
+	window.Hour, window.Minute = t.Hour(), t.Minute()
+
+	return window, nil
+}
+
+// parseWeekday parses a weekday name such as "Sun" or "sunday"
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) || strings.EqualFold(name, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", name)
+}
+
+// Next returns the next start of the window after t, in t's location
+func (w *MaintenanceWindow) Next(t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), w.Hour, w.Minute, 0, 0, t.Location())
+	for !next.After(t) || (w.Weekday != nil && next.Weekday() != *w.Weekday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// String returns the window in DB_MAINTENANCE_WINDOW format
+func (w *MaintenanceWindow) String() string {
+	if w.Weekday == nil {
+		return fmt.Sprintf("%02d:%02d", w.Hour, w.Minute)
+	}
+	return fmt.Sprintf("%s %02d:%02d", w.Weekday.String()[:3], w.Hour, w.Minute)
+}
+
+// runMaintenance analyzes and vacuums the database
+func (app *App) runMaintenance() error {
+	start := time.Now()
+
+	if err := app.db.Analyze(); err != nil {
+		return err
+	}
+	if err := app.db.Vacuum(); err != nil {
+		return err
+	}
+
+	log.Printf("Database maintenance finished in %v", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runMaintenanceJob runs database maintenance at each start of the maintenance window
+func (app *App) runMaintenanceJob() {
+	for {
+		now := clock.Now()
+		<-clock.After(app.maintenance.Next(now).Sub(now))
+
+		if err := app.runMaintenance(); err != nil {
+			log.Printf("Database maintenance: %v", err)
+		}
+	}
+}
+
+// getDBStats returns database file sizes and row counts per table
+func (app *App) getDBStats(c *gin.Context) {
+	stats, err := app.db.Stats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get database stats: %v", err))
+		return
+	}
+
+	response := gin.H{
+		"status": "success",
+		"stats":  stats,
+	}
+	if app.maintenance != nil {
+		response["maintenance_window"] = app.maintenance.String()
+		response["next_maintenance"] = app.maintenance.Next(clock.Now())
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// vacuumDB rebuilds the database file
+func (app *App) vacuumDB(c *gin.Context) {
+	before := app.db.Size()
+	start := time.Now()
+
+	if err := app.db.Vacuum(); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "%v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"message":     "Database vacuumed",
+		"size_before": before,
+		"size_after":  app.db.Size(),
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// analyzeDB updates the query planner statistics
+func (app *App) analyzeDB(c *gin.Context) {
+	start := time.Now()
+
+	if err := app.db.Analyze(); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "%v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"message":     "Database analyzed",
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
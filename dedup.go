@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deduplicator collapses identical outbound messages (same number and content)
+// submitted within a window into a single send
+type Deduplicator struct {
+	Window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// dedupEntry tracks the first send of a message and its duplicates
+type dedupEntry struct {
+	started    time.Time
+	duplicates int
+	done       chan struct{} // closed when the first send has finished
+	id         int64         // sent_sms record of the first send
+	err        error
+}
+
+// LoadDeduplicator reads the deduplication window from OUTBOX_DEDUP_WINDOW
+// (e.g. "5m"). It returns nil if the variable is not set.
+func LoadDeduplicator() (*Deduplicator, error) {
+	value := os.Getenv("OUTBOX_DEDUP_WINDOW")
+	if value == "" {
+		return nil, nil
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("OUTBOX_DEDUP_WINDOW: invalid duration %q", value)
+	}
+
+	return &Deduplicator{
+		Window:  window,
+		entries: make(map[string]*dedupEntry),
+	}, nil
+}
+
+// dedupKey identifies a message by recipient and content
+func dedupKey(number, content string) string {
+	return number + "\x00" + content
+}
+
+// claim returns the entry of a message and whether the caller submitted it
+// first and must send it. Later callers within the window get the same entry.
+func (d *Deduplicator) claim(number, content string) (*dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range d.entries {
+		if now.Sub(entry.started) >= d.Window {
+			delete(d.entries, key)
+		}
+	}
+
+	key := dedupKey(number, content)
+	if entry, ok := d.entries[key]; ok {
+		entry.duplicates++
+		return entry, false
+	}
+
+	entry := &dedupEntry{started: now, done: make(chan struct{})}
+	d.entries[key] = entry
+	return entry, true
+}
+
+// finish records the outcome of the first send. Failed sends are forgotten
+// so that the next submission tries again.
+func (d *Deduplicator) finish(number, content string, entry *dedupEntry, id int64, err error) {
+	d.mu.Lock()
+	entry.id, entry.err = id, err
+	if err != nil && d.entries[dedupKey(number, content)] == entry {
+		delete(d.entries, dedupKey(number, content))
+	}
+	d.mu.Unlock()
+
+	close(entry.done)
+}
+
+// erase forgets the messages to the number with the given conversation ID.
+// A send in progress still completes for the callers waiting on it. It
+// returns the number of messages forgotten.
+func (d *Deduplicator) erase(conversationID string) int {
+	if d == nil {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	erased := 0
+	for key := range d.entries {
+		number, _, _ := strings.Cut(key, "\x00")
+		if ConversationID(number) == conversationID {
+			delete(d.entries, key)
+			erased++
+		}
+	}
+	return erased
+}
+
+// deliverDeduplicated sends a message unless an identical one was submitted
+// within the dedup window, in which case it waits for that send and counts
+// the duplicate on its sent_sms record instead
+func (app *App) deliverDeduplicated(ctx context.Context, keyID, number, content string, opts SendOptions) (int64, error) {
+	entry, first := app.dedup.claim(number, content)
+	if first {
+		id, err := app.deliverAggregated(ctx, keyID, number, content, opts)
+		app.dedup.finish(number, content, entry, id, err)
+		return id, err
+	}
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return 0, ErrSendCancelled
+	}
+
+	if entry.err != nil {
+		return entry.id, entry.err
+	}
+
+	log.Printf("Collapsed duplicate SMS to %s into sent SMS %d", number, entry.id)
+	if err := app.db.IncrementSentSMSDuplicates(entry.id); err != nil {
+		log.Printf("Failed to count duplicate SMS: %v", err)
+	}
+	return entry.id, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Device event log entries
+const (
+	DeviceEventDisconnected     = "disconnected"       // the serial port failed
+	DeviceEventReconnected      = "reconnected"        // the serial port was reopened
+	DeviceEventPowerCycle       = "power_cycle"        // the Arduino's power was cut and restored
+	DeviceEventPowerCycleFailed = "power_cycle_failed" // the power switch failed
+	DeviceEventGoroutinePanic   = "goroutine_panic"    // a serial goroutine panicked and was restarted
+	DeviceEventGoroutineExited  = "goroutine_exited"   // a serial goroutine returned early and was restarted
+)
+
+// errPowerSwitchNotConfigured is returned when power cycling without a power switch
+var errPowerSwitchNotConfigured = errors.New("power switch is not configured")
+
+// DeviceEvent is an entry in the device event log
+type DeviceEvent struct {
+	ID        int       `json:"id"`
+	Port      string    `json:"port"`
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SaveDeviceEvent records an entry in the device event log
+func (d *Database) SaveDeviceEvent(port, event, detail string) error {
+	_, err := d.db.Exec(`INSERT INTO device_events (port, event, detail) VALUES (?, ?, ?)`, port, event, detail)
+	if err != nil {
+		return fmt.Errorf("failed to save device event: %w", err)
+	}
+	return nil
+}
+
+// ListDeviceEvents retrieves the most recent device events, newest first
+func (d *Database) ListDeviceEvents(limit int) ([]DeviceEvent, error) {
+	rows, err := d.db.Query(`
+		SELECT id, port, event, detail, created_at
+		FROM device_events
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []DeviceEvent{}
+	for rows.Next() {
+		var event DeviceEvent
+		var createdAtStr string
+
+		if err := rows.Scan(&event.ID, &event.Port, &event.Event, &event.Detail, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		event.CreatedAt = parseTimestamp(createdAtStr)
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return events, nil
+}
+
+// recordDeviceEvent adds an entry for this connection's port to the device event log
+func (a *ArduinoConnection) recordDeviceEvent(event, detail string) {
+	if err := a.db.SaveDeviceEvent(a.portName, event, detail); err != nil {
+		log.Printf("Device event log: %v", err)
+	}
+}
+
+// getDeviceEvents returns the device event log, newest first
+func (app *App) getDeviceEvents(c *gin.Context) {
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 500 {
+				limit = 500
+			}
+		}
+	}
+
+	events, err := app.db.ListDeviceEvents(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get device events: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"count":  len(events),
+		"events": events,
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of device labels
+const (
+	maxDeviceLabelLength    = 64
+	maxDeviceLocationLength = 128
+	maxDeviceMetadataKeys   = 32
+	maxDeviceMetadataLength = 256
+)
+
+// DeviceLabel is what operators know a device by, e.g. "warehouse SIM", so
+// that multi-site deployments can tell devices apart in the message history
+type DeviceLabel struct {
+	Label    string            `json:"label,omitempty"`
+	Location string            `json:"location,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"` // free-form, e.g. SIM contract or cost center
+}
+
+// validate checks the lengths of a label
+func (l DeviceLabel) validate() error {
+	if utf8.RuneCountInString(l.Label) > maxDeviceLabelLength {
+		return fmt.Errorf("label is longer than %d characters", maxDeviceLabelLength)
+	}
+	if utf8.RuneCountInString(l.Location) > maxDeviceLocationLength {
+		return fmt.Errorf("location is longer than %d characters", maxDeviceLocationLength)
+	}
+	if len(l.Metadata) > maxDeviceMetadataKeys {
+		return fmt.Errorf("metadata has more than %d keys", maxDeviceMetadataKeys)
+	}
+	for key, value := range l.Metadata {
+		if key == "" || utf8.RuneCountInString(key) > maxDeviceLabelLength {
+			return fmt.Errorf("metadata key %q is empty or longer than %d characters", key, maxDeviceLabelLength)
+		}
+		if utf8.RuneCountInString(value) > maxDeviceMetadataLength {
+			return fmt.Errorf("metadata value of %q is longer than %d characters", key, maxDeviceMetadataLength)
+		}
+	}
+	return nil
+}
+
+// Device is a configured device with its connection state and label
+type Device struct {
+	Name      string `json:"name"`
+	Port      string `json:"port,omitempty"`
+	Connected bool   `json:"connected"`
+	OwnNumber string `json:"own_number,omitempty"`
+	DeviceLabel
+}
+
+// SetDeviceLabel saves the label of a device, replacing the previous one
+func (d *Database) SetDeviceLabel(device string, label DeviceLabel) error {
+	metadata, _ := json.Marshal(label.Metadata)
+	_, err := d.db.Exec(`
+		INSERT INTO device_labels (device, label, location, metadata, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(device) DO UPDATE SET label = excluded.label, location = excluded.location,
+			metadata = excluded.metadata, updated_at = excluded.updated_at
+	`, device, label.Label, label.Location, string(metadata), time.Now().UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to save device label: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceLabels retrieves the labels of all devices by device name
+func (d *Database) GetDeviceLabels() (map[string]DeviceLabel, error) {
+	rows, err := d.db.Query(`SELECT device, label, location, metadata FROM device_labels`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device labels: %w", err)
+	}
+	defer rows.Close()
+
+	labels := make(map[string]DeviceLabel)
+	for rows.Next() {
+		var device, metadata string
+		var label DeviceLabel
+		if err := rows.Scan(&device, &label.Label, &label.Location, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		json.Unmarshal([]byte(metadata), &label.Metadata)
+		labels[device] = label
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return labels, nil
+}
+
+// DeleteDeviceLabel removes the label of a device, reporting whether it had one
+func (d *Database) DeleteDeviceLabel(device string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM device_labels WHERE device = ?`, device)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete device label: %w", err)
+	}
+
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// SetSentSMSDevice records the device that sent an SMS
+func (d *Database) SetSentSMSDevice(id int64, device string) error {
+	if _, err := d.db.Exec(`UPDATE sent_sms SET device = ? WHERE id = ?`, device, id); err != nil {
+		return fmt.Errorf("failed to update sent SMS: %w", err)
+	}
+	return nil
+}
+
+// recordSentDevice records the device that sent an SMS saved as sentID, if
+// there is a record
+func (d *Database) recordSentDevice(sentID int64, device string) {
+	if sentID == 0 {
+		return
+	}
+	if err := d.SetSentSMSDevice(sentID, device); err != nil {
+		log.Printf("Failed to save sent SMS to database: %v", err)
+	}
+}
+
+// routeDevices returns the configured devices: the primary device, and the
+// routing devices if least-cost routing is configured
+func (app *App) routeDevices() []*RouteDevice {
+	if app.routing != nil {
+		return app.routing.Devices
+	}
+	return []*RouteDevice{{Name: routingPrimary, Conn: app.smsConn}}
+}
+
+// listDevices returns the configured devices with their connection state and
+// labels
+func (app *App) listDevices(c *gin.Context) {
+	labels, err := app.db.GetDeviceLabels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get devices: %v", err))
+		return
+	}
+
+	devices := []Device{}
+	for _, d := range app.routeDevices() {
+		device := Device{Name: d.Name, Port: d.Port, Connected: d.Conn.IsConnected(), DeviceLabel: labels[d.Name]}
+		if device.Port == "" && d.Name == routingPrimary {
+			device.Port = app.deviceMode
+		}
+		device.OwnNumber, _ = d.Conn.OwnNumber()
+		devices = append(devices, device)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"devices": devices,
+	})
+}
+
+// setDeviceLabel assigns a name, location and metadata to a configured device
+func (app *App) setDeviceLabel(c *gin.Context) {
+	name := c.Param("name")
+	if !app.isDevice(name) {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Device %s not found", name))
+		return
+	}
+
+	var label DeviceLabel
+	if !bindStrictJSON(c, &label) {
+		return
+	}
+	if err := label.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid device label: %v", err))
+		return
+	}
+
+	if err := app.db.SetDeviceLabel(name, label); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to save device label: %v", err))
+		return
+	}
+
+	log.Printf("Labelled device %s as %q", name, label.Label)
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"device": gin.H{"name": name, "label": label.Label, "location": label.Location, "metadata": label.Metadata},
+	})
+}
+
+// deleteDeviceLabel removes the label of a device
+func (app *App) deleteDeviceLabel(c *gin.Context) {
+	name := c.Param("name")
+
+	deleted, err := app.db.DeleteDeviceLabel(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete device label: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Device %s has no label", name))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// isDevice reports whether name is a configured device
+func (app *App) isDevice(name string) bool {
+	for _, device := range app.routeDevices() {
+		if device.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// dialect writes the SQL that differs between SQLite and PostgreSQL. Queries
+// are written with ? placeholders and ask the dialect for everything else
+// that differs, e.g. "WHERE content " + d.dialect().like() + " ?".
+type dialect interface {
+	// bind returns the query and arguments in the form the driver takes
+	bind(query string, args []any) (string, []any)
+
+	// now is the current UTC time, formatted like sqliteTimeFormat
+	now() string
+	// timeAfter is now plus an interval argument such as "+30 seconds"
+	timeAfter() string
+	// utcTime is a timestamp column converted to UTC and formatted like now
+	utcTime(column string) string
+	// like is the case-insensitive LIKE operator
+	like() string
+	// position is the 1-based position of needle in haystack, 0 if absent
+	position(haystack, needle string) string
+	// notesColumn selects the notes of a received SMS as a JSON array
+	notesColumn() string
+
+	// types are the column types of the schema
+	types() schemaTypes
+}
+
+// schemaTypes are the column types and defaults the schema is written with
+type schemaTypes struct {
+	ID   string // auto-incrementing 64 bit primary key
+	Int  string // 64 bit integer
+	Bool string // boolean stored as 1 or 0
+	Time string // timestamp stored as text
+	Real string // floating point number
+	Now  string // default of timestamp columns set on insert
+}
+
+// schemaSQL fills in the column types of the schema for d
+func schemaSQL(d dialect, ddl string) string {
+	var b strings.Builder
+	template.Must(template.New("schema").Parse(ddl)).Execute(&b, d.types())
+	return b.String()
+}
+
+// sqliteDialect is the SQL of SQLite
+type sqliteDialect struct{}
+
+func (sqliteDialect) bind(query string, args []any) (string, []any) {
+	return query, args
+}
+
+func (sqliteDialect) now() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (sqliteDialect) timeAfter() string {
+	return "datetime('now', ?)"
+}
+
+func (sqliteDialect) utcTime(column string) string {
+	return "datetime(" + column + ")"
+}
+
+func (sqliteDialect) like() string {
+	return "LIKE"
+}
+
+func (sqliteDialect) position(haystack, needle string) string {
+	return "instr(" + haystack + ", " + needle + ")"
+}
+
+func (sqliteDialect) notesColumn() string {
+	return receivedNotesColumn
+}
+
+func (sqliteDialect) types() schemaTypes {
+	return schemaTypes{
+		ID:   "INTEGER PRIMARY KEY AUTOINCREMENT",
+		Int:  "INTEGER",
+		Bool: "BOOLEAN",
+		Time: "DATETIME",
+		Real: "REAL",
+		Now:  "CURRENT_TIMESTAMP",
+	}
+}
+
+// postgresDialect is the SQL of PostgreSQL. Timestamps are stored as text in
+// SQLite's format and booleans as integers, so both databases hold the same
+// values and scan into the same Go types.
+type postgresDialect struct{}
+
+func (postgresDialect) now() string {
+	return postgresNow
+}
+
+func (postgresDialect) timeAfter() string {
+	return postgresUTC("now() + CAST(? AS INTERVAL)")
+}
+
+// utcTime parses the column, since received timestamps are stored with the
+// zone they were received in
+func (postgresDialect) utcTime(column string) string {
+	return postgresUTC("CAST(" + column + " AS TIMESTAMPTZ)")
+}
+
+// like is ILIKE, as LIKE is case-sensitive on PostgreSQL
+func (postgresDialect) like() string {
+	return "ILIKE"
+}
+
+func (postgresDialect) position(haystack, needle string) string {
+	return "strpos(" + haystack + ", " + needle + ")"
+}
+
+func (postgresDialect) notesColumn() string {
+	return postgresNotesColumn
+}
+
+func (postgresDialect) types() schemaTypes {
+	return schemaTypes{
+		ID:   "BIGSERIAL PRIMARY KEY",
+		Int:  "BIGINT",
+		Bool: "BIGINT",
+		Time: "TEXT",
+		Real: "DOUBLE PRECISION",
+		Now:  postgresNow,
+	}
+}
+
+// bind numbers the ? placeholders of a query ($1, $2, ...), leaving string
+// literals alone, and converts the arguments with postgresArgs
+func (postgresDialect) bind(query string, args []any) (string, []any) {
+	var b strings.Builder
+	quoted := false
+	n := 0
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'':
+			quoted = !quoted
+		case !quoted && query[i] == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String(), postgresArgs(args)
+}
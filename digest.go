@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Digest schedules
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// digestMessageLimit caps the number of messages listed in one digest
+const digestMessageLimit = 200
+
+// DigestSettings holds configuration for the email digest
+type DigestSettings struct {
+	Schedule   string // daily or weekly
+	Hour       int    // local hour at which a digest period ends
+	Recipients []string
+	SMTP       *SMTPConfig
+	Locale     string // language of the digest
+
+	textTemplate *texttemplate.Template
+	htmlTemplate *htmltemplate.Template
+}
+
+// Digest is the data rendered into a digest email
+type Digest struct {
+	Schedule      string
+	From          time.Time
+	To            time.Time
+	ReceivedCount int
+	SentCount     int
+	FailedCount   int
+	Received      []ReceivedSMS
+	Failures      []SentSMS
+}
+
+// defaultDigestText is the built-in plain-text digest template
+const defaultDigestText = `{{T "SMS gateway %s digest" (T .Schedule)}}
+{{.From.Format "2006-01-02 15:04"}} - {{.To.Format "2006-01-02 15:04"}}
+
+{{T "Received"}}: {{.ReceivedCount}}
+{{T "Sent"}}: {{.SentCount}}
+{{T "Failed"}}: {{.FailedCount}}
+{{if .Received}}
+{{T "Received messages"}}
+-----------------
+{{range .Received}}{{.Timestamp.Format "2006-01-02 15:04"}}  {{.Number}}
+  {{.Content}}
+{{end}}{{if gt .ReceivedCount (len .Received)}}{{T "... and %d more" (sub .ReceivedCount (len .Received))}}
+{{end}}{{end}}{{if .Failures}}
+{{T "Failed sends"}}
+------------
+{{range .Failures}}{{.CreatedAt.Format "2006-01-02 15:04"}}  {{.Number}}: {{.Error}}
+  {{.Content}}
+{{end}}{{if gt .FailedCount (len .Failures)}}{{T "... and %d more" (sub .FailedCount (len .Failures))}}
+{{end}}{{end}}`
+
+// defaultDigestHTML is the built-in HTML digest template
+const defaultDigestHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<h2>{{T "SMS gateway %s digest" (T .Schedule)}}</h2>
+<p>{{.From.Format "2006-01-02 15:04"}} &ndash; {{.To.Format "2006-01-02 15:04"}}</p>
+<table>
+<tr><td>{{T "Received"}}</td><td><b>{{.ReceivedCount}}</b></td></tr>
+<tr><td>{{T "Sent"}}</td><td><b>{{.SentCount}}</b></td></tr>
+<tr><td>{{T "Failed"}}</td><td><b>{{.FailedCount}}</b></td></tr>
+</table>
+{{if .Received}}
+<h3>{{T "Received messages"}}</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>{{T "Time"}}</th><th>{{T "Number"}}</th><th>{{T "Message"}}</th></tr>
+{{range .Received}}<tr><td>{{.Timestamp.Format "2006-01-02 15:04"}}</td><td>{{.Number}}</td><td>{{.Content}}</td></tr>
+{{end}}</table>
+{{if gt .ReceivedCount (len .Received)}}<p>{{T "... and %d more" (sub .ReceivedCount (len .Received))}}</p>{{end}}
+{{end}}
+{{if .Failures}}
+<h3>{{T "Failed sends"}}</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>{{T "Time"}}</th><th>{{T "Number"}}</th><th>{{T "Error"}}</th><th>{{T "Message"}}</th></tr>
+{{range .Failures}}<tr><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{.Number}}</td><td>{{.Error}}</td><td>{{.Content}}</td></tr>
+{{end}}</table>
+{{if gt .FailedCount (len .Failures)}}<p>{{T "... and %d more" (sub .FailedCount (len .Failures))}}</p>{{end}}
+{{end}}
+</body>
+</html>
+`
+
+// digestFuncs returns the functions available to digest templates; T
+// translates a string to locale
+func digestFuncs(locale string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub": func(a, b int) int { return a - b },
+		"T": func(format string, args ...any) string {
+			return T(locale, format, args...)
+		},
+	}
+}
+
+// LoadDigestSettings reads digest settings from environment variables.
+// It returns nil if DIGEST_SCHEDULE is not set.
+func LoadDigestSettings(smtpConfig *SMTPConfig, locale string) (*DigestSettings, error) {
+	schedule := strings.ToLower(os.Getenv("DIGEST_SCHEDULE"))
+	if schedule == "" {
+		return nil, nil
+	}
+	if schedule != DigestDaily && schedule != DigestWeekly {
+		return nil, fmt.Errorf("invalid DIGEST_SCHEDULE %q, expected daily or weekly", schedule)
+	}
+
+	if smtpConfig == nil {
+		return nil, fmt.Errorf("DIGEST_SCHEDULE requires SMTP_HOST to be set")
+	}
+
+	settings := &DigestSettings{
+		Schedule: schedule,
+		Hour:     8,
+		SMTP:     smtpConfig,
+		Locale:   locale,
+	}
+
+	settings.Recipients = splitList(os.Getenv("DIGEST_RECIPIENTS"))
+	if len(settings.Recipients) == 0 {
+		return nil, fmt.Errorf("DIGEST_SCHEDULE requires DIGEST_RECIPIENTS to be set")
+	}
+
+	if hourStr := os.Getenv("DIGEST_HOUR"); hourStr != "" {
+		hour, err := strconv.Atoi(hourStr)
+		if err != nil || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("invalid DIGEST_HOUR %q, expected 0-23", hourStr)
+		}
+		settings.Hour = hour
+	}
+
+	// Templates can be replaced by files
+	textSource, err := readTemplateFile("DIGEST_TEXT_TEMPLATE", defaultDigestText)
+	if err != nil {
+		return nil, err
+	}
+	settings.textTemplate, err = texttemplate.New("digest.txt").Funcs(digestFuncs(locale)).Parse(textSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text digest template: %w", err)
+	}
+
+	htmlSource, err := readTemplateFile("DIGEST_HTML_TEMPLATE", defaultDigestHTML)
+	if err != nil {
+		return nil, err
+	}
+	settings.htmlTemplate, err = htmltemplate.New("digest.html").Funcs(digestFuncs(locale)).Parse(htmlSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML digest template: %w", err)
+	}
+
+	return settings, nil
+}
+
+// readTemplateFile returns the contents of the file named by an environment
+// variable, or the fallback if the variable is not set
+func readTemplateFile(env, fallback string) (string, error) {
+	path := os.Getenv(env)
+	if path == "" {
+		return fallback, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", env, err)
+	}
+
+	return string(data), nil
+}
+
+// periodEnd returns the end of the most recent digest period at or before now
+func (s *DigestSettings) periodEnd(now time.Time) time.Time {
+	end := time.Date(now.Year(), now.Month(), now.Day(), s.Hour, 0, 0, 0, now.Location())
+	if end.After(now) {
+		end = end.AddDate(0, 0, -1)
+	}
+
+	// Weekly digests end on Monday
+	if s.Schedule == DigestWeekly {
+		for end.Weekday() != time.Monday {
+			end = end.AddDate(0, 0, -1)
+		}
+	}
+
+	return end
+}
+
+// periodStart returns the start of the digest period ending at end
+func (s *DigestSettings) periodStart(end time.Time) time.Time {
+	if s.Schedule == DigestWeekly {
+		return end.AddDate(0, 0, -7)
+	}
+	return end.AddDate(0, 0, -1)
+}
+
+// BuildDigest collects the received messages and send failures in [from, to)
+func (d *Database) BuildDigest(schedule string, from, to time.Time) (*Digest, error) {
+	digest := &Digest{
+		Schedule: schedule,
+		From:     from,
+		To:       to,
+		Received: []ReceivedSMS{},
+		Failures: []SentSMS{},
+	}
+
+	start := from.UTC().Format("2006-01-02 15:04:05")
+	end := to.UTC().Format("2006-01-02 15:04:05")
+
+	err := d.db.QueryRow(`
+		SELECT COUNT(*) FROM received_sms WHERE created_at >= ? AND created_at < ?
+	`, start, end).Scan(&digest.ReceivedCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count received SMS: %w", err)
+	}
+
+	err = d.db.QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN status = 'success' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'error' THEN 1 ELSE 0 END), 0)
+		FROM sent_sms
+		WHERE created_at >= ? AND created_at < ?
+	`, start, end).Scan(&digest.SentCount, &digest.FailedCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count sent SMS: %w", err)
+	}
+
+	rows, err := d.db.Query(`
+		SELECT id, number, content, timestamp, created_at
+		FROM received_sms
+		WHERE created_at >= ? AND created_at < ?
+		ORDER BY id ASC
+		LIMIT ?
+	`, start, end, digestMessageLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query received SMS: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg ReceivedSMS
+		var timestampStr, createdAtStr string
+
+		if err := rows.Scan(&msg.ID, &msg.Number, &msg.Content, &timestampStr, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		msg.Timestamp = parseTimestamp(timestampStr)
+		msg.CreatedAt = parseTimestamp(createdAtStr)
+
+		digest.Received = append(digest.Received, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	failRows, err := d.db.Query(`
+		SELECT id, number, content, status, COALESCE(error, ''), COALESCE(error_class, ''), COALESCE(fallback, ''), created_at
+		FROM sent_sms
+		WHERE status = 'error' AND created_at >= ? AND created_at < ?
+		ORDER BY id ASC
+		LIMIT ?
+	`, start, end, digestMessageLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sent SMS: %w", err)
+	}
+	defer failRows.Close()
+
+	for failRows.Next() {
+		var msg SentSMS
+		var createdAtStr string
+
+		if err := failRows.Scan(&msg.ID, &msg.Number, &msg.Content, &msg.Status, &msg.Error, &msg.ErrorClass, &msg.Fallback, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		msg.CreatedAt = parseTimestamp(createdAtStr)
+
+		digest.Failures = append(digest.Failures, msg)
+	}
+
+	if err := failRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return digest, nil
+}
+
+// IsDigestSent reports whether the digest for the period ending at end was sent
+func (d *Database) IsDigestSent(end time.Time) (bool, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM email_digests WHERE period_end = ?`, end.UTC().Format(time.RFC3339)).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to query digests: %w", err)
+	}
+	return count > 0, nil
+}
+
+// MarkDigestSent records that the digest for the period ending at end was sent
+func (d *Database) MarkDigestSent(end time.Time) error {
+	_, err := d.db.Exec(`
+		INSERT INTO email_digests (period_end) VALUES (?)
+		ON CONFLICT(period_end) DO UPDATE SET sent_at = `+d.dialect().now()+`
+	`, end.UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to record digest: %w", err)
+	}
+	return nil
+}
+
+// sendDigest renders and emails the digest for the period [from, to)
+func (app *App) sendDigest(from, to time.Time) (*Digest, error) {
+	settings := app.digestSettings
+
+	digest, err := app.db.BuildDigest(settings.Schedule, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var text, html bytes.Buffer
+	if err := settings.textTemplate.Execute(&text, digest); err != nil {
+		return nil, fmt.Errorf("failed to render text digest: %w", err)
+	}
+	if err := settings.htmlTemplate.Execute(&html, digest); err != nil {
+		return nil, fmt.Errorf("failed to render HTML digest: %w", err)
+	}
+
+	subject := T(settings.Locale, "SMS gateway %s digest: %d received, %d failed", T(settings.Locale, settings.Schedule), digest.ReceivedCount, digest.FailedCount)
+	err = settings.SMTP.SendMail(MailMessage{
+		To:      settings.Recipients,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return digest, nil
+}
+
+// runDigestJob emails a digest after each daily or weekly period has ended
+func (app *App) runDigestJob() {
+	ticker := clock.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		end := app.digestSettings.periodEnd(clock.Now())
+
+		sent, err := app.db.IsDigestSent(end)
+		if err != nil {
+			log.Printf("Digest job: %v", err)
+		} else if !sent {
+			start := app.digestSettings.periodStart(end)
+			if _, err := app.sendDigest(start, end); err != nil {
+				log.Printf("Digest job: failed to send digest for %s: %v", end.Format(time.RFC3339), err)
+			} else if err := app.db.MarkDigestSent(end); err != nil {
+				log.Printf("Digest job: %v", err)
+			} else {
+				log.Printf("Sent %s digest to %s", app.digestSettings.Schedule, strings.Join(app.digestSettings.Recipients, ", "))
+			}
+		}
+
+		<-ticker.C()
+	}
+}
+
+// sendDigestNow emails a digest for the period up to now, e.g. to test the setup
+func (app *App) sendDigestNow(c *gin.Context) {
+	if app.digestSettings == nil {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "Email digest is not configured"))
+		return
+	}
+
+	now := clock.Now()
+	digest, err := app.sendDigest(app.digestSettings.periodStart(now), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to send digest: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"message":    fmt.Sprintf("Digest sent to %s", strings.Join(app.digestSettings.Recipients, ", ")),
+		"received":   digest.ReceivedCount,
+		"sent":       digest.SentCount,
+		"failed":     digest.FailedCount,
+		"recipients": app.digestSettings.Recipients,
+	})
+}
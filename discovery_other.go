@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// discoveryCandidates returns the ports to probe for an Arduino; outside
+// Windows the port names tell USB ports apart
+func discoveryCandidates(ports []string) []string {
+	return ports
+}
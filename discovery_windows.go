@@ -0,0 +1,40 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// arduinoUSBVendors are the USB vendor IDs of Arduino boards and common
+// USB-serial chips (Arduino, Arduino.org, WCH CH340, FTDI, Silicon Labs CP210x)
+var arduinoUSBVendors = []string{"2341", "2A03", "1A86", "0403", "10C4"}
+
+// discoveryCandidates orders the ports to probe for an Arduino. On Windows
+// every serial port is a COMn port, including Bluetooth and legacy ports that
+// can block when opened, so only USB ports are probed, Arduino vendors first.
+func discoveryCandidates(ports []string) []string {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		log.Printf("Failed to get USB details of serial ports: %v", err)
+		return ports
+	}
+
+	var arduino, other []string
+	for _, port := range details {
+		if !port.IsUSB {
+			continue
+		}
+		if slices.Contains(arduinoUSBVendors, strings.ToUpper(port.VID)) {
+			arduino = append(arduino, port.Name)
+		} else {
+			other = append(other, port.Name)
+		}
+	}
+
+	return append(arduino, other...)
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns the free and total bytes of the volume holding dir
+func diskSpace(dir string) (free, total int64, err error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var available, size, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &size, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return int64(available), int64(size), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMessage is a sample received SMS to try a webhook or rule against.
+// Timestamp defaults to now.
+type TestMessage struct {
+	Number       string     `json:"number" binding:"required"`
+	Content      string     `json:"content"`
+	DeviceNumber string     `json:"device_number"`
+	Timestamp    *time.Time `json:"timestamp"`
+}
+
+// WebhookTestRequest is a sample message and the event to render for it,
+// message.received unless set
+type WebhookTestRequest struct {
+	TestMessage
+	Event string `json:"event"`
+}
+
+// RenderedRequest is an HTTP request a webhook or rule would make
+type RenderedRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    interface{}       `json:"body"`
+}
+
+// RuleTestResult is what a rule would do with a sample message
+type RuleTestResult struct {
+	Matched  bool             `json:"matched"`
+	Error    string           `json:"error,omitempty"`   // why the condition could not be evaluated
+	Skipped  string           `json:"skipped,omitempty"` // loopback, muted or blocked: no rule runs
+	Action   string           `json:"action"`
+	Stop     bool             `json:"stop"`               // later rules would not run
+	Cooldown bool             `json:"cooldown,omitempty"` // reply suppressed, already replied within the cooldown
+	SendTo   string           `json:"send_to,omitempty"`
+	SendText string           `json:"send_text,omitempty"`
+	Request  *RenderedRequest `json:"request,omitempty"`
+}
+
+// receivedSMS builds the received SMS the sample stands for. It has no ID as
+// it is never stored.
+func (m TestMessage) receivedSMS() ReceivedSMS {
+	timestamp := clockNow()
+	if m.Timestamp != nil {
+		timestamp = *m.Timestamp
+	}
+
+	msg := ReceivedSMS{
+		Number:       m.Number,
+		Content:      m.Content,
+		Timestamp:    timestamp,
+		CreatedAt:    timestamp.UTC(),
+		DeviceNumber: m.DeviceNumber,
+
+		ConversationID: ConversationID(m.Number),
+		NumberClass:    ClassifyNumber(m.Number),
+		Encoding:       DetectEncoding(m.Content),
+	}
+	msg.Country, msg.Operator = LookupNumberOrigin(m.Number)
+	return msg
+}
+
+// jsonPost renders a JSON POST to a URL
+func jsonPost(url string, body interface{}) *RenderedRequest {
+	return &RenderedRequest{
+		Method:  http.MethodPost,
+		URL:     url,
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    body,
+	}
+}
+
+// repliedRecently reports whether a rule replied to a number within the
+// cooldown, without recording a reply like mayReply
+func (r *InboundRules) repliedRecently(ruleID int64, number string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	at, ok := r.replied[fmt.Sprintf("%d/%s", ruleID, number)]
+	return ok && time.Since(at) < ruleReplyCooldown
+}
+
+// testWebhook renders the request a webhook would receive for a sample
+// message, without posting it
+func (app *App) testWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid webhook ID"))
+		return
+	}
+
+	var req WebhookTestRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	msg := req.receivedSMS()
+	var data gin.H
+	switch req.Event {
+	case "", EventMessageReceived:
+		req.Event = EventMessageReceived
+		data = receivedEvent(msg)
+	case EventMessageEscalated:
+		msg.Escalations = 1
+		data = escalatedEvent(msg)
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Unsupported test event %q (use %s or %s)",
+			req.Event, EventMessageReceived, EventMessageEscalated))
+		return
+	}
+
+	hook, err := app.db.GetWebhook(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get webhook: %v", err))
+		return
+	}
+	if hook == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Webhook %d not found", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"event":   req.Event,
+		"request": jsonPost(hook.URL, webhookPayload(*hook, req.Event, msg, data)),
+	})
+}
+
+// testInboundRule reports what a rule would do with a sample message, as
+// applyInboundRules and runRuleAction would decide, without sending or
+// posting anything
+func (app *App) testInboundRule(c *gin.Context) {
+	rule := app.inboundRuleFromParam(c)
+	if rule == nil {
+		return
+	}
+
+	var req TestMessage
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	msg := req.receivedSMS()
+	result := RuleTestResult{Action: rule.Action, Stop: rule.Stop}
+
+	switch muted, err := app.db.IsMuted(msg.Number); {
+	case app.loopback.IsLoopback(msg):
+		result.Skipped = "loopback"
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to check mute: %v", err))
+		return
+	case muted:
+		result.Skipped = "muted"
+	case app.blocklist.IsBlocked(app.db, msg.Number):
+		result.Skipped = "blocked"
+	}
+
+	expr, err := CompileRuleExpr(rule.Condition)
+	if err == nil {
+		result.Matched, err = expr.Match(ruleVars(msg))
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if result.Matched {
+		switch rule.Action {
+		case RuleActionReply:
+			result.SendTo = msg.Number
+			result.SendText = rule.Message
+			result.Cooldown = app.rules.repliedRecently(rule.ID, msg.Number)
+		case RuleActionForward:
+			result.SendTo = rule.Target
+			result.SendText = fmt.Sprintf("%s: %s", msg.Number, msg.Content)
+		case RuleActionWebhook:
+			result.Request = jsonPost(rule.Target, gin.H{
+				"event": EventMessageReceived,
+				"rule":  gin.H{"id": rule.ID, "name": rule.Name},
+				"data":  receivedEvent(msg),
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"rule":   rule,
+		"result": result,
+	})
+}
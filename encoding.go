@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// SMS encodings
+const (
+	EncodingGSM7 = "GSM-7"
+	EncodingUCS2 = "UCS-2"
+)
+
+// gsm7Basic is the GSM 03.38 default alphabet
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// gsm7Extension holds characters that need an escape code (two septets) in GSM-7
+const gsm7Extension = "\f^{}\\[~]|€"
+
+// DetectEncoding returns the encoding an SMS with this content will be sent in
+func DetectEncoding(content string) string {
+	for _, r := range content {
+		if !strings.ContainsRune(gsm7Basic, r) && !strings.ContainsRune(gsm7Extension, r) {
+			return EncodingUCS2
+		}
+	}
+	return EncodingGSM7
+}
+
+// CountSegments returns the number of SMS segments needed to send the content
+func CountSegments(content string) int {
+	if content == "" {
+		return 1
+	}
+
+	var units, single, multi int
+
+	if DetectEncoding(content) == EncodingGSM7 {
+		for _, r := range content {
+			if strings.ContainsRune(gsm7Extension, r) {
+				units += 2
+			} else {
+				units++
+			}
+		}
+		single, multi = 160, 153
+	} else {
+		units = len(utf16.Encode([]rune(content)))
+		single, multi = 70, 67
+	}
+
+	if units <= single {
+		return 1
+	}
+	return (units + multi - 1) / multi
+}
+
+// backfillEncodings sets the encoding of received SMS, and the encoding and
+// segment count of sent SMS, stored before they were recorded
+func (d *Database) backfillEncodings() error {
+	for _, table := range []string{"received_sms", "sent_sms"} {
+		rows, err := d.db.Query(fmt.Sprintf("SELECT id, content FROM %s WHERE encoding IS NULL", table))
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %w", table, err)
+		}
+
+		contents := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var content string
+			if err := rows.Scan(&id, &content); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			contents[id] = content
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+		if len(contents) == 0 {
+			continue
+		}
+
+		tx, err := d.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		for id, content := range contents {
+			if table == "sent_sms" {
+				_, err = tx.Exec("UPDATE sent_sms SET encoding = ?, segments = ? WHERE id = ?", DetectEncoding(content), CountSegments(content), id)
+			} else {
+				_, err = tx.Exec("UPDATE received_sms SET encoding = ? WHERE id = ?", DetectEncoding(content), id)
+			}
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to update %s: %w", table, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit %s encodings: %w", table, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrorClass is a structured category of a send failure
+type ErrorClass string
+
+// Error classes
+const (
+	ErrorClassNoCredit       ErrorClass = "no_credit"       // prepaid balance exhausted or service barred
+	ErrorClassInvalidNumber  ErrorClass = "invalid_number"  // recipient does not exist or number is malformed
+	ErrorClassNetworkTimeout ErrorClass = "network_timeout" // network did not answer in time or is congested
+	ErrorClassNoNetwork      ErrorClass = "no_network"      // modem is not registered to a network
+	ErrorClassSIMFull        ErrorClass = "sim_full"        // SIM message storage is full
+	ErrorClassSIMError       ErrorClass = "sim_error"       // SIM missing, locked or failed
+	ErrorClassDevice         ErrorClass = "device"          // Arduino not connected or not responding
+	ErrorClassUnknown        ErrorClass = "unknown"
+)
+
+// ModemError is a send failure reported by the modem, e.g. "+CMS ERROR: 332"
+type ModemError struct {
+	Message string
+	Code    string // raw result code relayed by the Arduino, may be empty
+}
+
+// Error returns the modem's message with its result code
+func (e *ModemError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// modemCodeRe matches numeric +CMS/+CME error result codes
+var modemCodeRe = regexp.MustCompile(`\+(CMS|CME) ERROR:\s*(\d+)`)
+
+// cmsClasses maps +CMS ERROR codes (3GPP TS 27.005 and 24.011) to error classes
+var cmsClasses = map[int]ErrorClass{
+	1:   ErrorClassInvalidNumber,  // unassigned (unallocated) number
+	8:   ErrorClassNoCredit,       // operator determined barring
+	10:  ErrorClassNoCredit,       // call barred
+	21:  ErrorClassNoCredit,       // short message transfer rejected
+	27:  ErrorClassInvalidNumber,  // destination out of service
+	28:  ErrorClassInvalidNumber,  // unidentified subscriber
+	29:  ErrorClassNoCredit,       // facility rejected
+	30:  ErrorClassInvalidNumber,  // unknown subscriber
+	38:  ErrorClassNetworkTimeout, // network out of order
+	41:  ErrorClassNetworkTimeout, // temporary failure
+	42:  ErrorClassNetworkTimeout, // congestion
+	47:  ErrorClassNetworkTimeout, // resources unavailable
+	50:  ErrorClassNoCredit,       // requested facility not subscribed
+	96:  ErrorClassInvalidNumber,  // invalid mandatory information
+	310: ErrorClassSIMError,       // SIM not inserted
+	311: ErrorClassSIMError,       // SIM PIN required
+	313: ErrorClassSIMError,       // SIM failure
+	316: ErrorClassSIMError,       // SIM PUK required
+	322: ErrorClassSIMFull,        // memory full
+	330: ErrorClassNoNetwork,      // SMSC address unknown
+	331: ErrorClassNoNetwork,      // no network service
+	332: ErrorClassNetworkTimeout, // network timeout
+}
+
+// cmeClasses maps +CME ERROR codes (3GPP TS 27.007) to error classes
+var cmeClasses = map[int]ErrorClass{
+	10: ErrorClassSIMError,       // SIM not inserted
+	11: ErrorClassSIMError,       // SIM PIN required
+	12: ErrorClassSIMError,       // SIM PUK required
+	13: ErrorClassSIMError,       // SIM failure
+	20: ErrorClassSIMFull,        // memory full
+	30: ErrorClassNoNetwork,      // no network service
+	31: ErrorClassNetworkTimeout, // network timeout
+}
+
+// ClassifyModemCode returns the error class of a modem result code such as
+// "+CMS ERROR: 42"
+func ClassifyModemCode(code string) ErrorClass {
+	match := modemCodeRe.FindStringSubmatch(code)
+	if match == nil {
+		return ErrorClassUnknown
+	}
+
+	n, _ := strconv.Atoi(match[2])
+	classes := cmsClasses
+	if match[1] == "CME" {
+		classes = cmeClasses
+	}
+
+	if class, ok := classes[n]; ok {
+		return class
+	}
+	return ErrorClassUnknown
+}
+
+// ClassifyError returns the error class of a failed send
+func ClassifyError(err error) ErrorClass {
+	var modemErr *ModemError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &modemErr):
+		return ClassifyModemCode(modemErr.Code)
+	case errors.Is(err, ErrNotConnected):
+		return ErrorClassDevice
+	case strings.Contains(err.Error(), "GSM not ready"):
+		return ErrorClassNoNetwork
+	case strings.Contains(err.Error(), "no send result"):
+		return ErrorClassDevice
+	case strings.Contains(err.Error(), "serial port"):
+		return ErrorClassDevice
+	}
+	return ErrorClassUnknown
+}
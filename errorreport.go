@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorReporter sends panics to an error tracker, nil when none is configured
+var errorReporter *ErrorReporter
+
+// errorReportClient is used for all error reports
+var errorReportClient = &http.Client{Timeout: 5 * time.Second}
+
+// ErrorReporter sends panics to a Sentry-compatible error tracker (Sentry,
+// GlitchTip, Bugsink) using the store endpoint of the DSN
+type ErrorReporter struct {
+	StoreURL    string
+	Key         string
+	Environment string
+	ServerName  string
+}
+
+// LoadErrorReporter reads SENTRY_DSN (secret) and SENTRY_ENVIRONMENT, and
+// returns nil if no DSN is configured. A DSN has the form
+// https://<key>@<host>[/<path>]/<project>.
+func LoadErrorReporter() (*ErrorReporter, error) {
+	dsn, err := GetSecret("SENTRY_DSN")
+	if err != nil || dsn == "" {
+		return nil, err
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, fmt.Errorf("SENTRY_DSN: expected https://<key>@<host>/<project>")
+	}
+	path, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		path, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" {
+		return nil, fmt.Errorf("SENTRY_DSN: missing project ID")
+	}
+
+	r := &ErrorReporter{
+		StoreURL:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path, project),
+		Key:         u.User.Username(),
+		Environment: os.Getenv("SENTRY_ENVIRONMENT"),
+	}
+	r.ServerName, _ = os.Hostname()
+	return r, nil
+}
+
+// errorReportFrame is a stack frame of an error report
+type errorReportFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// panicFrames returns the stack of a panic being recovered, oldest call first,
+// without the frames of the runtime, the recovering function and the skip
+// functions that called it
+func panicFrames(skip int) []errorReportFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3+skip, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var stack []errorReportFrame
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			stack = append(stack, errorReportFrame{
+				Function: frame.Function,
+				Filename: frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(frame.Function, "main."),
+			})
+		}
+		if !more {
+			break
+		}
+	}
+
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// ReportPanic sends a recovered panic with its stack and tags. It does
+// nothing on a nil reporter.
+func (r *ErrorReporter) ReportPanic(value any, frames []errorReportFrame, tags map[string]string) {
+	if r == nil {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := gin.H{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"level":     "fatal",
+		"platform":  "go",
+		"logger":    "panic",
+		"tags":      tags,
+		"exception": gin.H{"values": []gin.H{{
+			"type":       fmt.Sprintf("panic: %T", value),
+			"value":      fmt.Sprint(value),
+			"stacktrace": gin.H{"frames": frames},
+		}}},
+	}
+	if r.ServerName != "" {
+		event["server_name"] = r.ServerName
+	}
+	if r.Environment != "" {
+		event["environment"] = r.Environment
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		event["release"] = info.Main.Version
+	}
+
+	body, _ := json.Marshal(event)
+	req, err := http.NewRequest(http.MethodPost, r.StoreURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error report: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=arduinoSmsServer/1.0, sentry_key=%s", r.Key))
+
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		log.Printf("Error report: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Error report: tracker returned %s", resp.Status)
+	}
+}
+
+// reportPanics runs a background goroutine's fn. A panic is logged with its
+// stack and reported before it crashes the server as before, so that the
+// service manager restarts it.
+func reportPanics(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in %s: %v\n%s", name, r, debug.Stack())
+			errorReporter.ReportPanic(r, panicFrames(0), map[string]string{"goroutine": name})
+			panic(r)
+		}
+	}()
+	fn()
+}
+
+// recoveryMiddleware answers requests whose handler panicked with 500 and
+// reports the panic. Broken connections are only logged.
+func recoveryMiddleware() gin.HandlerFunc {
+	return gin.CustomRecovery(func(c *gin.Context, err any) {
+		tags := map[string]string{"route": c.Request.Method + " " + c.FullPath()}
+		if id := c.GetString(requestIDContextKey); id != "" {
+			tags["request_id"] = id
+		}
+		// Skip gin's deferred function calling this one
+		go errorReporter.ReportPanic(err, panicFrames(1), tags)
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Internal server error"))
+	})
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Escalation statuses
+const (
+	EscalationActive       = "active"       // waiting for a reply or ack
+	EscalationAcknowledged = "acknowledged" // someone in the chain responded
+	EscalationExhausted    = "exhausted"    // nobody in the chain responded
+	EscalationCancelled    = "cancelled"
+)
+
+// Escalation step statuses
+const (
+	StepSent         = "sent"
+	StepFailed       = "failed"
+	StepTimedOut     = "timed_out"
+	StepAcknowledged = "acknowledged"
+	StepCancelled    = "cancelled"
+)
+
+// escalationCheckInterval is how often active escalations are checked for replies and timeouts
+const escalationCheckInterval = 15 * time.Second
+
+// sqliteTimeFormat matches the format of CURRENT_TIMESTAMP columns
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// EscalationPolicy is a named chain of numbers alerted one after another
+type EscalationPolicy struct {
+	Name    string
+	Numbers []string
+	Timeout time.Duration // wait per number for a reply or ack
+}
+
+// Escalations holds the configured policies and serializes state changes of
+// running escalations
+type Escalations struct {
+	Policies map[string]EscalationPolicy
+
+	mu sync.Mutex
+}
+
+// Escalation is an alert passed along a chain of numbers until someone responds
+type Escalation struct {
+	ID             int64            `json:"id"`
+	Policy         string           `json:"policy,omitempty"`
+	Content        string           `json:"content"`
+	Numbers        []string         `json:"numbers"`
+	TimeoutSeconds int              `json:"timeout_seconds"`
+	Status         string           `json:"status"`
+	CurrentStep    int              `json:"current_step"`
+	AckedBy        string           `json:"acked_by,omitempty"`
+	AckedAt        *time.Time       `json:"acked_at,omitempty"`
+	CreatedBy      string           `json:"created_by"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	Steps          []EscalationStep `json:"steps"`
+}
+
+// EscalationStep records the alert sent to one number of a chain
+type EscalationStep struct {
+	Step       int       `json:"step"`
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	SentSMSID  *int64    `json:"sent_sms_id,omitempty"`
+	ReplySMSID *int64    `json:"reply_sms_id,omitempty"` // inbound reply that acknowledged the escalation
+	Error      string    `json:"error,omitempty"`
+	SentAt     time.Time `json:"sent_at"`
+	Deadline   time.Time `json:"deadline"`
+}
+
+// EscalationRequest starts an escalation from a policy or an explicit chain
+type EscalationRequest struct {
+	Policy  string   `json:"policy"`
+	Numbers []string `json:"numbers"`
+	Timeout string   `json:"timeout"` // e.g. "10m", required with numbers
+	Content string   `json:"content" binding:"required"`
+}
+
+// LoadEscalations reads escalation policies from ESCALATION_POLICIES, e.g.
+// "critical=+38640111111,+38640222222:10m;db=+38640333333:5m"
+func LoadEscalations() (*Escalations, error) {
+	e := &Escalations{Policies: make(map[string]EscalationPolicy)}
+
+	for _, entry := range strings.Split(os.Getenv("ESCALATION_POLICIES"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, chain, found := strings.Cut(entry, "=")
+		numbersStr, timeoutStr, hasTimeout := strings.Cut(chain, ":")
+		name = strings.TrimSpace(name)
+		if !found || !hasTimeout || name == "" {
+			return nil, fmt.Errorf("ESCALATION_POLICIES: invalid policy %q (expected name=number,number:timeout)", entry)
+		}
+
+		timeout, err := time.ParseDuration(strings.TrimSpace(timeoutStr))
+		if err != nil || timeout < time.Minute {
+			return nil, fmt.Errorf("ESCALATION_POLICIES: invalid timeout in %q (minimum 1m)", entry)
+		}
+
+		numbers := splitList(numbersStr)
+		if len(numbers) == 0 {
+			return nil, fmt.Errorf("ESCALATION_POLICIES: policy %q has no numbers", name)
+		}
+
+		e.Policies[name] = EscalationPolicy{Name: name, Numbers: numbers, Timeout: timeout}
+	}
+
+	return e, nil
+}
+
+// CreateEscalation stores a new escalation and returns its ID
+func (d *Database) CreateEscalation(e *Escalation) (int64, error) {
+	var id int64
+	err := d.db.QueryRow(`
+		INSERT INTO escalations (policy, content, numbers, timeout_seconds, status, created_by)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, e.Policy, e.Content, strings.Join(e.Numbers, ","), e.TimeoutSeconds, EscalationActive, e.CreatedBy).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save escalation: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetEscalation retrieves an escalation with its steps, returning nil if it does not exist
+func (d *Database) GetEscalation(id int64) (*Escalation, error) {
+	e, err := scanEscalation(d.db.QueryRow(`SELECT `+escalationColumns+` FROM escalations WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escalation: %w", err)
+	}
+
+	if e.Steps, err = d.getEscalationSteps(id, e.TimeoutSeconds); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// ListEscalations retrieves escalations with their steps, newest first. An
+// empty status lists all escalations.
+func (d *Database) ListEscalations(status string, limit, offset int) ([]Escalation, error) {
+	rows, err := d.db.Query(`
+		SELECT `+escalationColumns+`
+		FROM escalations
+		WHERE ? = '' OR status = ?
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, status, status, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escalations: %w", err)
+	}
+
+	escalations := []Escalation{}
+	for rows.Next() {
+		e, err := scanEscalation(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		escalations = append(escalations, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for i := range escalations {
+		if escalations[i].Steps, err = d.getEscalationSteps(escalations[i].ID, escalations[i].TimeoutSeconds); err != nil {
+			return nil, err
+		}
+	}
+
+	return escalations, nil
+}
+
+// escalationColumns are the escalations columns read by scanEscalation
+const escalationColumns = `id, COALESCE(policy, ''), content, numbers, timeout_seconds, status, current_step,
+	COALESCE(acked_by, ''), COALESCE(acked_at, ''), created_by, created_at, updated_at`
+
+// scanEscalation reads an escalation selected with escalationColumns
+func scanEscalation(row interface{ Scan(...any) error }) (Escalation, error) {
+	var e Escalation
+	var numbers, ackedAtStr, createdAtStr, updatedAtStr string
+
+	err := row.Scan(&e.ID, &e.Policy, &e.Content, &numbers, &e.TimeoutSeconds, &e.Status, &e.CurrentStep,
+		&e.AckedBy, &ackedAtStr, &e.CreatedBy, &createdAtStr, &updatedAtStr)
+	if err != nil {
+		return e, err
+	}
+
+	e.Numbers = splitList(numbers)
+	e.CreatedAt = parseTimestamp(createdAtStr)
+	e.UpdatedAt = parseTimestamp(updatedAtStr)
+	if ackedAtStr != "" {
+		ackedAt := parseTimestamp(ackedAtStr)
+		e.AckedAt = &ackedAt
+	}
+
+	return e, nil
+}
+
+// getEscalationSteps retrieves the steps of an escalation in order
+func (d *Database) getEscalationSteps(id int64, timeoutSeconds int) ([]EscalationStep, error) {
+	rows, err := d.db.Query(`
+		SELECT step, number, status, sent_sms_id, reply_sms_id, COALESCE(error, ''), sent_at
+		FROM escalation_steps
+		WHERE escalation_id = ?
+		ORDER BY step
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escalation steps: %w", err)
+	}
+	defer rows.Close()
+
+	steps := []EscalationStep{}
+	for rows.Next() {
+		var step EscalationStep
+		var sentAtStr string
+
+		if err := rows.Scan(&step.Step, &step.Number, &step.Status, &step.SentSMSID, &step.ReplySMSID, &step.Error, &sentAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		step.SentAt = parseTimestamp(sentAtStr)
+		step.Deadline = step.SentAt.Add(time.Duration(timeoutSeconds) * time.Second)
+		steps = append(steps, step)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return steps, nil
+}
+
+// AddEscalationStep records the alert sent to a number of the chain
+func (d *Database) AddEscalationStep(id int64, step int, number, status string, sentSMSID int64, errMsg string) error {
+	var smsID any
+	if sentSMSID != 0 {
+		smsID = sentSMSID
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO escalation_steps (escalation_id, step, number, status, sent_sms_id, error, sent_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, step, number, status, smsID, errMsg, clock.Now().UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to save escalation step: %w", err)
+	}
+
+	_, err = d.db.Exec(`UPDATE escalations SET current_step = ?, updated_at = `+d.dialect().now()+` WHERE id = ?`, step, id)
+	if err != nil {
+		return fmt.Errorf("failed to update escalation: %w", err)
+	}
+
+	return nil
+}
+
+// SetEscalationStepStatus updates the status of a step, optionally recording the acknowledging reply
+func (d *Database) SetEscalationStepStatus(id int64, step int, status string, replySMSID int64) error {
+	var replyID any
+	if replySMSID != 0 {
+		replyID = replySMSID
+	}
+
+	_, err := d.db.Exec(`UPDATE escalation_steps SET status = ?, reply_sms_id = COALESCE(?, reply_sms_id) WHERE escalation_id = ? AND step = ?`,
+		status, replyID, id, step)
+	if err != nil {
+		return fmt.Errorf("failed to update escalation step: %w", err)
+	}
+
+	return nil
+}
+
+// SetEscalationStatus finishes an escalation. ackedBy is recorded for acknowledged escalations.
+func (d *Database) SetEscalationStatus(id int64, status, ackedBy string) error {
+	var ackedAt any
+	if status == EscalationAcknowledged {
+		ackedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	_, err := d.db.Exec(`
+		UPDATE escalations SET status = ?, acked_by = ?, acked_at = ?, updated_at = `+d.dialect().now()+`
+		WHERE id = ?
+	`, status, ackedBy, ackedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update escalation: %w", err)
+	}
+
+	return nil
+}
+
+// ListActiveEscalationIDs returns the IDs of escalations still waiting for a response
+func (d *Database) ListActiveEscalationIDs() ([]int64, error) {
+	rows, err := d.db.Query(`SELECT id FROM escalations WHERE status = ? ORDER BY id`, EscalationActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escalations: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// FindReplySince returns the first SMS received from a number at or after since
+func (d *Database) FindReplySince(number string, since time.Time) (int64, bool, error) {
+	var id int64
+	err := d.db.QueryRow(`
+		SELECT id FROM received_sms
+		WHERE conversation_id = ? AND created_at >= ?
+		ORDER BY id LIMIT 1
+	`, ConversationID(number), since.UTC().Format(sqliteTimeFormat)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to query replies: %w", err)
+	}
+
+	return id, true, nil
+}
+
+// sendEscalationStep alerts the number of a step. On-call targets are resolved
+// when the step is sent. Escalation alerts bypass deduplication and alert storm
+// digests. Must be called with the escalations lock held.
+func (app *App) sendEscalationStep(e *Escalation, step int) error {
+	number := app.resolveTarget(e.Numbers[step])
+	id, err := app.deliverSMSNow(context.Background(), e.CreatedBy, number, e.Content, SendOptions{})
+
+	status, errMsg := StepSent, ""
+	if err != nil {
+		status, errMsg = StepFailed, err.Error()
+		log.Printf("Escalation %d: failed to alert %s: %v", e.ID, number, err)
+	} else {
+		log.Printf("Escalation %d: alerted %s (step %d of %d)", e.ID, number, step+1, len(e.Numbers))
+	}
+
+	return app.db.AddEscalationStep(e.ID, step, number, status, id, errMsg)
+}
+
+// advanceEscalation checks the current step of an active escalation for a
+// reply and moves on to the next number once it has failed or timed out.
+// Must be called with the escalations lock held.
+func (app *App) advanceEscalation(id int64) error {
+	for {
+		e, err := app.db.GetEscalation(id)
+		if err != nil || e == nil || e.Status != EscalationActive {
+			return err
+		}
+
+		next := 0
+		if len(e.Steps) > 0 {
+			step := e.Steps[len(e.Steps)-1]
+
+			// A reply from anyone alerted so far acknowledges the escalation
+			for _, earlier := range e.Steps {
+				if earlier.Status == StepFailed {
+					continue
+				}
+				replyID, found, err := app.db.FindReplySince(earlier.Number, earlier.SentAt)
+				if err != nil {
+					return err
+				}
+				if found {
+					log.Printf("Escalation %d acknowledged by reply from %s", id, earlier.Number)
+					if err := app.db.SetEscalationStepStatus(id, earlier.Step, StepAcknowledged, replyID); err != nil {
+						return err
+					}
+					return app.db.SetEscalationStatus(id, EscalationAcknowledged, earlier.Number)
+				}
+			}
+
+			if step.Status == StepSent && clock.Now().Before(step.Deadline) {
+				return nil
+			}
+			if step.Status == StepSent {
+				if err := app.db.SetEscalationStepStatus(id, step.Step, StepTimedOut, 0); err != nil {
+					return err
+				}
+			}
+			next = step.Step + 1
+		}
+
+		if next >= len(e.Numbers) {
+			log.Printf("Escalation %d exhausted without a response", id)
+			return app.db.SetEscalationStatus(id, EscalationExhausted, "")
+		}
+
+		if err := app.sendEscalationStep(e, next); err != nil {
+			return err
+		}
+	}
+}
+
+// runEscalationJob periodically checks active escalations for replies and timeouts
+func (app *App) runEscalationJob() {
+	ticker := clock.NewTicker(escalationCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		ids, err := app.db.ListActiveEscalationIDs()
+		if err != nil {
+			log.Printf("Escalations: %v", err)
+			continue
+		}
+
+		for _, id := range ids {
+			app.escalations.mu.Lock()
+			if err := app.advanceEscalation(id); err != nil {
+				log.Printf("Escalation %d: %v", id, err)
+			}
+			app.escalations.mu.Unlock()
+		}
+	}
+}
+
+// escalationFromParam loads the escalation named by the id path parameter,
+// writing an error response and returning nil if it cannot
+func (app *App) escalationFromParam(c *gin.Context) *Escalation {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid escalation ID"))
+		return nil
+	}
+
+	e, err := app.db.GetEscalation(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get escalation: %v", err))
+		return nil
+	}
+	if e == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Escalation %d not found", id))
+		return nil
+	}
+
+	return e
+}
+
+// createEscalation starts an escalation and alerts the first number of its chain
+func (app *App) createEscalation(c *gin.Context) {
+	var req EscalationRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	e := &Escalation{Content: req.Content, CreatedBy: keyIDFromContext(c)}
+	switch {
+	case req.Policy != "" && len(req.Numbers) > 0:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Specify either policy or numbers, not both"))
+		return
+
+	case req.Policy != "":
+		policy, ok := app.escalations.Policies[req.Policy]
+		if !ok {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Unknown escalation policy %q", req.Policy))
+			return
+		}
+		e.Policy, e.Numbers, e.TimeoutSeconds = policy.Name, policy.Numbers, int(policy.Timeout.Seconds())
+
+	case len(req.Numbers) > 0:
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil || timeout < time.Minute {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid timeout %q (minimum 1m)", req.Timeout))
+			return
+		}
+		e.Numbers, e.TimeoutSeconds = req.Numbers, int(timeout.Seconds())
+
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Specify a policy or numbers"))
+		return
+	}
+
+	for _, number := range e.Numbers {
+		if err := app.validateSMS(app.resolveTarget(number), e.Content, SendOptions{}); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
+			return
+		}
+	}
+
+	id, err := app.db.CreateEscalation(e)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to create escalation: %v", err))
+		return
+	}
+
+	app.escalations.mu.Lock()
+	err = app.advanceEscalation(id)
+	app.escalations.mu.Unlock()
+	if err != nil {
+		log.Printf("Escalation %d: %v", id, err)
+	}
+
+	e, err = app.db.GetEscalation(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get escalation: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status":     "success",
+		"escalation": e,
+	})
+}
+
+// listEscalations returns escalations filtered by status (default: all)
+func (app *App) listEscalations(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", EscalationActive, EscalationAcknowledged, EscalationExhausted, EscalationCancelled:
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid status %q", status))
+		return
+	}
+
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	escalations, err := app.db.ListEscalations(status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list escalations: %v", err))
+		return
+	}
+
+	names := make([]string, 0, len(app.escalations.Policies))
+	for name := range app.escalations.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	policies := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		policy := app.escalations.Policies[name]
+		policies = append(policies, gin.H{
+			"name":            policy.Name,
+			"numbers":         policy.Numbers,
+			"timeout_seconds": int(policy.Timeout.Seconds()),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"policies":    policies,
+		"escalations": escalations,
+	})
+}
+
+// getEscalation returns an escalation with its steps
+func (app *App) getEscalation(c *gin.Context) {
+	e := app.escalationFromParam(c)
+	if e == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"escalation": e,
+	})
+}
+
+// finishEscalation acknowledges or cancels an active escalation
+func (app *App) finishEscalation(c *gin.Context, status string) {
+	var req AckRequest
+	if c.Request.ContentLength != 0 && !bindStrictJSON(c, &req) {
+		return
+	}
+	if req.By == "" {
+		req.By = keyIDFromContext(c)
+	}
+
+	app.escalations.mu.Lock()
+	defer app.escalations.mu.Unlock()
+
+	e := app.escalationFromParam(c)
+	if e == nil {
+		return
+	}
+	if e.Status != EscalationActive {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Escalation %d is %s", e.ID, e.Status))
+		return
+	}
+
+	stepStatus, ackedBy := StepAcknowledged, req.By
+	if status == EscalationCancelled {
+		stepStatus, ackedBy = StepCancelled, ""
+	}
+
+	err := app.db.SetEscalationStatus(e.ID, status, ackedBy)
+	if err == nil && len(e.Steps) > 0 && e.Steps[len(e.Steps)-1].Status == StepSent {
+		err = app.db.SetEscalationStepStatus(e.ID, e.Steps[len(e.Steps)-1].Step, stepStatus, 0)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to update escalation: %v", err))
+		return
+	}
+	log.Printf("Escalation %d %s by %s", e.ID, status, req.By)
+
+	e, err = app.db.GetEscalation(e.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get escalation: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"escalation": e,
+	})
+}
+
+// acknowledgeEscalation acknowledges an escalation, stopping its chain
+func (app *App) acknowledgeEscalation(c *gin.Context) {
+	app.finishEscalation(c, EscalationAcknowledged)
+}
+
+// cancelEscalation cancels an escalation, stopping its chain
+func (app *App) cancelEscalation(c *gin.Context) {
+	app.finishEscalation(c, EscalationCancelled)
+}
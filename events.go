@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus, with the type of their data
+const (
+	EventMessageReceived    = "message.received"             // ReceivedSMS, once stored
+	EventMessageSent        = "message.sent"                 // SentEvent, once recorded
+	EventMessageFailed      = "message.failed"               // SentEvent of a failed send, once recorded
+	EventMessageEscalated   = "message.escalated"            // ReceivedSMS still unacknowledged
+	EventMessageAcked       = "message.acked"                // AckEvent
+	EventDeviceConnected    = "device.connected"             // DeviceConnectionEvent
+	EventDeviceDisconnected = "device.disconnected"          // DeviceConnectionEvent
+	EventDeviceCorruption   = "device.corruption"            // CorruptionEvent
+	EventServiceLost        = "device.service_lost"          // *ServiceLoss
+	EventServiceRestored    = "device.service_restored"      // *ServiceLoss
+	EventGSMState           = "gsm.state"                    // GSMStateEvent
+	EventKeepAliveFailed    = "keepalive.failed"             // *KeepAliveCheck
+	EventLoopbackFailed     = "loopback.failed"              // *LoopbackCheck
+	EventClockDrift         = "clock.drift"                  // *ClockCheck
+	EventFilteringSuspected = "delivery.filtering_suspected" // *FilteringWarning
+	EventStorageLow         = "storage.low"                  // *StorageStatus
+)
+
+// Event is something that happened in the server, e.g. a received SMS
+type Event struct {
+	Type string
+	Time time.Time
+	Data interface{}
+}
+
+// EventSink handles events it is subscribed to
+type EventSink func(event Event)
+
+// SentEvent is the data of message.sent and message.failed events
+type SentEvent struct {
+	ID         int64      `json:"id"`
+	Number     string     `json:"number"`
+	Content    string     `json:"content"`
+	Status     string     `json:"status"` // success, simulated or error
+	Error      string     `json:"error,omitempty"`
+	ErrorClass ErrorClass `json:"error_class,omitempty"`
+	KeyID      string     `json:"-"` // API key the send is attributed to
+}
+
+// AckEvent is the data of a message.acked event
+type AckEvent struct {
+	ID      int        `json:"id"`
+	AckedBy string     `json:"acked_by"`
+	AckedAt *time.Time `json:"acked_at"`
+}
+
+// DeviceConnectionEvent is the data of device.connected and device.disconnected events
+type DeviceConnectionEvent struct {
+	Port        string `json:"port"`
+	Reconnected bool   `json:"reconnected,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// GSMStateEvent is the data of a gsm.state event
+type GSMStateEvent struct {
+	Port  string `json:"port"`
+	State string `json:"state"`
+	Ready bool   `json:"ready"`
+}
+
+// EventScope limits a subscription to the events of one API key: its own
+// sends and the SMS received on its routing targets, see tenants.go
+type EventScope struct {
+	KeyID   string
+	Devices map[string]bool // devices whose received SMS are in scope
+
+	device func(ownNumber string) string // device that received an SMS
+}
+
+// Allows reports whether an event is in scope. Events that are not about a
+// message, e.g. device events, are in no scope. A nil scope allows every event.
+func (s *EventScope) Allows(event Event) bool {
+	if s == nil {
+		return true
+	}
+	switch data := event.Data.(type) {
+	case SentEvent:
+		return data.KeyID == s.KeyID
+	case ReceivedSMS:
+		return s.Devices[s.device(data.DeviceNumber)]
+	}
+	return false
+}
+
+// eventSubscription is a sink and the event types it receives
+type eventSubscription struct {
+	id    int
+	sink  EventSink
+	types map[string]bool // nil for every type
+	scope *EventScope     // nil for every event
+}
+
+// EventBus passes events from the device, the API and the background jobs to
+// the subscribed sinks: WebSocket clients, webhooks, email, alerting, hooks and the log
+type EventBus struct {
+	mu            sync.RWMutex
+	subscriptions []eventSubscription
+	nextID        int
+}
+
+// NewEventBus creates a bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe passes events of the given types, or every event if none are
+// given, to sink
+func (b *EventBus) Subscribe(sink EventSink, types ...string) {
+	b.SubscribeScoped(nil, sink, types...)
+}
+
+// SubscribeScoped passes the events in scope of the given types, or of every
+// type if none are given, to sink. It returns a function ending the subscription.
+func (b *EventBus) SubscribeScoped(scope *EventScope, sink EventSink, types ...string) (unsubscribe func()) {
+	subscription := eventSubscription{sink: sink, scope: scope}
+	if len(types) > 0 {
+		subscription.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			subscription.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	subscription.id = b.nextID
+	b.subscriptions = append(b.subscriptions, subscription)
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// Publish may still iterate the old slice, so it is copied, not modified
+		b.subscriptions = slices.DeleteFunc(slices.Clone(b.subscriptions), func(s eventSubscription) bool {
+			return s.id == subscription.id
+		})
+	}
+}
+
+// Publish passes an event to the subscribed sinks, in the order they
+// subscribed and in the caller's goroutine, so sinks doing slow I/O must not
+// block. It does nothing on a nil bus.
+func (b *EventBus) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+
+	b.mu.RLock()
+	subscriptions := b.subscriptions
+	b.mu.RUnlock()
+
+	for _, subscription := range subscriptions {
+		if (subscription.types == nil || subscription.types[eventType]) && subscription.scope.Allows(event) {
+			subscription.sink(event)
+		}
+	}
+}
+
+// logEvent logs device connection and GSM state changes
+func logEvent(event Event) {
+	switch data := event.Data.(type) {
+	case DeviceConnectionEvent:
+		switch {
+		case event.Type == EventDeviceDisconnected:
+			log.Printf("Lost connection to Arduino on %s: %s", data.Port, data.Error)
+		case data.Reconnected:
+			log.Printf("Reconnected to Arduino on %s", data.Port)
+		default:
+			log.Printf("Connected to Arduino on %s", data.Port)
+		}
+	case GSMStateEvent:
+		log.Printf("GSM state changed: %s", data.State)
+	}
+}
+
+// alertSink notifies the fallback channels of events that need attention
+// while SMS itself may be what is broken
+func alertSink(fallbacks []FallbackChannel) EventSink {
+	return func(event Event) {
+		var title, message string
+		switch data := event.Data.(type) {
+		case *ServiceLoss:
+			if event.Type != EventServiceLost {
+				return
+			}
+			title = "Network service lost"
+			if data.SuspectedJamming {
+				title = "Possible jamming: signal and network service lost"
+			}
+			message = fmt.Sprintf("Modem registration changed to %s at %s", data.Registration, data.StartedAt.Format(time.RFC3339))
+		case *KeepAliveCheck:
+			title = "SIM keep-alive failed"
+			message = fmt.Sprintf("%s check %s failed: %s", data.Method, data.Target, data.Response)
+		case *LoopbackCheck:
+			title = "SMS loopback check failed"
+			message = fmt.Sprintf("SMS to %s did not come back: %s", data.Number, data.Error)
+		case *StorageStatus:
+			title = "Storage running low"
+			message = strings.Join(data.Problems, "; ")
+		case *FilteringWarning:
+			title = fmt.Sprintf("Possible carrier filtering of messages to %s", data.Prefix)
+			message = data.Summary()
+		case ReceivedSMS:
+			if event.Type != EventMessageEscalated {
+				return
+			}
+			title = fmt.Sprintf("Unacknowledged SMS from %s", data.Number)
+			message = data.Content
+		default:
+			return
+		}
+
+		for _, channel := range fallbacks {
+			if err := channel.Notify(title, message); err != nil {
+				log.Printf("Alert: failed to notify via %s: %v", channel.Name(), err)
+			}
+		}
+	}
+}
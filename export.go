@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Message types of the SMS Backup & Restore format, as in Android's
+// Telephony.TextBasedSmsColumns
+const (
+	smsBackupInbox  = 1
+	smsBackupSent   = 2
+	smsBackupFailed = 5
+)
+
+// ExportMessage is a received or sent SMS in an export
+type ExportMessage struct {
+	Sent    bool
+	Number  string
+	Content string
+	Status  string // send status, empty for received SMS
+	Time    time.Time
+}
+
+// EachExportMessage calls fn for each received and sent SMS in [from, to),
+// oldest first. Sends that were not handed to the modem (simulated,
+// aggregated, cancelled or still sending) are left out.
+func (d *Database) EachExportMessage(from, to *time.Time, fn func(ExportMessage) error) error {
+	receivedWhere, receivedArgs := ReceivedSMSFilter{From: from, To: to}.where(d.dialect())
+	sentConditions, sentArgs := SentSMSFilter{From: from, To: to}.conditions()
+	sentWhere, sentArgs := whereClause(append(sentConditions, "status IN ('success', 'error', 'unknown')"), sentArgs)
+
+	rows, err := d.db.Query(`
+		SELECT 0, number, content, '', `+d.dialect().utcTime("timestamp")+` AS at, id FROM received_sms `+receivedWhere+`
+		UNION ALL
+		SELECT 1, number, content, status, created_at AS at, id FROM sent_sms `+sentWhere+`
+		ORDER BY at, id
+	`, append(receivedArgs, sentArgs...)...)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg ExportMessage
+		var atStr string
+		var id int
+		if err := rows.Scan(&msg.Sent, &msg.Number, &msg.Content, &msg.Status, &atStr, &id); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		msg.Time = parseTimestamp(atStr)
+
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return nil
+}
+
+// CountExportMessages returns the number of messages EachExportMessage visits
+func (d *Database) CountExportMessages(from, to *time.Time) (int, error) {
+	received, err := d.CountFilteredReceivedSMS(ReceivedSMSFilter{From: from, To: to})
+	if err != nil {
+		return 0, err
+	}
+
+	conditions, args := SentSMSFilter{From: from, To: to}.conditions()
+	where, args := whereClause(append(conditions, "status IN ('success', 'error', 'unknown')"), args)
+	var sent int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM sent_sms "+where, args...).Scan(&sent); err != nil {
+		return 0, err
+	}
+
+	return received + sent, nil
+}
+
+// writeSMSBackup writes one message as an <sms> element of the SMS Backup &
+// Restore format. Sends whose outcome is unknown are restored as failed.
+func writeSMSBackup(w io.Writer, msg ExportMessage) error {
+	msgType := smsBackupInbox
+	if msg.Sent {
+		msgType = smsBackupSent
+		if msg.Status != "success" {
+			msgType = smsBackupFailed
+		}
+	}
+	millis := strconv.FormatInt(msg.Time.UnixMilli(), 10)
+
+	attrs := [][2]string{
+		{"protocol", "0"},
+		{"address", msg.Number},
+		{"date", millis},
+		{"type", strconv.Itoa(msgType)},
+		{"subject", "null"},
+		{"body", msg.Content},
+		{"toa", "null"},
+		{"sc_toa", "null"},
+		{"service_center", "null"},
+		{"read", "1"},
+		{"status", "-1"},
+		{"locked", "0"},
+		{"date_sent", millis},
+		{"readable_date", msg.Time.Local().Format("Jan 2, 2006 3:04:05 PM")},
+		{"contact_name", "(Unknown)"},
+	}
+
+	if _, err := io.WriteString(w, "  <sms"); err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		if _, err := fmt.Fprintf(w, ` %s="`, attr[0]); err != nil {
+			return err
+		}
+		if err := xml.EscapeText(w, []byte(attr[1])); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `"`); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, " />\n")
+	return err
+}
+
+// exportMessages streams the message history as a file. The only format is
+// xml, the SMS Backup & Restore format, which Android phones can restore.
+func (app *App) exportMessages(c *gin.Context) {
+	format := c.Query("format")
+	if format != "xml" {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Unsupported export format %q (expected xml)", format))
+		return
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	count, err := app.db.CountExportMessages(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	now := time.Now()
+	c.Header("Content-Type", "application/xml; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=sms-%s.xml", now.Format("20060102150405")))
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	fmt.Fprintf(w, "<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>\n")
+	fmt.Fprintf(w, "<smses count=\"%d\" backup_date=\"%d\" type=\"full\">\n", count, now.UnixMilli())
+
+	written := 0
+	err = app.db.EachExportMessage(from, to, func(msg ExportMessage) error {
+		written++
+		return writeSMSBackup(w, msg)
+	})
+	if err != nil {
+		// Leave the document unterminated so the restore fails instead of
+		// silently restoring part of the history
+		log.Printf("Export aborted after %d messages: %v", written, err)
+		return
+	}
+
+	fmt.Fprintf(w, "</smses>\n")
+}
+
+// exportFormats are the formats of GET /export/received and GET /export/sent,
+// with their content types
+var exportFormats = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// exportTime formats an optional time for a CSV cell
+func exportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// receivedCSVHeader names the columns of receivedCSVRow
+var receivedCSVHeader = []string{"id", "number", "content", "timestamp", "created_at", "conversation_id", "device_number",
+	"country", "operator", "number_class", "encoding", "read", "acked_at", "acked_by"}
+
+// receivedCSVRow returns the CSV cells of a received SMS
+func receivedCSVRow(msg ReceivedSMS) []string {
+	return []string{strconv.Itoa(msg.ID), msg.Number, msg.Content, exportTime(&msg.Timestamp), exportTime(&msg.CreatedAt),
+		msg.ConversationID, msg.DeviceNumber, msg.Country, msg.Operator, msg.NumberClass, msg.Encoding,
+		strconv.FormatBool(msg.Read), exportTime(msg.AckedAt), msg.AckedBy}
+}
+
+// sentCSVHeader names the columns of sentCSVRow
+var sentCSVHeader = []string{"id", "number", "content", "status", "error", "error_class", "created_at", "conversation_id",
+	"number_class", "encoding", "segments", "template", "template_version", "campaign", "retry_of"}
+
+// sentCSVRow returns the CSV cells of a sent SMS
+func sentCSVRow(msg SentSMS) []string {
+	templateVersion, retryOf := "", ""
+	if msg.TemplateVersion != 0 {
+		templateVersion = strconv.Itoa(msg.TemplateVersion)
+	}
+	if msg.RetryOf != nil {
+		retryOf = strconv.FormatInt(*msg.RetryOf, 10)
+	}
+	return []string{strconv.Itoa(msg.ID), msg.Number, msg.Content, msg.Status, msg.Error, string(msg.ErrorClass),
+		exportTime(&msg.CreatedAt), msg.ConversationID, msg.NumberClass, msg.Encoding, strconv.Itoa(msg.Segments),
+		msg.Template, templateVersion, msg.Campaign, retryOf}
+}
+
+// exportWriter writes the messages of an export as CSV rows or NDJSON lines
+type exportWriter struct {
+	c       *gin.Context
+	csv     *csv.Writer // nil for NDJSON
+	written int
+}
+
+// beginExport validates the format and writes the response headers and, for
+// CSV, the header row. It writes an error response and returns nil if the
+// format is not supported.
+func beginExport(c *gin.Context, name string, header []string) *exportWriter {
+	format := c.Query("format")
+	contentType, ok := exportFormats[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Unsupported export format %q (expected csv or ndjson)", format))
+		return nil
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.%s", name, time.Now().Format("20060102150405"), format))
+	c.Status(http.StatusOK)
+
+	w := &exportWriter{c: c}
+	if format == "csv" {
+		w.csv = csv.NewWriter(c.Writer)
+		w.csv.Write(header)
+	}
+	return w
+}
+
+// Write writes one message, as the CSV row or as JSON
+func (w *exportWriter) Write(row []string, msg any) error {
+	w.written++
+	if w.csv != nil {
+		if err := w.csv.Write(row); err != nil {
+			return err
+		}
+		// Flush regularly so that the response streams
+		if w.written%100 == 0 {
+			w.csv.Flush()
+		}
+		return w.csv.Error()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	_, err = w.c.Writer.Write(append(data, '\n'))
+	return err
+}
+
+// Finish flushes the export, or logs why it ended early
+func (w *exportWriter) Finish(err error) {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	if err != nil {
+		log.Printf("Export aborted after %d messages: %v", w.written, err)
+	}
+}
+
+// exportReceivedSMS streams the received SMS in the from/to range, oldest
+// first, row by row
+func (app *App) exportReceivedSMS(c *gin.Context) {
+	var filter ReceivedSMSFilter
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	filter.Order = ListOrder{Column: "id", Asc: true}
+
+	w := beginExport(c, "received", receivedCSVHeader)
+	if w == nil {
+		return
+	}
+	w.Finish(app.db.EachReceivedSMS(filter, -1, 0, func(msg ReceivedSMS) error {
+		return w.Write(receivedCSVRow(msg), msg)
+	}))
+}
+
+// exportSentSMS streams the sent SMS in the from/to range, oldest first, row by row
+func (app *App) exportSentSMS(c *gin.Context) {
+	var filter SentSMSFilter
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	filter.Order = ListOrder{Column: "id", Asc: true}
+
+	w := beginExport(c, "sent", sentCSVHeader)
+	if w == nil {
+		return
+	}
+	w.Finish(app.db.EachSentSMS(filter, -1, 0, func(msg SentSMS) error {
+		return w.Write(sentCSVRow(msg), msg)
+	}))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// fallbackClient is used for all fallback notification requests
+var fallbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// FallbackChannel delivers the content of a failed SMS through another service
+type FallbackChannel interface {
+	Name() string
+	Notify(title, message string) error
+}
+
+// PushoverChannel sends notifications through the Pushover API
+type PushoverChannel struct {
+	Token string
+	User  string
+}
+
+// Name returns the channel name recorded in the message history
+func (p *PushoverChannel) Name() string {
+	return "pushover"
+}
+
+// Notify sends a Pushover message
+func (p *PushoverChannel) Notify(title, message string) error {
+	resp, err := fallbackClient.PostForm("https://api.pushover.net/1/messages.json", url.Values{
+		"token":   {p.Token},
+		"user":    {p.User},
+		"title":   {title},
+		"message": {message},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reach Pushover: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Pushover returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// GotifyChannel sends notifications to a Gotify server
+type GotifyChannel struct {
+	URL   string
+	Token string
+}
+
+// Name returns the channel name recorded in the message history
+func (g *GotifyChannel) Name() string {
+	return "gotify"
+}
+
+// Notify sends a Gotify message
+func (g *GotifyChannel) Notify(title, message string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    title,
+		"message":  message,
+		"priority": 8,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode Gotify message: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(g.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Gotify request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.Token)
+
+	resp, err := fallbackClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Gotify: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Gotify returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// LoadFallbackChannels returns the fallback channels configured by environment variables
+func LoadFallbackChannels() ([]FallbackChannel, error) {
+	var channels []FallbackChannel
+
+	pushoverToken, err := GetSecret("PUSHOVER_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if pushoverToken != "" {
+		user := os.Getenv("PUSHOVER_USER")
+		if user == "" {
+			return nil, fmt.Errorf("PUSHOVER_TOKEN requires PUSHOVER_USER to be set")
+		}
+		channels = append(channels, &PushoverChannel{Token: pushoverToken, User: user})
+	}
+
+	if gotifyURL := os.Getenv("GOTIFY_URL"); gotifyURL != "" {
+		token, err := GetSecret("GOTIFY_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			return nil, fmt.Errorf("GOTIFY_URL requires GOTIFY_TOKEN to be set")
+		}
+		channels = append(channels, &GotifyChannel{URL: gotifyURL, Token: token})
+	}
+
+	return channels, nil
+}
+
+// sendFallback delivers the content of a failed SMS through the fallback
+// channels, stopping at the first that succeeds, and records the outcome
+func (app *App) sendFallback(id int64, number, content string) {
+	title := fmt.Sprintf("SMS to %s failed", number)
+
+	var outcomes []string
+	for _, channel := range app.fallbacks {
+		err := channel.Notify(title, content)
+		if err == nil {
+			outcomes = append(outcomes, channel.Name()+": sent")
+			log.Printf("Delivered failed SMS %d via %s", id, channel.Name())
+			break
+		}
+		outcomes = append(outcomes, fmt.Sprintf("%s: failed: %v", channel.Name(), err))
+		log.Printf("Fallback %s for SMS %d failed: %v", channel.Name(), id, err)
+	}
+
+	if err := app.db.SetSentSMSFallback(id, strings.Join(outcomes, "; ")); err != nil {
+		log.Printf("Failed to record fallback: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// filterWatchInterval is how often recent sends are checked for filtering
+const filterWatchInterval = time.Hour
+
+// FilterWatchSettings configures detection of silent carrier filtering. The
+// sketch reports no delivery receipts, so a send counts as delivered when the
+// recipient replied to it. A destination prefix is suspected of filtering
+// when its reply rate collapses while the other prefixes keep replying.
+type FilterWatchSettings struct {
+	Window      time.Duration // how far back sends are checked
+	ReplyWindow time.Duration // how long after a send a reply counts for it
+	MinSends    int           // sends to a prefix, and to the others, before it is judged
+	Ratio       float64       // reply rate, relative to the other prefixes, below which a prefix is flagged
+
+	mu        sync.Mutex
+	warnings  []FilteringWarning
+	checkedAt time.Time
+}
+
+// FilteringWarning is a destination prefix that is suspected of filtering
+// messages accepted by the modem
+type FilteringWarning struct {
+	Prefix       string    `json:"prefix"` // calling code and operator prefix, e.g. "+386 40"
+	Country      string    `json:"country,omitempty"`
+	Operator     string    `json:"operator,omitempty"`
+	Sends        int       `json:"sends"`               // sends accepted by the modem
+	Replied      int       `json:"replied"`             // sends the recipient replied to
+	ReplyRate    float64   `json:"reply_rate"`          // replied / sends
+	BaselineRate float64   `json:"baseline_rate"`       // reply rate of the other prefixes
+	Templates    []string  `json:"templates,omitempty"` // templates of the unanswered sends, most used first
+	Since        time.Time `json:"since"`               // check that first flagged the prefix
+}
+
+// filterWatchSend is an accepted send checked for a reply
+type filterWatchSend struct {
+	ConversationID string
+	Prefix         string
+	Country        string
+	Operator       string
+	Template       string
+	At             time.Time
+}
+
+// LoadFilterWatchSettings reads carrier filtering detection settings from
+// environment variables. It returns nil unless FILTER_WATCH is true.
+func LoadFilterWatchSettings() (*FilterWatchSettings, error) {
+	if os.Getenv("FILTER_WATCH") != "true" {
+		return nil, nil
+	}
+
+	settings := &FilterWatchSettings{
+		Window:      7 * 24 * time.Hour,
+		ReplyWindow: 24 * time.Hour,
+		MinSends:    20,
+		Ratio:       0.25,
+	}
+
+	if value := os.Getenv("FILTER_WATCH_WINDOW"); value != "" {
+		window, err := parseInterval(value)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("FILTER_WATCH_WINDOW: invalid window %q", value)
+		}
+		settings.Window = window
+	}
+
+	if value := os.Getenv("FILTER_WATCH_REPLY_WINDOW"); value != "" {
+		window, err := parseInterval(value)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("FILTER_WATCH_REPLY_WINDOW: invalid window %q", value)
+		}
+		settings.ReplyWindow = window
+	}
+	if settings.ReplyWindow >= settings.Window {
+		return nil, fmt.Errorf("FILTER_WATCH_REPLY_WINDOW must be shorter than FILTER_WATCH_WINDOW")
+	}
+
+	if value := os.Getenv("FILTER_WATCH_MIN_SENDS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("FILTER_WATCH_MIN_SENDS: invalid count %q", value)
+		}
+		settings.MinSends = n
+	}
+
+	if value := os.Getenv("FILTER_WATCH_RATIO"); value != "" {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio <= 0 || ratio >= 1 {
+			return nil, fmt.Errorf("FILTER_WATCH_RATIO: invalid ratio %q (between 0 and 1)", value)
+		}
+		settings.Ratio = ratio
+	}
+
+	return settings, nil
+}
+
+// String describes the settings for the startup log
+func (s *FilterWatchSettings) String() string {
+	return fmt.Sprintf("replies within %s to sends of the last %s, at least %d sends per prefix, flagged below %.0f%% of the other prefixes",
+		s.ReplyWindow, s.Window, s.MinSends, s.Ratio*100)
+}
+
+// destinationPrefix returns the calling code and operator prefix of a
+// number, e.g. "+386 40", or the first two national digits if the operator
+// is unknown, with the country and operator. The prefix is empty for numbers
+// that can't be normalized.
+func destinationPrefix(number string) (prefix, country, operator string) {
+	e164, err := NormalizeNumber(number)
+	if err != nil {
+		return "", "", ""
+	}
+
+	code, national := SplitCallingCode(e164)
+	match := matchOperatorPrefix(code, national)
+	if match.prefix == "" {
+		match.prefix = national[:min(2, len(national))]
+	}
+	return "+" + code + " " + match.prefix, callingCodes[code], match.operator
+}
+
+// FilterWatchSends returns the sends accepted by the modem between from and
+// to, and the times of the replies received since from per conversation
+func (d *Database) FilterWatchSends(from, to time.Time) ([]filterWatchSend, map[string][]time.Time, error) {
+	rows, err := d.db.Query(`
+		SELECT number, COALESCE(conversation_id, ''), COALESCE(template, ''), created_at
+		FROM sent_sms
+		WHERE status = 'success' AND created_at >= ? AND created_at < ?
+	`, from.UTC().Format(sqliteTimeFormat), to.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query sent_sms: %w", err)
+	}
+	defer rows.Close()
+
+	var sends []filterWatchSend
+	for rows.Next() {
+		var number, createdAtStr string
+		var send filterWatchSend
+		if err := rows.Scan(&number, &send.ConversationID, &send.Template, &createdAtStr); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		send.Prefix, send.Country, send.Operator = destinationPrefix(number)
+		if send.Prefix == "" {
+			continue
+		}
+		send.At = parseTimestamp(createdAtStr)
+		sends = append(sends, send)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	rows.Close()
+
+	rows, err = d.db.Query(`
+		SELECT conversation_id, created_at
+		FROM received_sms
+		WHERE conversation_id IS NOT NULL AND created_at >= ?
+	`, from.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query received_sms: %w", err)
+	}
+	defer rows.Close()
+
+	replies := make(map[string][]time.Time)
+	for rows.Next() {
+		var conversationID, createdAtStr string
+		if err := rows.Scan(&conversationID, &createdAtStr); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		replies[conversationID] = append(replies[conversationID], parseTimestamp(createdAtStr))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return sends, replies, nil
+}
+
+// evaluate returns the prefixes whose reply rate is below Ratio times the
+// reply rate of all other prefixes, lowest reply rate first
+func (s *FilterWatchSettings) evaluate(sends []filterWatchSend, replies map[string][]time.Time) []FilteringWarning {
+	type prefixStats struct {
+		country, operator string
+		sends, replied    int
+		unanswered        map[string]int // per template
+	}
+	stats := make(map[string]*prefixStats)
+	totalSends, totalReplied := 0, 0
+
+	for _, send := range sends {
+		ps := stats[send.Prefix]
+		if ps == nil {
+			ps = &prefixStats{country: send.Country, operator: send.Operator, unanswered: make(map[string]int)}
+			stats[send.Prefix] = ps
+		}
+		ps.sends++
+		totalSends++
+
+		replied := false
+		for _, at := range replies[send.ConversationID] {
+			if !at.Before(send.At) && at.Sub(send.At) <= s.ReplyWindow {
+				replied = true
+				break
+			}
+		}
+		if replied {
+			ps.replied++
+			totalReplied++
+		} else if send.Template != "" {
+			ps.unanswered[send.Template]++
+		}
+	}
+
+	var warnings []FilteringWarning
+	for prefix, ps := range stats {
+		otherSends, otherReplied := totalSends-ps.sends, totalReplied-ps.replied
+		if ps.sends < s.MinSends || otherSends < s.MinSends || otherReplied == 0 {
+			continue
+		}
+
+		rate := float64(ps.replied) / float64(ps.sends)
+		baseline := float64(otherReplied) / float64(otherSends)
+		if rate >= baseline*s.Ratio {
+			continue
+		}
+
+		warning := FilteringWarning{
+			Prefix:       prefix,
+			Country:      ps.country,
+			Operator:     ps.operator,
+			Sends:        ps.sends,
+			Replied:      ps.replied,
+			ReplyRate:    rate,
+			BaselineRate: baseline,
+		}
+		for template := range ps.unanswered {
+			warning.Templates = append(warning.Templates, template)
+		}
+		sort.Slice(warning.Templates, func(i, j int) bool {
+			a, b := warning.Templates[i], warning.Templates[j]
+			if ps.unanswered[a] != ps.unanswered[b] {
+				return ps.unanswered[a] > ps.unanswered[b]
+			}
+			return a < b
+		})
+		warnings = append(warnings, warning)
+	}
+
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].ReplyRate != warnings[j].ReplyRate {
+			return warnings[i].ReplyRate < warnings[j].ReplyRate
+		}
+		return warnings[i].Prefix < warnings[j].Prefix
+	})
+	return warnings
+}
+
+// Check evaluates the sends of the window that have had time for a reply and
+// returns the prefixes flagged for the first time
+func (s *FilterWatchSettings) Check(db *Database, now time.Time) ([]FilteringWarning, error) {
+	sends, replies, err := db.FilterWatchSends(now.Add(-s.Window), now.Add(-s.ReplyWindow))
+	if err != nil {
+		return nil, err
+	}
+	warnings := s.evaluate(sends, replies)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := make(map[string]time.Time, len(s.warnings))
+	for _, w := range s.warnings {
+		since[w.Prefix] = w.Since
+	}
+
+	var flagged []FilteringWarning
+	for i := range warnings {
+		if at, ok := since[warnings[i].Prefix]; ok {
+			warnings[i].Since = at
+			continue
+		}
+		warnings[i].Since = now
+		flagged = append(flagged, warnings[i])
+	}
+
+	s.warnings = warnings
+	s.checkedAt = now
+	return flagged, nil
+}
+
+// Warnings returns the prefixes flagged by the last check and when it ran
+func (s *FilterWatchSettings) Warnings() ([]FilteringWarning, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]FilteringWarning{}, s.warnings...), s.checkedAt
+}
+
+// runFilterWatchJob checks recent sends for silent carrier filtering and
+// alerts on newly flagged prefixes
+func (app *App) runFilterWatchJob() {
+	ticker := clock.NewTicker(filterWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		flagged, err := app.filterWatch.Check(app.db, clock.Now())
+		if err != nil {
+			log.Printf("Filter watch: %v", err)
+		}
+		for i := range flagged {
+			warning := flagged[i]
+			log.Printf("Filter watch: %s", warning.Summary())
+			app.events.Publish(EventFilteringSuspected, &warning)
+		}
+
+		<-ticker.C()
+	}
+}
+
+// Summary describes a warning and what to do about it for alerts
+func (w *FilteringWarning) Summary() string {
+	destination := w.Prefix
+	if w.Operator != "" {
+		destination += " (" + w.Operator + ")"
+	}
+
+	summary := fmt.Sprintf("%d of %d messages to %s were answered (%.0f%%, %.0f%% for other destinations)",
+		w.Replied, w.Sends, destination, w.ReplyRate*100, w.BaselineRate*100)
+	if len(w.Templates) > 0 {
+		summary += fmt.Sprintf(". Most unanswered messages used template %q; try rewording it or sending through another route", w.Templates[0])
+	} else {
+		summary += ". Try rewording the messages or sending through another route"
+	}
+	return summary
+}
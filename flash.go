@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.bug.st/serial"
+)
+
+// sketchProtocolVersion is the serial protocol version the sketch reports in
+// its ready message. It is bumped with the sketch on incompatible changes.
+const sketchProtocolVersion = 1
+
+// Flashing tools
+const (
+	FlashToolBossac  = "bossac"  // SAMD boards such as the MKR GSM 1400
+	FlashToolAVRDude = "avrdude" // AVR boards with the Arduino bootloader
+)
+
+// Flashing limits
+const (
+	flashToolTimeout    = 2 * time.Minute
+	flashBootloaderWait = 10 * time.Second // for the bootloader port to appear
+	flashVerifyTimeout  = 3 * time.Minute  // the sketch connects GSM before it reports ready
+)
+
+// errFlashUnsupported is returned when the connection can't be flashed
+var errFlashUnsupported = errors.New("flashing requires an Arduino connection")
+
+// FlashSettings configures uploading a compiled sketch to the Arduino
+type FlashSettings struct {
+	Image    string // compiled sketch (.bin for bossac, .hex for avrdude)
+	Tool     string // bossac or avrdude
+	ToolPath string // tool executable, found on PATH by default
+	AVRPart  string // avrdude part number
+}
+
+// FlashResult describes a completed flash
+type FlashResult struct {
+	Port     string `json:"port"`
+	Image    string `json:"image"`
+	Version  int    `json:"version"` // protocol version reported by the new sketch
+	Duration string `json:"duration"`
+	Output   string `json:"output"` // output of the flashing tool
+}
+
+// LoadFlashSettings reads flashing settings from environment variables.
+// Image is empty unless FLASH_IMAGE is set.
+func LoadFlashSettings() (FlashSettings, error) {
+	settings := FlashSettings{
+		Image:   os.Getenv("FLASH_IMAGE"),
+		Tool:    FlashToolBossac,
+		AVRPart: "atmega328p",
+	}
+
+	if value := os.Getenv("FLASH_TOOL"); value != "" {
+		if value != FlashToolBossac && value != FlashToolAVRDude {
+			return settings, fmt.Errorf("FLASH_TOOL: invalid tool %q (use bossac or avrdude)", value)
+		}
+		settings.Tool = value
+	}
+
+	settings.ToolPath = settings.Tool
+	if value := os.Getenv("FLASH_TOOL_PATH"); value != "" {
+		settings.ToolPath = value
+	}
+
+	if value := os.Getenv("FLASH_AVR_PART"); value != "" {
+		settings.AVRPart = value
+	}
+
+	return settings, nil
+}
+
+// FlashSketch uploads the image to the Arduino on portName and waits for the
+// new sketch to report ready with the expected protocol version. The port
+// must not be open.
+func FlashSketch(ctx context.Context, settings FlashSettings, portName string) (FlashResult, error) {
+	result := FlashResult{Port: portName, Image: settings.Image}
+	started := time.Now()
+
+	if _, err := os.Stat(settings.Image); err != nil {
+		return result, fmt.Errorf("failed to read sketch image: %w", err)
+	}
+
+	uploadPort := portName
+	if settings.Tool == FlashToolBossac {
+		port, err := enterBootloader(ctx, portName)
+		if err != nil {
+			return result, err
+		}
+		uploadPort = port
+	}
+
+	var args []string
+	switch settings.Tool {
+	case FlashToolBossac:
+		args = []string{"--port=" + uploadPort, "-i", "-e", "-w", "-v", "-R", settings.Image}
+	case FlashToolAVRDude:
+		args = []string{"-p", settings.AVRPart, "-c", "arduino", "-P", uploadPort, "-b", "115200", "-D",
+			"-U", "flash:w:" + settings.Image + ":a"}
+	}
+
+	toolCtx, cancel := context.WithTimeout(ctx, flashToolTimeout)
+	defer cancel()
+
+	log.Printf("Flashing %s to %s with %s", settings.Image, uploadPort, settings.Tool)
+	output, err := exec.CommandContext(toolCtx, settings.ToolPath, args...).CombinedOutput()
+	result.Output = string(output)
+	if err != nil {
+		return result, fmt.Errorf("%s failed: %w", settings.Tool, err)
+	}
+
+	version, err := waitForSketch(ctx, portName, flashVerifyTimeout)
+	result.Duration = time.Since(started).Round(time.Second).String()
+	if err != nil {
+		return result, fmt.Errorf("failed to verify flashed sketch: %w", err)
+	}
+	result.Version = version
+	if version != sketchProtocolVersion {
+		return result, fmt.Errorf("flashed sketch reports protocol version %d, expected %d", version, sketchProtocolVersion)
+	}
+
+	log.Printf("Flashed %s to %s in %s (protocol version %d)", settings.Image, portName, result.Duration, version)
+
+	return result, nil
+}
+
+// enterBootloader resets a SAMD board into its bootloader by opening the port
+// at 1200 baud, and returns the port the bootloader appears on
+func enterBootloader(ctx context.Context, portName string) (string, error) {
+	before, err := serial.GetPortsList()
+	if err != nil {
+		return "", fmt.Errorf("failed to list serial ports: %w", err)
+	}
+
+	port, err := serial.Open(portName, &serial.Mode{BaudRate: 1200})
+	if err != nil {
+		return "", fmt.Errorf("failed to open serial port %s: %w", portName, err)
+	}
+	port.SetDTR(false)
+	port.Close()
+
+	// The bootloader often comes back on a new port; if none appears it
+	// reuses the original one
+	deadline := time.Now().Add(flashBootloaderWait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+
+		ports, err := serial.GetPortsList()
+		if err != nil {
+			continue
+		}
+		for _, p := range ports {
+			if !slices.Contains(before, p) {
+				return p, nil
+			}
+		}
+	}
+
+	return portName, nil
+}
+
+// waitForSketch opens the port and waits for the sketch to report ready,
+// returning its protocol version (0 for sketches that don't report one)
+func waitForSketch(ctx context.Context, portName string, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The port disappears while the board restarts
+	var port serial.Port
+	for port == nil {
+		p, err := serial.Open(portName, &serial.Mode{BaudRate: 115200})
+		if err == nil {
+			port = p
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("serial port %s did not come back: %w", portName, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	defer port.Close()
+
+	if err := port.SetReadTimeout(500 * time.Millisecond); err != nil {
+		return 0, fmt.Errorf("failed to set read timeout: %w", err)
+	}
+
+	scanner := bufio.NewScanner(&contextReader{ctx: ctx, port: port})
+	for scanner.Scan() {
+		var response SerialResponse
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			continue
+		}
+		if response.Status == "ready" {
+			return response.Version, nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("sketch did not report ready within %s", timeout)
+	}
+	return 0, fmt.Errorf("failed to read from serial port: %w", scanner.Err())
+}
+
+// contextReader reads from a serial port until ctx is done, skipping read timeouts
+type contextReader struct {
+	ctx  context.Context
+	port serial.Port
+}
+
+// Read reads from the port, returning ctx's error once it is done
+func (r *contextReader) Read(p []byte) (int, error) {
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		n, err := r.port.Read(p)
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+// runFlash flashes the Arduino from the command line (-flash) and exits
+func runFlash(image string) error {
+	settings, err := LoadFlashSettings()
+	if err != nil {
+		return err
+	}
+	settings.Image = image
+
+	portName, err := DevicePort()
+	if err != nil {
+		return err
+	}
+
+	result, err := FlashSketch(context.Background(), settings, portName)
+	if result.Output != "" {
+		fmt.Print(result.Output)
+	}
+	return err
+}
+
+// Flash uploads a sketch to the Arduino, releasing the serial port while the
+// flashing tool runs and reopening it afterwards. Commands fail as not
+// connected in the meantime.
+func (a *ArduinoConnection) Flash(ctx context.Context, settings FlashSettings) (FlashResult, error) {
+	if !a.flashMu.TryLock() {
+		return FlashResult{}, fmt.Errorf("flash already in progress")
+	}
+	defer a.flashMu.Unlock()
+
+	a.mu.Lock()
+	if !a.connected {
+		a.mu.Unlock()
+		return FlashResult{}, fmt.Errorf("not connected to Arduino")
+	}
+	a.connected = false
+	a.port.Close()
+	a.mu.Unlock()
+	a.updateGSMState("disconnected")
+
+	result, err := FlashSketch(ctx, settings, a.portName)
+
+	if reopenErr := a.reopen(); reopenErr != nil {
+		if err == nil {
+			err = reopenErr
+		}
+		log.Printf("Failed to reconnect to Arduino after flashing: %v", reopenErr)
+	}
+
+	return result, err
+}
+
+// reopen opens the serial port again after it was released for flashing
+func (a *ArduinoConnection) reopen() error {
+	port, err := serial.Open(a.portName, &serial.Mode{
+		BaudRate: 115200,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open serial port %s: %w", a.portName, err)
+	}
+	if err := port.SetReadTimeout(100 * time.Millisecond); err != nil {
+		port.Close()
+		return fmt.Errorf("failed to set read timeout: %w", err)
+	}
+
+	a.mu.Lock()
+	a.port = port
+	a.connected = true
+	a.mu.Unlock()
+
+	time.Sleep(a.gsm.OpenDelay)
+	go a.setup()
+
+	a.events.Publish(EventDeviceConnected, DeviceConnectionEvent{Port: a.portName, Reconnected: true})
+
+	return nil
+}
+
+// Flash is not supported by the mock connection
+func (m *MockSerialConnection) Flash(ctx context.Context, settings FlashSettings) (FlashResult, error) {
+	return FlashResult{}, errFlashUnsupported
+}
+
+// flashSketch uploads FLASH_IMAGE to the Arduino. The send queue is paused
+// while flashing.
+func (app *App) flashSketch(c *gin.Context) {
+	if !app.queue.IsPaused() {
+		app.queue.Pause()
+		defer app.queue.Resume()
+	}
+
+	// Not cancelled with the request: interrupting an upload can leave the
+	// Arduino without a sketch
+	result, err := app.smsConn.Flash(context.Background(), app.flash)
+	if errors.Is(err, errFlashUnsupported) {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeDeviceNotConnected, "Flashing requires an Arduino connection"))
+		return
+	}
+	if err != nil {
+		resp := errorResponse(c, CodeInternalError, "Flash failed: %v", err)
+		resp.Details = gin.H{"result": result}
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"result": result,
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GSM wake strategies
+const (
+	GSMWakeOnDemand = "on_demand" // GSM sleeps when idle and is woken for sends and hourly checks
+	GSMWakeAlwaysOn = "always_on" // GSM is kept connected, for mains powered installations
+)
+
+// maxSendPipeline is the most sends that may be in flight to the Arduino at
+// once. The sketch queues 4 sends behind the one it is submitting.
+const maxSendPipeline = 5
+
+// Sources of the SIM's own number
+const (
+	OwnNumberConfigured = "configured" // set with OWN_NUMBER
+	OwnNumberSIM        = "sim"        // read from the SIM by the modem
+)
+
+// GSMSettings holds the timing, power, pipelining and protocol settings of the
+// Arduino connection, the SIM's own number when it is configured and the
+// power switch used to recover a lost connection
+type GSMSettings struct {
+	ReadyTimeout time.Duration // how long a send waits for GSM to connect
+	OpenDelay    time.Duration // how long to wait for the Arduino to reset after opening the port
+	WakeStrategy string        // on_demand or always_on
+	SendPipeline int           // sends in flight to the Arduino at once
+	Protocol     string        // json or cbor, see cbor.go
+	OwnNumber    string        // the SIM's own number, overriding the one read from the SIM
+	PowerSwitch  *PowerSwitch  // nil unless the Arduino's power can be cycled, see powerswitch.go
+}
+
+// LoadGSMSettings reads GSM settings from environment variables
+func LoadGSMSettings() (GSMSettings, error) {
+	settings := GSMSettings{
+		ReadyTimeout: 30 * time.Second,
+		OpenDelay:    2 * time.Second,
+		WakeStrategy: GSMWakeOnDemand,
+		SendPipeline: 1,
+		Protocol:     SerialProtocolJSON,
+	}
+
+	if value := os.Getenv("GSM_READY_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < time.Second || timeout > 5*time.Minute {
+			return settings, fmt.Errorf("GSM_READY_TIMEOUT: invalid duration %q (1s to 5m)", value)
+		}
+		settings.ReadyTimeout = timeout
+	}
+
+	if value := os.Getenv("SERIAL_OPEN_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 || delay > time.Minute {
+			return settings, fmt.Errorf("SERIAL_OPEN_DELAY: invalid duration %q (0 to 1m)", value)
+		}
+		settings.OpenDelay = delay
+	}
+
+	if value := os.Getenv("GSM_WAKE_STRATEGY"); value != "" {
+		if value != GSMWakeOnDemand && value != GSMWakeAlwaysOn {
+			return settings, fmt.Errorf("GSM_WAKE_STRATEGY: invalid strategy %q (use on_demand or always_on)", value)
+		}
+		settings.WakeStrategy = value
+	}
+
+	if value := os.Getenv("SEND_PIPELINE"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 || depth > maxSendPipeline {
+			return settings, fmt.Errorf("SEND_PIPELINE: invalid value %q (1 to %d)", value, maxSendPipeline)
+		}
+		settings.SendPipeline = depth
+	}
+
+	if value := os.Getenv("SERIAL_PROTOCOL"); value != "" {
+		if value != SerialProtocolJSON && value != SerialProtocolCBOR {
+			return settings, fmt.Errorf("SERIAL_PROTOCOL: invalid protocol %q (use json or cbor)", value)
+		}
+		settings.Protocol = value
+	}
+
+	if value := os.Getenv("OWN_NUMBER"); value != "" {
+		number, err := NormalizeNumber(value)
+		if err != nil {
+			return settings, fmt.Errorf("OWN_NUMBER: %w", err)
+		}
+		settings.OwnNumber = number
+	}
+
+	powerSwitch, err := LoadPowerSwitch()
+	if err != nil {
+		return settings, err
+	}
+	settings.PowerSwitch = powerSwitch
+
+	return settings, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"compress/gzip"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipWriterPool reuses gzip writers across responses
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// gzipResponseWriter compresses the response body. Compression starts on the
+// first write so empty responses (e.g. 304 Not Modified) stay empty.
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	gz *gzip.Writer
+}
+
+// start switches the response to gzip encoding
+func (w *gzipResponseWriter) start() {
+	header := w.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+
+	w.gz = gzipWriterPool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+// Write compresses data into the response
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if w.gz == nil {
+		w.start()
+	}
+	return w.gz.Write(data)
+}
+
+// WriteString compresses a string into the response
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends any buffered compressed data to the client
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close finishes the gzip stream and returns the writer to the pool
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Close()
+	gzipWriterPool.Put(w.gz)
+	w.gz = nil
+}
+
+// gzipMiddleware compresses responses for clients that accept gzip encoding
+func gzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") || c.Request.Method == "HEAD" {
+			c.Next()
+			return
+		}
+
+		c.Header("Vary", "Accept-Encoding")
+
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer writer.close()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// haNotifyRequest matches the payload of Home Assistant's RESTful notify platform
+// (message, title, target and data parameter names left at their defaults)
+type haNotifyRequest struct {
+	Message string          `json:"message"`
+	Title   string          `json:"title"`
+	Target  json.RawMessage `json:"target"`
+	Data    struct {
+		Class    *int   `json:"class"`
+		SenderID string `json:"sender_id"`
+	} `json:"data"`
+}
+
+// GetHomeAssistantTargets returns the numbers notified when a Home Assistant
+// notification has no target, from environment variable
+func GetHomeAssistantTargets() []string {
+	return splitList(os.Getenv("HOMEASSISTANT_TARGETS"))
+}
+
+// parseHATargets accepts a target given as a single string or a list of strings
+func parseHATargets(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return strings.Split(single, ","), nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("target must be a string or a list of strings")
+	}
+
+	return list, nil
+}
+
+// homeAssistantNotify sends a Home Assistant notification as SMS to each target
+func (app *App) homeAssistantNotify(c *gin.Context) {
+	var req haNotifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid request: %v", err))
+		return
+	}
+
+	targets, err := parseHATargets(req.Target)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	if len(targets) == 0 {
+		targets = append([]string(nil), app.haTargets...)
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "No target given and HOMEASSISTANT_TARGETS is not set"))
+		return
+	}
+
+	content := req.Message
+	if req.Title != "" {
+		content = req.Title + "\n" + req.Message
+	}
+
+	opts := SendOptions{Class: req.Data.Class, SenderID: req.Data.SenderID}
+
+	for i := range targets {
+		targets[i] = strings.TrimSpace(targets[i])
+		if err := app.validateSMS(targets[i], content, opts); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
+			return
+		}
+	}
+
+	var failed []string
+	failedClasses := gin.H{}
+	for _, number := range targets {
+		_, err := app.deliverSMS(c.Request.Context(), keyIDFromContext(c), number, content, opts)
+		var throttleErr *ThrottleError
+		if errors.Is(err, ErrNotConnected) || errors.As(err, &throttleErr) {
+			c.JSON(sendErrorResponse(c, err))
+			return
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", number, err))
+			failedClasses[number] = ClassifyError(err)
+		}
+	}
+
+	if len(failed) > 0 {
+		resp := errorResponse(c, CodeSendFailed, "Failed to send SMS to %s", strings.Join(failed, "; "))
+		resp.Details = gin.H{"failed": failedClasses}
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("SMS sent to %s", strings.Join(targets, ", ")),
+	})
+}
+
+// homeAssistantConnectivity returns "on" or "off" as plain text, which Home
+// Assistant's RESTful binary sensor reads without a value template
+func (app *App) homeAssistantConnectivity(c *gin.Context) {
+	state := "off"
+	if app.smsConn.IsConnected() && app.smsConn.IsGSMReady() {
+		state = "on"
+	}
+
+	c.String(http.StatusOK, state)
+}
+
+// homeAssistantSensor returns flat device and message counters for Home
+// Assistant's RESTful sensor (state from "state", the rest via json_attributes)
+func (app *App) homeAssistantSensor(c *gin.Context) {
+	state := "disconnected"
+	switch {
+	case app.smsConn.IsConnected() && app.smsConn.IsGSMReady():
+		state = "ready"
+	case app.smsConn.IsConnected():
+		state = "connected"
+	}
+
+	receivedCount, _ := app.db.CountReceivedSMS()
+	sentCount, _ := app.db.CountSentSMSByStatus("success")
+	failedCount, _ := app.db.CountSentSMSByStatus("error")
+
+	c.JSON(http.StatusOK, gin.H{
+		"state":          state,
+		"connected":      app.smsConn.IsConnected(),
+		"gsm_ready":      app.smsConn.IsGSMReady(),
+		"run_mode":       app.runMode.Get(),
+		"queue_length":   len(app.queue.Pending()),
+		"queue_paused":   app.queue.IsPaused(),
+		"received_total": receivedCount,
+		"sent_total":     sentCount,
+		"failed_total":   failedCount,
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HookSettings runs site-specific executables on events, like Git hooks: a
+// hook is a file in Dir named after the event type, e.g. message.received
+type HookSettings struct {
+	Dir     string
+	Timeout time.Duration // how long a hook may run before it is killed
+}
+
+// hookPayload is written to a hook's stdin
+type hookPayload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// HookInfo describes an installed hook
+type HookInfo struct {
+	Event      string `json:"event"`
+	Path       string `json:"path"`
+	Executable bool   `json:"executable"`
+}
+
+// LoadHookSettings reads hook settings from environment variables. It returns
+// nil if HOOKS_DIR is not set.
+func LoadHookSettings() (*HookSettings, error) {
+	dir := os.Getenv("HOOKS_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("HOOKS_DIR: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("HOOKS_DIR: %s is not a directory", dir)
+	}
+
+	settings := &HookSettings{Dir: dir, Timeout: 30 * time.Second}
+	if value := os.Getenv("HOOK_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < time.Second || timeout > 10*time.Minute {
+			return nil, fmt.Errorf("HOOK_TIMEOUT: invalid duration %q (1s to 10m)", value)
+		}
+		settings.Timeout = timeout
+	}
+
+	return settings, nil
+}
+
+// hookExtensions are the file extensions tried after the bare event name;
+// Windows only runs files with an executable extension
+func hookExtensions() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"", ".exe", ".bat", ".cmd"}
+	}
+	return []string{""}
+}
+
+// find returns the hook for an event type, or "" if none is installed
+func (h *HookSettings) find(eventType string) string {
+	for _, ext := range hookExtensions() {
+		path := filepath.Join(h.Dir, eventType+ext)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if !isExecutable(info) {
+			log.Printf("Hook %s is not executable, ignoring it", path)
+			return ""
+		}
+		return path
+	}
+	return ""
+}
+
+// isExecutable reports whether a hook file may be run. Windows has no
+// executable bit; hooks there are recognized by their extension.
+func isExecutable(info os.FileInfo) bool {
+	return runtime.GOOS == "windows" || info.Mode()&0111 != 0
+}
+
+// HandleEvent runs the hook for an event from the event bus, if one is
+// installed. Hooks run in the background so they don't hold up the event.
+func (h *HookSettings) HandleEvent(event Event) {
+	path := h.find(event.Type)
+	if path == "" {
+		return
+	}
+	go h.run(path, event)
+}
+
+// run executes a hook with the event as JSON on stdin and the event type in
+// SMS_EVENT, logging its output if it fails
+func (h *HookSettings) run(path string, event Event) {
+	payload, err := json.Marshal(hookPayload{Event: event.Type, Time: event.Time, Data: event.Data})
+	if err != nil {
+		log.Printf("Hook %s: failed to encode event: %v", path, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "SMS_EVENT="+event.Type)
+	cmd.WaitDelay = time.Second // don't wait for children of a killed hook holding its output open
+
+	started := time.Now()
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Hook %s timed out after %s", path, h.Timeout)
+		return
+	}
+	if err != nil {
+		log.Printf("Hook %s failed: %v: %s", path, err, strings.TrimSpace(string(output)))
+		return
+	}
+	log.Printf("Hook %s ran in %s", path, time.Since(started).Round(time.Millisecond))
+}
+
+// List returns the hooks installed in the hook directory
+func (h *HookSettings) List() ([]HookInfo, error) {
+	entries, err := os.ReadDir(h.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hook directory: %w", err)
+	}
+
+	hooks := []HookInfo{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		event := entry.Name()
+		for _, ext := range hookExtensions() {
+			if ext != "" && strings.HasSuffix(event, ext) {
+				event = strings.TrimSuffix(event, ext)
+			}
+		}
+		hooks = append(hooks, HookInfo{
+			Event:      event,
+			Path:       filepath.Join(h.Dir, entry.Name()),
+			Executable: isExecutable(info),
+		})
+	}
+	return hooks, nil
+}
+
+// getHooks returns the hook configuration and the installed hooks
+func (app *App) getHooks(c *gin.Context) {
+	if app.hooks == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"enabled": false,
+		})
+		return
+	}
+
+	hooks, err := app.hooks.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list hooks: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"enabled": true,
+		"dir":     app.hooks.Dir,
+		"timeout": app.hooks.Timeout.String(),
+		"hooks":   hooks,
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultLocale is the language strings are written in
+const defaultLocale = "en"
+
+// localeContextKey is the gin context key holding the request's locale
+const localeContextKey = "locale"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs maps a locale to its translations, keyed by the English format string
+var catalogs = mustLoadEmbeddedCatalogs()
+
+// mustLoadEmbeddedCatalogs parses the built-in translations
+func mustLoadEmbeddedCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	result := map[string]map[string]string{defaultLocale: {}}
+	for _, file := range files {
+		data, err := localeFiles.ReadFile("locales/" + file.Name())
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("invalid locale file %s: %v", file.Name(), err))
+		}
+		result[strings.TrimSuffix(file.Name(), ".json")] = catalog
+	}
+	return result
+}
+
+// LoadLocales adds or extends catalogs from the <locale>.json files in the
+// LOCALES_DIR directory and returns the configured DEFAULT_LOCALE
+func LoadLocales() (string, error) {
+	if dir := os.Getenv("LOCALES_DIR"); dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return "", fmt.Errorf("LOCALES_DIR: %w", err)
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			var catalog map[string]string
+			if err := json.Unmarshal(data, &catalog); err != nil {
+				return "", fmt.Errorf("invalid locale file %s: %w", path, err)
+			}
+
+			locale := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))
+			if catalogs[locale] == nil {
+				catalogs[locale] = map[string]string{}
+			}
+			for key, value := range catalog {
+				catalogs[locale][key] = value
+			}
+			log.Printf("Loaded %d translations for %s from %s", len(catalog), locale, path)
+		}
+	}
+
+	locale := strings.ToLower(os.Getenv("DEFAULT_LOCALE"))
+	if locale == "" {
+		return defaultLocale, nil
+	}
+	if catalogs[locale] == nil {
+		return "", fmt.Errorf("DEFAULT_LOCALE: unknown locale %q (available: %s)", locale, strings.Join(availableLocales(), ", "))
+	}
+	return locale, nil
+}
+
+// availableLocales returns the locales that have a catalog
+func availableLocales() []string {
+	locales := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// localizer is implemented by errors that can render their message in another locale
+type localizer interface {
+	Localize(locale string) string
+}
+
+// T formats a user-facing string in locale. The English format string is the
+// translation key; untranslated strings are returned in English.
+func T(locale, format string, args ...any) string {
+	if translated, ok := catalogs[locale][format]; ok && translated != "" {
+		format = translated
+	}
+	for i, arg := range args {
+		if l, ok := arg.(localizer); ok {
+			args[i] = l.Localize(locale)
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// matchLocale returns the best supported locale of an Accept-Language header,
+// or fallback if none is supported
+func matchLocale(acceptLanguage, fallback string) string {
+	best, bestQ := fallback, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		// "sl-SI" matches the "sl" catalog
+		tag = strings.ToLower(tag)
+		base, _, _ := strings.Cut(tag, "-")
+		for _, candidate := range []string{tag, base} {
+			if _, ok := catalogs[candidate]; ok && q > bestQ {
+				best, bestQ = candidate, q
+				break
+			}
+		}
+	}
+	return best
+}
+
+// localeMiddleware selects the locale of a request from the lang query
+// parameter or the Accept-Language header, falling back to defaultLocale
+func localeMiddleware(fallback string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Accept-Language")
+		if lang := c.Query("lang"); lang != "" {
+			header = lang
+		}
+		c.Set(localeContextKey, matchLocale(header, fallback))
+		c.Next()
+	}
+}
+
+// localeFromContext returns the locale selected for a request
+func localeFromContext(c *gin.Context) string {
+	if locale := c.GetString(localeContextKey); locale != "" {
+		return locale
+	}
+	return defaultLocale
+}
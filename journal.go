@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalFlushInterval is how often journaled messages are written back
+const journalFlushInterval = 15 * time.Second
+
+// ErrJournaled is returned when a message could not be written to the
+// database and is kept in the journal until it recovers
+var ErrJournaled = errors.New("database unavailable, message kept in the journal")
+
+// journalEntry is a sent or received SMS waiting to be written to the database
+type journalEntry struct {
+	seq       uint64
+	Sent      bool
+	Number    string
+	Content   string
+	CreatedAt time.Time
+
+	// Sent SMS
+	Status     string
+	Error      string
+	ErrorClass ErrorClass
+	Opts       SendOptions
+
+	// Received SMS
+	DeviceNumber string
+	Timestamp    time.Time
+}
+
+// Journal keeps the messages that could not be written to the database, e.g.
+// because the SD card is full, in a ring buffer until the database is
+// writable again. Sends and receives go on in the meantime.
+type Journal struct {
+	Size int // entries kept; the oldest are dropped when it is full
+
+	mu        sync.Mutex
+	entries   []journalEntry
+	nextSeq   uint64
+	dropped   int
+	flushed   int
+	since     time.Time // first failed write of the ongoing outage, zero while writable
+	lastError string
+}
+
+// JournalStatus is the database state reported by /health
+type JournalStatus struct {
+	Writable bool       `json:"writable"`
+	Since    *time.Time `json:"unwritable_since,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Pending  int        `json:"journal_pending"`
+	Size     int        `json:"journal_size"`
+	Dropped  int        `json:"journal_dropped"` // lost because the journal was full
+	Flushed  int        `json:"journal_flushed"` // written back since startup
+}
+
+// LoadJournal reads the journal size from DB_JOURNAL_SIZE (default 1000).
+// A size of 0 disables the journal.
+func LoadJournal() (*Journal, error) {
+	size := 1000
+	if value := os.Getenv("DB_JOURNAL_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("DB_JOURNAL_SIZE: invalid size %q", value)
+		}
+		size = n
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	return &Journal{Size: size}, nil
+}
+
+// unavailableErrors are the SQLite messages of writes that failed because the
+// database file can't be written, as opposed to e.g. constraint violations.
+// The messages are matched since the driver's error codes need cgo.
+var unavailableErrors = []string{
+	"database or disk is full",
+	"disk I/O error",
+	"attempt to write a readonly database",
+	"unable to open database file",
+	"database disk image is malformed",
+	"file is not a database",
+	"database is locked",
+	"database table is locked",
+}
+
+// isUnavailable reports whether a write failed because the database file
+// can't be written
+func isUnavailable(err error) bool {
+	msg := err.Error()
+	for _, unavailable := range unavailableErrors {
+		if strings.Contains(msg, unavailable) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep journals an entry whose write failed with err. It returns false if
+// the entry was not journaled, either because there is no journal or the
+// failure is not one the database recovers from.
+func (j *Journal) keep(entry journalEntry, err error) bool {
+	if j == nil || !isUnavailable(err) {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.since.IsZero() {
+		j.since = time.Now()
+		log.Printf("Database unavailable, journaling messages in memory: %v", err)
+	}
+	j.lastError = err.Error()
+
+	if len(j.entries) >= j.Size {
+		j.entries = j.entries[1:]
+		j.dropped++
+	}
+	j.nextSeq++
+	entry.seq = j.nextSeq
+	j.entries = append(j.entries, entry)
+	return true
+}
+
+// written records a successful write, ending the outage if nothing is left
+// to flush
+func (j *Journal) written() {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.since.IsZero() && len(j.entries) == 0 {
+		log.Printf("Database writable again after %s", time.Since(j.since).Round(time.Second))
+		j.since = time.Time{}
+		j.lastError = ""
+	}
+}
+
+// erase drops the journaled messages to or from the number with the given
+// conversation ID, so that a flush does not write them back after the number
+// was erased. It returns the number of entries dropped.
+func (j *Journal) erase(conversationID string) int {
+	if j == nil {
+		return 0
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	before := len(j.entries)
+	j.entries = slices.DeleteFunc(j.entries, func(entry journalEntry) bool {
+		return ConversationID(entry.Number) == conversationID
+	})
+	return before - len(j.entries)
+}
+
+// Status returns the database state for /health
+func (j *Journal) Status() JournalStatus {
+	if j == nil {
+		return JournalStatus{Writable: true}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := JournalStatus{
+		Writable: j.since.IsZero(),
+		Error:    j.lastError,
+		Pending:  len(j.entries),
+		Size:     j.Size,
+		Dropped:  j.dropped,
+		Flushed:  j.flushed,
+	}
+	if !j.since.IsZero() {
+		since := j.since
+		status.Since = &since
+	}
+	return status
+}
+
+// FlushJournal writes the journaled messages to the database, oldest first,
+// and stops at the first failure. It returns the number of messages written.
+func (d *Database) FlushJournal() (int, error) {
+	j := d.journal
+	if j == nil {
+		return 0, nil
+	}
+
+	flushed := 0
+	for {
+		j.mu.Lock()
+		if len(j.entries) == 0 {
+			j.mu.Unlock()
+			break
+		}
+		entry := j.entries[0]
+		j.mu.Unlock()
+
+		var err error
+		if entry.Sent {
+			_, err = d.insertSentSMS(entry.Number, entry.Content, entry.Status, entry.Error, entry.ErrorClass, entry.Opts, entry.CreatedAt)
+		} else {
+			_, err = d.insertReceivedSMS(entry.Number, entry.Content, entry.DeviceNumber, entry.Timestamp, entry.CreatedAt)
+		}
+		if err != nil {
+			j.mu.Lock()
+			j.lastError = err.Error()
+			j.mu.Unlock()
+			return flushed, err
+		}
+
+		// keep may have dropped the entry meanwhile if the journal was full
+		j.mu.Lock()
+		if len(j.entries) > 0 && j.entries[0].seq == entry.seq {
+			j.entries = j.entries[1:]
+		}
+		j.flushed++
+		j.mu.Unlock()
+		flushed++
+	}
+
+	j.written()
+	return flushed, nil
+}
+
+// runJournalFlushJob writes journaled messages back once the database
+// recovers
+func (app *App) runJournalFlushJob() {
+	ticker := clock.NewTicker(journalFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		if app.db.journal.Status().Pending == 0 {
+			continue
+		}
+
+		flushed, err := app.db.FlushJournal()
+		if flushed > 0 {
+			log.Printf("Wrote %d journaled messages to the database", flushed)
+		}
+		if err != nil && flushed == 0 {
+			log.Printf("Database still unavailable: %v", err)
+		}
+	}
+}
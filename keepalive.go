@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Keep-alive methods
+const (
+	KeepAliveSMS  = "sms"
+	KeepAliveUSSD = "ussd"
+)
+
+// keepAliveRetry is how long to wait before retrying a failed keep-alive check
+const keepAliveRetry = 1 * time.Hour
+
+// KeepAliveSettings holds configuration for the SIM keep-alive job
+type KeepAliveSettings struct {
+	Interval time.Duration
+	Method   string // sms or ussd
+	Number   string // recipient of keep-alive SMS
+	Message  string // content of keep-alive SMS
+	Code     string // USSD code, e.g. *100#
+}
+
+// KeepAliveCheck is the recorded result of one keep-alive check
+type KeepAliveCheck struct {
+	ID        int       `json:"id"`
+	Method    string    `json:"method"`
+	Target    string    `json:"target"`
+	Success   bool      `json:"success"`
+	Response  string    `json:"response,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// parseInterval parses a Go duration ("720h") or a number of days ("30d")
+func parseInterval(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q", value)
+	}
+	return interval, nil
+}
+
+// LoadKeepAliveSettings reads keep-alive settings from environment variables.
+// It returns nil if KEEPALIVE_INTERVAL is not set.
+func LoadKeepAliveSettings() (*KeepAliveSettings, error) {
+	intervalStr := os.Getenv("KEEPALIVE_INTERVAL")
+	if intervalStr == "" {
+		return nil, nil
+	}
+
+	interval, err := parseInterval(intervalStr)
+	if err != nil {
+		return nil, fmt.Errorf("KEEPALIVE_INTERVAL: %w", err)
+	}
+	if interval < time.Hour {
+		return nil, fmt.Errorf("KEEPALIVE_INTERVAL must be at least 1h")
+	}
+
+	settings := &KeepAliveSettings{
+		Interval: interval,
+		Number:   os.Getenv("KEEPALIVE_NUMBER"),
+		Message:  os.Getenv("KEEPALIVE_MESSAGE"),
+		Code:     os.Getenv("KEEPALIVE_USSD_CODE"),
+	}
+
+	switch {
+	case settings.Code != "":
+		settings.Method = KeepAliveUSSD
+	case settings.Number != "":
+		settings.Method = KeepAliveSMS
+		if settings.Message == "" {
+			settings.Message = "keep-alive"
+		}
+	default:
+		return nil, fmt.Errorf("KEEPALIVE_INTERVAL requires KEEPALIVE_USSD_CODE or KEEPALIVE_NUMBER to be set")
+	}
+
+	return settings, nil
+}
+
+// target returns the USSD code or number a check is run against
+func (s *KeepAliveSettings) target() string {
+	if s.Method == KeepAliveUSSD {
+		return s.Code
+	}
+	return s.Number
+}
+
+// SaveKeepAliveCheck records the result of a keep-alive check
+func (d *Database) SaveKeepAliveCheck(check *KeepAliveCheck) error {
+	err := d.db.QueryRow(`INSERT INTO keepalive_checks (method, target, success, response) VALUES (?, ?, ?, ?) RETURNING id`,
+		check.Method, check.Target, check.Success, check.Response).Scan(&check.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save keep-alive check: %w", err)
+	}
+
+	return nil
+}
+
+// ListKeepAliveChecks retrieves the most recent keep-alive checks, newest first
+func (d *Database) ListKeepAliveChecks(limit int) ([]KeepAliveCheck, error) {
+	rows, err := d.db.Query(`
+		SELECT id, method, target, success, COALESCE(response, ''), created_at
+		FROM keepalive_checks
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query keep-alive checks: %w", err)
+	}
+	defer rows.Close()
+
+	checks := []KeepAliveCheck{}
+	for rows.Next() {
+		var check KeepAliveCheck
+		var createdAtStr string
+
+		if err := rows.Scan(&check.ID, &check.Method, &check.Target, &check.Success, &check.Response, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		check.CreatedAt = parseTimestamp(createdAtStr)
+		checks = append(checks, check)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return checks, nil
+}
+
+// LastKeepAliveCheck returns the time of the most recent check (or successful
+// check), or the zero time if there is none
+func (d *Database) LastKeepAliveCheck(successOnly bool) (time.Time, error) {
+	var createdAtStr sql.NullString
+	err := d.db.QueryRow(`SELECT MAX(created_at) FROM keepalive_checks WHERE success = 1 OR ? = 0`, successOnly).Scan(&createdAtStr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query keep-alive checks: %w", err)
+	}
+	if !createdAtStr.Valid {
+		return time.Time{}, nil
+	}
+	return parseTimestamp(createdAtStr.String), nil
+}
+
+// runKeepAliveCheck performs one keep-alive check, records it and alerts on failure
+func (app *App) runKeepAliveCheck() *KeepAliveCheck {
+	settings := app.keepAlive
+	check := &KeepAliveCheck{
+		Method:    settings.Method,
+		Target:    settings.target(),
+		CreatedAt: clock.Now().UTC(),
+	}
+
+	var err error
+	switch settings.Method {
+	case KeepAliveUSSD:
+		check.Response, err = app.smsConn.USSD(settings.Code, time.Minute)
+	case KeepAliveSMS:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		_, err = app.deliverSMS(ctx, "keepalive", settings.Number, settings.Message, SendOptions{})
+		cancel()
+		check.Response = "SMS sent"
+	}
+
+	check.Success = err == nil
+	if err != nil {
+		check.Response = err.Error()
+	}
+
+	if saveErr := app.db.SaveKeepAliveCheck(check); saveErr != nil {
+		log.Printf("Keep-alive: %v", saveErr)
+	}
+
+	if check.Success {
+		log.Printf("Keep-alive %s check succeeded: %s", check.Method, check.Response)
+		return check
+	}
+
+	log.Printf("Keep-alive %s check failed: %v", check.Method, err)
+
+	// Also alerted through the fallback channels, since SMS may be what is broken
+	app.events.Publish(EventKeepAliveFailed, check)
+
+	return check
+}
+
+// keepAliveDue returns when the next keep-alive check is due
+func (app *App) keepAliveDue() (time.Time, error) {
+	lastSuccess, err := app.db.LastKeepAliveCheck(true)
+	if err != nil {
+		return time.Time{}, err
+	}
+	lastAttempt, err := app.db.LastKeepAliveCheck(false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	due := lastSuccess.Add(app.keepAlive.Interval)
+	if lastAttempt.After(lastSuccess) && lastAttempt.Add(keepAliveRetry).After(due) {
+		// Retry failed checks at most once per keepAliveRetry
+		due = lastAttempt.Add(keepAliveRetry)
+	}
+
+	return due, nil
+}
+
+// runKeepAliveJob runs keep-alive checks at the configured interval
+func (app *App) runKeepAliveJob() {
+	ticker := clock.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		due, err := app.keepAliveDue()
+		if err != nil {
+			log.Printf("Keep-alive: %v", err)
+		} else if !clock.Now().Before(due) {
+			app.runKeepAliveCheck()
+		}
+
+		<-ticker.C()
+	}
+}
+
+// getKeepAlive returns the keep-alive configuration and recent checks
+func (app *App) getKeepAlive(c *gin.Context) {
+	if app.keepAlive == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"enabled": false,
+		})
+		return
+	}
+
+	checks, err := app.db.ListKeepAliveChecks(20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get keep-alive checks: %v", err))
+		return
+	}
+
+	due, err := app.keepAliveDue()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get keep-alive checks: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"enabled":  true,
+		"method":   app.keepAlive.Method,
+		"target":   app.keepAlive.target(),
+		"interval": app.keepAlive.Interval.String(),
+		"next_due": due,
+		"checks":   checks,
+	})
+}
+
+// runKeepAliveNow runs a keep-alive check immediately
+func (app *App) runKeepAliveNow(c *gin.Context) {
+	if app.keepAlive == nil {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "SIM keep-alive is not configured"))
+		return
+	}
+
+	check := app.runKeepAliveCheck()
+
+	if !check.Success {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status": "error",
+			"check":  check,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"check":  check,
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListOrder is the sort order of a message list, from the order_by and sort
+// query parameters. The zero value is the list's default order, newest first.
+type ListOrder struct {
+	Column string // column from receivedOrderColumns or sentOrderColumns, empty for the default
+	Asc    bool
+}
+
+// receivedOrderColumns are the columns received SMS may be ordered by, by
+// order_by value. Only these are interpolated into queries.
+var receivedOrderColumns = map[string]string{
+	"timestamp":  "timestamp",
+	"created_at": "created_at",
+	"id":         "id",
+}
+
+// sentOrderColumns are the columns sent SMS may be ordered by. Sent SMS have
+// no modem timestamp, so timestamp orders them by created_at.
+var sentOrderColumns = map[string]string{
+	"timestamp":  "created_at",
+	"created_at": "created_at",
+	"id":         "id",
+}
+
+// parseListOrder reads order_by, one of columns, and sort, asc or desc
+// (default), from the query
+func parseListOrder(c *gin.Context, columns map[string]string) (ListOrder, error) {
+	var order ListOrder
+	if orderBy := c.Query("order_by"); orderBy != "" {
+		column, ok := columns[orderBy]
+		if !ok {
+			return order, apiErrorf(CodeInvalidRequest, "Invalid 'order_by' parameter, expected timestamp, created_at or id")
+		}
+		order.Column = column
+	}
+
+	switch c.Query("sort") {
+	case "", "desc":
+	case "asc":
+		order.Asc = true
+	default:
+		return order, apiErrorf(CodeInvalidRequest, "Invalid 'sort' parameter, expected asc or desc")
+	}
+
+	return order, nil
+}
+
+// clause returns the ORDER BY clause, ordering by defaultColumn unless a
+// column was chosen. The ID breaks ties in the same direction, so that pages
+// don't overlap.
+func (o ListOrder) clause(defaultColumn string) string {
+	column := o.Column
+	if column == "" {
+		column = defaultColumn
+	}
+	direction := "DESC"
+	if o.Asc {
+		direction = "ASC"
+	}
+	if column == "id" {
+		return fmt.Sprintf("ORDER BY id %s", direction)
+	}
+	return fmt.Sprintf("ORDER BY %s %s, id %s", column, direction, direction)
+}
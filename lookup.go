@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NumberLookup annotates a phone number for client UIs
+type NumberLookup struct {
+	Number      string `json:"number"`
+	E164        string `json:"e164,omitempty"`
+	Valid       bool   `json:"valid"`
+	Error       string `json:"error,omitempty"`
+	CallingCode string `json:"calling_code,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Operator    string `json:"operator,omitempty"`
+	Type        string `json:"type"`
+	NumberActivity
+}
+
+// NumberActivity summarizes the stored messages of a number
+type NumberActivity struct {
+	ReceivedCount  int        `json:"received_count"`
+	SentCount      int        `json:"sent_count"`
+	FailedCount    int        `json:"failed_count"`
+	LastReceivedAt *time.Time `json:"last_received_at,omitempty"`
+	LastSentAt     *time.Time `json:"last_sent_at,omitempty"`
+	OpenThreadID   *int       `json:"open_thread_id,omitempty"`
+}
+
+// GetNumberActivity counts the messages stored for a number under any of the given spellings
+func (d *Database) GetNumberActivity(numbers ...string) (*NumberActivity, error) {
+	var activity NumberActivity
+
+	for _, number := range numbers {
+		var received, sent, failed int
+		var lastReceived, lastSent sql.NullString
+
+		err := d.db.QueryRow(`SELECT COUNT(*), MAX(created_at) FROM received_sms WHERE number = ?`, number).Scan(&received, &lastReceived)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count received SMS: %w", err)
+		}
+
+		err = d.db.QueryRow(`
+			SELECT COUNT(*), COALESCE(SUM(CASE WHEN status = 'error' THEN 1 ELSE 0 END), 0), MAX(created_at)
+			FROM sent_sms
+			WHERE number = ?
+		`, number).Scan(&sent, &failed, &lastSent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count sent SMS: %w", err)
+		}
+
+		activity.ReceivedCount += received
+		activity.SentCount += sent
+		activity.FailedCount += failed
+		activity.LastReceivedAt = laterTime(activity.LastReceivedAt, lastReceived)
+		activity.LastSentAt = laterTime(activity.LastSentAt, lastSent)
+
+		var threadID int
+		err = d.db.QueryRow(`SELECT id FROM threads WHERE number = ? AND status = ? ORDER BY id DESC LIMIT 1`, number, ThreadOpen).Scan(&threadID)
+		if err == nil {
+			activity.OpenThreadID = &threadID
+		} else if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to query threads: %w", err)
+		}
+	}
+
+	return &activity, nil
+}
+
+// laterTime returns the later of current and a nullable timestamp column
+func laterTime(current *time.Time, value sql.NullString) *time.Time {
+	if !value.Valid {
+		return current
+	}
+	t := parseTimestamp(value.String)
+	if current != nil && current.After(t) {
+		return current
+	}
+	return &t
+}
+
+// lookupNumber returns the normalized form, country, type and message activity of a number
+func (app *App) lookupNumber(c *gin.Context) {
+	number := c.Param("number")
+
+	lookup := NumberLookup{
+		Number: number,
+		Type:   NumberTypeUnknown,
+	}
+
+	spellings := []string{number}
+	if isShortCode(number) {
+		lookup.Valid = true
+		lookup.Type = NumberTypeShortCode
+	} else if e164, err := NormalizeNumber(number); err != nil {
+		lookup.Error = err.Error()
+	} else {
+		lookup.Valid = true
+		lookup.E164 = e164
+		lookup.CallingCode, _ = SplitCallingCode(e164)
+		lookup.Country, lookup.Operator = LookupNumberOrigin(e164)
+		lookup.Type = LookupNumberType(e164)
+		if e164 != number {
+			spellings = append(spellings, e164)
+		}
+	}
+
+	activity, err := app.db.GetNumberActivity(spellings...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to look up number: %v", err))
+		return
+	}
+	lookup.NumberActivity = *activity
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"lookup": lookup,
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loopbackPrefix starts the content of loopback SMS, followed by a token
+const loopbackPrefix = "Loopback check "
+
+// loopbackWakeInterval is how often GSM is woken while waiting for the loopback
+// SMS, since the Arduino only checks for SMS while it is connected
+const loopbackWakeInterval = 30 * time.Second
+
+// LoopbackSettings holds configuration for the send-to-self check
+type LoopbackSettings struct {
+	Number   string        // the SIM's own number
+	Interval time.Duration // 0 for on-demand checks only
+	Timeout  time.Duration // how long the SMS may take to arrive back
+
+	mu sync.Mutex // one check at a time
+}
+
+// LoopbackCheck is the recorded result of one loopback check
+type LoopbackCheck struct {
+	ID        int       `json:"id"`
+	Number    string    `json:"number"`
+	Token     string    `json:"token"`
+	Success   bool      `json:"success"`
+	LatencyMS int64     `json:"latency_ms,omitempty"` // from submitting the SMS until it was received
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoadLoopbackSettings reads loopback settings from environment variables.
+// It returns nil if LOOPBACK_NUMBER is not set.
+func LoadLoopbackSettings() (*LoopbackSettings, error) {
+	value := os.Getenv("LOOPBACK_NUMBER")
+	if value == "" {
+		return nil, nil
+	}
+
+	number, err := NormalizeNumber(value)
+	if err != nil {
+		return nil, fmt.Errorf("LOOPBACK_NUMBER: %w", err)
+	}
+
+	settings := &LoopbackSettings{Number: number, Timeout: 5 * time.Minute}
+
+	if value := os.Getenv("LOOPBACK_INTERVAL"); value != "" {
+		interval, err := parseInterval(value)
+		if err != nil {
+			return nil, fmt.Errorf("LOOPBACK_INTERVAL: %w", err)
+		}
+		if interval < time.Hour {
+			return nil, fmt.Errorf("LOOPBACK_INTERVAL must be at least 1h")
+		}
+		settings.Interval = interval
+	}
+
+	if value := os.Getenv("LOOPBACK_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 30*time.Second || timeout > 30*time.Minute {
+			return nil, fmt.Errorf("LOOPBACK_TIMEOUT: invalid duration %q (30s to 30m)", value)
+		}
+		settings.Timeout = timeout
+	}
+
+	return settings, nil
+}
+
+// IsLoopback reports whether a received SMS is a loopback check coming back
+func (s *LoopbackSettings) IsLoopback(msg ReceivedSMS) bool {
+	return s != nil && strings.HasPrefix(msg.Content, loopbackPrefix) && ConversationID(msg.Number) == ConversationID(s.Number)
+}
+
+// SaveLoopbackCheck records the result of a loopback check
+func (d *Database) SaveLoopbackCheck(check *LoopbackCheck) error {
+	err := d.db.QueryRow(`INSERT INTO loopback_checks (number, token, success, latency_ms, error) VALUES (?, ?, ?, ?, ?) RETURNING id`,
+		check.Number, check.Token, check.Success, check.LatencyMS, check.Error).Scan(&check.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save loopback check: %w", err)
+	}
+
+	return nil
+}
+
+// ListLoopbackChecks retrieves the most recent loopback checks, newest first
+func (d *Database) ListLoopbackChecks(limit int) ([]LoopbackCheck, error) {
+	rows, err := d.db.Query(`
+		SELECT id, number, token, success, latency_ms, error, created_at
+		FROM loopback_checks
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query loopback checks: %w", err)
+	}
+	defer rows.Close()
+
+	checks := []LoopbackCheck{}
+	for rows.Next() {
+		var check LoopbackCheck
+		var createdAtStr string
+
+		if err := rows.Scan(&check.ID, &check.Number, &check.Token, &check.Success, &check.LatencyMS, &check.Error, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		check.CreatedAt = parseTimestamp(createdAtStr)
+		checks = append(checks, check)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return checks, nil
+}
+
+// LastLoopbackCheck returns the time of the most recent check, or the zero time if there is none
+func (d *Database) LastLoopbackCheck() (time.Time, error) {
+	var createdAtStr sql.NullString
+	err := d.db.QueryRow(`SELECT MAX(created_at) FROM loopback_checks`).Scan(&createdAtStr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query loopback checks: %w", err)
+	}
+	if !createdAtStr.Valid {
+		return time.Time{}, nil
+	}
+	return parseTimestamp(createdAtStr.String), nil
+}
+
+// FindLoopbackReply returns the ID of the first SMS from number after afterID
+// containing token, or 0 if none has arrived
+func (d *Database) FindLoopbackReply(number, token string, afterID int) (int, error) {
+	var id int
+	err := d.db.QueryRow(`
+		SELECT id FROM received_sms
+		WHERE conversation_id = ? AND id > ? AND `+d.dialect().position("content", "?")+` > 0
+		ORDER BY id LIMIT 1
+	`, ConversationID(number), afterID, token).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query received SMS: %w", err)
+	}
+	return id, nil
+}
+
+// runLoopbackCheck sends an SMS to the gateway's own number and waits for it
+// to arrive back, records the result and alerts on failure
+func (app *App) runLoopbackCheck() *LoopbackCheck {
+	settings := app.loopback
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	check := &LoopbackCheck{
+		Number:    settings.Number,
+		Token:     hex.EncodeToString(nonce),
+		CreatedAt: clock.Now().UTC(),
+	}
+
+	latency, err := app.loopbackRoundTrip(settings, check.Token)
+	check.Success = err == nil
+	if err != nil {
+		check.Error = err.Error()
+	} else {
+		check.LatencyMS = latency.Milliseconds()
+	}
+
+	if saveErr := app.db.SaveLoopbackCheck(check); saveErr != nil {
+		log.Printf("Loopback: %v", saveErr)
+	}
+
+	if check.Success {
+		log.Printf("Loopback check %s succeeded in %s", check.Token, latency.Round(time.Second))
+		return check
+	}
+
+	log.Printf("Loopback check %s failed: %v", check.Token, err)
+
+	// Also alerted through the fallback channels, since SMS may be what is broken
+	app.events.Publish(EventLoopbackFailed, check)
+
+	return check
+}
+
+// loopbackRoundTrip sends the loopback SMS and returns how long it took to arrive back
+func (app *App) loopbackRoundTrip(settings *LoopbackSettings, token string) (time.Duration, error) {
+	// Only messages received after this point count
+	version, err := app.db.GetTableVersion("received_sms")
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if _, err := app.deliverSMSNow(ctx, "loopback", settings.Number, loopbackPrefix+token, SendOptions{}); err != nil {
+		return 0, fmt.Errorf("failed to send: %w", err)
+	}
+	sent := clock.Now()
+
+	timeout := clock.After(settings.Timeout)
+	wakeup := clock.NewTicker(loopbackWakeInterval)
+	defer wakeup.Stop()
+
+	for {
+		// Subscribe before querying so a message saved in between is not missed
+		wait := app.receivedNotifier.Wait()
+
+		id, err := app.db.FindLoopbackReply(settings.Number, token, version.MaxID)
+		if err != nil {
+			return 0, err
+		}
+		if id != 0 {
+			return clock.Now().Sub(sent), nil
+		}
+
+		select {
+		case <-wait:
+		case <-wakeup.C():
+			if err := app.smsConn.Wakeup(); err != nil {
+				log.Printf("Loopback: %v", err)
+			}
+		case <-timeout:
+			return 0, fmt.Errorf("not received within %s", settings.Timeout)
+		}
+	}
+}
+
+// runLoopbackJob runs loopback checks at the configured interval
+func (app *App) runLoopbackJob() {
+	ticker := clock.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		last, err := app.db.LastLoopbackCheck()
+		if err != nil {
+			log.Printf("Loopback: %v", err)
+		} else if !clock.Now().Before(last.Add(app.loopback.Interval)) {
+			app.runLoopbackCheck()
+		}
+
+		<-ticker.C()
+	}
+}
+
+// getLoopback returns the loopback configuration and recent checks
+func (app *App) getLoopback(c *gin.Context) {
+	if app.loopback == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"enabled": false,
+		})
+		return
+	}
+
+	checks, err := app.db.ListLoopbackChecks(20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get loopback checks: %v", err))
+		return
+	}
+
+	resp := gin.H{
+		"status":  "success",
+		"enabled": true,
+		"number":  app.loopback.Number,
+		"timeout": app.loopback.Timeout.String(),
+		"checks":  checks,
+	}
+	if app.loopback.Interval > 0 {
+		resp["interval"] = app.loopback.Interval.String()
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// runLoopbackNow runs a loopback check immediately
+func (app *App) runLoopbackNow(c *gin.Context) {
+	if app.loopback == nil {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "Loopback check is not configured"))
+		return
+	}
+
+	check := app.runLoopbackCheck()
+
+	if !check.Success {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status": "error",
+			"check":  check,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"check":  check,
+	})
+}
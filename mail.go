@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig holds the outgoing mail server settings
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// LoadSMTPConfig reads SMTP settings from environment variables.
+// It returns nil if SMTP_HOST is not set.
+func LoadSMTPConfig() (*SMTPConfig, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	config := &SMTPConfig{
+		Host:     host,
+		Port:     587,
+		Username: os.Getenv("SMTP_USERNAME"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+
+	if portStr := os.Getenv("SMTP_PORT"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 {
+			return nil, fmt.Errorf("invalid SMTP_PORT %q", portStr)
+		}
+		config.Port = port
+	}
+
+	password, err := GetSecret("SMTP_PASSWORD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SMTP password: %w", err)
+	}
+	config.Password = password
+
+	if config.From == "" {
+		config.From = config.Username
+	}
+	if _, err := mail.ParseAddress(config.From); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM address %q", config.From)
+	}
+
+	return config, nil
+}
+
+// MailMessage is an outgoing email with a plain-text and an HTML body
+type MailMessage struct {
+	To      []string
+	ReplyTo string // optional
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// SendMail sends a message as multipart/alternative.
+// The connection is upgraded with STARTTLS when the server supports it.
+func (s *SMTPConfig) SendMail(m MailMessage) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+
+	for _, part := range parts {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create mail part: %w", err)
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return fmt.Errorf("failed to write mail part: %w", err)
+		}
+		qp.Close()
+	}
+	writer.Close()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	if m.ReplyTo != "" {
+		fmt.Fprintf(&msg, "Reply-To: %s\r\n", m.ReplyTo)
+	}
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", writer.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	if err := smtp.SendMail(addr, auth, s.From, m.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+
+	return nil
+}
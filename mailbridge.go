@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxReplySize limits the size of an inbound reply email
+const maxReplySize = 1 << 20
+
+// MailBridge forwards received SMS to email and turns replies to the
+// forwarded emails back into SMS
+type MailBridge struct {
+	SMTP      *SMTPConfig
+	ForwardTo []string
+	Locale    string // language of forwarded emails
+
+	// Replies are accepted at ReplyLocal+<number>.<signature>@ReplyDomain
+	ReplyListen    string
+	ReplyLocal     string
+	ReplyDomain    string
+	AllowedSenders []string
+	secret         []byte
+}
+
+// LoadMailBridge reads email forwarding settings from environment variables.
+// It returns nil if EMAIL_FORWARD_TO is not set.
+func LoadMailBridge(smtpConfig *SMTPConfig, locale string) (*MailBridge, error) {
+	forwardTo := splitList(os.Getenv("EMAIL_FORWARD_TO"))
+	if len(forwardTo) == 0 {
+		return nil, nil
+	}
+
+	if smtpConfig == nil {
+		return nil, fmt.Errorf("EMAIL_FORWARD_TO requires SMTP_HOST to be set")
+	}
+
+	bridge := &MailBridge{
+		SMTP:      smtpConfig,
+		ForwardTo: forwardTo,
+		Locale:    locale,
+	}
+
+	bridge.ReplyListen = os.Getenv("EMAIL_REPLY_LISTEN")
+	if bridge.ReplyListen == "" {
+		return bridge, nil
+	}
+
+	address := os.Getenv("EMAIL_REPLY_ADDRESS")
+	local, domain, found := strings.Cut(address, "@")
+	if !found || local == "" || domain == "" || strings.Contains(local, "+") {
+		return nil, fmt.Errorf("EMAIL_REPLY_LISTEN requires EMAIL_REPLY_ADDRESS (e.g. sms-reply@gateway.example.com) to be set")
+	}
+	bridge.ReplyLocal = local
+	bridge.ReplyDomain = strings.ToLower(domain)
+
+	secret, err := GetSecret("EMAIL_REPLY_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("EMAIL_REPLY_LISTEN requires EMAIL_REPLY_SECRET to be set")
+	}
+	bridge.secret = []byte(secret)
+
+	bridge.AllowedSenders = splitList(os.Getenv("EMAIL_REPLY_ALLOWED_SENDERS"))
+	if len(bridge.AllowedSenders) == 0 {
+		bridge.AllowedSenders = forwardTo
+	}
+
+	return bridge, nil
+}
+
+// RepliesEnabled reports whether replies to forwarded emails are accepted
+func (b *MailBridge) RepliesEnabled() bool {
+	return b.ReplyListen != ""
+}
+
+// signature returns the token that authorizes replies to a number
+func (b *MailBridge) signature(number string) string {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// ReplyAddress returns the address that replies for number are sent to.
+// A leading "+" is encoded as "p" to keep the local part unambiguous.
+func (b *MailBridge) ReplyAddress(number string) string {
+	encoded := number
+	if strings.HasPrefix(encoded, "+") {
+		encoded = "p" + encoded[1:]
+	}
+	return fmt.Sprintf("%s+%s.%s@%s", b.ReplyLocal, encoded, b.signature(number), b.ReplyDomain)
+}
+
+// NumberFromReplyAddress returns the number a reply address belongs to,
+// verifying its signature
+func (b *MailBridge) NumberFromReplyAddress(address string) (string, error) {
+	local, domain, found := strings.Cut(address, "@")
+	if !found || !strings.EqualFold(domain, b.ReplyDomain) {
+		return "", fmt.Errorf("unknown domain")
+	}
+
+	prefix := b.ReplyLocal + "+"
+	if !strings.HasPrefix(strings.ToLower(local), strings.ToLower(prefix)) {
+		return "", fmt.Errorf("unknown mailbox")
+	}
+
+	encoded, signature, found := strings.Cut(local[len(prefix):], ".")
+	if !found || encoded == "" {
+		return "", fmt.Errorf("invalid reply address")
+	}
+
+	number := encoded
+	if strings.HasPrefix(number, "p") {
+		number = "+" + number[1:]
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(b.signature(number))) {
+		return "", fmt.Errorf("invalid reply address signature")
+	}
+
+	return number, nil
+}
+
+// senderAllowed reports whether replies from an address are accepted
+func (b *MailBridge) senderAllowed(address string) bool {
+	for _, allowed := range b.AllowedSenders {
+		if strings.EqualFold(address, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardReceived emails a received SMS to the forward addresses
+func (b *MailBridge) ForwardReceived(msg ReceivedSMS) {
+	number := msg.Number
+	received := msg.Timestamp.Local().Format("2006-01-02 15:04:05")
+
+	from, receivedLabel := T(b.Locale, "From"), T(b.Locale, "Received")
+
+	text := fmt.Sprintf("%s: %s\n%s: %s\n\n%s\n", from, number, receivedLabel, received, msg.Content)
+	htmlBody := fmt.Sprintf("<p><b>%s:</b> %s<br><b>%s:</b> %s</p>\n<p>%s</p>\n",
+		html.EscapeString(from),
+		html.EscapeString(number),
+		html.EscapeString(receivedLabel),
+		received,
+		strings.ReplaceAll(html.EscapeString(msg.Content), "\n", "<br>"))
+
+	mailMsg := MailMessage{
+		To:      b.ForwardTo,
+		Subject: T(b.Locale, "SMS from %s", number),
+		Text:    text,
+		HTML:    htmlBody,
+	}
+
+	if b.RepliesEnabled() {
+		replyHint := T(b.Locale, "Reply to this email to answer by SMS.")
+		mailMsg.ReplyTo = b.ReplyAddress(number)
+		mailMsg.Text += "\n-- \n" + replyHint + "\n"
+		mailMsg.HTML += "<p><small>" + html.EscapeString(replyHint) + "</small></p>\n"
+	}
+
+	if err := b.SMTP.SendMail(mailMsg); err != nil {
+		log.Printf("Failed to forward SMS from %s to email: %v", number, err)
+		return
+	}
+
+	log.Printf("Forwarded SMS from %s to %s", number, strings.Join(b.ForwardTo, ", "))
+}
+
+// quoteStart matches the line introducing the quoted original in a reply
+var quoteStart = regexp.MustCompile(`^(>|On .*wrote:$|-----\s*Original Message\s*-----|-- $|From: )`)
+
+// extractReplyText returns the new text of a reply email, without the quoted original
+func extractReplyText(msg *mail.Message) (string, error) {
+	text, err := plainTextBody(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if quoteStart.MatchString(line) {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// plainTextBody returns the decoded text/plain body of a message or MIME part,
+// searching multipart bodies recursively
+func plainTextBody(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", fmt.Errorf("no text/plain part")
+			}
+			if err != nil {
+				return "", fmt.Errorf("failed to read MIME part: %w", err)
+			}
+
+			text, err := plainTextBody(part.Header, part)
+			if err == nil {
+				return text, nil
+			}
+		}
+	}
+
+	if mediaType != "text/plain" {
+		return "", fmt.Errorf("unsupported content type %s", mediaType)
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// serveMailReplies accepts replies to forwarded emails over SMTP and sends
+// their text back as SMS
+func (app *App) serveMailReplies() {
+	listener, err := net.Listen("tcp", app.mailBridge.ReplyListen)
+	if err != nil {
+		log.Printf("Email replies disabled: %v", err)
+		return
+	}
+	log.Printf("Accepting email replies on %s for %s@%s", app.mailBridge.ReplyListen, app.mailBridge.ReplyLocal, app.mailBridge.ReplyDomain)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Email replies: accept failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go app.handleSMTPConn(conn)
+	}
+}
+
+// handleSMTPConn speaks a minimal subset of SMTP, enough for an MTA to relay
+// replies to the gateway
+func (app *App) handleSMTPConn(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		return text.PrintfLine("%d %s", code, msg) == nil
+	}
+
+	var from string
+	var numbers []string
+
+	if !reply(220, "arduinoSmsServer ESMTP") {
+		return
+	}
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			reply(250, "arduinoSmsServer")
+
+		case "MAIL":
+			from = smtpPathArg(arg, "FROM:")
+			numbers = nil
+			if !app.mailBridge.senderAllowed(from) {
+				log.Printf("Email replies: rejected sender %q", from)
+				reply(550, "Sender not allowed")
+				from = ""
+				continue
+			}
+			reply(250, "OK")
+
+		case "RCPT":
+			if from == "" {
+				reply(503, "MAIL first")
+				continue
+			}
+			number, err := app.mailBridge.NumberFromReplyAddress(smtpPathArg(arg, "TO:"))
+			if err != nil {
+				reply(550, "No such mailbox")
+				continue
+			}
+			numbers = append(numbers, number)
+			reply(250, "OK")
+
+		case "DATA":
+			if len(numbers) == 0 {
+				reply(503, "RCPT first")
+				continue
+			}
+			if !reply(354, "End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(text.DotReader(), maxReplySize+1))
+			if err != nil {
+				return
+			}
+			if len(data) > maxReplySize {
+				io.Copy(io.Discard, text.DotReader())
+				reply(552, "Message too large")
+				continue
+			}
+
+			if err := app.sendMailReply(from, numbers, data); err != nil {
+				log.Printf("Email replies: %v", err)
+				reply(554, err.Error())
+			} else {
+				reply(250, "OK")
+			}
+			from, numbers = "", nil
+
+		case "RSET":
+			from, numbers = "", nil
+			reply(250, "OK")
+
+		case "NOOP":
+			reply(250, "OK")
+
+		case "QUIT":
+			reply(221, "Bye")
+			return
+
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// smtpPathArg extracts the address from a MAIL FROM:<...> or RCPT TO:<...> argument
+func smtpPathArg(arg, prefix string) string {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return ""
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if end := strings.Index(path, ">"); strings.HasPrefix(path, "<") && end > 0 {
+		path = path[1:end]
+	}
+	return path
+}
+
+// sendMailReply sends the text of a reply email as SMS to each number
+func (app *App) sendMailReply(from string, numbers []string, data []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	content, err := extractReplyText(msg)
+	if err != nil {
+		return fmt.Errorf("failed to read reply text: %w", err)
+	}
+
+	for _, number := range numbers {
+		if err := app.validateSMS(number, content, SendOptions{}); err != nil {
+			return err
+		}
+		if mode := app.runMode.Get(); mode != RunModeNormal {
+			return fmt.Errorf("service is in %s mode", mode)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		_, err := app.deliverSMS(ctx, "email:"+from, number, content, SendOptions{})
+		cancel()
+		if errors.Is(err, ErrNotConnected) {
+			return fmt.Errorf("not connected to Arduino device")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send SMS to %s: %v", number, err)
+		}
+
+		log.Printf("Sent email reply from %s as SMS to %s", from, number)
+	}
+
+	return nil
+}
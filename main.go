@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -8,32 +10,58 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// shutdownTimeout is how long requests in progress may take to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
 // SMSConnection interface for both real and mock connections
 type SMSConnection interface {
-	SendSMS(number, content string) error
+	SendSMS(number, content string, opts SendOptions) error
 	Close() error
 	IsConnected() bool
 	IsGSMReady() bool
 	Wakeup() error
 	EnsureGSMReady(timeout time.Duration) error
+	USSD(code string, timeout time.Duration) (string, error)
+	ModemStatus() ModemStatus
+	OwnNumber() (string, string)
+	NetworkTime(timeout time.Duration) (time.Time, error)
+	SerialStats() SerialStats
+	Flash(ctx context.Context, settings FlashSettings) (FlashResult, error)
+	PowerCycle(reason string) error
 }
 
 // SMSRequest represents the incoming SMS request structure
 type SMSRequest struct {
-	Number  string `json:"number" binding:"required"`
-	Content string `json:"content" binding:"required"`
+	Number   string `json:"number,omitempty"`  // Recipient, or the name of an on-call schedule
+	Contact  string `json:"contact,omitempty"` // Name of a contact to send to instead of a number
+	Content  string `json:"content" binding:"required"`
+	Class    *int   `json:"class,omitempty"`     // SMS message class, 0 = flash SMS
+	SenderID string `json:"sender_id,omitempty"` // Alphanumeric sender ID, must be allowlisted
+	Template string `json:"template,omitempty"`  // Template label for statistics
+	Campaign string `json:"campaign,omitempty"`  // Campaign label for statistics
+	Group    string `json:"group,omitempty"`     // Number group to send from
+
+	TemplateVersion int `json:"template_version,omitempty"` // Approved template version the content is
+
+	ConfirmSpecial bool `json:"confirm_special,omitempty"` // Confirm a send to a short code or premium number
 }
 
 // SMSResponse represents the API response
 type SMSResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status    string `json:"status"`
+	Code      string `json:"code,omitempty"` // Machine-readable error code, e.g. GSM_NOT_READY
+	Message   string `json:"message"`
+	ID        int64  `json:"id,omitempty"`         // Sent SMS of an async send or a retry, see async.go and sentretry.go
+	Warning   string `json:"warning,omitempty"`    // E.g. that the number is premium-rate, see specialnumbers.go
+	Details   gin.H  `json:"details,omitempty"`    // Error specifics, e.g. the error_class of a failed send
+	RequestID string `json:"request_id,omitempty"` // ID of the failed request, also in the X-Request-ID header
 }
 
 // SMSListResponse represents the response for listing received SMS
@@ -54,17 +82,143 @@ type SentSMSListResponse struct {
 
 // App holds the application state
 type App struct {
-	db         *Database
-	smsConn    SMSConnection
-	deviceMode string
+	db               *Database
+	smsConn          SMSConnection
+	deviceMode       string
+	runMode          *RunModeState
+	queue            *SendQueue
+	dedup            *Deduplicator
+	storm            *StormAggregator
+	auth             *JWTConfig
+	senderIDs        []string
+	numberValidation *NumberValidation
+	specialNumbers   *SpecialNumberPolicies
+	templateApproval bool // Campaign sends must use an approved template version, see templates.go
+	haTargets        []string
+	fallbacks        []FallbackChannel
+
+	receivedNotifier *Notifier
+	events           *EventBus
+	wsHub            *WSHub
+	webhooks         *WebhookDispatcher
+	hooks            *HookSettings
+	ackEscalation    *AckEscalation
+	escalations      *Escalations
+	surveys          *Surveys
+	rules            *InboundRules
+	blocklist        *Blocklist
+	onCall           map[string]*OnCallSchedule
+	recoverySettings *RecoverySettings
+
+	reportSettings ReportSettings
+	digestSettings *DigestSettings
+	mailBridge     *MailBridge
+	keepAlive      *KeepAliveSettings
+	loopback       *LoopbackSettings
+	routing        *Router
+	tenants        *TenantScopes
+	claim          *ClaimedConnection
+	serviceWatch   *ServiceWatchSettings
+	filterWatch    *FilterWatchSettings
+	clockSync      *ClockSyncSettings
+	simClock       *SimulatedClock
+	rawSerial      *RawSerialSettings
+	flash          FlashSettings
+	testMode       *TestMode
+	maintenance    *MaintenanceWindow
+	storage        *StorageMonitor
+	healthHistory  *HealthHistory
+	recovery       *RecoveryReport
+	backup         *BackupSettings
+	sendLimit      *RateLimiter
+	listLimit      *RateLimiter
+	throttle       *ThrottleSettings
+	maxBodyBytes   int64
+	locale         string
+	modules        *Modules
 }
 
 func main() {
 	port := flag.Int("port", 7070, "HTTP server port")
+	restore := flag.String("restore", "", "Restore sms.db from a backup (\"latest\" or an object key) and exit")
+	flash := flag.String("flash", "", "Upload a compiled sketch to the Arduino, verify it and exit")
+	selftest := flag.Bool("selftest", false, "Run the device self-test, print a pass/fail report and exit")
+	installSvc := flag.Bool("install-service", false, "Install the server as a Windows service started with the given -port, and exit")
+	uninstallSvc := flag.Bool("uninstall-service", false, "Remove the Windows service and exit")
 	flag.Parse()
 
+	if *installSvc {
+		if err := installService(*port); err != nil {
+			log.Fatalf("Failed to install service: %v", err)
+		}
+		return
+	}
+
+	if *uninstallSvc {
+		if err := uninstallService(); err != nil {
+			log.Fatalf("Failed to uninstall service: %v", err)
+		}
+		return
+	}
+
+	if *restore != "" {
+		if err := RestoreBackup(*restore, DatabasePath()); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		return
+	}
+
+	if *flash != "" {
+		if err := runFlash(*flash); err != nil {
+			log.Fatalf("Flash failed: %v", err)
+		}
+		return
+	}
+
+	if *selftest {
+		if err := runSelfTest(); err != nil {
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		return
+	}
+
+	// Started by the Windows service manager, which also stops it
+	if isWindowsService() {
+		if err := runWindowsService(*port); err != nil {
+			log.Fatalf("Service failed: %v", err)
+		}
+		return
+	}
+
+	// Shut down gracefully on interrupt and termination signals
+	stop := make(chan struct{})
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+		close(stop)
+	}()
+
+	if err := runServer(*port, stop); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// runServer initializes the database, the Arduino connection and the enabled
+// modules and serves the API on port until stop is closed
+func runServer(port int, stop <-chan struct{}) error {
+	// Report panics to an error tracker
+	reporter, err := LoadErrorReporter()
+	if err != nil {
+		log.Fatalf("Failed to load error reporting configuration: %v", err)
+	}
+	if reporter != nil {
+		log.Printf("Reporting panics to %s", reporter.StoreURL)
+	}
+	errorReporter = reporter
+
 	// Initialize database
-	db, err := NewDatabase("./sms.db")
+	db, err := NewDatabase(DatabasePath())
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
@@ -72,120 +226,1161 @@ func main() {
 
 	log.Println("Database initialized successfully")
 
+	// Check the database for corruption left by a crash or a failing SD card
+	recovery := CheckIntegrity(db)
+	recoverySettings, err := LoadRecoverySettings()
+	if err != nil {
+		log.Fatalf("Failed to load recovery configuration: %v", err)
+	}
+
+	// Keep messages in memory while the database can't be written
+	db.journal, err = LoadJournal()
+	if err != nil {
+		log.Fatalf("Failed to load database journal configuration: %v", err)
+	}
+
+	// Load the optional modules to initialize
+	modules, err := LoadModules()
+	if err != nil {
+		log.Fatalf("Failed to load module configuration: %v", err)
+	}
+
+	// Load JWT authentication settings
+	auth, err := LoadJWTConfig()
+	if err != nil {
+		log.Fatalf("Failed to load JWT configuration: %v", err)
+	}
+	if auth == nil {
+		log.Println("JWT authentication disabled (no JWT_SECRET or JWT_PUBLIC_KEY set)")
+	}
+
+	// Load translations of user-facing strings
+	locale, err := LoadLocales()
+	if err != nil {
+		log.Fatalf("Failed to load locales: %v", err)
+	}
+
+	// Load email digest and forwarding settings
+	smtpConfig, err := LoadSMTPConfig()
+	if err != nil {
+		log.Fatalf("Failed to load SMTP configuration: %v", err)
+	}
+	var digestSettings *DigestSettings
+	if modules.Enabled(ModuleDigest) {
+		digestSettings, err = LoadDigestSettings(smtpConfig, locale)
+		if err != nil {
+			log.Fatalf("Failed to load digest configuration: %v", err)
+		}
+	}
+	var mailBridge *MailBridge
+	if modules.Enabled(ModuleMail) {
+		mailBridge, err = LoadMailBridge(smtpConfig, locale)
+		if err != nil {
+			log.Fatalf("Failed to load email forwarding configuration: %v", err)
+		}
+	}
+
+	// Load SIM keep-alive settings
+	var keepAlive *KeepAliveSettings
+	if modules.Enabled(ModuleKeepAlive) {
+		keepAlive, err = LoadKeepAliveSettings()
+		if err != nil {
+			log.Fatalf("Failed to load keep-alive configuration: %v", err)
+		}
+	}
+
+	// Load send-to-self check settings
+	var loopback *LoopbackSettings
+	if modules.Enabled(ModuleLoopback) {
+		loopback, err = LoadLoopbackSettings()
+		if err != nil {
+			log.Fatalf("Failed to load loopback configuration: %v", err)
+		}
+	}
+
+	// Load service loss detection settings
+	var serviceWatch *ServiceWatchSettings
+	if modules.Enabled(ModuleServiceWatch) {
+		serviceWatch, err = LoadServiceWatchSettings()
+		if err != nil {
+			log.Fatalf("Failed to load service watch configuration: %v", err)
+		}
+	}
+
+	// Load carrier filtering detection settings
+	var filterWatch *FilterWatchSettings
+	if modules.Enabled(ModuleFilterWatch) {
+		filterWatch, err = LoadFilterWatchSettings()
+		if err != nil {
+			log.Fatalf("Failed to load filter watch configuration: %v", err)
+		}
+	}
+
+	// Load event hooks
+	var hooks *HookSettings
+	if modules.Enabled(ModuleHooks) {
+		hooks, err = LoadHookSettings()
+		if err != nil {
+			log.Fatalf("Failed to load hook configuration: %v", err)
+		}
+	}
+
+	// Load block list feeds
+	var blocklist *Blocklist
+	if modules.Enabled(ModuleBlocklist) {
+		blocklist, err = LoadBlocklist()
+		if err != nil {
+			log.Fatalf("Failed to load block list configuration: %v", err)
+		}
+	}
+
+	// Load least-cost routing across devices
+	var routing *Router
+	if modules.Enabled(ModuleRouting) {
+		routing, err = LoadRouting()
+		if err != nil {
+			log.Fatalf("Failed to load routing configuration: %v", err)
+		}
+	}
+
+	// Load clock sync settings
+	var clockSync *ClockSyncSettings
+	if modules.Enabled(ModuleClockSync) {
+		clockSync, err = LoadClockSyncSettings()
+		if err != nil {
+			log.Fatalf("Failed to load clock sync configuration: %v", err)
+		}
+	}
+
+	// Load raw serial payload storage settings
+	var rawSerial *RawSerialSettings
+	if modules.Enabled(ModuleRawSerial) {
+		rawSerial, err = LoadRawSerialSettings()
+		if err != nil {
+			log.Fatalf("Failed to load raw serial configuration: %v", err)
+		}
+	}
+
+	// Load database maintenance window
+	var maintenance *MaintenanceWindow
+	if modules.Enabled(ModuleMaintenance) {
+		maintenance, err = LoadMaintenanceWindow()
+		if err != nil {
+			log.Fatalf("Failed to load maintenance configuration: %v", err)
+		}
+	}
+
+	// Load storage limits; the database size and free space are always monitored
+	storage, err := LoadStorageMonitor()
+	if err != nil {
+		log.Fatalf("Failed to load storage configuration: %v", err)
+	}
+
+	// Load the interval of the health snapshots behind /stats/availability
+	healthHistory, err := LoadHealthHistory()
+	if err != nil {
+		log.Fatalf("Failed to load health history settings: %v", err)
+	}
+
+	// Load remote backup settings
+	var backup *BackupSettings
+	if modules.Enabled(ModuleBackup) {
+		backup, err = LoadBackupSettings()
+		if err != nil {
+			log.Fatalf("Failed to load backup configuration: %v", err)
+		}
+	}
+
+	// Load per-client rate limits
+	sendLimit, err := LoadRateLimiter("RATE_LIMIT_SEND")
+	if err != nil {
+		log.Fatalf("Failed to load rate limits: %v", err)
+	}
+	listLimit, err := LoadRateLimiter("RATE_LIMIT_LIST")
+	if err != nil {
+		log.Fatalf("Failed to load rate limits: %v", err)
+	}
+
+	// Load the daily send quota and send queue limit
+	throttle, err := LoadThrottleSettings()
+	if err != nil {
+		log.Fatalf("Failed to load send limits: %v", err)
+	}
+
+	// Load the window in which identical messages are sent only once
+	dedup, err := LoadDeduplicator()
+	if err != nil {
+		log.Fatalf("Failed to load deduplication settings: %v", err)
+	}
+
+	// Load alert storm aggregation settings
+	storm, err := LoadStormAggregator()
+	if err != nil {
+		log.Fatalf("Failed to load alert storm settings: %v", err)
+	}
+
+	// Load re-notification settings for unacknowledged received SMS
+	ackEscalation, err := LoadAckEscalation()
+	if err != nil {
+		log.Fatalf("Failed to load escalation settings: %v", err)
+	}
+
+	// Load on-call rotations usable as send targets
+	onCall, err := LoadOnCallSchedules()
+	if err != nil {
+		log.Fatalf("Failed to load on-call schedules: %v", err)
+	}
+	for _, schedule := range onCall {
+		log.Printf("On-call schedule %s: %s rotation of %d numbers", schedule.Name, schedule.Rotation, len(schedule.Numbers))
+	}
+
+	// Load escalation chains for critical alerts
+	var escalations *Escalations
+	if modules.Enabled(ModuleEscalations) {
+		escalations, err = LoadEscalations()
+		if err != nil {
+			log.Fatalf("Failed to load escalation policies: %v", err)
+		}
+	}
+
+	// Surveys are defined through the API
+	var surveys *Surveys
+	if modules.Enabled(ModuleSurveys) {
+		surveys = &Surveys{}
+	}
+
+	// Inbound rules are defined through the API
+	var rules *InboundRules
+	if modules.Enabled(ModuleRules) {
+		rules = NewInboundRules()
+	}
+
+	// Load fallback channels for failed sends
+	fallbacks, err := LoadFallbackChannels()
+	if err != nil {
+		log.Fatalf("Failed to load fallback channels: %v", err)
+	}
+	for _, channel := range fallbacks {
+		log.Printf("Fallback channel for failed SMS: %s", channel.Name())
+	}
+
+	// Load the initial runtime mode
+	runMode, err := GetRunMode()
+	if err != nil {
+		log.Fatalf("Failed to load runtime mode: %v", err)
+	}
+
+	// Load the rules for numbers SMS are sent to
+	numberValidation, err := LoadNumberValidation()
+	if err != nil {
+		log.Fatalf("Failed to load number validation: %v", err)
+	}
+	log.Printf("Number validation: %s", numberValidation)
+	normalizedLengths = numberValidation.bounds()
+
+	// Load the policies for sending to short codes and premium-rate numbers
+	specialNumbers, err := LoadSpecialNumberPolicies()
+	if err != nil {
+		log.Fatalf("Failed to load special number policies: %v", err)
+	}
+	log.Printf("Special number policies: %s", specialNumbers)
+
 	// Get device mode from environment
 	deviceMode := GetDeviceMode()
 	log.Printf("Device mode: %s", deviceMode)
 
-	// Initialize connection to Arduino
+	// Run the time-driven jobs on a simulated clock for tests
+	simClock, err := LoadSimulatedClock(deviceMode)
+	if err != nil {
+		log.Fatalf("Failed to load simulated clock: %v", err)
+	}
+	if simClock != nil {
+		clock = simClock
+		log.Printf("Simulated clock: starting at %s, advanced through POST /admin/clock/advance", simClock.Now().Format(time.RFC3339))
+	}
+
+	// Coordinate with other instances sharing the database
+	deviceClaim, err := LoadDeviceClaimSettings()
+	if err != nil {
+		log.Fatalf("Failed to load device claim configuration: %v", err)
+	}
+	if deviceClaim != nil && routing != nil {
+		log.Fatalf("DEVICE_CLAIM can't be combined with least-cost routing")
+	}
+
+	// Load the API keys that only get the events of their own messages
+	tenants, err := LoadTenantScopes(routing)
+	if err != nil {
+		log.Fatalf("Failed to load tenant scopes: %v", err)
+	}
+
+	// Thread, wake long-polling clients, push to WebSocket clients, call webhooks
+	// and forward to email (unless the number is muted) whenever a new SMS is
+	// received. The hub and dispatcher stay nil when their module is disabled.
+	receivedNotifier := NewNotifier()
+	var wsHub *WSHub
+	if modules.Enabled(ModuleWebSocket) {
+		wsHub = NewWSHub()
+	}
+	var webhooks *WebhookDispatcher
+	if modules.Enabled(ModuleWebhooks) {
+		webhooks = NewWebhookDispatcher(db, tenants)
+	}
+	events := NewEventBus()
+	events.Subscribe(logEvent, EventDeviceConnected, EventDeviceDisconnected, EventGSMState)
+	events.Subscribe(func(event Event) {
+		msg := event.Data.(ReceivedSMS)
+		if rawSerial != nil && msg.ID != 0 && msg.Raw != "" {
+			if err := db.SaveSerialPayload(int64(msg.ID), 0, "", msg.Raw); err != nil {
+				log.Printf("Failed to save serial payload: %v", err)
+			}
+		}
+		if msg.ID != 0 {
+			if threadID, opened, err := db.AddToThread(msg); err != nil {
+				log.Printf("Failed to add SMS to thread: %v", err)
+			} else if opened {
+				log.Printf("Opened thread %d for %s", threadID, msg.Number)
+			}
+		}
+		receivedNotifier.Notify()
+	}, EventMessageReceived)
+	// Received SMS are passed on by webhook and email unless they are loopback
+	// checks coming back, which are only matched by the check, or from muted
+	// or blocked numbers
+	events.Subscribe(func(event Event) {
+		msg := event.Data.(ReceivedSMS)
+		if loopback.IsLoopback(msg) {
+			log.Printf("Received loopback check from %s", msg.Number)
+			return
+		}
+		if blocklist.IsBlocked(db, msg.Number) {
+			log.Printf("Not forwarding SMS from blocked number %s", msg.Number)
+			return
+		}
+		if muted, err := db.IsMuted(msg.Number); err != nil {
+			log.Printf("Failed to check mute of %s: %v", msg.Number, err)
+		} else if muted {
+			log.Printf("Not forwarding SMS from muted number %s", msg.Number)
+			return
+		}
+		webhooks.DispatchReceived(msg)
+		if mailBridge != nil {
+			go mailBridge.ForwardReceived(msg)
+		}
+	}, EventMessageReceived)
+	if webhooks != nil {
+		events.Subscribe(webhooks.HandleEvent, EventMessageEscalated, EventServiceLost, EventServiceRestored)
+	}
+	if hooks != nil {
+		events.Subscribe(hooks.HandleEvent)
+	}
+	events.Subscribe(alertSink(fallbacks), EventServiceLost, EventKeepAliveFailed, EventLoopbackFailed, EventMessageEscalated, EventFilteringSuspected, EventStorageLow)
+
+	gsmSettings, err := LoadGSMSettings()
+	if err != nil {
+		log.Fatalf("Failed to load GSM configuration: %v", err)
+	}
+	if ps := gsmSettings.PowerSwitch; ps != nil {
+		log.Printf("Power switch: %s, cycling power after %s without connection", ps.Method(), ps.After)
+	}
+
+	// Load sketch flashing settings
+	flashSettings, err := LoadFlashSettings()
+	if err != nil {
+		log.Fatalf("Failed to load flash configuration: %v", err)
+	}
+
+	// Count corrupted serial lines and report bursts of them
+	corruptionThreshold, err := LoadSerialCorruptionThreshold()
+	if err != nil {
+		log.Fatalf("Failed to load serial configuration: %v", err)
+	}
+	monitor := NewSerialMonitor(corruptionThreshold, func(event CorruptionEvent) {
+		events.Publish(EventDeviceCorruption, event)
+	})
+
+	// Initialize connection to Arduino. With a device claim only the instance
+	// holding it connects; the others serve the API from the shared database.
 	var smsConn SMSConnection
+	var claimedConn *ClaimedConnection
 
-	if deviceMode == "mock" {
-		log.Println("Using mock serial connection")
+	if deviceClaim != nil {
+		log.Printf("Device claim: %s as instance %s", deviceClaim.Device, deviceClaim.Instance)
+		claimedConn = NewClaimedConnection(deviceClaim, db, func() (SMSConnection, error) {
+			return OpenDevice(deviceMode, db, gsmSettings, events, monitor)
+		})
+		smsConn = claimedConn
+	} else if conn, err := OpenDevice(deviceMode, db, gsmSettings, events, monitor); err != nil {
+		log.Printf("%v", err)
+		log.Println("Falling back to mock mode")
 		smsConn = NewMockSerialConnection("/dev/ttyACM0")
 	} else {
-		// Auto-discover or use specific port
-		var portName string
-
-		if deviceMode == "auto" {
-			log.Println("Auto-discovering Arduino device...")
-			discoveredPort, err := DiscoverArduino()
-			if err != nil {
-				log.Printf("Arduino discovery failed: %v", err)
-				log.Println("Falling back to mock mode")
-				smsConn = NewMockSerialConnection("/dev/ttyACM0")
-			} else {
-				portName = discoveredPort
-			}
-		} else {
-			portName = deviceMode
-		}
-
-		if portName != "" {
-			arduinoConn, err := NewArduinoConnection(portName, db)
-			if err != nil {
-				log.Printf("Failed to connect to Arduino on %s: %v", portName, err)
-				log.Println("Falling back to mock mode")
-				smsConn = NewMockSerialConnection(portName)
-			} else {
-				smsConn = arduinoConn
-				log.Printf("Successfully connected to Arduino on %s", portName)
+		smsConn = conn
+	}
+
+	defer smsConn.Close()
+
+	// Send through the cheapest device when routing is configured
+	send := func(number, content string, opts SendOptions) error {
+		err := smsConn.SendSMS(number, content, opts)
+		if err == nil {
+			db.recordSentDevice(opts.SentID, routingPrimary)
+		}
+		return err
+	}
+	if routing != nil {
+		routing.OpenDevices(smsConn, db, gsmSettings, events)
+		defer routing.Close()
+		send = routing.SendSMS
+	}
+
+	// Mark queued sends as sending once a dispatcher hands them to the device
+	deviceSend := send
+	send = func(number, content string, opts SendOptions) error {
+		if opts.SentID != 0 {
+			if err := db.MarkSentSMSSending(opts.SentID); err != nil {
+				log.Printf("Failed to save sent SMS to database: %v", err)
 			}
 		}
+		return deviceSend(number, content, opts)
 	}
 
-	defer smsConn.Close()
+	// Start the outbound send queue
+	retryPolicies, err := LoadRetryPolicies()
+	if err != nil {
+		log.Fatalf("Failed to load retry policies: %v", err)
+	}
+	queue := NewSendQueue(send, retryPolicies, gsmSettings.SendPipeline)
+	if err := queue.UseOutbox(db); err != nil {
+		log.Fatalf("Failed to open outbox: %v", err)
+	}
+	// Messages queued before a switch to read-only or maintenance mode wait
+	// until the mode is normal again
+	runModeState := NewRunModeState(runMode)
+	queue.HoldWhile(func() bool { return runModeState.Get() != RunModeNormal })
+	queue.Start()
+	defer queue.Stop()
 
 	// Create app instance
 	app := &App{
-		db:         db,
-		smsConn:    smsConn,
-		deviceMode: deviceMode,
+		db:               db,
+		smsConn:          smsConn,
+		deviceMode:       deviceMode,
+		runMode:          runModeState,
+		queue:            queue,
+		dedup:            dedup,
+		storm:            storm,
+		auth:             auth,
+		senderIDs:        GetSenderIDAllowlist(),
+		numberValidation: numberValidation,
+		specialNumbers:   specialNumbers,
+		templateApproval: os.Getenv("TEMPLATE_APPROVAL") == "true",
+		haTargets:        GetHomeAssistantTargets(),
+		fallbacks:        fallbacks,
+
+		receivedNotifier: receivedNotifier,
+		events:           events,
+		wsHub:            wsHub,
+		webhooks:         webhooks,
+		hooks:            hooks,
+		ackEscalation:    ackEscalation,
+		escalations:      escalations,
+		surveys:          surveys,
+		rules:            rules,
+		blocklist:        blocklist,
+		onCall:           onCall,
+		recoverySettings: recoverySettings,
+
+		reportSettings: GetReportSettings(),
+		digestSettings: digestSettings,
+		mailBridge:     mailBridge,
+		keepAlive:      keepAlive,
+		loopback:       loopback,
+		routing:        routing,
+		tenants:        tenants,
+		claim:          claimedConn,
+		serviceWatch:   serviceWatch,
+		filterWatch:    filterWatch,
+		clockSync:      clockSync,
+		simClock:       simClock,
+		rawSerial:      rawSerial,
+		flash:          flashSettings,
+		testMode:       LoadTestMode(),
+		maintenance:    maintenance,
+		storage:        storage,
+		healthHistory:  healthHistory,
+		recovery:       recovery,
+		backup:         backup,
+		sendLimit:      sendLimit,
+		listLimit:      listLimit,
+		throttle:       throttle,
+		maxBodyBytes:   GetMaxBodyBytes(),
+		locale:         locale,
+		modules:        modules,
+	}
+	log.Printf("Runtime mode: %s", app.runMode.Get())
+	if app.testMode != nil {
+		log.Printf("Test mode: only sending to %s, all other sends are simulated", strings.Join(app.testMode.allowlist, ", "))
+	}
+
+	if dedup != nil {
+		log.Printf("Outbox deduplication window: %s", dedup.Window)
+	}
+	if storm != nil {
+		log.Printf("Alert storm digests: %s", storm)
+	}
+	if sendLimit != nil {
+		log.Printf("Send rate limit: %s", sendLimit)
+	}
+	if listLimit != nil {
+		log.Printf("List rate limit: %s", listLimit)
+	}
+	if throttle != nil {
+		log.Printf("Send limits: %s", throttle)
+	}
+	if tenants != nil {
+		log.Printf("Tenant scopes: %s", tenants)
+	}
+	if app.templateApproval {
+		log.Printf("Template approval: campaign sends must use an approved template version")
+	}
+
+	if wsHub != nil {
+		modules.Activate(ModuleWebSocket)
+	}
+	if webhooks != nil {
+		modules.Activate(ModuleWebhooks)
+	}
+	if hooks != nil {
+		log.Printf("Event hooks: running executables from %s", hooks.Dir)
+		modules.Activate(ModuleHooks)
+	}
+	if rules != nil {
+		events.Subscribe(app.applyInboundRules, EventMessageReceived)
+		modules.Activate(ModuleRules)
+	}
+	if blocklist != nil {
+		modules.Activate(ModuleBlocklist)
+	}
+
+	// Every instance writes back its own journal
+	if db.journal != nil {
+		go app.runJournalFlushJob()
+	}
+
+	// Background jobs run on one instance only: with a device claim they start
+	// once this instance first holds it
+	startJobs := func() {
+		// Reconcile sends a crash left without an outcome and resume the
+		// ones still waiting in the outbox
+		go reportPanics("resumeOutbox", func() {
+			app.reconcileInterruptedSends()
+			app.resumeOutbox()
+		})
+
+		// Re-notify about received SMS nobody has acknowledged
+		if ackEscalation != nil {
+			log.Printf("Escalating unacknowledged SMS every %s, up to %d times", ackEscalation.After, ackEscalation.Limit)
+			go reportPanics("runAckEscalationJob", app.runAckEscalationJob)
+		}
+
+		// Pass escalations along their chains
+		if escalations != nil {
+			log.Printf("Escalation policies: %d", len(escalations.Policies))
+			modules.Activate(ModuleEscalations)
+			go reportPanics("runEscalationJob", app.runEscalationJob)
+		}
+
+		// Advance survey runs as answers arrive
+		if surveys != nil {
+			modules.Activate(ModuleSurveys)
+			go reportPanics("runSurveyJob", app.runSurveyJob)
+		}
+
+		// Generate monthly usage reports in the background
+		if modules.Enabled(ModuleReports) {
+			modules.Activate(ModuleReports)
+			go reportPanics("runReportJob", app.runReportJob)
+		}
+
+		// Email a digest of received messages and failures
+		if digestSettings != nil {
+			log.Printf("Email digest: %s to %s", digestSettings.Schedule, strings.Join(digestSettings.Recipients, ", "))
+			modules.Activate(ModuleDigest)
+			go reportPanics("runDigestJob", app.runDigestJob)
+		}
+
+		// Forward received SMS by email and accept replies
+		if mailBridge != nil {
+			modules.Activate(ModuleMail)
+			if mailBridge.RepliesEnabled() {
+				go reportPanics("serveMailReplies", app.serveMailReplies)
+			}
+		}
+
+		// Keep the SIM active with periodic outgoing activity
+		if keepAlive != nil {
+			log.Printf("SIM keep-alive: %s %s every %s", keepAlive.Method, keepAlive.target(), keepAlive.Interval)
+			modules.Activate(ModuleKeepAlive)
+			go reportPanics("runKeepAliveJob", app.runKeepAliveJob)
+		}
+
+		// Check the full send and receive path by sending to the own number
+		if loopback != nil {
+			modules.Activate(ModuleLoopback)
+			if loopback.Interval > 0 {
+				log.Printf("Loopback check: SMS to %s every %s", loopback.Number, loopback.Interval)
+				go reportPanics("runLoopbackJob", app.runLoopbackJob)
+			}
+		}
+
+		// Alert on sudden loss of network service, e.g. from jamming
+		if serviceWatch != nil {
+			log.Printf("Service watch: alerting on loss of network registration")
+			modules.Activate(ModuleServiceWatch)
+			go reportPanics("runServiceWatchJob", app.runServiceWatchJob)
+		}
+
+		// Warn about destinations that silently stopped receiving messages
+		if filterWatch != nil {
+			log.Printf("Filter watch: %s", filterWatch)
+			modules.Activate(ModuleFilterWatch)
+			go reportPanics("runFilterWatchJob", app.runFilterWatchJob)
+		}
+
+		// Route sends by destination prefix across devices
+		if routing != nil {
+			log.Printf("Least-cost routing across %d devices", len(routing.Devices))
+			for _, group := range routing.Groups {
+				log.Printf("Number group %s: %d devices, %s rotation", group.Name, len(group.Devices), group.Rotation)
+			}
+			modules.Activate(ModuleRouting)
+		}
+
+		// Compare the local clock with network time
+		if clockSync != nil {
+			log.Printf("Clock sync: checking drift from network time every %s (%s mode)", clockSync.Interval, clockSync.Mode)
+			modules.Activate(ModuleClockSync)
+			go reportPanics("runClockSyncJob", app.runClockSyncJob)
+		}
+
+		// Keep raw serial payloads for forensic debugging
+		if rawSerial != nil {
+			log.Printf("Storing raw serial payloads for %s", rawSerial.Retention)
+			modules.Activate(ModuleRawSerial)
+			go reportPanics("runRawSerialPruneJob", app.runRawSerialPruneJob)
+		}
+
+		// Analyze and vacuum the database in the maintenance window
+		if maintenance != nil {
+			log.Printf("Database maintenance window: %s", maintenance)
+			modules.Activate(ModuleMaintenance)
+			go reportPanics("runMaintenanceJob", app.runMaintenanceJob)
+		}
+
+		// Watch the database size and free disk space
+		log.Printf("Storage limits: %s", storage)
+		go reportPanics("runStorageJob", app.runStorageJob)
+
+		// Record the gateway's health for availability reporting
+		log.Printf("Health snapshots every %s", healthHistory.Interval)
+		go reportPanics("runHealthSnapshotJob", app.runHealthSnapshotJob)
+
+		// Import block list feeds
+		if blocklist != nil && len(blocklist.Feeds) > 0 {
+			log.Printf("Block list feeds: %d, imported every %s", len(blocklist.Feeds), blocklist.Refresh)
+			go reportPanics("runBlocklistJob", app.runBlocklistJob)
+		}
+
+		// Upload encrypted database backups
+		if backup != nil {
+			log.Printf("Backups: every %s to %s/%s/%s", backup.Interval, backup.S3.Endpoint, backup.S3.Bucket, backup.Prefix)
+			modules.Activate(ModuleBackup)
+			go reportPanics("runBackupJob", app.runBackupJob)
+		}
+	}
+	if claimedConn != nil {
+		go func() {
+			<-claimedConn.Held()
+			startJobs()
+		}()
+	} else {
+		startJobs()
 	}
 
-	// Create Gin router
-	router := gin.Default()
+	// Create Gin router; handler panics are answered with 500 and reported
+	router := gin.New()
+	router.Use(gin.Logger(), recoveryMiddleware())
 
 	// Setup routes
 	app.setupRoutes(router)
 
-	// Handle graceful shutdown
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: router,
+	}
+
+	// Handle graceful shutdown; the queue, connection and database are
+	// closed by the deferred calls once the server has stopped
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-		<-sigChan
+		<-stop
 
 		log.Println("Shutting down...")
-		smsConn.Close()
-		db.Close()
-		os.Exit(0)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			// Long-polling and WebSocket clients don't finish by themselves
+			server.Close()
+		}
 	}()
 
 	// Start server
-	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Starting Arduino SMS Server on port %d", *port)
-	if err := router.Run(addr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	log.Printf("Starting Arduino SMS Server on port %d", port)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// apiVersionPrefix is the path prefix of the current API version
+const apiVersionPrefix = "/v1"
+
+// unversionedPath returns a request path without the API version prefix
+func unversionedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, apiVersionPrefix); ok && (rest == "" || rest[0] == '/') {
+		return rest
 	}
+	return path
+}
+
+// apiPath returns the path of a route in the API version of the request
+func apiPath(c *gin.Context, path string) string {
+	if unversionedPath(c.Request.URL.Path) != c.Request.URL.Path {
+		return apiVersionPrefix + path
+	}
+	return path
 }
 
 // setupRoutes configures all API routes
 func (app *App) setupRoutes(router *gin.Engine) {
+	// Tag every request with an ID returned in error responses
+	router.Use(requestIDMiddleware())
+
+	// Select the language of error messages
+	router.Use(localeMiddleware(app.locale))
+
+	// Compress responses for clients that accept gzip
+	router.Use(gzipMiddleware())
+
+	// Only accept JSON request bodies of limited size
+	router.Use(jsonBodyMiddleware(app.maxBodyBytes))
+
+	// API description of the versioned routes
+	router.GET("/openapi.json", app.runModeMiddleware(), app.serveOpenAPI(router))
+	if SwaggerUIEnabled() {
+		router.GET("/docs", app.runModeMiddleware(), serveSwaggerUI)
+	}
+
+	// The API is served under /v1, and without a prefix for integrations
+	// written before it was versioned. Breaking changes ship under /v2.
+	app.setupAPIRoutes(router.Group(apiVersionPrefix))
+	app.setupAPIRoutes(&router.RouterGroup)
+
+	// Modules that only add routes are active once their routes are registered
+	for _, name := range []string{ModuleRPC, ModuleMetrics, ModuleHomeAssistant, ModuleNodeRED, ModuleNotify} {
+		if app.modules.Enabled(name) {
+			app.modules.Activate(name)
+		}
+	}
+	log.Printf("Active modules: %s", strings.Join(app.modules.Active(), ", "))
+}
+
+// setupAPIRoutes registers the API routes on base
+func (app *App) setupAPIRoutes(base *gin.RouterGroup) {
 	// Health check endpoint
-	router.GET("/health", app.healthCheck)
+	base.GET("/health", app.healthCheck)
+
+	// Routes other than /health and the admin routes are rejected when not
+	// allowed in the current runtime mode
+	router := base.Group("", app.runModeMiddleware())
+
+	// Routes requiring the sms:send role, rate limited per client and
+	// subject to the daily quota and queue limit
+	send := router.Group("", app.requireRole(RoleSend), app.rateLimit(app.sendLimit), app.sendThrottle())
 
 	// SMS sending endpoint
-	router.POST("/send", app.sendSMS)
+	send.POST("/send", app.sendSMS)
+
+	// Send and wait for the reply, which also requires the sms:read role
+	send.POST("/send/await", app.requireRole(RoleRead), app.sendAndAwaitReply)
+
+	// Send a failed SMS again
+	send.POST("/sent/:id/retry", app.retrySentSMS)
+
+	// Support thread replies
+	send.POST("/threads/:id/reply", app.replyToThread)
+	send.POST("/threads/:id/close", app.closeThread)
+
+	// Escalation chains
+	if app.escalations != nil {
+		send.POST("/escalations", app.createEscalation)
+		send.POST("/escalations/:id/cancel", app.cancelEscalation)
+	}
+
+	// Surveys
+	if app.surveys != nil {
+		send.POST("/surveys/:id/start", app.startSurvey)
+		send.POST("/surveys/:id/runs/:run/cancel", app.cancelSurveyRun)
+	}
+
+	// Home Assistant RESTful notify target
+	if app.modules.Enabled(ModuleHomeAssistant) {
+		send.POST("/homeassistant/notify", app.homeAssistantNotify)
+	}
+
+	// Routes requiring the sms:read role
+	read := router.Group("", app.requireRole(RoleRead))
+
+	// List endpoints hit the database on every call and are rate limited per client
+	list := read.Group("", app.rateLimit(app.listLimit))
 
 	// Get received SMS
-	router.GET("/received", app.getReceivedSMS)
+	list.GET("/received", app.getReceivedSMS)
 
 	// Search received SMS by content
-	router.GET("/received/search", app.searchReceivedSMS)
+	list.GET("/received/search", app.searchReceivedSMS)
+
+	// Long-poll for new received SMS
+	list.GET("/received/poll", app.pollReceivedSMS)
+
+	// Unacknowledged received SMS
+	list.GET("/received/unacked", app.getUnackedSMS)
 
-	// Get received SMS by number
-	router.GET("/received/:number", app.getReceivedSMSByNumber)
+	// Get received SMS by number, or one by ID
+	list.GET("/received/:number", app.getReceivedSMSByNumber)
+	read.GET("/received/id/:id", app.getReceivedSMSByID)
 
 	// Get sent SMS
-	router.GET("/sent", app.getSentSMS)
+	list.GET("/sent", app.getSentSMS)
+
+	// Get sent SMS by number, or one by ID
+	list.GET("/sent/:number", app.getSentSMSByNumber)
+	read.GET("/sent/id/:id", app.getSentSMSByID)
+
+	// Export the message history
+	list.GET("/export", app.exportMessages)
+	list.GET("/export/received", app.exportReceivedSMS)
+	list.GET("/export/sent", app.exportSentSMS)
+
+	// Acknowledge a received SMS
+	router.POST("/received/:id/ack", app.requireRole(RoleSend), app.ackReceivedSMS)
+
+	// Read flags for consumers processing received SMS
+	read.POST("/received/:id/read", app.markReceivedSMSRead)
+	read.POST("/received/read-all", app.markAllReceivedSMSRead)
+
+	// Operator notes on received SMS
+	router.POST("/received/:id/notes", app.requireRole(RoleSend), app.addNote)
+	router.DELETE("/received/:id/notes/:note_id", app.requireRole(RoleSend), app.deleteNote)
+	list.GET("/notes", app.searchNotes)
+
+	// Saved searches
+	list.GET("/searches", app.listSearches)
+	read.GET("/searches/:name", app.getSearch)
+	list.GET("/searches/:name/run", app.runSearch)
+	router.POST("/searches", app.requireRole(RoleSend), app.createSearch)
+	router.DELETE("/searches/:name", app.requireRole(RoleSend), app.deleteSearch)
+
+	// Versioned message templates
+	read.GET("/templates", app.listTemplates)
+	read.GET("/templates/:name", app.getTemplate)
+	router.POST("/templates/:name/versions", app.requireRole(RoleSend), app.addTemplateVersion)
+
+	// Contact languages for template translations
+	list.GET("/contacts", app.listContacts)
+	router.POST("/contacts", app.requireRole(RoleSend), app.createContact)
+	read.GET("/contacts/:number", app.getContact)
+	router.PUT("/contacts/:number", app.requireRole(RoleSend), app.setContact)
+	router.DELETE("/contacts/:number", app.requireRole(RoleSend), app.deleteContact)
+
+	// Escalation chains
+	if app.escalations != nil {
+		list.GET("/escalations", app.listEscalations)
+		read.GET("/escalations/:id", app.getEscalation)
+		read.POST("/escalations/:id/ack", app.acknowledgeEscalation)
+	}
+
+	// Inbound routing and auto-reply rules
+	if app.rules != nil {
+		read.GET("/rules", app.listInboundRules)
+		read.GET("/rules/:id", app.getInboundRule)
+	}
 
-	// Get sent SMS by number
-	router.GET("/sent/:number", app.getSentSMSByNumber)
+	// Surveys and their results
+	if app.surveys != nil {
+		read.GET("/surveys", app.listSurveys)
+		read.GET("/surveys/:id", app.getSurvey)
+		list.GET("/surveys/:id/results", app.getSurveyResults)
+	}
+
+	// On-call schedules
+	read.GET("/oncall", app.getOnCall)
+
+	// Device and SIM details
+	read.GET("/device/info", app.getDeviceInfo)
+	read.GET("/devices", app.listDevices)
 
 	// Get statistics
-	router.GET("/stats", app.getStats)
+	read.GET("/stats", app.getStats)
+	read.GET("/stats/availability", app.getAvailability)
+
+	// Prometheus metrics
+	if app.modules.Enabled(ModuleMetrics) {
+		read.GET("/metrics", app.getMetrics)
+	}
+
+	// Annotate a number with its country, type and message activity
+	read.GET("/lookup/:number", app.lookupNumber)
+
+	// Conversations and the messages exchanged with each peer
+	list.GET("/conversations", app.getConversations)
+	list.GET("/conversations/:id", app.getConversation)
+
+	// Support threads
+	list.GET("/threads", app.listThreads)
+	read.GET("/threads/:id", app.getThread)
+
+	// Node-RED pull endpoint
+	if app.modules.Enabled(ModuleNodeRED) {
+		read.GET("/nodered/received", app.noderedReceived)
+	}
+
+	// Home Assistant RESTful sensors
+	if app.modules.Enabled(ModuleHomeAssistant) {
+		read.GET("/homeassistant/connectivity", app.homeAssistantConnectivity)
+		read.GET("/homeassistant/sensor", app.homeAssistantSensor)
+	}
+
+	// List pending outbound messages
+	read.GET("/queue", app.getQueue)
+
+	// JSON-RPC endpoint; roles are checked per method
+	if app.modules.Enabled(ModuleRPC) {
+		router.POST("/rpc", app.requireAuth(), app.handleRPC)
+	}
+
+	// WebSocket event and command channel; roles are checked per command
+	if app.wsHub != nil {
+		router.GET("/ws", tokenFromQuery(), app.requireAuth(), app.handleWebSocket)
+	}
+
+	// Monitoring alert script compatibility (token may be passed as ?access_token=)
+	if app.modules.Enabled(ModuleNotify) {
+		router.Match([]string{http.MethodGet, http.MethodPost}, "/notify", tokenFromQuery(), app.requireRole(RoleSend), app.notifyCompat)
+	}
+
+	// Routes requiring the admin role
+	admin := base.Group("", app.requireRole(RoleAdmin))
 
 	// GSM wakeup endpoint
-	router.GET("/wakeup", app.wakeupGSM)
+	admin.GET("/wakeup", app.wakeupGSM)
+
+	// Erase all stored data for a number (GDPR)
+	admin.DELETE("/numbers/:number/data", app.eraseNumberData)
+
+	// Delete messages from the history, one by one or in bulk
+	admin.DELETE("/received", app.purgeReceivedSMS)
+	admin.DELETE("/received/id/:id", app.deleteReceivedSMS)
+	admin.DELETE("/sent", app.purgeSentSMS)
+	admin.DELETE("/sent/id/:id", app.deleteSentSMS)
+
+	// Approve a template version for sending
+	admin.POST("/templates/:name/versions/:version/approve", app.approveTemplateVersion)
+
+	// Silence webhooks and email forwarding for a number
+	admin.GET("/mutes", app.listMutes)
+	admin.POST("/numbers/:number/mute", app.muteNumber)
+	admin.DELETE("/numbers/:number/mute", app.unmuteNumber)
+
+	// Blocked numbers and block list feeds
+	if app.blocklist != nil {
+		admin.GET("/admin/blocklist", app.listNumberFilters)
+		admin.POST("/admin/blocklist", app.setNumberFilter)
+		admin.DELETE("/admin/blocklist/:number", app.deleteNumberFilter)
+		admin.GET("/admin/blocklist/feeds", app.listBlocklistFeeds)
+		admin.POST("/admin/blocklist/feeds/:name/import", app.importBlocklistFeed)
+	}
+
+	// Rule and survey definitions
+	if app.rules != nil {
+		admin.POST("/rules", app.createInboundRule)
+		admin.DELETE("/rules/:id", app.deleteInboundRule)
+		admin.POST("/rules/:id/test", app.testInboundRule)
+	}
+	if app.surveys != nil {
+		admin.POST("/surveys", app.createSurvey)
+		admin.DELETE("/surveys/:id", app.deleteSurvey)
+	}
+
+	// Outbound queue control
+	admin.POST("/queue/pause", app.pauseQueue)
+	admin.POST("/queue/resume", app.resumeQueue)
+	admin.DELETE("/queue/:id", app.cancelQueuedSMS)
+
+	// Admin endpoints
+	admin.GET("/admin/mode", app.getRunMode)
+	admin.PUT("/admin/mode", app.setRunMode)
+	admin.GET("/admin/keys/:id/usage", app.getKeyUsage)
+
+	// Monthly usage reports
+	if app.modules.Enabled(ModuleReports) {
+		admin.GET("/reports", app.listReports)
+		admin.GET("/reports/:month", app.getReport)
+	}
+
+	// Webhooks
+	if app.modules.Enabled(ModuleWebhooks) {
+		admin.GET("/webhooks", app.listWebhooks)
+		admin.POST("/webhooks", app.createWebhook)
+		admin.DELETE("/webhooks/:id", app.deleteWebhook)
+		admin.POST("/webhooks/:id/replay", app.replayWebhook)
+		admin.POST("/webhooks/:id/test", app.testWebhook)
+	}
+
+	// Email digest
+	if app.modules.Enabled(ModuleDigest) {
+		admin.POST("/admin/digest", app.sendDigestNow)
+	}
+
+	// Database maintenance
+	admin.GET("/admin/db/stats", app.getDBStats)
+	admin.POST("/admin/db/vacuum", app.vacuumDB)
+	admin.POST("/admin/db/analyze", app.analyzeDB)
+	admin.GET("/admin/recovery", app.getRecovery)
+
+	// Remote backups
+	if app.modules.Enabled(ModuleBackup) {
+		admin.GET("/admin/backups", app.listBackupsHandler)
+		admin.POST("/admin/backup", app.backupNow)
+	}
+
+	// SIM keep-alive
+	if app.modules.Enabled(ModuleKeepAlive) {
+		admin.GET("/admin/keepalive", app.getKeepAlive)
+		admin.POST("/admin/keepalive", app.runKeepAliveNow)
+	}
+
+	// Send-to-self checks
+	if app.modules.Enabled(ModuleLoopback) {
+		admin.GET("/admin/loopback", app.getLoopback)
+		admin.POST("/admin/loopback", app.runLoopbackNow)
+	}
+	if app.modules.Enabled(ModuleRouting) {
+		admin.GET("/admin/routing", app.getRouting)
+	}
+	if app.modules.Enabled(ModuleServiceWatch) {
+		admin.GET("/admin/service", app.getServiceWatch)
+	}
+	if app.modules.Enabled(ModuleHooks) {
+		admin.GET("/admin/hooks", app.getHooks)
+	}
+
+	// Clock sync with network time
+	if app.modules.Enabled(ModuleClockSync) {
+		admin.GET("/admin/clock", app.getClock)
+		admin.POST("/admin/clock/sync", app.syncClockNow)
+	}
+
+	// Simulated clock in mock mode
+	if app.simClock != nil {
+		admin.POST("/admin/clock/advance", app.advanceClock)
+	}
+
+	// Raw serial payloads of messages
+	if app.rawSerial != nil {
+		admin.GET("/admin/raw/received/:id", app.getReceivedSerialPayload)
+		admin.GET("/admin/raw/sent/:id", app.getSentSerialPayload)
+	}
+
+	// Sketch updates
+	if app.flash.Image != "" {
+		admin.POST("/admin/flash", app.flashSketch)
+	}
+
+	// Device recovery
+	admin.GET("/admin/device/events", app.getDeviceEvents)
+	admin.PUT("/admin/devices/:name", app.setDeviceLabel)
+	admin.DELETE("/admin/devices/:name", app.deleteDeviceLabel)
+	admin.POST("/admin/device/power-cycle", app.powerCycleDevice)
 }
 
 // healthCheck returns the health status of the service
 func (app *App) healthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
+	database := app.db.journal.Status()
+	health := gin.H{
 		"status":    "healthy",
 		"service":   "Arduino SMS Server",
 		"connected": app.smsConn.IsConnected(),
 		"gsm_ready": app.smsConn.IsGSMReady(),
 		"mode":      app.deviceMode,
+		"run_mode":  app.runMode.Get(),
+		"test_mode": app.testMode != nil,
+		"modules":   app.modules.Active(),
+		"database":  database,
+	}
+	if !database.Writable {
+		health["status"] = "degraded"
+	}
+	if app.claim != nil {
+		health["device_claim"] = app.claim.Status()
+	}
+	c.JSON(http.StatusOK, health)
+}
+
+// deviceStatus summarizes the device connection and send queue state
+func (app *App) deviceStatus() gin.H {
+	return gin.H{
+		"connected":    app.smsConn.IsConnected(),
+		"gsm_ready":    app.smsConn.IsGSMReady(),
+		"mode":         app.deviceMode,
+		"run_mode":     app.runMode.Get(),
+		"test_mode":    app.testMode != nil,
+		"queue_length": len(app.queue.Pending()),
+		"queue_paused": app.queue.IsPaused(),
+	}
+}
+
+// getDeviceInfo returns the device connection, the SIM's own number and the modem and serial line state
+func (app *App) getDeviceInfo(c *gin.Context) {
+	device := gin.H{
+		"name":      routingPrimary,
+		"connected": app.smsConn.IsConnected(),
+		"gsm_ready": app.smsConn.IsGSMReady(),
+		"mode":      app.deviceMode,
+		"modem":     app.smsConn.ModemStatus(),
+		"serial":    app.smsConn.SerialStats(),
+	}
+	if number, source := app.smsConn.OwnNumber(); number != "" {
+		device["own_number"] = number
+		device["own_number_source"] = source
+	}
+	if labels, err := app.db.GetDeviceLabels(); err == nil {
+		label := labels[routingPrimary]
+		if label.Label != "" {
+			device["label"] = label.Label
+		}
+		if label.Location != "" {
+			device["location"] = label.Location
+		}
+		if len(label.Metadata) > 0 {
+			device["metadata"] = label.Metadata
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"device": device,
 	})
 }
 
@@ -193,64 +1388,43 @@ func (app *App) healthCheck(c *gin.Context) {
 func (app *App) sendSMS(c *gin.Context) {
 	var req SMSRequest
 
-	// Bind and validate JSON request
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Invalid request: %v", err),
-		})
+	// Bind and validate JSON request, rejecting unknown fields
+	if !bindStrictJSON(c, &req) {
 		return
 	}
 
-	// Validate phone number (basic validation)
-	if len(req.Number) < 10 {
-		c.JSON(http.StatusBadRequest, SMSResponse{
-			Status:  "error",
-			Message: "Invalid phone number (minimum 10 digits)",
-		})
+	opts := SendOptions{Class: req.Class, SenderID: req.SenderID, Template: req.Template, Campaign: req.Campaign, Group: req.Group,
+		TemplateVersion: req.TemplateVersion, ConfirmSpecial: req.ConfirmSpecial}
+	number, err := app.requestNumber(req)
+	if err != nil {
+		c.JSON(sendErrorResponse(c, err))
 		return
 	}
 
-	// Validate content
-	if len(req.Content) == 0 {
-		c.JSON(http.StatusBadRequest, SMSResponse{
-			Status:  "error",
-			Message: "SMS content cannot be empty",
-		})
+	// Validate number, content and options
+	if err := app.validateSMS(number, req.Content, opts); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
 		return
 	}
+	req.Content = app.localizeTemplate(number, req.Content, opts)
 
-	// Check if connected
-	if !app.smsConn.IsConnected() {
-		c.JSON(http.StatusServiceUnavailable, SMSResponse{
-			Status:  "error",
-			Message: "Not connected to Arduino device",
-		})
+	// Return right away for async sends, the client follows the sent SMS
+	if c.Query("async") == "true" {
+		app.acceptSMS(c, number, req.Content, opts)
 		return
 	}
 
-	// Send SMS via serial connection
-	err := app.smsConn.SendSMS(req.Number, req.Content)
-	if err != nil {
-		// Save failed SMS to database
-		app.db.SaveSentSMS(req.Number, req.Content, "error", err.Error())
-
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to send SMS: %v", err),
-		})
+	// Send SMS through the queue
+	if _, err := app.deliverSMS(c.Request.Context(), keyIDFromContext(c), number, req.Content, opts); err != nil {
+		c.JSON(sendErrorResponse(c, err))
 		return
 	}
 
-	// Save successful SMS to database
-	if saveErr := app.db.SaveSentSMS(req.Number, req.Content, "success", ""); saveErr != nil {
-		log.Printf("Failed to save sent SMS to database: %v", saveErr)
-	}
-
 	// Success response
 	c.JSON(http.StatusOK, SMSResponse{
 		Status:  "success",
-		Message: fmt.Sprintf("SMS sent to %s", req.Number),
+		Message: fmt.Sprintf("SMS sent to %s", number),
+		Warning: app.specialNumbers.Warning(localeFromContext(c), number),
 	})
 }
 
@@ -275,28 +1449,35 @@ func (app *App) getReceivedSMS(c *gin.Context) {
 		}
 	}
 
-	// Get messages from database
-	messages, err := app.db.GetReceivedSMS(limit, offset)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to retrieve messages: %v", err),
-		})
+	filter := ReceivedSMSFilter{Country: c.Query("country"), Unread: c.Query("unread") == "true"}
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	if filter.Order, err = parseListOrder(c, receivedOrderColumns); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	// Answer conditional requests from pollers without re-reading messages
+	if app.notModified(c, "received_sms") {
 		return
 	}
 
 	// Get total count
-	total, err := app.db.CountReceivedSMS()
+	total, err := app.db.CountFilteredReceivedSMS(filter)
 	if err != nil {
 		total = 0
 	}
 
-	c.JSON(http.StatusOK, SMSListResponse{
-		Status:   "success",
-		Total:    total,
-		Count:    len(messages),
-		Messages: messages,
-	})
+	// Stream messages from database
+	labels := app.loadMessageLabels()
+	stream := newJSONListStream(c, total)
+	stream.Finish(app.db.EachReceivedSMS(filter, limit, offset, func(msg ReceivedSMS) error {
+		labels.received(&msg)
+		return stream.Write(msg)
+	}))
 }
 
 // getReceivedSMSByNumber retrieves received SMS messages from a specific number
@@ -322,16 +1503,26 @@ func (app *App) getReceivedSMSByNumber(c *gin.Context) {
 		}
 	}
 
+	filter := ReceivedSMSFilter{Unread: c.Query("unread") == "true"}
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	if filter.Order, err = parseListOrder(c, receivedOrderColumns); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
 	// Get messages from database
-	messages, err := app.db.GetReceivedSMSByNumber(number, limit, offset)
+	messages, err := app.db.GetReceivedSMSByNumber(number, filter, limit, offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to retrieve messages: %v", err),
-		})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
 		return
 	}
 
+	app.loadMessageLabels().receivedList(messages)
+
 	c.JSON(http.StatusOK, SMSListResponse{
 		Status:   "success",
 		Total:    len(messages),
@@ -344,10 +1535,7 @@ func (app *App) getReceivedSMSByNumber(c *gin.Context) {
 func (app *App) searchReceivedSMS(c *gin.Context) {
 	q := c.Query("q")
 	if q == "" {
-		c.JSON(http.StatusBadRequest, SMSResponse{
-			Status:  "error",
-			Message: "Missing required query parameter: q",
-		})
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Missing required query parameter: q"))
 		return
 	}
 
@@ -355,10 +1543,7 @@ func (app *App) searchReceivedSMS(c *gin.Context) {
 	if afterStr := c.Query("after"); afterStr != "" {
 		parsed, err := time.Parse(time.RFC3339, afterStr)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, SMSResponse{
-				Status:  "error",
-				Message: "Invalid 'after' parameter, expected RFC3339 format (e.g. 2025-01-15T10:30:00Z)",
-			})
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid 'after' parameter, expected RFC3339 format (e.g. 2025-01-15T10:30:00Z)"))
 			return
 		}
 		after = parsed
@@ -366,18 +1551,12 @@ func (app *App) searchReceivedSMS(c *gin.Context) {
 
 	msg, err := app.db.FindReceivedSMS(q, after)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to search messages: %v", err),
-		})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to search messages: %v", err))
 		return
 	}
 
 	if msg == nil {
-		c.JSON(http.StatusNotFound, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("No received SMS containing %q", q),
-		})
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "No received SMS containing %q", q))
 		return
 	}
 
@@ -410,28 +1589,35 @@ func (app *App) getSentSMS(c *gin.Context) {
 		}
 	}
 
-	// Get messages from database
-	messages, err := app.db.GetSentSMS(limit, offset)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to retrieve messages: %v", err),
-		})
+	var filter SentSMSFilter
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	if filter.Order, err = parseListOrder(c, sentOrderColumns); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	// Answer conditional requests from pollers without re-reading messages
+	if app.notModified(c, "sent_sms") {
 		return
 	}
 
 	// Get total count
-	total, err := app.db.CountSentSMS()
+	total, err := app.db.CountFilteredSentSMS(filter)
 	if err != nil {
 		total = 0
 	}
 
-	c.JSON(http.StatusOK, SentSMSListResponse{
-		Status:   "success",
-		Total:    total,
-		Count:    len(messages),
-		Messages: messages,
-	})
+	// Stream messages from database
+	labels := app.loadMessageLabels()
+	stream := newJSONListStream(c, total)
+	stream.Finish(app.db.EachSentSMS(filter, limit, offset, func(msg SentSMS) error {
+		labels.sent(&msg)
+		return stream.Write(msg)
+	}))
 }
 
 // getSentSMSByNumber retrieves sent SMS messages to a specific number
@@ -457,16 +1643,26 @@ func (app *App) getSentSMSByNumber(c *gin.Context) {
 		}
 	}
 
+	var filter SentSMSFilter
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+	if filter.Order, err = parseListOrder(c, sentOrderColumns); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
 	// Get messages from database
-	messages, err := app.db.GetSentSMSByNumber(number, limit, offset)
+	messages, err := app.db.GetSentSMSByNumber(number, filter, limit, offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to retrieve messages: %v", err),
-		})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
 		return
 	}
 
+	app.loadMessageLabels().sentList(messages)
+
 	c.JSON(http.StatusOK, SentSMSListResponse{
 		Status:   "success",
 		Total:    len(messages),
@@ -497,7 +1693,27 @@ func (app *App) getStats(c *gin.Context) {
 		sentError = 0
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	receivedByOrigin, err := app.db.CountReceivedSMSByOrigin()
+	if err != nil {
+		receivedByOrigin = []ReceivedOriginCount{}
+	}
+
+	byTemplate, err := app.db.CountSentSMSByLabel("template")
+	if err != nil {
+		byTemplate = []LabelStats{}
+	}
+
+	byCampaign, err := app.db.CountSentSMSByLabel("campaign")
+	if err != nil {
+		byCampaign = []LabelStats{}
+	}
+
+	throttled, err := app.db.GetThrottleStats(time.Now().UTC().AddDate(0, 0, -throttleStatsDays+1).Format(dayFormat))
+	if err != nil {
+		throttled = &ThrottleStats{Total: map[string]int{}, Days: []ThrottleDay{}}
+	}
+
+	stats := gin.H{
 		"status":         "success",
 		"total_received": totalReceived,
 		"total_sent":     totalSent,
@@ -506,17 +1722,27 @@ func (app *App) getStats(c *gin.Context) {
 		"connected":      app.smsConn.IsConnected(),
 		"gsm_ready":      app.smsConn.IsGSMReady(),
 		"mode":           app.deviceMode,
-	})
+
+		"received_by_origin": receivedByOrigin,
+		"by_template":        byTemplate,
+		"by_campaign":        byCampaign,
+		"storage":            app.storage.Status(app.db),
+		"throttled":          throttled,
+	}
+	if app.filterWatch != nil {
+		warnings, checkedAt := app.filterWatch.Warnings()
+		stats["filtering_warnings"] = warnings
+		stats["filtering_checked_at"] = checkedAt
+	}
+
+	c.JSON(http.StatusOK, stats)
 }
 
 // wakeupGSM sends a wakeup command to the Arduino (fire-and-forget)
 func (app *App) wakeupGSM(c *gin.Context) {
 	err := app.smsConn.Wakeup()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, SMSResponse{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to send wakeup: %v", err),
-		})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to send wakeup: %v", err))
 		return
 	}
 
@@ -525,3 +1751,31 @@ func (app *App) wakeupGSM(c *gin.Context) {
 		Message: "GSM wakeup initiated",
 	})
 }
+
+// eraseNumberData removes everything stored about a number and reports what was deleted
+func (app *App) eraseNumberData(c *gin.Context) {
+	number := c.Param("number")
+
+	// Queued messages to the number would be sent and stored again afterwards
+	conversationID := ConversationID(number)
+	for _, entry := range app.queue.Pending() {
+		if ConversationID(entry.Number) == conversationID {
+			app.queue.Cancel(entry.ID)
+		}
+	}
+
+	report, err := app.db.EraseNumberData(number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to erase data: %v", err))
+		return
+	}
+	report.Memory["dedup"] = int64(app.dedup.erase(conversationID))
+	report.Memory["storm"] = int64(app.storm.erase(conversationID))
+
+	log.Printf("Erased data for %s: %d received, %d sent", number, report.ReceivedDeleted, report.SentDeleted)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"report": report,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSentSMSByID retrieves a sent SMS, returning nil if it does not exist
+func (d *Database) GetSentSMSByID(id int) (*SentSMS, error) {
+	msg, err := scanSentSMS(d.db.QueryRow(`
+		SELECT `+sentSMSColumns+`
+		FROM sent_sms
+		WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sent SMS: %w", err)
+	}
+
+	return &msg, nil
+}
+
+// getReceivedSMSByID returns a single received SMS. IDs have their own
+// route, since short codes look like IDs to /received/:number.
+func (app *App) getReceivedSMSByID(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	msg, err := app.db.GetReceivedSMSByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+	if msg == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+	app.loadMessageLabels().received(msg)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": msg,
+	})
+}
+
+// getSentSMSByID returns a single sent SMS
+func (app *App) getSentSMSByID(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	msg, err := app.db.GetSentSMSByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+	if msg == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+	app.loadMessageLabels().sent(msg)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": msg,
+	})
+}
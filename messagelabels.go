@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+)
+
+// messageLabels attaches what the team knows about the devices and peers of
+// messages to their records: the device and its label (see devices.go) and
+// the contact name (see contacts.go). Received SMS are matched to a device by
+// the own number of its SIM when routing across devices; with a single
+// device they are all from it.
+type messageLabels struct {
+	devices  map[string]DeviceLabel
+	byOwner  map[string]string // device name by own number
+	single   string            // the only device, empty with routing
+	contacts map[string]string // contact name by conversation ID
+}
+
+// loadMessageLabels reads the device labels, own numbers and contact names
+// for labelling messages. Labels are only informational: if they can't be
+// read, the error is logged and nil returned, which labels nothing.
+func (app *App) loadMessageLabels() *messageLabels {
+	devices, err := app.db.GetDeviceLabels()
+	if err != nil {
+		log.Printf("Message labels: %v", err)
+		return nil
+	}
+	contacts, err := app.db.GetContactNames()
+	if err != nil {
+		log.Printf("Message labels: %v", err)
+		return nil
+	}
+
+	l := &messageLabels{devices: devices, byOwner: make(map[string]string), contacts: contacts}
+	for _, device := range app.routeDevices() {
+		if number, _ := device.Conn.OwnNumber(); number != "" {
+			l.byOwner[number] = device.Name
+		}
+	}
+	if app.routing == nil {
+		l.single = routingPrimary
+	}
+	return l
+}
+
+// deviceLabel returns the label of a device, nil if it has none
+func (l *messageLabels) deviceLabel(device string) *DeviceLabel {
+	if label, ok := l.devices[device]; ok {
+		return &label
+	}
+	return nil
+}
+
+// received sets the device, its label and the contact name of a received SMS
+func (l *messageLabels) received(msg *ReceivedSMS) {
+	if l == nil {
+		return
+	}
+	device, ok := l.byOwner[msg.DeviceNumber]
+	if !ok {
+		device = l.single
+	}
+	msg.Device = device
+	msg.DeviceLabel = l.deviceLabel(device)
+	msg.ContactName = l.contacts[msg.ConversationID]
+}
+
+// receivedList labels a list of received SMS
+func (l *messageLabels) receivedList(messages []ReceivedSMS) {
+	for i := range messages {
+		l.received(&messages[i])
+	}
+}
+
+// sent sets the device label and the contact name of a sent SMS
+func (l *messageLabels) sent(msg *SentSMS) {
+	if l == nil {
+		return
+	}
+	msg.DeviceLabel = l.deviceLabel(msg.Device)
+	msg.ContactName = l.contacts[msg.ConversationID]
+}
+
+// sentList labels a list of sent SMS
+func (l *messageLabels) sentList(messages []SentSMS) {
+	for i := range messages {
+		l.sent(&messages[i])
+	}
+}
+
+// messageLabelsVersion summarizes the device labels and contact names for
+// cache validation, as they are part of the message lists
+func (d *Database) messageLabelsVersion() (string, error) {
+	var version string
+	err := d.db.QueryRow(`
+		SELECT COALESCE((SELECT string_agg(device || ? || label || ? || location || ? || metadata, ? ORDER BY device)
+			FROM device_labels), '')
+		|| ? ||
+		COALESCE((SELECT string_agg(conversation_id || ? || name, ? ORDER BY conversation_id)
+			FROM contacts WHERE name != ''), '')
+	`, "\x1f", "\x1f", "\x1f", "\x1e", "\x1d", "\x1f", "\x1e").Scan(&version)
+	return version, err
+}
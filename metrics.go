@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registrationStates lists the network registration states exported as a state set
+var registrationStates = []string{"home", "roaming", "searching", "denied", "not_registered", "unknown"}
+
+// balanceRe matches the first amount in a USSD balance reply, e.g. "10.00" or "5,23"
+var balanceRe = regexp.MustCompile(`\d+(?:[.,]\d+)?`)
+
+// parseBalance extracts the balance from a USSD reply such as "Your balance is 10.00 EUR"
+func parseBalance(reply string) (float64, bool) {
+	match := balanceRe.FindString(reply)
+	if match == "" {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.Replace(match, ",", ".", 1), 64)
+	return value, err == nil
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// header writes the HELP and TYPE lines of a metric
+func (w *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels are name/value pairs
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			fmt.Fprintf(&w.b, "%s=%q", labels[i], labels[i+1])
+		}
+		w.b.WriteByte('}')
+	}
+	w.b.WriteByte(' ')
+	w.b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	w.b.WriteByte('\n')
+}
+
+// gauge writes a metric with a single unlabeled sample
+func (w *metricsWriter) gauge(name, help string, value float64) {
+	w.header(name, "gauge", help)
+	w.sample(name, value)
+}
+
+// boolValue converts a boolean to a 0/1 sample value
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// CountSentSMSByStatusAndClass returns the number of sent SMS per status and
+// per error class of failed sends
+func (d *Database) CountSentSMSByStatusAndClass() (map[string]int, map[ErrorClass]int, error) {
+	rows, err := d.db.Query(`SELECT status, COALESCE(error_class, ''), COUNT(*) FROM sent_sms GROUP BY 1, 2`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to count sent SMS: %w", err)
+	}
+	defer rows.Close()
+
+	byStatus := map[string]int{}
+	byClass := map[ErrorClass]int{}
+	for rows.Next() {
+		var status, class string
+		var count int
+		if err := rows.Scan(&status, &class, &count); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		byStatus[status] += count
+		if class != "" {
+			byClass[ErrorClass(class)] += count
+		}
+	}
+
+	return byStatus, byClass, rows.Err()
+}
+
+// CountSentSMSDuplicates returns the number of messages collapsed into an earlier identical send
+func (d *Database) CountSentSMSDuplicates() (int, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COALESCE(SUM(duplicates), 0) FROM sent_sms`).Scan(&count)
+	return count, err
+}
+
+// LastUSSDBalance returns the balance parsed from the most recent successful
+// USSD keep-alive check and when it was reported
+func (d *Database) LastUSSDBalance() (float64, time.Time, bool, error) {
+	var response, createdAtStr string
+	err := d.db.QueryRow(`
+		SELECT response, created_at FROM keepalive_checks
+		WHERE method = ? AND success = 1
+		ORDER BY id DESC LIMIT 1
+	`, KeepAliveUSSD).Scan(&response, &createdAtStr)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, false, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, false, fmt.Errorf("failed to query keep-alive checks: %w", err)
+	}
+
+	balance, ok := parseBalance(response)
+	return balance, parseTimestamp(createdAtStr), ok, nil
+}
+
+// getMetrics exports API counters and modem gauges in the Prometheus text format
+func (app *App) getMetrics(c *gin.Context) {
+	var w metricsWriter
+
+	// Device and modem
+	w.gauge("sms_device_connected", "Whether the Arduino is connected.", boolValue(app.smsConn.IsConnected()))
+	w.gauge("sms_gsm_ready", "Whether the GSM modem is connected to the network.", boolValue(app.smsConn.IsGSMReady()))
+
+	// Database
+	journal := app.db.journal.Status()
+	w.gauge("sms_database_writable", "Whether the database accepted the last write.", boolValue(journal.Writable))
+	w.gauge("sms_database_journal_pending", "Messages kept in memory until the database is writable.", float64(journal.Pending))
+	storage := app.storage.Status(app.db)
+	w.gauge("sms_database_size_bytes", "Size of the database file and its WAL.", float64(storage.DBSize))
+	if storage.Error == "" {
+		w.gauge("sms_disk_free_bytes", "Free space on the disk holding the database.", float64(storage.FreeSpace))
+		w.gauge("sms_disk_total_bytes", "Size of the disk holding the database.", float64(storage.TotalSpace))
+	}
+	w.gauge("sms_storage_limit_crossed", "Whether the database size or free space limit is crossed.", boolValue(len(storage.Problems) > 0))
+
+	serial := app.smsConn.SerialStats()
+	w.header("sms_serial_lines_total", "counter", "Lines read from the Arduino.")
+	w.sample("sms_serial_lines_total", float64(serial.Lines))
+	w.header("sms_serial_line_errors_total", "counter", "Corrupted lines read from the Arduino by reason.")
+	w.sample("sms_serial_line_errors_total", float64(serial.ParseFailures), "reason", "parse")
+	w.sample("sms_serial_line_errors_total", float64(serial.Oversized), "reason", "oversized")
+	w.header("sms_serial_lines_recovered_total", "counter", "Responses parsed after skipping leading garbage.")
+	w.sample("sms_serial_lines_recovered_total", float64(serial.Recovered))
+
+	status := app.smsConn.ModemStatus()
+	if !status.UpdatedAt.IsZero() {
+		if status.RSSI != nil {
+			w.gauge("sms_modem_rssi_dbm", "Signal strength reported by the modem in dBm.", float64(*status.RSSI))
+		}
+
+		w.header("sms_modem_registration_state", "gauge", "Network registration state of the modem (1 for the current state).")
+		for _, state := range registrationStates {
+			w.sample("sms_modem_registration_state", boolValue(status.Registration == state), "state", state)
+		}
+		w.gauge("sms_modem_registered", "Whether the modem is registered to its home network or roaming.",
+			boolValue(status.Registration == "home" || status.Registration == "roaming"))
+		w.gauge("sms_modem_sim_present", "Whether a SIM card is inserted.",
+			boolValue(status.SIM == "ready" || status.SIM == "locked"))
+		w.gauge("sms_modem_sim_ready", "Whether the SIM card is unlocked and ready.", boolValue(status.SIM == "ready"))
+		w.gauge("sms_modem_status_timestamp_seconds", "When the modem status was last reported.", float64(status.UpdatedAt.Unix()))
+	}
+
+	if app.serviceWatch != nil {
+		loss := app.serviceWatch.Current()
+		w.gauge("sms_service_lost", "Whether network service was lost while GSM was connected.", boolValue(loss != nil))
+		w.gauge("sms_service_jamming_suspected", "Whether the ongoing service loss came with a sudden loss of signal.", boolValue(loss != nil && loss.SuspectedJamming))
+	}
+
+	if balance, at, ok, err := app.db.LastUSSDBalance(); err == nil && ok {
+		w.gauge("sms_sim_balance", "Prepaid balance parsed from the last USSD keep-alive reply.", balance)
+		w.gauge("sms_sim_balance_timestamp_seconds", "When the prepaid balance was last checked.", float64(at.Unix()))
+	}
+
+	if app.loopback != nil {
+		if checks, err := app.db.ListLoopbackChecks(1); err == nil && len(checks) > 0 {
+			last := checks[0]
+			w.gauge("sms_loopback_success", "Whether the last send-to-self check came back.", boolValue(last.Success))
+			w.gauge("sms_loopback_latency_seconds", "Round trip time of the last send-to-self check.", float64(last.LatencyMS)/1000)
+			w.gauge("sms_loopback_timestamp_seconds", "When the last send-to-self check ran.", float64(last.CreatedAt.Unix()))
+		}
+	}
+
+	// Messages
+	if byStatus, byClass, err := app.db.CountSentSMSByStatusAndClass(); err == nil {
+		w.header("sms_sent_total", "counter", "Sent SMS by status.")
+		statuses := make([]string, 0, len(byStatus))
+		for status := range byStatus {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			w.sample("sms_sent_total", float64(byStatus[status]), "status", status)
+		}
+
+		w.header("sms_send_errors_total", "counter", "Failed sends by error class.")
+		classes := make([]string, 0, len(byClass))
+		for class := range byClass {
+			classes = append(classes, string(class))
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			w.sample("sms_send_errors_total", float64(byClass[ErrorClass(class)]), "class", class)
+		}
+	}
+
+	if duplicates, err := app.db.CountSentSMSDuplicates(); err == nil {
+		w.header("sms_sent_duplicates_total", "counter", "Identical messages collapsed into an earlier send.")
+		w.sample("sms_sent_duplicates_total", float64(duplicates))
+	}
+
+	if received, err := app.db.CountReceivedSMS(); err == nil {
+		w.header("sms_received_total", "counter", "Received SMS.")
+		w.sample("sms_received_total", float64(received))
+	}
+
+	w.gauge("sms_queue_length", "SMS waiting in the send queue.", float64(len(app.queue.Pending())))
+	w.gauge("sms_queue_paused", "Whether the send queue is paused.", boolValue(app.queue.IsPaused()))
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(w.b.String()))
+}
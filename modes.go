@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Runtime modes
+const (
+	RunModeNormal      = "normal"
+	RunModeReadOnly    = "read-only"
+	RunModeMaintenance = "maintenance"
+)
+
+// RunModeRequest represents a request to change the runtime mode
+type RunModeRequest struct {
+	Mode string `json:"mode" binding:"required"`
+}
+
+// RunModeState holds the current runtime mode
+type RunModeState struct {
+	mu   sync.RWMutex
+	mode string
+}
+
+// NewRunModeState creates a runtime mode state with the given initial mode
+func NewRunModeState(mode string) *RunModeState {
+	if !isValidRunMode(mode) {
+		mode = RunModeNormal
+	}
+	return &RunModeState{mode: mode}
+}
+
+// Get returns the current runtime mode
+func (s *RunModeState) Get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mode
+}
+
+// Set changes the runtime mode
+func (s *RunModeState) Set(mode string) error {
+	if !isValidRunMode(mode) {
+		return fmt.Errorf("invalid mode %q (expected %s, %s or %s)", mode, RunModeNormal, RunModeReadOnly, RunModeMaintenance)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = mode
+	return nil
+}
+
+// isValidRunMode checks whether mode is a known runtime mode
+func isValidRunMode(mode string) bool {
+	switch mode {
+	case RunModeNormal, RunModeReadOnly, RunModeMaintenance:
+		return true
+	}
+	return false
+}
+
+// GetRunMode returns the initial runtime mode from environment variable.
+// Unknown modes are an error, so a typo doesn't start the service in normal mode.
+func GetRunMode() (string, error) {
+	mode := os.Getenv("RUN_MODE")
+	if mode == "" {
+		return RunModeNormal, nil
+	}
+	if !isValidRunMode(mode) {
+		return "", fmt.Errorf("RUN_MODE: unknown mode %q (expected %s, %s or %s)", mode, RunModeNormal, RunModeReadOnly, RunModeMaintenance)
+	}
+	return mode, nil
+}
+
+// runModeMiddleware rejects requests that are not allowed in the current runtime mode.
+// It is not used on /health and the admin routes, and callers with the admin role
+// are always allowed, so the mode can be inspected and switched back.
+func (app *App) runModeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := app.runMode.Get()
+		if mode == RunModeNormal || app.adminCaller(c) {
+			c.Next()
+			return
+		}
+
+		switch mode {
+		case RunModeMaintenance:
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorResponse(c, CodeMaintenanceMode, "Service is in maintenance mode"))
+			return
+
+		case RunModeReadOnly:
+			// JSON-RPC calls are always POSTed; sms.send checks the mode itself
+			if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead && unversionedPath(c.Request.URL.Path) != "/rpc" {
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorResponse(c, CodeReadOnlyMode, "Service is in read-only mode"))
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// adminCaller reports whether the request carries a valid bearer token with the
+// admin role. Unlike requireRole it never rejects the request.
+func (app *App) adminCaller(c *gin.Context) bool {
+	if app.auth == nil {
+		return false
+	}
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return false
+	}
+	claims, err := app.auth.Verify(token)
+	return err == nil && claims.HasRole(RoleAdmin)
+}
+
+// getRunMode returns the current runtime mode
+func (app *App) getRunMode(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"mode":   app.runMode.Get(),
+	})
+}
+
+// setRunMode switches the runtime mode
+func (app *App) setRunMode(c *gin.Context) {
+	var req RunModeRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid request: %v", err))
+		return
+	}
+
+	if err := app.runMode.Set(req.Mode); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	log.Printf("Runtime mode changed to %s", req.Mode)
+
+	// Queued messages wait while the mode isn't normal
+	if app.queue != nil {
+		app.queue.wake()
+	}
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("Runtime mode set to %s", req.Mode),
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signTestToken returns an HS256 token with roles, signed with secret
+func signTestToken(t *testing.T, secret string, roles ...string) string {
+	payload, err := json.Marshal(map[string]any{"sub": "test", "roles": roles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestMaintenanceModeAllowsAdmins(t *testing.T) {
+	const secret = "test-secret"
+	server := newTestServer(t, func(app *App) {
+		app.runMode = NewRunModeState(RunModeMaintenance)
+		app.auth = &JWTConfig{Secret: []byte(secret)}
+		app.queue = NewSendQueue(func(number, content string, opts SendOptions) error { return nil }, nil, 1)
+	})
+	admin := signTestToken(t, secret, RoleAdmin)
+	reader := signTestToken(t, secret, RoleRead)
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/v1/queue", reader, http.StatusServiceUnavailable},
+		{http.MethodGet, "/v1/queue", admin, http.StatusOK},
+		{http.MethodPost, "/v1/queue/pause", admin, http.StatusOK},
+		{http.MethodDelete, "/v1/numbers/+38640123456/data", admin, http.StatusOK},
+		{http.MethodGet, "/v1/admin/mode", admin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s got %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestNoSendsOutsideNormalMode(t *testing.T) {
+	for _, mode := range []string{RunModeReadOnly, RunModeMaintenance} {
+		app := &App{runMode: NewRunModeState(mode)}
+		_, err := app.deliverSMSNow(context.Background(), "rule:1", "+38640123456", "hi", SendOptions{})
+		if code := errorCode(err, ""); code != runModeErrorCode(mode) {
+			t.Errorf("%s mode: deliverSMSNow returned %v, want %s", mode, err, runModeErrorCode(mode))
+		}
+	}
+}
+
+func TestQueueHold(t *testing.T) {
+	sent := make(chan string, 1)
+	q := NewSendQueue(func(number, content string, opts SendOptions) error {
+		sent <- number
+		return nil
+	}, nil, 1)
+
+	var hold atomic.Bool
+	hold.Store(true)
+	q.HoldWhile(hold.Load)
+	q.Start()
+	defer q.Stop()
+
+	q.Enqueue("anonymous", "+38640123456", "hi", SendOptions{})
+	select {
+	case <-sent:
+		t.Fatal("held queue sent a message")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if entries := q.Pending(); len(entries) != 1 || entries[0].ETA != nil {
+		t.Errorf("pending = %+v, want the message without an ETA", entries)
+	}
+
+	hold.Store(false)
+	q.wake()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("queue didn't send the message once released")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Optional subsystems that can be switched off with MODULES or MODULES_DISABLED
+const (
+	ModuleWebhooks      = "webhooks"      // webhook registry and delivery of received SMS
+	ModuleWebSocket     = "websocket"     // /ws event and command channel
+	ModuleRPC           = "rpc"           // /rpc JSON-RPC endpoint
+	ModuleMetrics       = "metrics"       // /metrics Prometheus exporter
+	ModuleReports       = "reports"       // monthly usage reports
+	ModuleDigest        = "digest"        // email digest
+	ModuleMail          = "mail"          // email forwarding and replies
+	ModuleKeepAlive     = "keepalive"     // SIM keep-alive checks
+	ModuleMaintenance   = "maintenance"   // scheduled database maintenance
+	ModuleBackup        = "backup"        // remote database backups
+	ModuleHomeAssistant = "homeassistant" // Home Assistant notify target and sensors
+	ModuleNodeRED       = "nodered"       // Node-RED pull endpoint
+	ModuleNotify        = "notify"        // monitoring alert script compatibility endpoint
+	ModuleEscalations   = "escalations"   // escalation chains for critical alerts
+	ModuleSurveys       = "surveys"       // questionnaires answered by SMS
+	ModuleClockSync     = "clocksync"     // clock drift checks against network time
+	ModuleRawSerial     = "rawserial"     // storage of raw serial payloads per message
+	ModuleLoopback      = "loopback"      // send-to-self end-to-end checks
+	ModuleRouting       = "routing"       // least-cost routing across devices
+	ModuleServiceWatch  = "servicewatch"  // alerts on sudden loss of network service
+	ModuleHooks         = "hooks"         // executables run on events
+	ModuleRules         = "rules"         // inbound routing and auto-reply rules
+	ModuleBlocklist     = "blocklist"     // blocked numbers and imported block list feeds
+	ModuleFilterWatch   = "filterwatch"   // warnings about silent carrier filtering
+)
+
+// allModules lists every optional module
+var allModules = []string{
+	ModuleWebhooks, ModuleWebSocket, ModuleRPC, ModuleMetrics, ModuleReports,
+	ModuleDigest, ModuleMail, ModuleKeepAlive, ModuleMaintenance, ModuleBackup,
+	ModuleHomeAssistant, ModuleNodeRED, ModuleNotify, ModuleEscalations, ModuleSurveys,
+	ModuleClockSync, ModuleRawSerial, ModuleLoopback, ModuleRouting,
+	ModuleServiceWatch, ModuleHooks, ModuleRules, ModuleBlocklist, ModuleFilterWatch,
+}
+
+// Modules records which optional subsystems are enabled by configuration and
+// which of them were actually started
+type Modules struct {
+	enabled map[string]bool
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// LoadModules reads the enabled modules from environment variables. MODULES
+// lists the modules to enable (default: all), MODULES_DISABLED the modules to
+// switch off.
+func LoadModules() (*Modules, error) {
+	m := &Modules{
+		enabled: make(map[string]bool),
+		active:  make(map[string]bool),
+	}
+
+	enabled := splitList(os.Getenv("MODULES"))
+	if len(enabled) == 0 {
+		enabled = allModules
+	}
+	for _, name := range enabled {
+		if err := checkModuleName("MODULES", name); err != nil {
+			return nil, err
+		}
+		m.enabled[name] = true
+	}
+
+	for _, name := range splitList(os.Getenv("MODULES_DISABLED")) {
+		if err := checkModuleName("MODULES_DISABLED", name); err != nil {
+			return nil, err
+		}
+		delete(m.enabled, name)
+	}
+
+	return m, nil
+}
+
+// checkModuleName returns an error if name is not a known module
+func checkModuleName(env, name string) error {
+	for _, module := range allModules {
+		if name == module {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: unknown module %q (available: %s)", env, name, strings.Join(allModules, ", "))
+}
+
+// Enabled reports whether a module may be initialized
+func (m *Modules) Enabled(name string) bool {
+	return m.enabled[name]
+}
+
+// Activate records that a module was started
+func (m *Modules) Activate(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active[name] = true
+}
+
+// Active returns the names of the started modules
+func (m *Modules) Active() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.active))
+	for name := range m.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Mute silences webhooks and email forwarding of messages from a number
+type Mute struct {
+	Number    string     `json:"number"`
+	Until     *time.Time `json:"until,omitempty"` // nil mutes until unmuted
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// MuteRequest represents a request to mute a number. Until and Duration are
+// optional; without them the number stays muted until it is unmuted.
+type MuteRequest struct {
+	Until    *time.Time `json:"until"`
+	Duration string     `json:"duration"` // e.g. "2h"
+}
+
+// MuteNumber mutes a number, replacing an existing mute. Numbers are matched
+// by conversation ID, so all spellings of a number are muted.
+func (d *Database) MuteNumber(number string, until *time.Time) error {
+	var untilStr any
+	if until != nil {
+		untilStr = until.UTC().Format(time.RFC3339)
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO number_mutes (conversation_id, number, until, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(conversation_id) DO UPDATE SET
+			number = excluded.number, until = excluded.until, created_at = excluded.created_at
+	`, ConversationID(number), number, untilStr, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to mute number: %w", err)
+	}
+
+	return nil
+}
+
+// UnmuteNumber removes the mute of a number, reporting whether it was muted
+func (d *Database) UnmuteNumber(number string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM number_mutes WHERE conversation_id = ?`, ConversationID(number))
+	if err != nil {
+		return false, fmt.Errorf("failed to unmute number: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// IsMuted reports whether messages from a number are muted
+func (d *Database) IsMuted(number string) (bool, error) {
+	var until sql.NullString
+	err := d.db.QueryRow(`SELECT until FROM number_mutes WHERE conversation_id = ?`, ConversationID(number)).Scan(&until)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query mutes: %w", err)
+	}
+
+	return !until.Valid || time.Now().Before(parseTimestamp(until.String)), nil
+}
+
+// ListMutes returns the active mutes and drops expired ones
+func (d *Database) ListMutes() ([]Mute, error) {
+	if _, err := d.db.Exec(`DELETE FROM number_mutes WHERE until IS NOT NULL AND until <= ?`, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return nil, fmt.Errorf("failed to delete expired mutes: %w", err)
+	}
+
+	rows, err := d.db.Query(`SELECT number, until, created_at FROM number_mutes ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mutes: %w", err)
+	}
+	defer rows.Close()
+
+	mutes := []Mute{}
+	for rows.Next() {
+		var mute Mute
+		var until sql.NullString
+		var createdAtStr string
+
+		if err := rows.Scan(&mute.Number, &until, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if until.Valid {
+			t := parseTimestamp(until.String)
+			mute.Until = &t
+		}
+		mute.CreatedAt = parseTimestamp(createdAtStr)
+		mutes = append(mutes, mute)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return mutes, nil
+}
+
+// muteNumber mutes a number, optionally until a time or for a duration
+func (app *App) muteNumber(c *gin.Context) {
+	number := c.Param("number")
+
+	var req MuteRequest
+	if c.Request.ContentLength != 0 && !bindStrictJSON(c, &req) {
+		return
+	}
+
+	until := req.Until
+	if req.Duration != "" {
+		if until != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Specify either until or duration, not both"))
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid duration %q", req.Duration))
+			return
+		}
+		t := time.Now().Add(duration).UTC().Truncate(time.Second)
+		until = &t
+	}
+	if until != nil && !until.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "until must be in the future"))
+		return
+	}
+
+	if err := app.db.MuteNumber(number, until); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to mute number: %v", err))
+		return
+	}
+
+	if until != nil {
+		log.Printf("Muted %s until %s", number, until.Format(time.RFC3339))
+	} else {
+		log.Printf("Muted %s", number)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"mute":   Mute{Number: number, Until: until, CreatedAt: time.Now().UTC()},
+	})
+}
+
+// unmuteNumber removes the mute of a number
+func (app *App) unmuteNumber(c *gin.Context) {
+	number := c.Param("number")
+
+	unmuted, err := app.db.UnmuteNumber(number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to unmute number: %v", err))
+		return
+	}
+	if !unmuted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Number %s is not muted", number))
+		return
+	}
+
+	log.Printf("Unmuted %s", number)
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// listMutes returns the muted numbers
+func (app *App) listMutes(c *gin.Context) {
+	mutes, err := app.db.ListMutes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list mutes: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"mutes":  mutes,
+	})
+}
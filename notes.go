@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxNoteLength limits the text of a note
+const maxNoteLength = 4000
+
+// MessageNote is a free-text note an operator attached to a received SMS
+type MessageNote struct {
+	ID         int       `json:"id"`
+	ReceivedID int       `json:"received_id,omitempty"` // only set when listed without the message
+	Text       string    `json:"text"`
+	Author     string    `json:"author"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// NoteRequest represents a request to add a note to a message
+type NoteRequest struct {
+	Text   string `json:"text" binding:"required"`
+	Author string `json:"author"` // defaults to the API key
+}
+
+// receivedNotesColumn selects the notes of a received SMS as a JSON array,
+// read by scanReceivedSMS together with the message
+const receivedNotesColumn = `(SELECT json_group_array(json_object('id', n.id, 'text', n.text, 'author', n.author, 'created_at', n.created_at))
+		FROM received_notes n WHERE n.received_id = received_sms.id)`
+
+// postgresNotesColumn is receivedNotesColumn for PostgreSQL
+const postgresNotesColumn = `(SELECT COALESCE(CAST(json_agg(json_build_object('id', n.id, 'text', n.text, 'author', n.author, 'created_at', n.created_at) ORDER BY n.id) AS TEXT), '[]')
+		FROM received_notes n WHERE n.received_id = received_sms.id)`
+
+// parseNotes decodes the notes selected with receivedNotesColumn
+func parseNotes(notesJSON string) []MessageNote {
+	if notesJSON == "" || notesJSON == "[]" {
+		return nil
+	}
+
+	var notes []MessageNote
+	if err := json.Unmarshal([]byte(notesJSON), &notes); err != nil {
+		log.Printf("Failed to decode notes: %v", err)
+		return nil
+	}
+	return notes
+}
+
+// AddNote attaches a note to a received SMS and returns it, or nil if the
+// message does not exist
+func (d *Database) AddNote(receivedID int, text, author string) (*MessageNote, error) {
+	note := &MessageNote{Text: text, Author: author, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+
+	err := d.db.QueryRow(`
+		INSERT INTO received_notes (received_id, text, author, created_at)
+		SELECT id, ?, ?, ? FROM received_sms WHERE id = ?
+		RETURNING id
+	`, text, author, note.CreatedAt.Format(time.RFC3339), receivedID).Scan(&note.ID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save note: %w", err)
+	}
+
+	return note, nil
+}
+
+// DeleteNote removes a note of a received SMS, reporting whether it existed
+func (d *Database) DeleteNote(receivedID, noteID int) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM received_notes WHERE id = ? AND received_id = ?`, noteID, receivedID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete note: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// SearchNotes returns the notes containing search (case-insensitive), newest
+// first. An empty search returns the latest notes.
+func (d *Database) SearchNotes(search string, limit, offset int) ([]MessageNote, error) {
+	rows, err := d.db.Query(`
+		SELECT id, received_id, text, author, created_at
+		FROM received_notes
+		WHERE text `+d.dialect().like()+` '%' || ? || '%'
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?
+	`, search, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []MessageNote{}
+	for rows.Next() {
+		var note MessageNote
+		var createdAtStr string
+		if err := rows.Scan(&note.ID, &note.ReceivedID, &note.Text, &note.Author, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		note.CreatedAt = parseTimestamp(createdAtStr)
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return notes, nil
+}
+
+// addNote attaches a note to a received SMS
+func (app *App) addNote(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	var req NoteRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Note text cannot be empty"))
+		return
+	}
+	if len(req.Text) > maxNoteLength {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Note text is too long (maximum %d characters)", maxNoteLength))
+		return
+	}
+	if req.Author == "" {
+		req.Author = keyIDFromContext(c)
+	}
+
+	note, err := app.db.AddNote(id, req.Text, req.Author)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to save note: %v", err))
+		return
+	}
+	if note == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status": "success",
+		"note":   note,
+	})
+}
+
+// deleteNote removes a note from a received SMS
+func (app *App) deleteNote(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+	noteID, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid note ID"))
+		return
+	}
+
+	deleted, err := app.db.DeleteNote(id, noteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete note: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Note %d not found", noteID))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// searchNotes finds notes containing the q query parameter, newest first
+func (app *App) searchNotes(c *gin.Context) {
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	notes, err := app.db.SearchNotes(c.Query("q"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to search notes: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"count":  len(notes),
+		"notes":  notes,
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import "sync"
+
+// Notifier broadcasts "something changed" signals to any number of waiters
+type Notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// NewNotifier creates a notifier
+func NewNotifier() *Notifier {
+	return &Notifier{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed on the next Notify call
+func (n *Notifier) Wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// Notify wakes all current waiters
+func (n *Notifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
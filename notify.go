@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// firstParam returns the first non-empty query or form value among names
+func firstParam(c *gin.Context, names ...string) string {
+	for _, name := range names {
+		if value := c.Request.FormValue(name); strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// notifyCompat sends an SMS for classic monitoring alert scripts (Nagios, Zabbix,
+// Icinga). Parameters come from the query string or a form body: "to" (comma
+// separated numbers) and "message". Responses are plain text so scripts can check
+// the HTTP status, e.g. with curl --fail.
+func (app *App) notifyCompat(c *gin.Context) {
+	// GET requests pass the read-only check, so it is enforced here
+	if mode := app.runMode.Get(); mode != RunModeNormal {
+		c.String(http.StatusServiceUnavailable, "ERROR: service is in %s mode\n", mode)
+		return
+	}
+
+	to := firstParam(c, "to", "number", "phone", "recipient")
+	message := firstParam(c, "message", "msg", "text", "body")
+
+	if to == "" || message == "" {
+		c.String(http.StatusBadRequest, "ERROR: 'to' and 'message' parameters are required\n")
+		return
+	}
+
+	numbers := strings.Split(to, ",")
+	for i := range numbers {
+		// Scripts often put "+386..." in the URL unencoded, which decodes to a space
+		if strings.HasPrefix(numbers[i], " ") && !strings.HasPrefix(strings.TrimSpace(numbers[i]), "+") {
+			numbers[i] = "+" + strings.TrimSpace(numbers[i])
+		}
+		numbers[i] = strings.TrimSpace(numbers[i])
+		if err := app.validateSMS(numbers[i], message, SendOptions{}); err != nil {
+			c.String(http.StatusBadRequest, "ERROR: %s\n", err.Error())
+			return
+		}
+	}
+
+	// One request takes one token from the send rate limit, like /send
+	if notifyThrottled(c, app.allowSend(c)) {
+		return
+	}
+
+	var failed []string
+	for _, number := range numbers {
+		_, err := app.deliverSMS(c.Request.Context(), keyIDFromContext(c), number, message, SendOptions{})
+		if errors.Is(err, ErrNotConnected) {
+			c.String(http.StatusServiceUnavailable, "ERROR: not connected to Arduino device\n")
+			return
+		}
+		if notifyThrottled(c, err) {
+			return
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", number, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		c.String(http.StatusInternalServerError, "ERROR: failed to send SMS to %s\n", strings.Join(failed, "; "))
+		return
+	}
+
+	c.String(http.StatusOK, "OK: SMS sent to %s\n", strings.Join(numbers, ", "))
+}
+
+// notifyThrottled answers with 429 Too Many Requests and a Retry-After header
+// when err rejects a send over a limit, and reports whether it did
+func notifyThrottled(c *gin.Context, err error) bool {
+	var throttleErr *ThrottleError
+	if !errors.As(err, &throttleErr) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(throttleErr.retryAfterSeconds()))
+	c.String(http.StatusTooManyRequests, "ERROR: %s\n", throttleErr.Error())
+	return true
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Rotation policies of a number group
+const (
+	RotationRoundRobin = "round_robin" // every send goes out through the next device
+	RotationSticky     = "sticky"      // a conversation stays on the device it started on
+)
+
+// NumberGroup is a set of devices whose SIMs share outbound traffic
+type NumberGroup struct {
+	Name     string
+	Devices  []*RouteDevice
+	Rotation string
+
+	mu   sync.Mutex
+	next int // device the next round-robin pick starts at
+}
+
+// parseNumberGroups reads ROUTING_GROUPS, e.g.
+// "bulk=a1,a2,a3:round_robin;support=primary,a1:sticky", and
+// ROUTING_DEFAULT_GROUP into the router. The rotation defaults to sticky.
+func (r *Router) parseNumberGroups() error {
+	for _, entry := range strings.Split(os.Getenv("ROUTING_GROUPS"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, members, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return fmt.Errorf("ROUTING_GROUPS: invalid group %q (expected name=device,device:rotation)", entry)
+		}
+		if r.Group(name) != nil {
+			return fmt.Errorf("ROUTING_GROUPS: duplicate group %q", name)
+		}
+
+		group := &NumberGroup{Name: name, Rotation: RotationSticky}
+		if list, rotation, found := strings.Cut(members, ":"); found {
+			members = list
+			group.Rotation = strings.TrimSpace(rotation)
+		}
+		if group.Rotation != RotationRoundRobin && group.Rotation != RotationSticky {
+			return fmt.Errorf("ROUTING_GROUPS: unknown rotation %q for %s (expected %s or %s)",
+				group.Rotation, name, RotationRoundRobin, RotationSticky)
+		}
+
+		for _, member := range splitList(members) {
+			device := r.Device(member)
+			if device == nil {
+				return fmt.Errorf("ROUTING_GROUPS: unknown device %q in %s", member, name)
+			}
+			if slices.Contains(group.Devices, device) {
+				return fmt.Errorf("ROUTING_GROUPS: duplicate device %q in %s", member, name)
+			}
+			group.Devices = append(group.Devices, device)
+		}
+		if len(group.Devices) == 0 {
+			return fmt.Errorf("ROUTING_GROUPS: group %s has no devices", name)
+		}
+
+		r.Groups = append(r.Groups, group)
+	}
+
+	r.DefaultGroup = strings.TrimSpace(os.Getenv("ROUTING_DEFAULT_GROUP"))
+	if r.DefaultGroup != "" && r.Group(r.DefaultGroup) == nil {
+		return fmt.Errorf("ROUTING_DEFAULT_GROUP: unknown group %q", r.DefaultGroup)
+	}
+
+	return nil
+}
+
+// Group returns the number group with the given name, or nil
+func (r *Router) Group(name string) *NumberGroup {
+	for _, group := range r.Groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// sendGroup returns the group a send goes through: the one it names, the
+// default group, or nil for least-cost routing
+func (r *Router) sendGroup(opts SendOptions) *NumberGroup {
+	if opts.Group != "" {
+		return r.Group(opts.Group)
+	}
+	if r.DefaultGroup != "" {
+		return r.Group(r.DefaultGroup)
+	}
+	return nil
+}
+
+// rotate returns the group's devices starting at the next round-robin pick
+// and advances the pick
+func (g *NumberGroup) rotate() []*RouteDevice {
+	g.mu.Lock()
+	start := g.next % len(g.Devices)
+	g.next = start + 1
+	g.mu.Unlock()
+
+	return append(slices.Clone(g.Devices[start:]), g.Devices[:start]...)
+}
+
+// Order returns the group's devices in the order they are tried for number.
+// Sticky groups try the device the conversation is assigned to first, else
+// the SIM the number last wrote to, before falling back to round-robin.
+func (g *NumberGroup) Order(db *Database, number string) []*RouteDevice {
+	devices := g.rotate()
+	if g.Rotation != RotationSticky {
+		return devices
+	}
+
+	conversationID := ConversationID(number)
+	preferred, err := db.GetConversationDevice(g.Name, conversationID)
+	if err != nil {
+		log.Printf("Routing: %v", err)
+	}
+	if preferred == "" {
+		preferred = g.deviceForOwnNumber(db, conversationID)
+	}
+
+	for i, device := range devices {
+		if device.Name == preferred {
+			return append([]*RouteDevice{device}, append(devices[:i:i], devices[i+1:]...)...)
+		}
+	}
+	return devices
+}
+
+// deviceForOwnNumber returns the name of the group's device whose SIM last
+// received a message in the conversation, so replies come from the number
+// the contact wrote to
+func (g *NumberGroup) deviceForOwnNumber(db *Database, conversationID string) string {
+	ownNumber, err := db.LastReceivingNumber(conversationID)
+	if err != nil {
+		log.Printf("Routing: %v", err)
+	}
+	if ownNumber == "" {
+		return ""
+	}
+
+	for _, device := range g.Devices {
+		if number, _ := device.Conn.OwnNumber(); number == ownNumber {
+			return device.Name
+		}
+	}
+	return ""
+}
+
+// Sent records the device a send went out through, keeping the
+// conversation on it in sticky groups
+func (g *NumberGroup) Sent(db *Database, number string, device *RouteDevice) {
+	if g.Rotation != RotationSticky {
+		return
+	}
+	if err := db.SetConversationDevice(g.Name, ConversationID(number), device.Name); err != nil {
+		log.Printf("Routing: %v", err)
+	}
+}
+
+// GetConversationDevice returns the device a conversation is assigned to in
+// a number group, or an empty string
+func (d *Database) GetConversationDevice(group, conversationID string) (string, error) {
+	var device string
+	err := d.db.QueryRow(`SELECT device FROM conversation_devices WHERE group_name = ? AND conversation_id = ?`,
+		group, conversationID).Scan(&device)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query conversation device: %w", err)
+	}
+	return device, nil
+}
+
+// SetConversationDevice assigns a conversation to a device of a number group
+func (d *Database) SetConversationDevice(group, conversationID, device string) error {
+	_, err := d.db.Exec(`
+		INSERT INTO conversation_devices (group_name, conversation_id, device, updated_at)
+		VALUES (?, ?, ?, `+d.dialect().now()+`)
+		ON CONFLICT (group_name, conversation_id) DO UPDATE SET device = excluded.device, updated_at = excluded.updated_at
+	`, group, conversationID, device)
+	if err != nil {
+		return fmt.Errorf("failed to save conversation device: %w", err)
+	}
+	return nil
+}
+
+// LastReceivingNumber returns the own number of the SIM that received the
+// latest message of a conversation, or an empty string if unknown
+func (d *Database) LastReceivingNumber(conversationID string) (string, error) {
+	var number string
+	err := d.db.QueryRow(`
+		SELECT device_number FROM received_sms
+		WHERE conversation_id = ? AND device_number IS NOT NULL
+		ORDER BY id DESC LIMIT 1
+	`, conversationID).Scan(&number)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query receiving number: %w", err)
+	}
+	return number, nil
+}
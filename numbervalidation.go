@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultNumberLengths are the digit counts allowed when NUMBER_LENGTHS is not set
+const defaultNumberLengths = "10-15"
+
+// numberSeparators are written between the digits of a number, e.g.
+// "+386 (40) 123-456", and removed before it is checked or normalized
+const numberSeparators = " -()./"
+
+// normalizedLengths are the lowest and highest digit counts NormalizeNumber
+// accepts, set from NUMBER_LENGTHS at startup
+var normalizedLengths = [2]int{10, 15}
+
+// cleanNumber removes the separators from a number
+func cleanNumber(number string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(numberSeparators, r) {
+			return -1
+		}
+		return r
+	}, number)
+}
+
+// NumberValidation configures which numbers SMS may be sent to
+type NumberValidation struct {
+	Lengths    [][2]int // allowed digit counts, as inclusive ranges
+	Prefixes   []string // required prefixes, any number if empty
+	E164       bool     // require "+" and the country code
+	ShortCodes []string // if not empty, only these short codes, see isShortCode
+}
+
+// LoadNumberValidation reads NUMBER_LENGTHS (e.g. "8,10-15", default
+// "10-15"), NUMBER_PREFIXES, NUMBER_E164 and NUMBER_SHORT_CODES (a list of
+// codes) from environment variables. Whether short codes may be sent to at
+// all is decided by SHORT_CODE_POLICY, see SpecialNumberPolicies.
+func LoadNumberValidation() (*NumberValidation, error) {
+	v := &NumberValidation{
+		Prefixes: splitList(os.Getenv("NUMBER_PREFIXES")),
+		E164:     os.Getenv("NUMBER_E164") == "true",
+	}
+
+	lengths := os.Getenv("NUMBER_LENGTHS")
+	if lengths == "" {
+		lengths = defaultNumberLengths
+	}
+	for _, entry := range splitList(lengths) {
+		lo, hi, found := strings.Cut(entry, "-")
+		if !found {
+			hi = lo
+		}
+		first, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		last, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || first < 1 || last < first || last > 15 {
+			return nil, fmt.Errorf("NUMBER_LENGTHS: invalid length %q, expected digit counts up to 15 like 10 or 10-15", entry)
+		}
+		v.Lengths = append(v.Lengths, [2]int{first, last})
+	}
+	if len(v.Lengths) == 0 {
+		return nil, fmt.Errorf("NUMBER_LENGTHS: no lengths in %q", lengths)
+	}
+
+	for _, prefix := range v.Prefixes {
+		if digits, _ := strings.CutPrefix(prefix, "+"); digits == "" || strings.Trim(digits, "0123456789") != "" {
+			return nil, fmt.Errorf("NUMBER_PREFIXES: invalid prefix %q, expected digits with an optional +", prefix)
+		}
+	}
+
+	switch value := os.Getenv("NUMBER_SHORT_CODES"); value {
+	case "true", "false":
+		return nil, fmt.Errorf("NUMBER_SHORT_CODES: expected a list of short codes; use SHORT_CODE_POLICY to allow or block them")
+	default:
+		v.ShortCodes = splitList(value)
+		for _, code := range v.ShortCodes {
+			if !isShortCode(code) {
+				return nil, fmt.Errorf("NUMBER_SHORT_CODES: invalid short code %q, expected 3-6 digits", code)
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// lengths returns the allowed digit counts, e.g. "8, 10-15"
+func (v *NumberValidation) lengths() string {
+	ranges := make([]string, len(v.Lengths))
+	for i, r := range v.Lengths {
+		if r[0] == r[1] {
+			ranges[i] = strconv.Itoa(r[0])
+		} else {
+			ranges[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+		}
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// bounds returns the lowest and highest allowed digit counts
+func (v *NumberValidation) bounds() [2]int {
+	b := v.Lengths[0]
+	for _, r := range v.Lengths[1:] {
+		b[0] = min(b[0], r[0])
+		b[1] = max(b[1], r[1])
+	}
+	return b
+}
+
+// String describes the rules for the startup log
+func (v *NumberValidation) String() string {
+	rules := []string{v.lengths() + " digits"}
+	if v.E164 {
+		rules = append(rules, "E.164")
+	}
+	if len(v.Prefixes) > 0 {
+		rules = append(rules, "prefixes "+strings.Join(v.Prefixes, ", "))
+	}
+	if len(v.ShortCodes) > 0 {
+		rules = append(rules, "short codes "+strings.Join(v.ShortCodes, ", "))
+	}
+	return strings.Join(rules, "; ")
+}
+
+// Check validates a number SMS are sent to. Numbers are digits with an
+// optional leading "+" and separators; short codes skip the other rules and
+// are left to SHORT_CODE_POLICY.
+func (v *NumberValidation) Check(number string) error {
+	number = cleanNumber(number)
+	digits, plus := strings.CutPrefix(number, "+")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return apiErrorf(CodeInvalidNumber, "Invalid phone number (only digits, spaces, -()./ and a leading + allowed)")
+	}
+
+	if !plus && isShortCode(digits) {
+		if len(v.ShortCodes) == 0 || slices.Contains(v.ShortCodes, digits) {
+			return nil
+		}
+		return apiErrorf(CodeInvalidNumber, "Short code %s is not allowed", digits)
+	}
+
+	if v.E164 && !plus {
+		return apiErrorf(CodeInvalidNumber, "Invalid phone number (must be in E.164 format, e.g. +38640123456)")
+	}
+
+	allowed := false
+	for _, r := range v.Lengths {
+		if len(digits) >= r[0] && len(digits) <= r[1] {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return apiErrorf(CodeInvalidNumber, "Invalid phone number (%d digits, allowed: %s)", len(digits), v.lengths())
+	}
+
+	if len(v.Prefixes) > 0 && !slices.ContainsFunc(v.Prefixes, func(prefix string) bool { return strings.HasPrefix(number, prefix) }) {
+		return apiErrorf(CodeInvalidNumber, "Invalid phone number (must start with %s)", strings.Join(v.Prefixes, ", "))
+	}
+
+	return nil
+}
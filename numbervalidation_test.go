@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestShortCodeSettings(t *testing.T) {
+	tests := []struct {
+		policy, shortCodes string
+		number             string
+		confirmed          bool
+		want               string // error code, empty for a send that goes through
+	}{
+		{"", "", "1414", false, CodeNumberBlocked},
+		{"allow", "", "1414", false, ""},
+		{"warn", "", "1414", false, ""},
+		{"confirm", "", "1414", false, CodeConfirmationRequired},
+		{"confirm", "", "1414", true, ""},
+		{"allow", "1414,38012", "38012", false, ""},
+		{"allow", "1414,38012", "1415", false, CodeInvalidNumber},
+		{"block", "1414", "1414", false, CodeNumberBlocked},
+		{"", "", "+38640123456", false, ""},
+		{"block", "1414", "+38640123456", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("SHORT_CODE_POLICY", tt.policy)
+		t.Setenv("NUMBER_SHORT_CODES", tt.shortCodes)
+		validation, err := LoadNumberValidation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		policies, err := LoadSpecialNumberPolicies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = validation.Check(tt.number)
+		if err == nil {
+			err = policies.Check(tt.number, tt.confirmed)
+		}
+		if got := errorCode(err, ""); got != tt.want {
+			t.Errorf("SHORT_CODE_POLICY=%q NUMBER_SHORT_CODES=%q: send to %s gave %q, want %q", tt.policy, tt.shortCodes, tt.number, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"true", "false"} {
+		t.Setenv("NUMBER_SHORT_CODES", value)
+		if _, err := LoadNumberValidation(); err == nil {
+			t.Errorf("NUMBER_SHORT_CODES=%s was accepted", value)
+		}
+	}
+}
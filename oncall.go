@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// On-call rotations
+const (
+	RotationDaily  = "daily"
+	RotationWeekly = "weekly" // hands over on Mondays
+)
+
+// rotationEpoch is the Monday the first number of every rotation is on call
+var rotationEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// OnCallSchedule maps a virtual target such as "oncall" to the number whose turn it is
+type OnCallSchedule struct {
+	Name     string
+	Rotation string // daily or weekly
+	Numbers  []string
+	Handover time.Duration // time of day of the handover
+}
+
+// LoadOnCallSchedules reads on-call schedules from ONCALL_SCHEDULES, e.g.
+// "oncall=weekly:+38640111111,+38640222222;db=daily:+38640333333,+38640444444".
+// ONCALL_HANDOVER sets the local time of day of handovers (default 09:00).
+func LoadOnCallSchedules() (map[string]*OnCallSchedule, error) {
+	handover := 9 * time.Hour
+	if value := os.Getenv("ONCALL_HANDOVER"); value != "" {
+		t, err := time.Parse("15:04", value)
+		if err != nil {
+			return nil, fmt.Errorf("ONCALL_HANDOVER: invalid time %q (expected HH:MM)", value)
+		}
+		handover = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	schedules := make(map[string]*OnCallSchedule)
+	for _, entry := range strings.Split(os.Getenv("ONCALL_SCHEDULES"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, spec, found := strings.Cut(entry, "=")
+		rotation, numbersStr, hasRotation := strings.Cut(spec, ":")
+		name, rotation = strings.TrimSpace(name), strings.TrimSpace(rotation)
+		if !found || !hasRotation || name == "" {
+			return nil, fmt.Errorf("ONCALL_SCHEDULES: invalid schedule %q (expected name=daily|weekly:number,number)", entry)
+		}
+		if rotation != RotationDaily && rotation != RotationWeekly {
+			return nil, fmt.Errorf("ONCALL_SCHEDULES: invalid rotation %q in %q (use daily or weekly)", rotation, entry)
+		}
+		if strings.ContainsAny(name, "+0123456789") {
+			return nil, fmt.Errorf("ONCALL_SCHEDULES: schedule name %q must not look like a number", name)
+		}
+
+		numbers := splitList(numbersStr)
+		if len(numbers) == 0 {
+			return nil, fmt.Errorf("ONCALL_SCHEDULES: schedule %q has no numbers", name)
+		}
+
+		schedules[name] = &OnCallSchedule{Name: name, Rotation: rotation, Numbers: numbers, Handover: handover}
+	}
+
+	return schedules, nil
+}
+
+// periodDays returns the rotation period length in days
+func (s *OnCallSchedule) periodDays() int {
+	if s.Rotation == RotationDaily {
+		return 1
+	}
+	return 7
+}
+
+// shift returns the index of the number on call at t and when that shift ends.
+// Shifts are counted in calendar days so that DST changes don't move handovers.
+func (s *OnCallSchedule) shift(t time.Time) (int, time.Time) {
+	hour, minute := int(s.Handover.Hours()), int(s.Handover.Minutes())%60
+
+	t = t.Local()
+	year, month, day := t.Date()
+	days := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Sub(rotationEpoch).Hours() / 24)
+	if t.Before(time.Date(year, month, day, hour, minute, 0, 0, time.Local)) {
+		days--
+	}
+	if days < 0 {
+		days = 0
+	}
+
+	periods := days / s.periodDays()
+	end := time.Date(rotationEpoch.Year(), rotationEpoch.Month(), rotationEpoch.Day()+(periods+1)*s.periodDays(), hour, minute, 0, 0, time.Local)
+
+	return periods % len(s.Numbers), end
+}
+
+// Current returns the number on call at t
+func (s *OnCallSchedule) Current(t time.Time) string {
+	index, _ := s.shift(t)
+	return s.Numbers[index]
+}
+
+// resolveTarget returns the number currently on call if target names an
+// on-call schedule, and target unchanged otherwise
+func (app *App) resolveTarget(target string) string {
+	if schedule, ok := app.onCall[target]; ok {
+		return schedule.Current(clock.Now())
+	}
+	return cleanNumber(target)
+}
+
+// getOnCall returns every schedule with the number currently on call and the next handover
+func (app *App) getOnCall(c *gin.Context) {
+	names := make([]string, 0, len(app.onCall))
+	for name := range app.onCall {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := clock.Now()
+	schedules := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		schedule := app.onCall[name]
+		index, end := schedule.shift(now)
+		schedules = append(schedules, gin.H{
+			"name":          schedule.Name,
+			"rotation":      schedule.Rotation,
+			"numbers":       schedule.Numbers,
+			"current":       schedule.Numbers[index],
+			"next":          schedule.Numbers[(index+1)%len(schedule.Numbers)],
+			"next_handover": end,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"schedules": schedules,
+	})
+}
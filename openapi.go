@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIOperation describes the bodies of a route in the OpenAPI document.
+// Routes without one are documented with a generic JSON object.
+type openAPIOperation struct {
+	Summary  string
+	Request  any      // zero value of the request body type, nil for none
+	Response any      // zero value of the success response type, nil for a generic object
+	Query    []string // query parameters, see openAPIQueryParams
+}
+
+// listQuery are the query parameters of the message lists
+var listQuery = []string{"limit", "offset", "from", "to", "order_by", "sort"}
+
+// openAPIOperations documents the main routes by handler name
+var openAPIOperations = map[string]openAPIOperation{
+	"healthCheck":            {Summary: "Health of the service and the device connection"},
+	"sendSMS":                {Summary: "Send an SMS", Request: SMSRequest{}, Response: SMSResponse{}, Query: []string{"async"}},
+	"sendAndAwaitReply":      {Summary: "Send an SMS and wait for the reply", Request: SMSRequest{}},
+	"retrySentSMS":           {Summary: "Send a failed SMS again", Response: SMSResponse{}},
+	"getReceivedSMS":         {Summary: "List received SMS", Response: SMSListResponse{}, Query: append([]string{"country", "unread"}, listQuery...)},
+	"getReceivedSMSByNumber": {Summary: "List received SMS from a number", Response: SMSListResponse{}, Query: append([]string{"unread"}, listQuery...)},
+	"getReceivedSMSByID":     {Summary: "Get a received SMS by ID"},
+	"getSentSMS":             {Summary: "List sent SMS", Response: SentSMSListResponse{}, Query: listQuery},
+	"getSentSMSByNumber":     {Summary: "List sent SMS to a number", Response: SentSMSListResponse{}, Query: listQuery},
+	"getSentSMSByID":         {Summary: "Get a sent SMS by ID"},
+	"markReceivedSMSRead":    {Summary: "Mark a received SMS read"},
+	"markAllReceivedSMSRead": {Summary: "Mark all received SMS read", Request: ReadAllRequest{}},
+	"ackReceivedSMS":         {Summary: "Acknowledge a received SMS", Request: AckRequest{}},
+	"exportMessages":         {Summary: "Export the message history for SMS Backup & Restore", Query: []string{"format", "from", "to"}},
+	"exportReceivedSMS":      {Summary: "Export received SMS as CSV or NDJSON", Query: []string{"format", "from", "to"}},
+	"exportSentSMS":          {Summary: "Export sent SMS as CSV or NDJSON", Query: []string{"format", "from", "to"}},
+	"addTemplateVersion":     {Summary: "Add a template version", Request: TemplateVersionRequest{}},
+	"createContact":          {Summary: "Add a contact", Request: ContactRequest{}},
+	"setContact":             {Summary: "Create or replace the contact of a number", Request: ContactRequest{}},
+	"setDeviceLabel":         {Summary: "Label a device", Request: DeviceLabel{}},
+	"createSearch":           {Summary: "Save a search", Request: SavedSearch{}},
+	"getAvailability":        {Summary: "Uptime over the last 24 hours, 7 and 30 days"},
+}
+
+// openAPIQueryParams describes the query parameters of openAPIOperations
+var openAPIQueryParams = map[string]map[string]any{
+	"limit":    {"type": "integer", "minimum": 1, "maximum": 100, "default": 50},
+	"offset":   {"type": "integer", "minimum": 0, "default": 0},
+	"from":     {"type": "string", "description": "RFC 3339 time or day, inclusive"},
+	"to":       {"type": "string", "description": "RFC 3339 time or day, exclusive"},
+	"order_by": {"type": "string", "enum": []string{"timestamp", "created_at", "id"}},
+	"sort":     {"type": "string", "enum": []string{"desc", "asc"}, "default": "desc"},
+	"country":  {"type": "string", "description": "ISO country code of the sender"},
+	"unread":   {"type": "boolean"},
+	"async":    {"type": "boolean"},
+	"format":   {"type": "string"},
+}
+
+// openAPIPublicPaths are served without a bearer token
+var openAPIPublicPaths = map[string]bool{"/health": true}
+
+// pathParamPattern matches gin path parameters, e.g. ":id" or "*path"
+var pathParamPattern = regexp.MustCompile(`[:*]([A-Za-z_]+)`)
+
+// openAPISchemas builds JSON schemas from Go types, collecting named structs
+// as components
+type openAPISchemas struct {
+	components map[string]any
+}
+
+// schema returns the JSON schema of a type, a reference for named structs
+func (s *openAPISchemas) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	case reflect.TypeOf(gin.H{}):
+		return map[string]any{"type": "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.schema(t.Elem())
+		if _, ref := schema["$ref"]; !ref {
+			schema["nullable"] = true
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s.components[t.Name()]; !ok {
+			s.components[t.Name()] = nil // placeholder for recursive types
+			s.components[t.Name()] = s.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema of a struct from its JSON field names. Fields
+// without omitempty, or with binding:"required", are required.
+func (s *openAPISchemas) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = s.schema(field.Type)
+		if strings.Contains(field.Tag.Get("binding"), "required") || !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// buildOpenAPI describes the versioned routes of a router as an OpenAPI 3
+// document. The unversioned aliases are left out.
+func buildOpenAPI(routes gin.RoutesInfo, authEnabled bool) map[string]any {
+	schemas := &openAPISchemas{components: map[string]any{}}
+	errorSchema := schemas.schema(reflect.TypeOf(SMSResponse{}))
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	paths := map[string]any{}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, apiVersionPrefix+"/") {
+			continue
+		}
+		route.Path = unversionedPath(route.Path)
+		path := pathParamPattern.ReplaceAllString(route.Path, "{$1}")
+		handler := route.Handler[strings.LastIndex(route.Handler, ".")+1:]
+		handler = strings.TrimSuffix(handler, "-fm")
+		op := openAPIOperations[handler]
+
+		var parameters []any
+		for _, match := range pathParamPattern.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, name := range op.Query {
+			parameters = append(parameters, map[string]any{"name": name, "in": "query", "schema": openAPIQueryParams[name]})
+		}
+
+		responseSchema := map[string]any{"type": "object"}
+		if op.Response != nil {
+			responseSchema = schemas.schema(reflect.TypeOf(op.Response))
+		}
+		operation := map[string]any{
+			"operationId": handler,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "Success",
+					"content":     map[string]any{"application/json": map[string]any{"schema": responseSchema}},
+				},
+				"default": map[string]any{
+					"description": "Error, with a machine-readable code",
+					"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+				},
+			},
+		}
+		if op.Summary != "" {
+			operation["summary"] = op.Summary
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{"application/json": map[string]any{
+					"schema": schemas.schema(reflect.TypeOf(op.Request)),
+				}},
+			}
+		}
+		if authEnabled && !openAPIPublicPaths[route.Path] {
+			operation["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+		}
+
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	components := map[string]any{"schemas": schemas.components}
+	if authEnabled {
+		components["securitySchemes"] = map[string]any{
+			"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Arduino SMS Server",
+			"version":     "1",
+			"description": "Send and receive SMS through an Arduino GSM modem. The roles each route requires are listed in the README.",
+		},
+		"servers":    []any{map[string]any{"url": apiVersionPrefix}},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// serveOpenAPI returns a handler serving the OpenAPI document of the router's
+// routes, built on the first request once all routes are registered
+func (app *App) serveOpenAPI(router *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	var doc []byte
+	return func(c *gin.Context) {
+		once.Do(func() {
+			doc, _ = json.Marshal(buildOpenAPI(router.Routes(), app.auth != nil))
+		})
+		c.Data(http.StatusOK, "application/json; charset=utf-8", doc)
+	}
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at /openapi.json
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Arduino SMS Server API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// SwaggerUIEnabled reports whether /docs serves Swagger UI, from environment variable
+func SwaggerUIEnabled() bool {
+	return os.Getenv("SWAGGER_UI") == "true"
+}
+
+// serveSwaggerUI serves the Swagger UI page
+func serveSwaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
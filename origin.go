@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// operatorPrefix assigns a national mobile prefix to the operator it was
+// allocated to
+type operatorPrefix struct {
+	prefix, operator string
+}
+
+// operatorPrefixes holds the original allocation of mobile prefixes for the
+// countries in numberPlans. Numbers ported to another operator keep their
+// prefix, so the operator is a hint rather than the current network.
+var operatorPrefixes = map[string][]operatorPrefix{
+	"386": {
+		{"30", "A1 Slovenija"}, {"40", "A1 Slovenija"}, {"68", "A1 Slovenija"}, {"69", "A1 Slovenija"},
+		{"31", "Telekom Slovenije"}, {"41", "Telekom Slovenije"}, {"51", "Telekom Slovenije"}, {"65", "Telekom Slovenije"},
+		{"64", "T-2"},
+		{"70", "Telemach"}, {"71", "Telemach"},
+	},
+	"385": {
+		{"91", "A1 Hrvatska"},
+		{"92", "Telemach"}, {"95", "Telemach"},
+		{"97", "Hrvatski Telekom"}, {"98", "Hrvatski Telekom"}, {"99", "Hrvatski Telekom"},
+	},
+	"43": {
+		{"664", "A1"}, {"680", "A1"}, {"688", "A1"},
+		{"650", "Magenta"}, {"676", "Magenta"},
+		{"660", "Drei"}, {"699", "Drei"},
+	},
+	"49": {
+		{"151", "Telekom"}, {"160", "Telekom"}, {"170", "Telekom"}, {"171", "Telekom"}, {"175", "Telekom"},
+		{"152", "Vodafone"}, {"162", "Vodafone"}, {"172", "Vodafone"}, {"173", "Vodafone"}, {"174", "Vodafone"},
+		{"155", "O2"}, {"157", "O2"}, {"159", "O2"}, {"163", "O2"}, {"176", "O2"}, {"177", "O2"}, {"178", "O2"}, {"179", "O2"},
+	},
+	"39": {
+		{"32", "WindTre"}, {"38", "WindTre"}, {"39", "WindTre"},
+		{"33", "TIM"}, {"36", "TIM"},
+		{"34", "Vodafone"},
+		{"35", "Iliad"},
+	},
+}
+
+// ReceivedOriginCount is the number of received messages from a country and operator
+type ReceivedOriginCount struct {
+	Country  string `json:"country"`
+	Operator string `json:"operator,omitempty"`
+	Count    int    `json:"count"`
+}
+
+// LookupNumberOrigin returns the ISO country code and the operator of a
+// sender number from its prefix. Both are empty if they can't be derived,
+// e.g. for alphanumeric senders and short codes.
+func LookupNumberOrigin(number string) (country, operator string) {
+	e164, err := NormalizeNumber(number)
+	if err != nil {
+		return "", ""
+	}
+
+	code, national := SplitCallingCode(e164)
+	return callingCodes[code], matchOperatorPrefix(code, national).operator
+}
+
+// matchOperatorPrefix returns the longest operator prefix of a national
+// number, or an empty one if none matches
+func matchOperatorPrefix(code, national string) operatorPrefix {
+	var best operatorPrefix
+	for _, p := range operatorPrefixes[code] {
+		if len(p.prefix) > len(best.prefix) && strings.HasPrefix(national, p.prefix) {
+			best = p
+		}
+	}
+	return best
+}
+
+// backfillReceivedOrigins sets the country and operator of received SMS
+// stored before they were recorded
+func (d *Database) backfillReceivedOrigins() error {
+	rows, err := d.db.Query("SELECT DISTINCT number FROM received_sms WHERE country IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to query received_sms: %w", err)
+	}
+
+	var numbers []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		numbers = append(numbers, number)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for _, number := range numbers {
+		country, operator := LookupNumberOrigin(number)
+		if _, err := d.db.Exec("UPDATE received_sms SET country = ?, operator = ? WHERE number = ? AND country IS NULL",
+			country, operator, number); err != nil {
+			return fmt.Errorf("failed to update received_sms: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CountReceivedSMSByOrigin returns the number of received SMS per country and
+// operator, most frequent first. Senders of unknown origin have an empty country.
+func (d *Database) CountReceivedSMSByOrigin() ([]ReceivedOriginCount, error) {
+	rows, err := d.db.Query(`
+		SELECT COALESCE(country, ''), COALESCE(operator, ''), COUNT(*)
+		FROM received_sms
+		GROUP BY 1, 2
+		ORDER BY 3 DESC, 1, 2
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count SMS by origin: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []ReceivedOriginCount{}
+	for rows.Next() {
+		var count ReceivedOriginCount
+		if err := rows.Scan(&count.Country, &count.Operator, &count.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// SaveOutboxItem stores a message waiting in the send queue, replacing the
+// stored copy if it is waiting for a retry
+func (d *Database) SaveOutboxItem(item *QueuedSMS) error {
+	options, err := json.Marshal(item.SendOptions)
+	if err != nil {
+		return fmt.Errorf("failed to encode send options: %w", err)
+	}
+
+	var sentID, retryAt any
+	if item.SentID != 0 {
+		sentID = item.SentID
+	}
+	if item.RetryAt != nil {
+		retryAt = item.RetryAt.UTC().Format(sqliteTimeFormat)
+	}
+
+	_, err = d.db.Exec(`
+		INSERT INTO outbound_queue (id, sent_sms_id, key_id, number, content, options, retries, retry_at, last_error, enqueued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			sent_sms_id = excluded.sent_sms_id, key_id = excluded.key_id, number = excluded.number, content = excluded.content,
+			options = excluded.options, retries = excluded.retries, retry_at = excluded.retry_at, last_error = excluded.last_error,
+			enqueued_at = excluded.enqueued_at
+	`, item.ID, sentID, item.KeyID, item.Number, item.Content, string(options), item.Retries, retryAt, item.LastError,
+		item.EnqueuedAt.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to save queued SMS: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteOutboxItem removes a message that is no longer waiting in the send queue
+func (d *Database) DeleteOutboxItem(id int64) error {
+	if _, err := d.db.Exec(`DELETE FROM outbound_queue WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete queued SMS: %w", err)
+	}
+	return nil
+}
+
+// MaxOutboxID returns the highest queue ID in the outbox, 0 if it is empty
+func (d *Database) MaxOutboxID() (int64, error) {
+	var id int64
+	if err := d.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM outbound_queue`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	return id, nil
+}
+
+// LoadOutbox returns the messages left waiting in the send queue, oldest first
+func (d *Database) LoadOutbox() ([]*QueuedSMS, error) {
+	rows, err := d.db.Query(`
+		SELECT id, COALESCE(sent_sms_id, 0), key_id, number, content, options, retries, COALESCE(retry_at, ''),
+			COALESCE(last_error, ''), enqueued_at
+		FROM outbound_queue
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*QueuedSMS
+	for rows.Next() {
+		item := &QueuedSMS{result: make(chan error, 1)}
+		var sentID int64
+		var options, retryAtStr, enqueuedAtStr string
+		if err := rows.Scan(&item.ID, &sentID, &item.KeyID, &item.Number, &item.Content, &options, &item.Retries, &retryAtStr,
+			&item.LastError, &enqueuedAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := json.Unmarshal([]byte(options), &item.SendOptions); err != nil {
+			return nil, fmt.Errorf("failed to decode send options of queued SMS %d: %w", item.ID, err)
+		}
+		item.SentID = sentID
+		item.EnqueuedAt = parseTimestamp(enqueuedAtStr)
+		if retryAtStr != "" {
+			retryAt := parseTimestamp(retryAtStr)
+			item.RetryAt = &retryAt
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return items, nil
+}
+
+// outboxSentIDs is a subquery of the sent SMS waiting in the outbox
+const outboxSentIDs = `SELECT sent_sms_id FROM outbound_queue WHERE sent_sms_id IS NOT NULL`
+
+// resumeOutbox puts the messages a previous run left waiting in the outbox
+// back on the queue and records their outcome once they are sent. Their
+// senders are gone, so the outcome is only found in GET /sent.
+func (app *App) resumeOutbox() {
+	items, err := app.db.LoadOutbox()
+	if err != nil {
+		log.Printf("Outbox: %v", err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	for _, item := range items {
+		if app.rawSerial != nil {
+			item.Raw = &SerialExchange{}
+		}
+	}
+
+	items = app.queue.Restore(items)
+	for _, item := range items {
+		go func(item *QueuedSMS) {
+			err := <-item.result
+			if _, err := app.recordSendOutcome(item.KeyID, item.Number, item.Content, item.SendOptions, err); err != nil {
+				log.Printf("Outbox: SMS %d to %s failed: %v", item.ID, item.Number, err)
+			}
+		}(item)
+	}
+	log.Printf("Outbox: resumed %d SMS queued before the restart", len(items))
+}
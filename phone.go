@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Number types detected by LookupNumberType
+const (
+	NumberTypeMobile    = "mobile"
+	NumberTypeLandline  = "landline"
+	NumberTypeTollFree  = "toll_free"
+	NumberTypePremium   = "premium"
+	NumberTypeShortCode = "short_code"
+	NumberTypeUnknown   = "unknown"
+)
+
+// callingCodes maps international calling codes to ISO 3166 country codes.
+// Code 1 is shared by the North American Numbering Plan countries.
+var callingCodes = map[string]string{
+	"1": "US", "7": "RU", "20": "EG", "27": "ZA", "30": "GR", "31": "NL", "32": "BE",
+	"33": "FR", "34": "ES", "36": "HU", "39": "IT", "40": "RO", "41": "CH", "43": "AT",
+	"44": "GB", "45": "DK", "46": "SE", "47": "NO", "48": "PL", "49": "DE", "51": "PE",
+	"52": "MX", "53": "CU", "54": "AR", "55": "BR", "56": "CL", "57": "CO", "58": "VE",
+	"60": "MY", "61": "AU", "62": "ID", "63": "PH", "64": "NZ", "65": "SG", "66": "TH",
+	"81": "JP", "82": "KR", "84": "VN", "86": "CN", "90": "TR", "91": "IN", "92": "PK",
+	"93": "AF", "94": "LK", "95": "MM", "98": "IR", "212": "MA", "213": "DZ", "216": "TN",
+	"218": "LY", "220": "GM", "221": "SN", "233": "GH", "234": "NG", "254": "KE",
+	"255": "TZ", "256": "UG", "351": "PT", "352": "LU", "353": "IE", "354": "IS",
+	"355": "AL", "356": "MT", "357": "CY", "358": "FI", "359": "BG", "370": "LT",
+	"371": "LV", "372": "EE", "373": "MD", "374": "AM", "375": "BY", "376": "AD",
+	"377": "MC", "378": "SM", "380": "UA", "381": "RS", "382": "ME", "383": "XK",
+	"385": "HR", "386": "SI", "387": "BA", "389": "MK", "420": "CZ", "421": "SK",
+	"423": "LI", "852": "HK", "853": "MO", "880": "BD", "886": "TW", "961": "LB",
+	"962": "JO", "963": "SY", "964": "IQ", "965": "KW", "966": "SA", "971": "AE",
+	"972": "IL", "974": "QA", "995": "GE",
+}
+
+// numberPlan lists national number prefixes by type for a calling code
+type numberPlan struct {
+	mobile, tollFree, premium, landline []string
+}
+
+// numberPlans holds simplified numbering plans for type detection. Numbers of
+// countries without a plan are reported as unknown.
+var numberPlans = map[string]numberPlan{
+	"386": {mobile: []string{"30", "31", "40", "41", "51", "64", "65", "68", "69", "70", "71"}, tollFree: []string{"80"}, premium: []string{"90"}, landline: []string{"1", "2", "3", "4", "5", "7"}},
+	"385": {mobile: []string{"9"}, tollFree: []string{"800"}, premium: []string{"60"}, landline: []string{"1", "2", "3", "4", "5"}},
+	"43":  {mobile: []string{"6"}, tollFree: []string{"800"}, premium: []string{"900", "930"}, landline: []string{"1", "2", "3", "4", "5", "7"}},
+	"49":  {mobile: []string{"15", "16", "17"}, tollFree: []string{"800"}, premium: []string{"900"}, landline: []string{"2", "3", "4", "5", "6", "7", "8", "9"}},
+	"44":  {mobile: []string{"71", "72", "73", "74", "75", "77", "78", "79"}, tollFree: []string{"800", "808"}, premium: []string{"9"}, landline: []string{"1", "2"}},
+	"39":  {mobile: []string{"3"}, tollFree: []string{"800", "803"}, premium: []string{"89"}, landline: []string{"0"}},
+	"33":  {mobile: []string{"6", "7"}, tollFree: []string{"80"}, premium: []string{"89"}, landline: []string{"1", "2", "3", "4", "5", "9"}},
+	"34":  {mobile: []string{"6", "7"}, tollFree: []string{"900"}, premium: []string{"80"}, landline: []string{"8", "9"}},
+}
+
+// GetDefaultCountryCode returns the calling code used for national numbers
+// (e.g. "386"), from environment variable
+func GetDefaultCountryCode() string {
+	return strings.TrimPrefix(os.Getenv("DEFAULT_COUNTRY_CODE"), "+")
+}
+
+// NormalizeNumber converts a phone number to E.164 form (e.g. "+38640123456").
+// Spaces and punctuation are removed, a leading "00" is treated as "+" and
+// national numbers starting with "0" get the DEFAULT_COUNTRY_CODE.
+func NormalizeNumber(number string) (string, error) {
+	var digits strings.Builder
+	plus := false
+	for i, r := range strings.TrimSpace(number) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			plus = true
+		case strings.ContainsRune(numberSeparators, r):
+		default:
+			return "", fmt.Errorf("invalid character %q in number", r)
+		}
+	}
+
+	national := digits.String()
+	switch {
+	case plus:
+	case strings.HasPrefix(national, "00"):
+		national = national[2:]
+	case strings.HasPrefix(national, "0"):
+		countryCode := GetDefaultCountryCode()
+		if countryCode == "" {
+			return "", fmt.Errorf("national number without DEFAULT_COUNTRY_CODE")
+		}
+		national = countryCode + national[1:]
+	}
+
+	if len(national) < normalizedLengths[0] || len(national) > normalizedLengths[1] {
+		return "", fmt.Errorf("number must have %d-%d digits including the country code", normalizedLengths[0], normalizedLengths[1])
+	}
+
+	return "+" + national, nil
+}
+
+// SplitCallingCode splits an E.164 number into its calling code and national number.
+// The calling code is empty if it is not known.
+func SplitCallingCode(e164 string) (string, string) {
+	digits := strings.TrimPrefix(e164, "+")
+	for n := 3; n >= 1; n-- {
+		if len(digits) > n {
+			if _, ok := callingCodes[digits[:n]]; ok {
+				return digits[:n], digits[n:]
+			}
+		}
+	}
+	return "", digits
+}
+
+// LookupNumberType detects the type of an E.164 number from its numbering plan
+func LookupNumberType(e164 string) string {
+	code, national := SplitCallingCode(e164)
+	plan, ok := numberPlans[code]
+	if !ok {
+		return NumberTypeUnknown
+	}
+
+	// Special ranges first, e.g. German toll-free 800 before landline 8
+	for _, group := range []struct {
+		kind     string
+		prefixes []string
+	}{
+		{NumberTypeTollFree, plan.tollFree},
+		{NumberTypePremium, plan.premium},
+		{NumberTypeMobile, plan.mobile},
+		{NumberTypeLandline, plan.landline},
+	} {
+		for _, prefix := range group.prefixes {
+			if strings.HasPrefix(national, prefix) {
+				return group.kind
+			}
+		}
+	}
+
+	return NumberTypeUnknown
+}
+
+// isShortCode reports whether number is a short code (3-6 digits, no country code)
+func isShortCode(number string) bool {
+	if len(number) < 3 || len(number) > 6 {
+		return false
+	}
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Long-poll timeouts
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 120 * time.Second
+)
+
+// GetReceivedSMSSince retrieves received SMS with an ID greater than sinceID, oldest first
+func (d *Database) GetReceivedSMSSince(sinceID, limit int) ([]ReceivedSMS, error) {
+	query := `
+		SELECT ` + d.receivedSMSColumns() + `
+		FROM received_sms
+		WHERE id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`
+
+	rows, err := d.db.Query(query, sinceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SMS: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []ReceivedSMS
+
+	for rows.Next() {
+		msg, err := scanReceivedSMS(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return messages, nil
+}
+
+// parsePollTimeout parses a long-poll timeout given as a Go duration ("30s") or in seconds ("30")
+func parsePollTimeout(value string) (time.Duration, error) {
+	return parseTimeout(value, defaultPollTimeout, maxPollTimeout)
+}
+
+// parseTimeout parses a timeout given as a Go duration or in seconds,
+// returning def if value is empty and capping it at max
+func parseTimeout(value string, def, max time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid timeout %q", value)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	if timeout > max {
+		timeout = max
+	}
+
+	return timeout, nil
+}
+
+// pollReceivedSMS holds the request open until a message newer than since_id
+// arrives or the timeout elapses. Without since_id it waits for the next new message.
+func (app *App) pollReceivedSMS(c *gin.Context) {
+	timeout, err := parsePollTimeout(c.Query("timeout"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid 'timeout' parameter: %v", err))
+		return
+	}
+
+	var sinceID int
+	if sinceStr := c.Query("since_id"); sinceStr != "" {
+		sinceID, err = strconv.Atoi(sinceStr)
+		if err != nil || sinceID < 0 {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid 'since_id' parameter"))
+			return
+		}
+	} else {
+		version, err := app.db.GetTableVersion("received_sms")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+			return
+		}
+		sinceID = version.MaxID
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Subscribe before querying so a message saved in between is not missed
+		wait := app.receivedNotifier.Wait()
+
+		messages, err := app.db.GetReceivedSMSSince(sinceID, 100)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+			return
+		}
+
+		if len(messages) > 0 {
+			app.loadMessageLabels().receivedList(messages)
+			c.JSON(http.StatusOK, gin.H{
+				"status":   "success",
+				"count":    len(messages),
+				"last_id":  messages[len(messages)-1].ID,
+				"messages": messages,
+			})
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-timer.C:
+			c.JSON(http.StatusOK, gin.H{
+				"status":   "success",
+				"count":    0,
+				"last_id":  sinceID,
+				"messages": []ReceivedSMS{},
+			})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// defaultDatabasePath is the SQLite database used when DATABASE_URL is not set
+const defaultDatabasePath = "./sms.db"
+
+// postgresNow is CURRENT_TIMESTAMP in the format SQLite gives it, so stored
+// timestamps compare and parse the same on both databases
+var postgresNow = postgresUTC("now()")
+
+// postgresUTC formats a timestamptz expression in UTC like CURRENT_TIMESTAMP
+func postgresUTC(expr string) string {
+	return "to_char((" + expr + ") AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')"
+}
+
+// sqliteDriverTimeFormat is how go-sqlite3 stores time.Time arguments
+const sqliteDriverTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// DatabasePath returns the database to use from environment variable: a
+// postgres:// URL in DATABASE_URL, or the SQLite file sms.db
+func DatabasePath() string {
+	if url := os.Getenv("DATABASE_URL"); url != "" {
+		return url
+	}
+	return defaultDatabasePath
+}
+
+// isPostgresURL reports whether a database path is a PostgreSQL connection URL
+func isPostgresURL(path string) bool {
+	return strings.HasPrefix(path, "postgres://") || strings.HasPrefix(path, "postgresql://")
+}
+
+// postgres reports whether the database is PostgreSQL
+func (d *Database) postgres() bool {
+	_, ok := d.db.dialect.(postgresDialect)
+	return ok
+}
+
+// dialect returns the SQL dialect of the database
+func (d *Database) dialect() dialect {
+	return d.db.dialect
+}
+
+// sqlDB runs queries on SQLite or PostgreSQL, binding placeholders and
+// arguments for the driver with the dialect
+type sqlDB struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// sqlTx is a transaction on a sqlDB
+type sqlTx struct {
+	tx      *sql.Tx
+	dialect dialect
+}
+
+// Exec runs a statement
+func (db *sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	query, args = db.dialect.bind(query, args)
+	return db.db.Exec(query, args...)
+}
+
+// Query runs a query returning rows
+func (db *sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	query, args = db.dialect.bind(query, args)
+	return db.db.Query(query, args...)
+}
+
+// QueryRow runs a query returning at most one row
+func (db *sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	query, args = db.dialect.bind(query, args)
+	return db.db.QueryRow(query, args...)
+}
+
+// Begin starts a transaction
+func (db *sqlDB) Begin() (*sqlTx, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx: tx, dialect: db.dialect}, nil
+}
+
+// Close closes the database
+func (db *sqlDB) Close() error {
+	return db.db.Close()
+}
+
+// Exec runs a statement in the transaction
+func (tx *sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	query, args = tx.dialect.bind(query, args)
+	return tx.tx.Exec(query, args...)
+}
+
+// Query runs a query returning rows in the transaction
+func (tx *sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	query, args = tx.dialect.bind(query, args)
+	return tx.tx.Query(query, args...)
+}
+
+// QueryRow runs a query returning at most one row in the transaction
+func (tx *sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	query, args = tx.dialect.bind(query, args)
+	return tx.tx.QueryRow(query, args...)
+}
+
+// Commit commits the transaction
+func (tx *sqlTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+// Rollback aborts the transaction
+func (tx *sqlTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// postgresArgs stores arguments the way go-sqlite3 does: booleans as 1 or 0
+// and times as text, so both databases hold the same values
+func postgresArgs(args []any) []any {
+	converted := make([]any, len(args))
+	for i, arg := range args {
+		if valuer, ok := arg.(driver.Valuer); ok {
+			if value, err := valuer.Value(); err == nil {
+				arg = value
+			}
+		}
+		switch v := arg.(type) {
+		case *bool:
+			if v != nil {
+				arg = *v
+			}
+		case *time.Time:
+			if v != nil {
+				arg = *v
+			}
+		}
+		switch v := arg.(type) {
+		case bool:
+			if v {
+				arg = int64(1)
+			} else {
+				arg = int64(0)
+			}
+		case time.Time:
+			arg = v.Format(sqliteDriverTimeFormat)
+		}
+		converted[i] = arg
+	}
+	return converted
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// newPostgresDatabase opens the PostgreSQL database in TEST_DATABASE_URL with
+// a fresh schema that is dropped after the test. The test is skipped when
+// the variable is not set.
+func newPostgresDatabase(t *testing.T) *Database {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("sms_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	db, err := NewDatabase(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPostgres(t *testing.T) {
+	db := newPostgresDatabase(t)
+	const number = "+38640123456"
+
+	// Received in another zone, so filters have to compare in UTC
+	received := time.Date(2026, 3, 1, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+	id, err := db.SaveReceivedSMS(number, "Door OPEN in hall", "", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveSentSMS(number, "hi", "success", "", "", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Searches are case-insensitive, as LIKE is on SQLite
+	msg, err := db.FindReceivedSMS("door open", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil || msg.ID != int(id) {
+		t.Fatalf("FindReceivedSMS found %+v, want SMS %d", msg, id)
+	}
+
+	from, to := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC), time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	count, err := db.CountFilteredReceivedSMS(ReceivedSMSFilter{From: &from, To: &to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d SMS received between 09:00 and 09:30 UTC, want 1", count)
+	}
+
+	if _, err := db.AddNote(int(id), "Called back", "me"); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = db.GetReceivedSMSByID(int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Notes) != 1 || msg.Notes[0].Text != "Called back" {
+		t.Errorf("SMS has notes %+v, want the one added", msg.Notes)
+	}
+	notes, err := db.SearchNotes("CALLED", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 {
+		t.Errorf("SearchNotes found %d notes, want 1", len(notes))
+	}
+
+	reply, err := db.FindLoopbackReply(number, "OPEN", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != int(id) {
+		t.Errorf("FindLoopbackReply found %d, want %d", reply, id)
+	}
+
+	// A second instance can't take an unexpired claim
+	claim, err := db.ClaimDevice("modem", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim, err = db.ClaimDevice("modem", "b", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if claim.Instance != "a" || !claim.ExpiresAt.After(claim.ClaimedAt) {
+		t.Errorf("claim = %+v, want instance a holding it for a minute", claim)
+	}
+
+	report, err := db.EraseNumberData(number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ReceivedDeleted != 1 || report.SentDeleted != 1 || report.Tables["received_notes"] != 1 {
+		t.Errorf("report = %+v, want the SMS and note deleted", report)
+	}
+}
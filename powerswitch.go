@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// powerCommandTimeout limits each power switch command
+const powerCommandTimeout = 30 * time.Second
+
+// PowerSwitch cuts and restores the Arduino's power feed through a GPIO pin
+// driving a relay, or through commands for e.g. a USB relay or uhubctl
+type PowerSwitch struct {
+	GPIO       string        // value file of an exported GPIO, e.g. /sys/class/gpio/gpio17/value
+	ActiveLow  bool          // the relay cuts power when the GPIO is high
+	OffCommand string        // shell command cutting power
+	OnCommand  string        // shell command restoring power
+	OffTime    time.Duration // how long power stays off
+	After      time.Duration // how long reconnecting may fail before power is cycled
+}
+
+// LoadPowerSwitch reads power switch settings from environment variables. It
+// returns nil if neither POWER_SWITCH_GPIO nor the power commands are set.
+func LoadPowerSwitch() (*PowerSwitch, error) {
+	ps := &PowerSwitch{
+		GPIO:       os.Getenv("POWER_SWITCH_GPIO"),
+		ActiveLow:  os.Getenv("POWER_SWITCH_ACTIVE_LOW") == "true",
+		OffCommand: os.Getenv("POWER_SWITCH_OFF_COMMAND"),
+		OnCommand:  os.Getenv("POWER_SWITCH_ON_COMMAND"),
+		OffTime:    5 * time.Second,
+		After:      2 * time.Minute,
+	}
+
+	switch {
+	case ps.GPIO == "" && ps.OffCommand == "" && ps.OnCommand == "":
+		return nil, nil
+	case ps.GPIO != "" && (ps.OffCommand != "" || ps.OnCommand != ""):
+		return nil, fmt.Errorf("POWER_SWITCH_GPIO and the power switch commands are mutually exclusive")
+	case ps.GPIO == "" && (ps.OffCommand == "" || ps.OnCommand == ""):
+		return nil, fmt.Errorf("POWER_SWITCH_OFF_COMMAND and POWER_SWITCH_ON_COMMAND must both be set")
+	}
+
+	if value := os.Getenv("POWER_OFF_TIME"); value != "" {
+		offTime, err := time.ParseDuration(value)
+		if err != nil || offTime < time.Second || offTime > time.Minute {
+			return nil, fmt.Errorf("POWER_OFF_TIME: invalid duration %q (1s to 1m)", value)
+		}
+		ps.OffTime = offTime
+	}
+
+	if value := os.Getenv("POWER_CYCLE_AFTER"); value != "" {
+		after, err := time.ParseDuration(value)
+		if err != nil || after < 30*time.Second {
+			return nil, fmt.Errorf("POWER_CYCLE_AFTER: invalid duration %q (minimum 30s)", value)
+		}
+		ps.After = after
+	}
+
+	return ps, nil
+}
+
+// Method describes how power is switched, for logs and the device event log
+func (ps *PowerSwitch) Method() string {
+	if ps.GPIO != "" {
+		return "gpio " + ps.GPIO
+	}
+	return "command"
+}
+
+// Cycle cuts power, waits OffTime and restores it. Power is restored even if
+// cutting it failed.
+func (ps *PowerSwitch) Cycle(ctx context.Context) error {
+	offErr := ps.set(ctx, false)
+	if offErr == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(ps.OffTime):
+		}
+	}
+
+	if err := ps.set(context.Background(), true); err != nil {
+		return err
+	}
+	return offErr
+}
+
+// set switches power on or off
+func (ps *PowerSwitch) set(ctx context.Context, on bool) error {
+	if ps.GPIO != "" {
+		value := "0"
+		if on != ps.ActiveLow {
+			value = "1"
+		}
+		if err := os.WriteFile(ps.GPIO, []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to write GPIO: %w", err)
+		}
+		return nil
+	}
+
+	command, state := ps.OffCommand, "off"
+	if on {
+		command, state = ps.OnCommand, "on"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, powerCommandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("power %s command failed: %w: %s", state, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// PowerCycle cuts and restores the Arduino's power and records it in the
+// device event log. The connection is reestablished by the reconnect loop.
+func (a *ArduinoConnection) PowerCycle(reason string) error {
+	ps := a.gsm.PowerSwitch
+	if ps == nil {
+		return errPowerSwitchNotConfigured
+	}
+
+	log.Printf("Power cycling the Arduino via %s: %s", ps.Method(), reason)
+	err := ps.Cycle(context.Background())
+	if err != nil {
+		log.Printf("Power cycle failed: %v", err)
+		a.recordDeviceEvent(DeviceEventPowerCycleFailed, fmt.Sprintf("%s; via %s: %v", reason, ps.Method(), err))
+		return err
+	}
+
+	a.recordDeviceEvent(DeviceEventPowerCycle, fmt.Sprintf("%s; via %s", reason, ps.Method()))
+	return nil
+}
+
+// PowerCycle is not supported by the mock connection
+func (m *MockSerialConnection) PowerCycle(reason string) error {
+	return errPowerSwitchNotConfigured
+}
+
+// powerCycleDevice cuts and restores the Arduino's power on request
+func (app *App) powerCycleDevice(c *gin.Context) {
+	err := app.smsConn.PowerCycle("requested via API")
+	if err == errPowerSwitchNotConfigured {
+		c.JSON(http.StatusServiceUnavailable, errorResponse(c, CodeNotConfigured, "Power switch is not configured"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Power cycle failed: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Arduino power cycled",
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MessagePurgeFilter selects the messages of a bulk delete
+type MessagePurgeFilter struct {
+	Number string     // conversation with this number, empty for any
+	From   *time.Time // stored at or after
+	To     *time.Time // stored before
+}
+
+// where returns the SQL condition selecting the filtered messages
+func (f MessagePurgeFilter) where() (string, []any) {
+	clause := "1 = 1"
+	var args []any
+	if f.Number != "" {
+		clause += " AND conversation_id = ?"
+		args = append(args, ConversationID(f.Number))
+	}
+	if f.From != nil {
+		clause += " AND created_at >= ?"
+		args = append(args, f.From.UTC().Format(sqliteTimeFormat))
+	}
+	if f.To != nil {
+		clause += " AND created_at < ?"
+		args = append(args, f.To.UTC().Format(sqliteTimeFormat))
+	}
+	return clause, args
+}
+
+// parseTimeQuery parses a time query parameter given as RFC 3339 or as a
+// day (YYYY-MM-DD, midnight UTC). It returns nil if the parameter is empty.
+func parseTimeQuery(c *gin.Context, param string) (*time.Time, error) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	if t, err := time.Parse(dayFormat, value); err == nil {
+		return &t, nil
+	}
+	return nil, fmt.Errorf("invalid '%s' parameter, expected RFC 3339 or YYYY-MM-DD", param)
+}
+
+// parseTimeRange parses the from and to query parameters (see
+// parseTimeQuery), checking that from is before to
+func parseTimeRange(c *gin.Context) (from, to *time.Time, err error) {
+	if from, err = parseTimeQuery(c, "from"); err != nil {
+		return nil, nil, err
+	}
+	if to, err = parseTimeQuery(c, "to"); err != nil {
+		return nil, nil, err
+	}
+	if from != nil && to != nil && !from.Before(*to) {
+		return nil, nil, apiErrorf(CodeInvalidRequest, "'from' must be before 'to'")
+	}
+	return from, to, nil
+}
+
+// DeleteReceivedSMS deletes a received SMS with its notes and serial
+// payload, reporting whether it existed
+func (d *Database) DeleteReceivedSMS(id int) (bool, error) {
+	n, err := d.deleteReceivedWhere("id = ?", []any{id})
+	return n > 0, err
+}
+
+// DeleteSentSMS deletes a sent SMS with its serial payload, reporting
+// whether it existed
+func (d *Database) DeleteSentSMS(id int) (bool, error) {
+	n, err := d.deleteSentWhere("id = ?", []any{id})
+	return n > 0, err
+}
+
+// PurgeReceivedSMS deletes the received SMS matching filter and returns how many were deleted
+func (d *Database) PurgeReceivedSMS(filter MessagePurgeFilter) (int64, error) {
+	clause, args := filter.where()
+	return d.deleteReceivedWhere(clause, args)
+}
+
+// PurgeSentSMS deletes the sent SMS matching filter and returns how many were deleted
+func (d *Database) PurgeSentSMS(filter MessagePurgeFilter) (int64, error) {
+	clause, args := filter.where()
+	return d.deleteSentWhere(clause, args)
+}
+
+// deleteReceivedWhere deletes the received SMS matching a condition, with the
+// records attached to them, in a single transaction
+func (d *Database) deleteReceivedWhere(clause string, args []any) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	selected := "SELECT id FROM received_sms WHERE " + clause
+	if _, err := tx.Exec("DELETE FROM received_notes WHERE received_id IN ("+selected+")", args...); err != nil {
+		return 0, fmt.Errorf("failed to delete notes: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM serial_payloads WHERE received_sms_id IN ("+selected+")", args...); err != nil {
+		return 0, fmt.Errorf("failed to delete serial payloads: %w", err)
+	}
+
+	res, err := tx.Exec("DELETE FROM received_sms WHERE "+clause, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete received SMS: %w", err)
+	}
+	n, _ := res.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	return n, nil
+}
+
+// deleteSentWhere deletes the sent SMS matching a condition, with their serial
+// payloads, in a single transaction
+func (d *Database) deleteSentWhere(clause string, args []any) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM serial_payloads WHERE sent_sms_id IN (SELECT id FROM sent_sms WHERE "+clause+")", args...); err != nil {
+		return 0, fmt.Errorf("failed to delete serial payloads: %w", err)
+	}
+
+	res, err := tx.Exec("DELETE FROM sent_sms WHERE "+clause, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sent SMS: %w", err)
+	}
+	n, _ := res.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	return n, nil
+}
+
+// deleteMessage deletes one received or sent SMS by ID
+func (app *App) deleteMessage(c *gin.Context, kind string, remove func(id int) (bool, error)) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	deleted, err := remove(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete message: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+
+	log.Printf("Deleted %s SMS %d", kind, id)
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// deleteReceivedSMS deletes a received SMS, e.g. one containing a one-time code
+func (app *App) deleteReceivedSMS(c *gin.Context) {
+	app.deleteMessage(c, "received", app.db.DeleteReceivedSMS)
+}
+
+// deleteSentSMS deletes a sent SMS
+func (app *App) deleteSentSMS(c *gin.Context) {
+	app.deleteMessage(c, "sent", app.db.DeleteSentSMS)
+}
+
+// purgeMessages deletes the received or sent SMS selected by the number, from
+// and to query parameters. At least one of them is required, so that a bare
+// request can't empty the history.
+func (app *App) purgeMessages(c *gin.Context, kind string, purge func(MessagePurgeFilter) (int64, error)) {
+	var filter MessagePurgeFilter
+	if value := c.Query("number"); value != "" {
+		number, err := NormalizeNumber(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidNumber, "Invalid number: %v", err))
+			return
+		}
+		filter.Number = number
+	}
+
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	if filter.Number == "" && filter.From == nil && filter.To == nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Specify 'number', 'from' or 'to' to delete messages in bulk"))
+		return
+	}
+
+	deleted, err := purge(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete messages: %v", err))
+		return
+	}
+
+	log.Printf("Deleted %d %s SMS", deleted, kind)
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"deleted": deleted,
+	})
+}
+
+// purgeReceivedSMS deletes received SMS in bulk
+func (app *App) purgeReceivedSMS(c *gin.Context) {
+	app.purgeMessages(c, "received", app.db.PurgeReceivedSMS)
+}
+
+// purgeSentSMS deletes sent SMS in bulk
+func (app *App) purgeSentSMS(c *gin.Context) {
+	app.purgeMessages(c, "sent", app.db.PurgeSentSMS)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrSendCancelled is returned for queued messages that were cancelled before being sent
+var ErrSendCancelled = errors.New("SMS was cancelled before sending")
+
+// defaultSendDuration is the assumed send time until a real average is known
+const defaultSendDuration = 5 * time.Second
+
+// QueuedSMS represents an outbound SMS waiting to be sent
+type QueuedSMS struct {
+	ID         int64      `json:"id"`
+	Number     string     `json:"number"`
+	Content    string     `json:"content"`
+	EnqueuedAt time.Time  `json:"enqueued_at"`
+	Retries    int        `json:"retries,omitempty"`  // failed attempts retried so far
+	RetryAt    *time.Time `json:"retry_at,omitempty"` // earliest time of the next attempt
+	LastError  string     `json:"last_error,omitempty"`
+	KeyID      string     `json:"-"` // API key the send is attributed to
+	SendOptions
+
+	result chan error
+}
+
+// QueueEntry represents a pending message with its position and estimated send time
+type QueueEntry struct {
+	QueuedSMS
+	Position int        `json:"position"`
+	ETA      *time.Time `json:"eta,omitempty"`
+}
+
+// SendQueue passes outbound SMS to a fixed number of dispatcher goroutines,
+// one per message that may be in flight to the modem at once
+type SendQueue struct {
+	mu       sync.Mutex
+	items    []*QueuedSMS
+	nextID   int64
+	paused   bool
+	hold     func() bool         // holds the queue while it returns true, nil never does
+	inFlight map[int64]time.Time // start time of messages being sent
+	avgSend  time.Duration
+	send     func(number, content string, opts SendOptions) error
+	outbox   *Database // persists waiting messages, nil keeps them in memory only
+	retry    RetryPolicies
+	workers  int
+	wakeChan chan struct{}
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSendQueue creates a queue that delivers messages using the given send function,
+// retrying failed sends according to the retry policies. Up to workers
+// messages are sent concurrently.
+func NewSendQueue(send func(number, content string, opts SendOptions) error, retry RetryPolicies, workers int) *SendQueue {
+	return &SendQueue{
+		inFlight: make(map[int64]time.Time),
+		avgSend:  defaultSendDuration,
+		send:     send,
+		retry:    retry,
+		workers:  workers,
+		wakeChan: make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// UseOutbox persists the messages waiting in the queue in db, so that they
+// survive a restart (see outbox.go). It must be called before Start.
+func (q *SendQueue) UseOutbox(db *Database) error {
+	maxID, err := db.MaxOutboxID()
+	if err != nil {
+		return err
+	}
+
+	q.outbox = db
+	q.nextID = maxID
+	return nil
+}
+
+// HoldWhile makes the dispatcher hold the queued messages while hold returns
+// true, e.g. outside the normal runtime mode. Call wake once it turns false.
+// It must be called before Start.
+func (q *SendQueue) HoldWhile(hold func() bool) {
+	q.hold = hold
+}
+
+// Start launches the dispatcher goroutines
+func (q *SendQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		go q.run()
+	}
+}
+
+// Stop stops the dispatcher; pending messages are left unsent
+func (q *SendQueue) Stop() {
+	q.stopOnce.Do(func() {
+		close(q.stopChan)
+	})
+}
+
+// Enqueue adds a message sent on behalf of keyID to the end of the queue
+func (q *SendQueue) Enqueue(keyID, number, content string, opts SendOptions) *QueuedSMS {
+	q.mu.Lock()
+	q.nextID++
+	item := &QueuedSMS{
+		ID:          q.nextID,
+		Number:      number,
+		Content:     content,
+		EnqueuedAt:  time.Now(),
+		KeyID:       keyID,
+		SendOptions: opts,
+		result:      make(chan error, 1),
+	}
+	q.mu.Unlock()
+
+	// Saved before a dispatcher can take it, which removes it again
+	q.persist(item)
+
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+
+	q.wake()
+	return item
+}
+
+// Restore puts messages loaded from the outbox back on the queue and returns
+// them, leaving out any this queue already holds
+func (q *SendQueue) Restore(items []*QueuedSMS) []*QueuedSMS {
+	q.mu.Lock()
+	held := make(map[int64]bool, len(q.items)+len(q.inFlight))
+	for _, item := range q.items {
+		held[item.ID] = true
+	}
+	for id := range q.inFlight {
+		held[id] = true
+	}
+
+	var restored []*QueuedSMS
+	for _, item := range items {
+		if held[item.ID] {
+			continue
+		}
+		q.nextID = max(q.nextID, item.ID)
+		restored = append(restored, item)
+	}
+	q.items = append(q.items, restored...)
+	q.mu.Unlock()
+
+	q.wake()
+	return restored
+}
+
+// persist saves a waiting message in the outbox
+func (q *SendQueue) persist(item *QueuedSMS) {
+	if q.outbox == nil {
+		return
+	}
+	if err := q.outbox.SaveOutboxItem(item); err != nil {
+		log.Printf("Outbox: %v, SMS %d is only queued in memory", err, item.ID)
+	}
+}
+
+// unpersist removes a message from the outbox once it is no longer waiting
+func (q *SendQueue) unpersist(id int64) {
+	if q.outbox == nil {
+		return
+	}
+	if err := q.outbox.DeleteOutboxItem(id); err != nil {
+		log.Printf("Outbox: %v", err)
+	}
+}
+
+// Cancel removes a pending message from the queue. It returns false if the
+// message is not queued (already sent, in flight or unknown).
+func (q *SendQueue) Cancel(id int64) bool {
+	q.mu.Lock()
+	var cancelled *QueuedSMS
+	for i, item := range q.items {
+		if item.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			cancelled = item
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	if cancelled == nil {
+		return false
+	}
+	q.unpersist(id)
+	cancelled.result <- ErrSendCancelled
+	return true
+}
+
+// Pause stops the dispatcher from taking new messages off the queue
+func (q *SendQueue) Pause() {
+	q.mu.Lock()
+	q.paused = true
+	q.mu.Unlock()
+}
+
+// Resume lets the dispatcher continue sending queued messages
+func (q *SendQueue) Resume() {
+	q.mu.Lock()
+	q.paused = false
+	q.mu.Unlock()
+
+	q.wake()
+}
+
+// held returns whether the queue is held by the function passed to HoldWhile
+func (q *SendQueue) held() bool {
+	return q.hold != nil && q.hold()
+}
+
+// IsPaused returns whether the queue is paused
+func (q *SendQueue) IsPaused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused
+}
+
+// Pending returns the queued messages in send order with estimated send times.
+// ETAs are omitted while the queue is paused or held.
+func (q *SendQueue) Pending() []QueueEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+
+	// Time until the oldest in-flight message (if all dispatchers are busy)
+	// is expected to finish
+	var wait time.Duration
+	if len(q.inFlight) >= q.workers {
+		var oldest time.Time
+		for _, startedAt := range q.inFlight {
+			if oldest.IsZero() || startedAt.Before(oldest) {
+				oldest = startedAt
+			}
+		}
+		wait = q.avgSend - now.Sub(oldest)
+		if wait < 0 {
+			wait = 0
+		}
+	}
+
+	entries := make([]QueueEntry, 0, len(q.items))
+	for i, item := range q.items {
+		entry := QueueEntry{
+			QueuedSMS: *item,
+			Position:  i + 1,
+		}
+		if !q.paused && !q.held() {
+			eta := now.Add(wait + time.Duration(i/q.workers)*q.avgSend)
+			if item.RetryAt != nil && item.RetryAt.After(eta) {
+				eta = *item.RetryAt
+			}
+			entry.ETA = &eta
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Overflow returns whether at least limit messages wait in the queue and, if
+// so, about how long until one fewer than limit do
+func (q *SendQueue) Overflow(limit int) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	excess := len(q.items) - limit + 1
+	if excess <= 0 {
+		return false, 0
+	}
+	return true, time.Duration((excess+q.workers-1)/q.workers) * q.avgSend
+}
+
+// wake signals the dispatcher that the queue state changed
+func (q *SendQueue) wake() {
+	select {
+	case q.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// next blocks until a message can be sent, or returns nil when the queue is stopped.
+// Messages waiting for a retry are skipped until their retry time.
+func (q *SendQueue) next() *QueuedSMS {
+	for {
+		var retryWait <-chan time.Time
+
+		q.mu.Lock()
+		if !q.paused && !q.held() {
+			now := time.Now()
+			var earliest time.Time
+			for i, item := range q.items {
+				if item.RetryAt != nil && item.RetryAt.After(now) {
+					if earliest.IsZero() || item.RetryAt.Before(earliest) {
+						earliest = *item.RetryAt
+					}
+					continue
+				}
+
+				q.items = append(q.items[:i], q.items[i+1:]...)
+				q.inFlight[item.ID] = now
+				more := len(q.items) > 0
+				q.mu.Unlock()
+
+				// A crash from here on leaves the send to startup recovery
+				q.unpersist(item.ID)
+
+				// Wake signals coalesce, so pass one on to the next idle dispatcher
+				if more {
+					q.wake()
+				}
+				return item
+			}
+			if !earliest.IsZero() {
+				retryWait = time.After(earliest.Sub(now))
+			}
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.wakeChan:
+		case <-retryWait:
+		case <-q.stopChan:
+			return nil
+		}
+	}
+}
+
+// run is a dispatcher loop sending one message at a time
+func (q *SendQueue) run() {
+	for {
+		item := q.next()
+		if item == nil {
+			return
+		}
+
+		start := time.Now()
+		err := q.send(item.Number, item.Content, item.SendOptions)
+		elapsed := time.Since(start)
+
+		q.mu.Lock()
+		// Exponential moving average of send duration for ETA estimates
+		q.avgSend = (q.avgSend*3 + elapsed) / 4
+		q.mu.Unlock()
+
+		// Put transient failures back on the queue until their retries run out
+		if err != nil {
+			if delay, ok := q.retry.RetryDelay(err, item.Retries); ok {
+				retryAt := time.Now().Add(delay)
+				item.Retries++
+				item.RetryAt = &retryAt
+				item.LastError = err.Error()
+
+				// Saved outside the lock, as in Enqueue; the message stays in
+				// flight until it is back on the queue
+				q.persist(item)
+
+				q.mu.Lock()
+				delete(q.inFlight, item.ID)
+				q.items = append(q.items, item)
+				q.mu.Unlock()
+
+				log.Printf("SMS %d to %s failed (%s), retry %d in %v: %v", item.ID, item.Number, ClassifyError(err), item.Retries, delay, err)
+				continue
+			}
+		}
+
+		q.mu.Lock()
+		delete(q.inFlight, item.ID)
+		q.mu.Unlock()
+
+		if err != nil && item.Retries > 0 {
+			err = fmt.Errorf("%w (after %d retries)", err, item.Retries)
+		}
+		item.result <- err
+	}
+}
+
+// getQueue lists pending outbound messages
+func (app *App) getQueue(c *gin.Context) {
+	entries := app.queue.Pending()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"paused":   app.queue.IsPaused(),
+		"count":    len(entries),
+		"messages": entries,
+	})
+}
+
+// pauseQueue stops sending queued messages
+func (app *App) pauseQueue(c *gin.Context) {
+	app.queue.Pause()
+	log.Println("Send queue paused")
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: "Queue paused",
+	})
+}
+
+// resumeQueue continues sending queued messages
+func (app *App) resumeQueue(c *gin.Context) {
+	app.queue.Resume()
+	log.Println("Send queue resumed")
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: "Queue resumed",
+	})
+}
+
+// cancelQueuedSMS removes a message from the queue before it is sent
+func (app *App) cancelQueuedSMS(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid queue ID"))
+		return
+	}
+
+	if !app.queue.Cancel(id) {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "No queued SMS with ID %d", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("Queued SMS %d cancelled", id),
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitPruneInterval is how often idle buckets are dropped
+const rateLimitPruneInterval = 10 * time.Minute
+
+// RateLimiter is a token bucket rate limiter keyed by client (API key or IP)
+type RateLimiter struct {
+	Rate  float64 // sustained rate in requests per second
+	Burst int     // bucket size
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// tokenBucket holds the tokens of one client
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// LoadRateLimiter reads a rate limit such as "10/m" or "10/m:30" (sustained
+// rate per s, m or h, optionally followed by the burst size) from an
+// environment variable. It returns nil if the variable is not set.
+func LoadRateLimiter(name string) (*RateLimiter, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil, nil
+	}
+
+	spec, burstStr, hasBurst := strings.Cut(value, ":")
+	countStr, unit, found := strings.Cut(spec, "/")
+	if !found {
+		return nil, fmt.Errorf("%s: invalid rate limit %q (expected e.g. 10/m:30)", name, value)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("%s: invalid request count in %q", name, value)
+	}
+
+	var per time.Duration
+	switch strings.TrimSpace(unit) {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return nil, fmt.Errorf("%s: invalid unit in %q (use s, m or h)", name, value)
+	}
+
+	burst := count
+	if hasBurst {
+		if burst, err = strconv.Atoi(strings.TrimSpace(burstStr)); err != nil || burst < 1 {
+			return nil, fmt.Errorf("%s: invalid burst in %q", name, value)
+		}
+	}
+
+	return NewRateLimiter(float64(count)/per.Seconds(), burst), nil
+}
+
+// NewRateLimiter creates a limiter allowing rate requests per second with bursts of burst requests
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:      rate,
+		Burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// String returns the limit in a human readable form
+func (l *RateLimiter) String() string {
+	return fmt.Sprintf("%.4g/min, burst %d", l.Rate*60, l.Burst)
+}
+
+// Allow takes a token from the client's bucket. It returns whether the request
+// is allowed, the tokens remaining and how long until the next token is available.
+func (l *RateLimiter) Allow(client string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.Burst), updated: now}
+		l.buckets[client] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(l.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*l.Rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, 0, l.wait(1 - bucket.tokens)
+	}
+
+	bucket.tokens--
+	return true, int(bucket.tokens), 0
+}
+
+// untilFull returns how long until the client's bucket is full again
+func (l *RateLimiter) untilFull(client string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		return 0
+	}
+	return l.wait(float64(l.Burst) - bucket.tokens)
+}
+
+// wait returns how long it takes to refill the given number of tokens
+func (l *RateLimiter) wait(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// prune drops buckets that have refilled completely, since they are
+// equivalent to new buckets. Must be called with mu held.
+func (l *RateLimiter) prune(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastPrune = now
+}
+
+// rateLimitClient identifies the caller by API key, or by IP address when the
+// request is not authenticated
+func rateLimitClient(c *gin.Context) string {
+	if keyID := keyIDFromContext(c); keyID != "anonymous" {
+		return "key:" + keyID
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// rateLimit returns middleware that enforces limiter and sets the X-RateLimit
+// headers. A nil limiter allows every request.
+func (app *App) rateLimit(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter == nil {
+			c.Next()
+			return
+		}
+
+		client := rateLimitClient(c)
+		allowed, remaining, retryAfter := limiter.Allow(client)
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limiter.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(limiter.untilFull(client).Seconds()))))
+
+		if !allowed {
+			rejectThrottled(c, app.rateLimited(retryAfter))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// rateLimited creates the error for a request over the rate limit
+func (app *App) rateLimited(retryAfter time.Duration) *ThrottleError {
+	seconds := max(1, int(math.Ceil(retryAfter.Seconds())))
+	return app.throttled(ThrottleRate, retryAfter, CodeRateLimited, "Rate limit exceeded, retry in %d seconds", seconds)
+}
+
+// allowSend takes a token from the send rate limit for a send that is not
+// made through a route of the send group, like a JSON-RPC or WebSocket send,
+// so that every entry point of a client shares one budget
+func (app *App) allowSend(c *gin.Context) error {
+	if app.sendLimit == nil {
+		return nil
+	}
+	if allowed, _, retryAfter := app.sendLimit.Allow(rateLimitClient(c)); !allowed {
+		return app.rateLimited(retryAfter)
+	}
+	return nil
+}
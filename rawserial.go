@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rawSerialPruneInterval is how often raw payloads past their retention are deleted
+const rawSerialPruneInterval = time.Hour
+
+// RawSerialSettings controls storage of the raw serial lines behind messages
+type RawSerialSettings struct {
+	Retention time.Duration
+}
+
+// SerialExchange holds the raw serial lines of one send: the command written
+// to the Arduino and the send result it answered with
+type SerialExchange struct {
+	Command string
+	Result  string
+}
+
+// SerialPayload is the stored raw serial traffic of a message
+type SerialPayload struct {
+	ReceivedSMSID *int64    `json:"received_sms_id,omitempty"`
+	SentSMSID     *int64    `json:"sent_sms_id,omitempty"`
+	Command       string    `json:"command,omitempty"`  // line written to the Arduino
+	Response      string    `json:"response,omitempty"` // line read from the Arduino
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// LoadRawSerialSettings reads raw payload settings from environment variables.
+// It returns nil unless STORE_RAW_SERIAL is true.
+func LoadRawSerialSettings() (*RawSerialSettings, error) {
+	value := os.Getenv("STORE_RAW_SERIAL")
+	if value == "" {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("STORE_RAW_SERIAL: invalid value %q (use true or false)", value)
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	settings := &RawSerialSettings{Retention: 7 * 24 * time.Hour}
+	if value := os.Getenv("RAW_SERIAL_RETENTION"); value != "" {
+		retention, err := parseInterval(value)
+		if err != nil {
+			return nil, fmt.Errorf("RAW_SERIAL_RETENTION: %w", err)
+		}
+		if retention < time.Hour {
+			return nil, fmt.Errorf("RAW_SERIAL_RETENTION must be at least 1h")
+		}
+		settings.Retention = retention
+	}
+
+	return settings, nil
+}
+
+// SaveSerialPayload stores the raw serial lines of a received (receivedID) or sent (sentID) message
+func (d *Database) SaveSerialPayload(receivedID, sentID int64, command, response string) error {
+	var received, sent any
+	if receivedID != 0 {
+		received = receivedID
+	}
+	if sentID != 0 {
+		sent = sentID
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO serial_payloads (received_sms_id, sent_sms_id, command, response)
+		VALUES (?, ?, ?, ?)
+	`, received, sent, command, response)
+	if err != nil {
+		return fmt.Errorf("failed to save serial payload: %w", err)
+	}
+
+	return nil
+}
+
+// GetSerialPayload retrieves the raw serial lines of a message, returning nil
+// if none are stored. column is received_sms_id or sent_sms_id.
+func (d *Database) GetSerialPayload(column string, id int64) (*SerialPayload, error) {
+	var p SerialPayload
+	var createdAtStr string
+
+	err := d.db.QueryRow(`
+		SELECT received_sms_id, sent_sms_id, command, response, created_at
+		FROM serial_payloads
+		WHERE `+column+` = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, id).Scan(&p.ReceivedSMSID, &p.SentSMSID, &p.Command, &p.Response, &createdAtStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query serial payload: %w", err)
+	}
+
+	p.CreatedAt = parseTimestamp(createdAtStr)
+
+	return &p, nil
+}
+
+// PruneSerialPayloads deletes raw payloads stored before a time, returning how many
+func (d *Database) PruneSerialPayloads(before time.Time) (int64, error) {
+	res, err := d.db.Exec(`DELETE FROM serial_payloads WHERE created_at < ?`, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune serial payloads: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// saveSentSerialPayload stores the raw serial lines of a send, if any were captured
+func (app *App) saveSentSerialPayload(sentID int64, exchange *SerialExchange) {
+	if exchange == nil || exchange.Command == "" || sentID == 0 {
+		return
+	}
+	if err := app.db.SaveSerialPayload(0, sentID, exchange.Command, exchange.Result); err != nil {
+		log.Printf("Failed to save serial payload: %v", err)
+	}
+}
+
+// runRawSerialPruneJob deletes raw payloads past their retention
+func (app *App) runRawSerialPruneJob() {
+	ticker := clock.NewTicker(rawSerialPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := app.db.PruneSerialPayloads(clock.Now().Add(-app.rawSerial.Retention))
+		if err != nil {
+			log.Printf("Raw serial payloads: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d raw serial payloads older than %s", n, app.rawSerial.Retention)
+		}
+
+		<-ticker.C()
+	}
+}
+
+// getSerialPayload returns the raw serial lines of a received or sent message
+func (app *App) getSerialPayload(c *gin.Context, column string) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	payload, err := app.db.GetSerialPayload(column, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get serial payload: %v", err))
+		return
+	}
+	if payload == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "No serial payload stored for message %d", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"payload": payload,
+	})
+}
+
+// getReceivedSerialPayload returns the raw serial line a received SMS was parsed from
+func (app *App) getReceivedSerialPayload(c *gin.Context) {
+	app.getSerialPayload(c, "received_sms_id")
+}
+
+// getSentSerialPayload returns the raw command and send result of a sent SMS
+func (app *App) getSentSerialPayload(c *gin.Context) {
+	app.getSerialPayload(c, "sent_sms_id")
+}
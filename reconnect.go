@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// reconnectInterval is how often reopening the serial port is attempted
+const reconnectInterval = 2 * time.Second
+
+// handleDisconnect closes the port after a read error and starts reconnecting.
+// It does nothing if the port was already released, e.g. for flashing.
+func (a *ArduinoConnection) handleDisconnect(err error) {
+	a.mu.Lock()
+	if !a.connected {
+		a.mu.Unlock()
+		return
+	}
+	a.connected = false
+	a.port.Close()
+	a.mu.Unlock()
+	a.updateGSMState("disconnected")
+
+	a.events.Publish(EventDeviceDisconnected, DeviceConnectionEvent{Port: a.portName, Error: err.Error()})
+	a.recordDeviceEvent(DeviceEventDisconnected, err.Error())
+
+	go a.supervise("reconnectLoop", false, a.reconnectLoop)
+}
+
+// reconnectLoop reopens the serial port until it succeeds or the connection is
+// closed. When a power switch is configured and reconnecting fails for longer
+// than its threshold, the Arduino's power is cycled, at most once per threshold.
+func (a *ArduinoConnection) reconnectLoop() {
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+
+	since := time.Now()
+	lastCycle := since
+	for {
+		select {
+		case <-a.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		err := a.reopen()
+		if err == nil {
+			a.recordDeviceEvent(DeviceEventReconnected, fmt.Sprintf("after %s", time.Since(since).Round(time.Second)))
+			return
+		}
+
+		ps := a.gsm.PowerSwitch
+		if ps != nil && time.Since(lastCycle) >= ps.After {
+			a.PowerCycle(fmt.Sprintf("no connection for %s: %v", time.Since(since).Round(time.Second), err))
+			lastCycle = time.Now()
+		}
+	}
+}
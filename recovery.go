@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recoveryConnectTimeout is how long interrupted sends wait for the device
+// before they are given up
+const recoveryConnectTimeout = 2 * time.Minute
+
+// interruptedSendError is stored on sends whose outcome was lost in a crash
+const interruptedSendError = "Interrupted by a restart before the modem reported the outcome"
+
+// interruptedQueuedError is stored on sends a crash kept from being sent
+const interruptedQueuedError = "Interrupted by a restart before it was sent"
+
+// RecoverySettings configures how sends interrupted by a crash are reconciled
+type RecoverySettings struct {
+	Retry       bool          // resend interrupted sends
+	RetryMaxAge time.Duration // only resend sends younger than this
+}
+
+// RecoveryReport is the outcome of the startup checks
+type RecoveryReport struct {
+	StartedAt         time.Time         `json:"started_at"`
+	Integrity         string            `json:"integrity"`                    // ok, failed or error
+	IntegrityProblems []string          `json:"integrity_problems,omitempty"` // reported by SQLite, or why the check failed
+	IntegrityMillis   int64             `json:"integrity_check_ms"`
+	ReconciledAt      *time.Time        `json:"reconciled_at,omitempty"` // once this instance drives the device
+	Interrupted       []InterruptedSend `json:"interrupted"`
+
+	mu sync.Mutex
+}
+
+// InterruptedSend is a send left queued or sending by a previous run
+type InterruptedSend struct {
+	ID        int       `json:"id"`
+	Number    string    `json:"number"`
+	CreatedAt time.Time `json:"created_at"`
+	Action    string    `json:"action"`              // marked_unknown, marked_failed, resent or resend_failed
+	ResentID  int64     `json:"resent_id,omitempty"` // sent SMS of the resend
+	Error     string    `json:"error,omitempty"`     // why the resend failed
+}
+
+// LoadRecoverySettings reads RECOVERY_RETRY and RECOVERY_RETRY_MAX_AGE
+// (default 1h) from environment variables
+func LoadRecoverySettings() (*RecoverySettings, error) {
+	settings := &RecoverySettings{
+		Retry:       os.Getenv("RECOVERY_RETRY") == "true",
+		RetryMaxAge: time.Hour,
+	}
+
+	if value := os.Getenv("RECOVERY_RETRY_MAX_AGE"); value != "" {
+		age, err := parseInterval(value)
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("RECOVERY_RETRY_MAX_AGE: invalid age %q", value)
+		}
+		settings.RetryMaxAge = age
+	}
+
+	return settings, nil
+}
+
+// IntegrityCheck runs SQLite's integrity check and returns the problems it
+// found, or none if the database is intact. PostgreSQL checks its own pages
+// and has no equivalent, so nothing is reported there.
+func (d *Database) IntegrityCheck() ([]string, error) {
+	if d.postgres() {
+		return nil, nil
+	}
+
+	rows, err := d.db.Query(`PRAGMA integrity_check(20)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", err)
+	}
+
+	return problems, nil
+}
+
+// CheckIntegrity runs the integrity check for the startup report
+func CheckIntegrity(db *Database) *RecoveryReport {
+	report := &RecoveryReport{StartedAt: time.Now(), Interrupted: []InterruptedSend{}}
+
+	problems, err := db.IntegrityCheck()
+	report.IntegrityMillis = time.Since(report.StartedAt).Milliseconds()
+	switch {
+	case err != nil:
+		report.Integrity = "error"
+		report.IntegrityProblems = []string{err.Error()}
+		log.Printf("Database integrity check failed: %v", err)
+	case len(problems) > 0:
+		report.Integrity = "failed"
+		report.IntegrityProblems = problems
+		log.Printf("Database integrity check found %d problems, consider restoring a backup:", len(problems))
+		for _, problem := range problems {
+			log.Printf("  %s", problem)
+		}
+	default:
+		report.Integrity = "ok"
+		log.Printf("Database integrity check passed in %d ms", report.IntegrityMillis)
+	}
+
+	return report
+}
+
+// InterruptedSends returns the sends still queued or sending that were
+// recorded before a time
+func (d *Database) InterruptedSends(before time.Time) ([]SentSMS, error) {
+	rows, err := d.db.Query(`
+		SELECT id, number, content, status, created_at, COALESCE(template, ''), COALESCE(template_version, 0), COALESCE(campaign, '')
+		FROM sent_sms
+		WHERE status IN ('queued', 'sending') AND created_at < ?
+			AND id NOT IN (`+outboxSentIDs+`)
+		ORDER BY id
+	`, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sent SMS: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []SentSMS
+	for rows.Next() {
+		var msg SentSMS
+		var createdAtStr string
+		if err := rows.Scan(&msg.ID, &msg.Number, &msg.Content, &msg.Status, &createdAtStr, &msg.Template, &msg.TemplateVersion, &msg.Campaign); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		msg.CreatedAt = parseTimestamp(createdAtStr)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return messages, nil
+}
+
+// reconcileInterruptedSends marks the sends a previous run left sending as
+// unknown and those it left queued as failed and, if enabled, sends the
+// recent ones again. It
+// runs once this instance drives the device, so another instance's sends
+// are never touched.
+func (app *App) reconcileInterruptedSends() {
+	now := time.Now()
+	messages, err := app.db.InterruptedSends(now)
+	if err != nil {
+		log.Printf("Recovery: %v", err)
+		return
+	}
+
+	report := app.recovery
+	report.mu.Lock()
+	report.ReconciledAt = &now
+	report.mu.Unlock()
+
+	if len(messages) == 0 {
+		log.Printf("Recovery: no interrupted sends")
+		return
+	}
+
+	type resend struct {
+		index int // in report.Interrupted
+		msg   SentSMS
+	}
+	var resends []resend
+	for _, msg := range messages {
+		status, errorMsg, action := "unknown", interruptedSendError, "marked_unknown"
+		if msg.Status == "queued" {
+			status, errorMsg, action = "error", interruptedQueuedError, "marked_failed"
+		}
+		if err := app.db.FinishSentSMS(int64(msg.ID), status, errorMsg, ""); err != nil {
+			log.Printf("Recovery: %v", err)
+			continue
+		}
+
+		report.mu.Lock()
+		report.Interrupted = append(report.Interrupted, InterruptedSend{
+			ID:        msg.ID,
+			Number:    msg.Number,
+			CreatedAt: msg.CreatedAt,
+			Action:    action,
+		})
+		if app.recoverySettings.Retry && now.Sub(msg.CreatedAt) <= app.recoverySettings.RetryMaxAge {
+			resends = append(resends, resend{index: len(report.Interrupted) - 1, msg: msg})
+		}
+		report.mu.Unlock()
+	}
+	log.Printf("Recovery: marked %d sends interrupted by a restart as unknown or failed, resending %d", len(messages), len(resends))
+
+	if len(resends) == 0 {
+		return
+	}
+
+	// The modem may still be starting up
+	deadline := time.Now().Add(recoveryConnectTimeout)
+	for !app.smsConn.IsConnected() && (app.routing == nil || !app.routing.IsConnected()) && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+
+	for _, r := range resends {
+		opts := SendOptions{Template: r.msg.Template, TemplateVersion: r.msg.TemplateVersion, Campaign: r.msg.Campaign}
+		id, err := app.deliverSMSNow(context.Background(), "", r.msg.Number, r.msg.Content, opts)
+
+		report.mu.Lock()
+		interrupted := &report.Interrupted[r.index]
+		interrupted.ResentID = id
+		if err != nil {
+			interrupted.Action = "resend_failed"
+			interrupted.Error = err.Error()
+			log.Printf("Recovery: failed to resend SMS %d to %s: %v", r.msg.ID, r.msg.Number, err)
+		} else {
+			interrupted.Action = "resent"
+			log.Printf("Recovery: resent SMS %d to %s as SMS %d", r.msg.ID, r.msg.Number, id)
+		}
+		report.mu.Unlock()
+	}
+}
+
+// getRecovery returns the report of the startup checks
+func (app *App) getRecovery(c *gin.Context) {
+	report := app.recovery
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"recovery": report,
+	})
+}
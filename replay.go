@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxReplayMessages caps the messages re-sent by one replay
+const maxReplayMessages = 10000
+
+// ReplayRequest selects the received SMS to re-send to a webhook, either by
+// a saved search or by time and numbers. From is required without a search;
+// To defaults to now and an empty Numbers matches every number.
+type ReplayRequest struct {
+	Search  string     `json:"search"`
+	From    *time.Time `json:"from"`
+	To      *time.Time `json:"to"`
+	Numbers []string   `json:"numbers"`
+}
+
+// errReplayTruncated stops collecting messages once the replay limit is reached
+var errReplayTruncated = errors.New("replay truncated")
+
+// GetReceivedSMSForReplay retrieves the received SMS matching a search, oldest
+// first. It returns at most limit messages and whether more matched.
+func (d *Database) GetReceivedSMSForReplay(s *SavedSearch, limit int) ([]ReceivedSMS, bool, error) {
+	messages := []ReceivedSMS{}
+	err := d.EachReceivedMatch(s, time.Now(), true, func(msg ReceivedSMS) error {
+		if len(messages) == limit {
+			return errReplayTruncated
+		}
+		messages = append(messages, msg)
+		return nil
+	})
+	if errors.Is(err, errReplayTruncated) {
+		return messages, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return messages, false, nil
+}
+
+// Replay re-sends received SMS to one webhook as message.received events, in
+// order and one at a time so the consumer isn't flooded. Default format
+// payloads are marked "replayed": true.
+func (w *WebhookDispatcher) Replay(hook Webhook, messages []ReceivedSMS) {
+	failed := 0
+	for _, msg := range messages {
+		data := receivedEvent(msg)
+		data["replayed"] = true
+		if err := w.post(hook, webhookPayload(hook, EventMessageReceived, msg, data)); err != nil {
+			failed++
+		}
+	}
+
+	log.Printf("Webhook %d: replayed %d messages, %d failed", hook.ID, len(messages), failed)
+}
+
+// replayWebhook re-sends historical received SMS matching a filter to a
+// webhook, e.g. to bootstrap a new consumer or recover one after an outage.
+// Messages are sent in the background; the response reports how many.
+func (app *App) replayWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid webhook ID"))
+		return
+	}
+
+	var req ReplayRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	var search *SavedSearch
+	if req.Search != "" {
+		if req.From != nil || req.To != nil || len(req.Numbers) > 0 {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Specify either search or from, to and numbers"))
+			return
+		}
+		search, err = app.db.GetSearch(req.Search)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get search: %v", err))
+			return
+		}
+		if search == nil {
+			c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Search %s not found", req.Search))
+			return
+		}
+		if search.Type != SearchReceived {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Search %s does not select received messages", req.Search))
+			return
+		}
+	} else {
+		if req.From == nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Missing required field: from"))
+			return
+		}
+		to := time.Now()
+		if req.To != nil {
+			to = *req.To
+		}
+		if !req.From.Before(to) {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "from must be before to"))
+			return
+		}
+		search = &SavedSearch{Type: SearchReceived, Numbers: req.Numbers, From: req.From, To: &to}
+	}
+
+	hook, err := app.db.GetWebhook(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get webhook: %v", err))
+		return
+	}
+	if hook == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Webhook %d not found", id))
+		return
+	}
+
+	messages, truncated, err := app.db.GetReceivedSMSForReplay(search, maxReplayMessages)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	// Messages outside the scope of the webhook's API key are left out
+	scope := app.tenants.Scope(hook.KeyID)
+	messages = slices.DeleteFunc(messages, func(msg ReceivedSMS) bool {
+		return !scope.Allows(Event{Type: EventMessageReceived, Data: msg})
+	})
+
+	if req.Search != "" {
+		log.Printf("Webhook %d: replaying %d messages of search %s", hook.ID, len(messages), req.Search)
+	} else {
+		log.Printf("Webhook %d: replaying %d messages from %s to %s", hook.ID, len(messages),
+			req.From.Format(time.RFC3339), search.To.Format(time.RFC3339))
+	}
+	go app.webhooks.Replay(*hook, messages)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":    "success",
+		"count":     len(messages),
+		"truncated": truncated,
+	})
+}
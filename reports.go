@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// monthFormat is the layout used to identify report months
+const monthFormat = "2006-01"
+
+// UsageReportRow represents usage for one key or number prefix in a report
+type UsageReportRow struct {
+	Group         string  `json:"group"`
+	Messages      int     `json:"messages"`
+	Failed        int     `json:"failed"`
+	Segments      int     `json:"segments"`
+	EstimatedCost float64 `json:"estimated_cost"`
+}
+
+// UsageReport represents a monthly usage summary
+type UsageReport struct {
+	Month          string           `json:"month"`
+	GeneratedAt    time.Time        `json:"generated_at"`
+	CostPerSegment float64          `json:"cost_per_segment"`
+	Keys           []UsageReportRow `json:"keys"`
+	Prefixes       []UsageReportRow `json:"prefixes"`
+	Encodings      []UsageReportRow `json:"encodings"` // Sent messages by GSM-7 or UCS-2 encoding
+}
+
+// ReportSettings holds configuration for usage reports
+type ReportSettings struct {
+	CostPerSegment float64
+	PrefixLength   int
+}
+
+// GetReportSettings returns report settings from environment variables
+func GetReportSettings() ReportSettings {
+	settings := ReportSettings{
+		CostPerSegment: 0,
+		PrefixLength:   4,
+	}
+
+	if cost, err := strconv.ParseFloat(os.Getenv("SMS_SEGMENT_COST"), 64); err == nil && cost >= 0 {
+		settings.CostPerSegment = cost
+	}
+
+	if length, err := strconv.Atoi(os.Getenv("REPORT_PREFIX_LENGTH")); err == nil && length > 0 {
+		settings.PrefixLength = length
+	}
+
+	return settings
+}
+
+// GenerateUsageReport builds the usage report for a month (YYYY-MM)
+func (d *Database) GenerateUsageReport(month string, settings ReportSettings) (*UsageReport, error) {
+	start, err := time.Parse(monthFormat, month)
+	if err != nil {
+		return nil, fmt.Errorf("invalid month %q: %w", month, err)
+	}
+	end := start.AddDate(0, 1, 0)
+
+	report := &UsageReport{
+		Month:          month,
+		GeneratedAt:    time.Now().UTC(),
+		CostPerSegment: settings.CostPerSegment,
+		Keys:           []UsageReportRow{},
+		Prefixes:       []UsageReportRow{},
+		Encodings:      []UsageReportRow{},
+	}
+
+	// Per key usage from the daily counters
+	rows, err := d.db.Query(`
+		SELECT key_id, SUM(sent), SUM(failed), SUM(segments)
+		FROM key_usage
+		WHERE day >= ? AND day < ?
+		GROUP BY key_id
+		ORDER BY key_id
+	`, start.Format(dayFormat), end.Format(dayFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key usage: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row UsageReportRow
+		if err := rows.Scan(&row.Group, &row.Messages, &row.Failed, &row.Segments); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		row.EstimatedCost = float64(row.Segments) * settings.CostPerSegment
+		report.Keys = append(report.Keys, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	// Per number prefix and per encoding usage from the sent messages
+	prefixes, encodings, err := d.sentUsage(start, end, settings)
+	if err != nil {
+		return nil, err
+	}
+	report.Prefixes = prefixes
+	report.Encodings = encodings
+
+	return report, nil
+}
+
+// sentUsage aggregates sent messages in [start, end) by destination number
+// prefix and by encoding, using the segment counts stored with them
+func (d *Database) sentUsage(start, end time.Time, settings ReportSettings) ([]UsageReportRow, []UsageReportRow, error) {
+	rows, err := d.db.Query(`
+		SELECT number, COALESCE(encoding, ''), COALESCE(segments, 0), status
+		FROM sent_sms
+		WHERE created_at >= ? AND created_at < ?
+	`, start.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query sent SMS: %w", err)
+	}
+	defer rows.Close()
+
+	byPrefix := make(map[string]*UsageReportRow)
+	byEncoding := make(map[string]*UsageReportRow)
+
+	for rows.Next() {
+		var number, encoding, status string
+		var segments int
+		if err := rows.Scan(&number, &encoding, &segments, &status); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		prefix := number
+		if len(prefix) > settings.PrefixLength {
+			prefix = prefix[:settings.PrefixLength]
+		}
+
+		for _, row := range []*UsageReportRow{usageRow(byPrefix, prefix), usageRow(byEncoding, encoding)} {
+			switch status {
+			case "success":
+				row.Messages++
+				row.Segments += segments
+			case "error":
+				row.Failed++
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return usageRows(byPrefix, settings), usageRows(byEncoding, settings), nil
+}
+
+// usageRow returns the row of a group, adding it if it is new
+func usageRow(rows map[string]*UsageReportRow, group string) *UsageReportRow {
+	row, ok := rows[group]
+	if !ok {
+		row = &UsageReportRow{Group: group}
+		rows[group] = row
+	}
+	return row
+}
+
+// usageRows returns the rows sorted by group, with their estimated cost
+func usageRows(rows map[string]*UsageReportRow, settings ReportSettings) []UsageReportRow {
+	result := make([]UsageReportRow, 0, len(rows))
+	for _, row := range rows {
+		row.EstimatedCost = float64(row.Segments) * settings.CostPerSegment
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Group < result[j].Group
+	})
+	return result
+}
+
+// SaveUsageReport stores a generated report, replacing any previous one for the month
+func (d *Database) SaveUsageReport(report *UsageReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	_, err = d.db.Exec(`
+		INSERT INTO usage_reports (month, data) VALUES (?, ?)
+		ON CONFLICT(month) DO UPDATE SET data = excluded.data, generated_at = `+d.dialect().now()+`
+	`, report.Month, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to save report: %w", err)
+	}
+
+	return nil
+}
+
+// GetUsageReport retrieves a stored report, returning nil if none exists for the month
+func (d *Database) GetUsageReport(month string) (*UsageReport, error) {
+	var data string
+	err := d.db.QueryRow(`SELECT data FROM usage_reports WHERE month = ?`, month).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query report: %w", err)
+	}
+
+	var report UsageReport
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return nil, fmt.Errorf("failed to decode report: %w", err)
+	}
+
+	return &report, nil
+}
+
+// ListUsageReports returns the months that have a stored report, newest first
+func (d *Database) ListUsageReports() ([]string, error) {
+	rows, err := d.db.Query(`SELECT month FROM usage_reports ORDER BY month DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reports: %w", err)
+	}
+	defer rows.Close()
+
+	months := []string{}
+	for rows.Next() {
+		var month string
+		if err := rows.Scan(&month); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		months = append(months, month)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return months, nil
+}
+
+// runReportJob generates the report for the previous month once it has ended
+func (app *App) runReportJob() {
+	ticker := clock.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		month := clock.Now().UTC().AddDate(0, -1, 0).Format(monthFormat)
+
+		existing, err := app.db.GetUsageReport(month)
+		if err != nil {
+			log.Printf("Report job: %v", err)
+		} else if existing == nil {
+			report, err := app.db.GenerateUsageReport(month, app.reportSettings)
+			if err == nil {
+				err = app.db.SaveUsageReport(report)
+			}
+			if err != nil {
+				log.Printf("Report job: failed to generate report for %s: %v", month, err)
+			} else {
+				log.Printf("Generated usage report for %s", month)
+			}
+		}
+
+		<-ticker.C()
+	}
+}
+
+// listReports returns the months with stored usage reports
+func (app *App) listReports(c *gin.Context) {
+	months, err := app.db.ListUsageReports()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list reports: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"months": months,
+	})
+}
+
+// getReport returns the usage report for a month as JSON or CSV (format=csv).
+// Months without a stored report (e.g. the current one) are generated on the fly.
+func (app *App) getReport(c *gin.Context) {
+	month := c.Param("month")
+	if _, err := time.Parse(monthFormat, month); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid month, expected YYYY-MM"))
+		return
+	}
+
+	report, err := app.db.GetUsageReport(month)
+	if err == nil && report == nil {
+		report, err = app.db.GenerateUsageReport(month, app.reportSettings)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get report: %v", err))
+		return
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
+			"report": report,
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s.csv", month))
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"month", "type", "group", "messages", "failed", "segments", "estimated_cost"})
+
+	writeRows := func(kind string, rows []UsageReportRow) {
+		for _, row := range rows {
+			w.Write([]string{
+				report.Month,
+				kind,
+				row.Group,
+				strconv.Itoa(row.Messages),
+				strconv.Itoa(row.Failed),
+				strconv.Itoa(row.Segments),
+				strconv.FormatFloat(row.EstimatedCost, 'f', 4, 64),
+			})
+		}
+	}
+	writeRows("key", report.Keys)
+	writeRows("prefix", report.Prefixes)
+	writeRows("encoding", report.Encodings)
+
+	w.Flush()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryBackoff caps the exponential backoff between retries
+const maxRetryBackoff = 10 * time.Minute
+
+// RetryDisconnected is the retry policy key of sends that found the device
+// disconnected. Nothing reached the modem, so unlike other device errors
+// they can't be sent twice by a retry.
+const RetryDisconnected ErrorClass = "disconnected"
+
+// RetryPolicy controls how often a failed send is retried
+type RetryPolicy struct {
+	Retries int           `json:"retries"` // retries after the first attempt, 0 fails immediately
+	Backoff time.Duration `json:"backoff"` // delay before the first retry, doubled for each further retry
+}
+
+// RetryPolicies holds the retry policy of each error class. Classes without
+// a policy are not retried.
+type RetryPolicies map[ErrorClass]RetryPolicy
+
+// DefaultRetryPolicies retries transient network errors and sends while the
+// device is briefly disconnected, and fails immediately on everything else
+func DefaultRetryPolicies() RetryPolicies {
+	return RetryPolicies{
+		ErrorClassNetworkTimeout: {Retries: 3, Backoff: 30 * time.Second},
+		ErrorClassNoNetwork:      {Retries: 3, Backoff: time.Minute},
+		RetryDisconnected:        {Retries: 8, Backoff: 5 * time.Second},
+	}
+}
+
+// LoadRetryPolicies returns the default retry policies, overridden by the
+// RETRY_POLICY environment variable, e.g. "network_timeout=5:30s,unknown=1:1m"
+func LoadRetryPolicies() (RetryPolicies, error) {
+	policies := DefaultRetryPolicies()
+
+	for _, entry := range splitList(os.Getenv("RETRY_POLICY")) {
+		class, spec, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid retry policy %q (expected class=retries:backoff)", entry)
+		}
+
+		retriesStr, backoffStr, _ := strings.Cut(spec, ":")
+		retries, err := strconv.Atoi(strings.TrimSpace(retriesStr))
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid retry count in %q", entry)
+		}
+
+		policy := RetryPolicy{Retries: retries, Backoff: 30 * time.Second}
+		if backoffStr != "" {
+			policy.Backoff, err = time.ParseDuration(strings.TrimSpace(backoffStr))
+			if err != nil || policy.Backoff <= 0 {
+				return nil, fmt.Errorf("invalid backoff in %q", entry)
+			}
+		}
+
+		policies[ErrorClass(strings.TrimSpace(class))] = policy
+	}
+
+	return policies, nil
+}
+
+// RetryDelay returns how long to wait before retrying a send that failed with
+// err after the given number of retries, or false if it should not be retried
+func (p RetryPolicies) RetryDelay(err error, retries int) (time.Duration, bool) {
+	class := ClassifyError(err)
+	if errors.Is(err, ErrNotConnected) {
+		class = RetryDisconnected
+	}
+
+	policy, ok := p[class]
+	if !ok || retries >= policy.Retries {
+		return 0, false
+	}
+
+	delay := policy.Backoff
+	for i := 0; i < retries && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+
+	return delay, true
+}
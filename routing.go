@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routingPrimary is the name of the device configured with DEVICE_MODE
+const routingPrimary = "primary"
+
+// RouteDevice is a device that outbound SMS can be routed through
+type RouteDevice struct {
+	Name  string
+	Port  string
+	Conn  SMSConnection
+	Rates map[string]float64 // cost per segment by destination prefix, e.g. "+386"
+}
+
+// Rate returns the device's rate for the longest prefix of number in its rate
+// table, or false if none matches
+func (d *RouteDevice) Rate(number string) (float64, bool) {
+	best := -1
+	var rate float64
+	for prefix, r := range d.Rates {
+		if strings.HasPrefix(number, prefix) && len(prefix) > best {
+			best = len(prefix)
+			rate = r
+		}
+	}
+	return rate, best >= 0
+}
+
+// Router sends SMS through the device with the cheapest rate for the
+// destination, falling back to the next cheapest when a send fails. Sends
+// for a number group rotate across the group's devices instead.
+type Router struct {
+	Devices      []*RouteDevice // primary first, then in configured order
+	Groups       []*NumberGroup
+	DefaultGroup string // group of sends that don't name one, empty for least-cost routing
+
+	db *Database
+}
+
+// RouteCandidate is a device in the routing order for a number
+type RouteCandidate struct {
+	Device    string   `json:"device"`
+	Rate      *float64 `json:"rate,omitempty"` // nil if the device has no rate for the number
+	Connected bool     `json:"connected"`
+}
+
+// LoadRouting reads additional devices and the rate table from environment
+// variables. ROUTING_DEVICES names extra Arduinos, e.g.
+// "a1=/dev/ttyUSB1;a2=/dev/ttyUSB2", and ROUTING_RATES the cost per segment of
+// each device by destination prefix, e.g. "primary=+386:0.02,+:0.10;a1=+49:0.03".
+// ROUTING_GROUPS defines number groups, see parseNumberGroups. It returns nil
+// if neither ROUTING_RATES nor ROUTING_GROUPS is set. The devices are opened
+// by OpenDevices.
+func LoadRouting() (*Router, error) {
+	ratesValue := os.Getenv("ROUTING_RATES")
+	if ratesValue == "" && os.Getenv("ROUTING_GROUPS") == "" {
+		return nil, nil
+	}
+
+	router := &Router{Devices: []*RouteDevice{{Name: routingPrimary}}}
+
+	for _, entry := range strings.Split(os.Getenv("ROUTING_DEVICES"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, port, found := strings.Cut(entry, "=")
+		name, port = strings.TrimSpace(name), strings.TrimSpace(port)
+		if !found || name == "" || port == "" {
+			return nil, fmt.Errorf("ROUTING_DEVICES: invalid device %q (expected name=port)", entry)
+		}
+		if router.Device(name) != nil {
+			return nil, fmt.Errorf("ROUTING_DEVICES: duplicate device %q", name)
+		}
+
+		router.Devices = append(router.Devices, &RouteDevice{Name: name, Port: port})
+	}
+
+	for _, entry := range strings.Split(ratesValue, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, table, found := strings.Cut(entry, "=")
+		device := router.Device(strings.TrimSpace(name))
+		if !found {
+			return nil, fmt.Errorf("ROUTING_RATES: invalid entry %q (expected device=prefix:rate,prefix:rate)", entry)
+		}
+		if device == nil {
+			return nil, fmt.Errorf("ROUTING_RATES: unknown device %q", strings.TrimSpace(name))
+		}
+
+		device.Rates = make(map[string]float64)
+		for _, pair := range splitList(table) {
+			prefix, rateStr, found := strings.Cut(pair, ":")
+			prefix = strings.TrimSpace(prefix)
+			rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+			if !found || !strings.HasPrefix(prefix, "+") || err != nil || rate < 0 {
+				return nil, fmt.Errorf("ROUTING_RATES: invalid rate %q for %s (expected +prefix:rate)", pair, device.Name)
+			}
+			device.Rates[prefix] = rate
+		}
+	}
+
+	if err := router.parseNumberGroups(); err != nil {
+		return nil, err
+	}
+
+	return router, nil
+}
+
+// OpenDevices connects to the additional devices. The primary device is
+// connected by the caller. A device that can't be opened is logged and left
+// out of routing and its groups.
+func (r *Router) OpenDevices(primary SMSConnection, db *Database, gsm GSMSettings, events *EventBus) {
+	r.db = db
+	r.Devices[0].Conn = primary
+
+	devices := r.Devices[:1]
+	for _, device := range r.Devices[1:] {
+		conn, err := NewArduinoConnection(device.Port, db, gsm, events, nil)
+		if err != nil {
+			log.Printf("Routing: failed to connect device %s: %v", device.Name, err)
+			continue
+		}
+		device.Conn = conn
+		devices = append(devices, device)
+		log.Printf("Routing: connected device %s on %s", device.Name, device.Port)
+	}
+	r.Devices = devices
+
+	for _, group := range r.Groups {
+		group.Devices = slices.DeleteFunc(group.Devices, func(device *RouteDevice) bool {
+			return device.Conn == nil
+		})
+		if len(group.Devices) == 0 {
+			log.Printf("Routing: no device of group %s is connected", group.Name)
+		}
+	}
+}
+
+// Close closes the additional devices
+func (r *Router) Close() {
+	for _, device := range r.Devices[1:] {
+		device.Conn.Close()
+	}
+}
+
+// Device returns the device with the given name, or nil
+func (r *Router) Device(name string) *RouteDevice {
+	for _, device := range r.Devices {
+		if device.Name == name {
+			return device
+		}
+	}
+	return nil
+}
+
+// Route returns the devices in the order they are tried for number: cheapest
+// first, then devices without a rate for it in configured order
+func (r *Router) Route(number string) []*RouteDevice {
+	type ranked struct {
+		device *RouteDevice
+		rate   float64
+	}
+
+	candidates := make([]ranked, 0, len(r.Devices))
+	for _, device := range r.Devices {
+		rate, ok := device.Rate(number)
+		if !ok {
+			rate = math.Inf(1)
+		}
+		candidates = append(candidates, ranked{device, rate})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rate < candidates[j].rate
+	})
+
+	devices := make([]*RouteDevice, len(candidates))
+	for i, c := range candidates {
+		devices[i] = c.device
+	}
+	return devices
+}
+
+// IsConnected reports whether any device is connected
+func (r *Router) IsConnected() bool {
+	for _, device := range r.Devices {
+		if device.Conn.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// SendSMS sends through the cheapest connected device for the number, or the
+// next device of its number group, trying the next one when a send fails.
+// Invalid numbers are not retried on other devices.
+func (r *Router) SendSMS(number, content string, opts SendOptions) error {
+	devices := r.Route(number)
+	group := r.sendGroup(opts)
+	if group != nil {
+		devices = group.Order(r.db, number)
+	}
+
+	err := ErrNotConnected
+	for _, device := range devices {
+		if !device.Conn.IsConnected() {
+			continue
+		}
+
+		if err = device.Conn.SendSMS(number, content, opts); err == nil {
+			log.Printf("Routing: sent SMS to %s via %s", number, device.Name)
+			r.db.recordSentDevice(opts.SentID, device.Name)
+			if group != nil {
+				group.Sent(r.db, number, device)
+			}
+			return nil
+		}
+		if ClassifyError(err) == ErrorClassInvalidNumber {
+			return err
+		}
+		log.Printf("Routing: send to %s via %s failed, trying next device: %v", number, device.Name, err)
+	}
+	return err
+}
+
+// getRouting returns the routing devices and rates, and the routing order for
+// the number query parameter if given
+func (app *App) getRouting(c *gin.Context) {
+	if app.routing == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"enabled": false,
+		})
+		return
+	}
+
+	devices := make([]gin.H, 0, len(app.routing.Devices))
+	for _, device := range app.routing.Devices {
+		d := gin.H{
+			"name":      device.Name,
+			"connected": device.Conn.IsConnected(),
+			"rates":     device.Rates,
+		}
+		if device.Port != "" {
+			d["port"] = device.Port
+		}
+		devices = append(devices, d)
+	}
+
+	groups := make([]gin.H, 0, len(app.routing.Groups))
+	for _, group := range app.routing.Groups {
+		names := make([]string, len(group.Devices))
+		for i, device := range group.Devices {
+			names[i] = device.Name
+		}
+		groups = append(groups, gin.H{
+			"name":     group.Name,
+			"rotation": group.Rotation,
+			"devices":  names,
+			"default":  group.Name == app.routing.DefaultGroup,
+		})
+	}
+
+	resp := gin.H{
+		"status":  "success",
+		"enabled": true,
+		"devices": devices,
+		"groups":  groups,
+	}
+
+	if value := c.Query("number"); value != "" {
+		number, err := NormalizeNumber(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidNumber, "Invalid number: %v", err))
+			return
+		}
+
+		route := []RouteCandidate{}
+		for _, device := range app.routing.Route(number) {
+			candidate := RouteCandidate{Device: device.Name, Connected: device.Conn.IsConnected()}
+			if rate, ok := device.Rate(number); ok {
+				candidate.Rate = &rate
+			}
+			route = append(route, candidate)
+		}
+		resp["number"] = number
+		resp["route"] = route
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
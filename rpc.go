@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	// Application defined server errors
+	rpcSendFailed  = -32000
+	rpcForbidden   = -32001
+	rpcUnavailable = -32002
+	rpcCancelled   = -32003
+	rpcThrottled   = -32004
+)
+
+// rpcRequest represents a JSON-RPC 2.0 request or notification
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcResponse represents a JSON-RPC 2.0 response
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcError represents a JSON-RPC 2.0 error object
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcSendParams are the parameters of sms.send
+type rpcSendParams struct {
+	Number   string `json:"number"`
+	Content  string `json:"content"`
+	Class    *int   `json:"class"`
+	SenderID string `json:"sender_id"`
+	Template string `json:"template"`
+	Campaign string `json:"campaign"`
+	Group    string `json:"group"`
+
+	TemplateVersion int  `json:"template_version"`
+	ConfirmSpecial  bool `json:"confirm_special"`
+}
+
+// rpcListParams are the parameters of sms.list
+type rpcListParams struct {
+	Type   string `json:"type"` // received (default) or sent
+	Number string `json:"number"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// nullID is used for responses to requests whose ID could not be read
+var nullID = json.RawMessage("null")
+
+// handleRPC serves JSON-RPC 2.0 requests, including batches
+func (app *App) handleRPC(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusOK, rpcErrorResponse(nullID, rpcParseError, "Failed to read request"))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		c.JSON(http.StatusOK, rpcErrorResponse(nullID, rpcParseError, "Parse error"))
+		return
+	}
+
+	// Single request
+	if body[0] != '[' {
+		resp := app.callRPC(c, body)
+		if resp == nil {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	// Batch request
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+		c.JSON(http.StatusOK, rpcErrorResponse(nullID, rpcInvalidRequest, "Invalid Request"))
+		return
+	}
+
+	responses := make([]*rpcResponse, 0, len(batch))
+	for _, raw := range batch {
+		if resp := app.callRPC(c, raw); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+
+	// A batch of notifications gets no response
+	if len(responses) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// callRPC executes one JSON-RPC call. It returns nil for notifications.
+func (app *App) callRPC(c *gin.Context, raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcErrorResponse(nullID, rpcInvalidRequest, "Invalid Request")
+	}
+
+	result, rpcErr := app.dispatchRPC(c, req)
+
+	// Notifications (no id member) never get a response
+	if req.ID == nil {
+		return nil
+	}
+
+	if rpcErr != nil {
+		return &rpcResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+	}
+
+	return &rpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+// dispatchRPC routes a call to its method implementation
+func (app *App) dispatchRPC(c *gin.Context, req rpcRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "sms.send":
+		if !app.hasRole(c, RoleSend) {
+			return nil, &rpcError{Code: rpcForbidden, Message: fmt.Sprintf("Token lacks required role %s", RoleSend)}
+		}
+		return app.rpcSend(c, req.Params)
+
+	case "sms.list":
+		if !app.hasRole(c, RoleRead) {
+			return nil, &rpcError{Code: rpcForbidden, Message: fmt.Sprintf("Token lacks required role %s", RoleRead)}
+		}
+		return app.rpcList(req.Params)
+
+	case "device.status":
+		if !app.hasRole(c, RoleRead) {
+			return nil, &rpcError{Code: rpcForbidden, Message: fmt.Sprintf("Token lacks required role %s", RoleRead)}
+		}
+		return app.deviceStatus(), nil
+
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("Method not found: %s", req.Method)}
+	}
+}
+
+// rpcSend implements sms.send
+func (app *App) rpcSend(c *gin.Context, params json.RawMessage) (interface{}, *rpcError) {
+	var p rpcSendParams
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	opts := SendOptions{Class: p.Class, SenderID: p.SenderID, Template: p.Template, Campaign: p.Campaign, Group: p.Group,
+		TemplateVersion: p.TemplateVersion, ConfirmSpecial: p.ConfirmSpecial}
+	number := app.resolveTarget(p.Number)
+	if err := app.validateSMS(number, p.Content, opts); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error(), Data: gin.H{"code": errorCode(err, CodeInvalidRequest)}}
+	}
+	p.Content = app.localizeTemplate(number, p.Content, opts)
+
+	if app.runMode.Get() != RunModeNormal {
+		return nil, &rpcError{Code: rpcUnavailable, Message: fmt.Sprintf("Service is in %s mode", app.runMode.Get()), Data: gin.H{"code": runModeErrorCode(app.runMode.Get())}}
+	}
+
+	err := app.allowSend(c)
+	if err == nil {
+		_, err = app.deliverSMS(c.Request.Context(), keyIDFromContext(c), number, p.Content, opts)
+	}
+	var throttleErr *ThrottleError
+	switch {
+	case errors.As(err, &throttleErr):
+		return nil, &rpcError{Code: rpcThrottled, Message: throttleErr.Error(), Data: gin.H{"code": throttleErr.Code, "reason": throttleErr.Reason, "retry_after": throttleErr.retryAfterSeconds()}}
+	case errors.Is(err, ErrNotConnected):
+		return nil, &rpcError{Code: rpcUnavailable, Message: "Not connected to Arduino device", Data: gin.H{"code": CodeDeviceNotConnected}}
+	case errors.Is(err, ErrSendCancelled):
+		return nil, &rpcError{Code: rpcCancelled, Message: err.Error(), Data: gin.H{"code": CodeSendCancelled}}
+	case err != nil:
+		return nil, &rpcError{Code: rpcSendFailed, Message: fmt.Sprintf("Failed to send SMS: %v", err), Data: gin.H{"code": sendErrorCode(err), "error_class": ClassifyError(err)}}
+	}
+
+	return gin.H{
+		"status":  "success",
+		"message": fmt.Sprintf("SMS sent to %s", number),
+	}, nil
+}
+
+// rpcList implements sms.list
+func (app *App) rpcList(params json.RawMessage) (interface{}, *rpcError) {
+	p := rpcListParams{Type: "received", Limit: 50}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	if p.Limit <= 0 {
+		p.Limit = 50
+	}
+	if p.Limit > 100 {
+		p.Limit = 100
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	var messages interface{}
+	var count, total int
+	var err error
+
+	switch p.Type {
+	case "received":
+		var list []ReceivedSMS
+		if p.Number != "" {
+			list, err = app.db.GetReceivedSMSByNumber(p.Number, ReceivedSMSFilter{}, p.Limit, p.Offset)
+			total = len(list)
+		} else {
+			list, err = app.db.GetReceivedSMS(p.Limit, p.Offset)
+			total, _ = app.db.CountReceivedSMS()
+		}
+		messages, count = list, len(list)
+
+	case "sent":
+		var list []SentSMS
+		if p.Number != "" {
+			list, err = app.db.GetSentSMSByNumber(p.Number, SentSMSFilter{}, p.Limit, p.Offset)
+			total = len(list)
+		} else {
+			list, err = app.db.GetSentSMS(p.Limit, p.Offset)
+			total, _ = app.db.CountSentSMS()
+		}
+		messages, count = list, len(list)
+
+	default:
+		return nil, &rpcError{Code: rpcInvalidParams, Message: `type must be "received" or "sent"`}
+	}
+
+	if err != nil {
+		return nil, &rpcError{Code: rpcInternalError, Message: fmt.Sprintf("Failed to retrieve messages: %v", err)}
+	}
+
+	return gin.H{
+		"total":    total,
+		"count":    count,
+		"messages": messages,
+	}, nil
+}
+
+// decodeRPCParams decodes named (object) params; missing params are allowed
+func decodeRPCParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("params must be an object with the method's named parameters")
+	}
+	return nil
+}
+
+// rpcErrorResponse builds an error response
+func rpcErrorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{
+		JSONRPC: "2.0",
+		Error:   &rpcError{Code: code, Message: message},
+		ID:      id,
+	}
+}
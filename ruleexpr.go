@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// RuleExpr is a compiled rule condition written in the expr language
+// (https://expr-lang.org), e.g.
+//
+//	sender startsWith "+386" && (hour < 8 || weekday in ["sat", "sun"])
+type RuleExpr struct {
+	source  string
+	program *vm.Program
+}
+
+// RuleVars are the variables available to a rule condition, all times local
+type RuleVars struct {
+	Sender  string `expr:"sender"`
+	Content string `expr:"content"`
+	Device  string `expr:"device"`  // the SIM's own number
+	Hour    int    `expr:"hour"`    // 0 to 23
+	Minute  int    `expr:"minute"`  // 0 to 59
+	Weekday string `expr:"weekday"` // mon to sun
+	Date    string `expr:"date"`    // 2025-01-15
+	Time    string `expr:"time"`    // 17:30
+}
+
+// CompileRuleExpr parses and type-checks a rule condition, which must result
+// in a boolean. Unknown variables are an error here rather than on a match.
+func CompileRuleExpr(source string) (*RuleExpr, error) {
+	program, err := expr.Compile(source, expr.Env(RuleVars{}), expr.AsBool())
+	if err != nil {
+		return nil, err
+	}
+	return &RuleExpr{source: source, program: program}, nil
+}
+
+// String returns the source of the condition
+func (e *RuleExpr) String() string {
+	return e.source
+}
+
+// Match evaluates the condition
+func (e *RuleExpr) Match(vars RuleVars) (bool, error) {
+	result, err := expr.Run(e.program, vars)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition is %T, not a boolean", result)
+	}
+	return matched, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleExpr(t *testing.T) {
+	// Saturday 19:05 local time
+	vars := ruleVars(ReceivedSMS{
+		Number:       "+38640123456",
+		Content:      "ALARM: door open",
+		DeviceNumber: "+38641000000",
+		Timestamp:    time.Date(2026, 3, 7, 19, 5, 0, 0, time.Local),
+	})
+
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{`sender startsWith "+386" && (time >= "18:00" || time < "08:00" || weekday in ["sat", "sun"])`, true},
+		{`sender == "+38640123456"`, true},
+		{`sender != "+38640123456"`, false},
+		{`sender endsWith "456" && device == "+38641000000"`, true},
+		{`content contains "door"`, true},
+		{`content contains "DOOR"`, false},
+		{`lower(content) contains "door" && upper(content) startsWith "ALARM"`, true},
+		{`content matches "(?i)^alarm"`, true},
+		{`content matches "^alarm"`, false},
+		{`len(trim(content)) > 10`, true},
+		{`hour >= 18 && minute == 5`, true},
+		{`hour < 8 || hour > 20`, false},
+		{`weekday in ["mon", "tue", "wed", "thu", "fri"]`, false},
+		{`!(weekday in ["sat", "sun"])`, false},
+		{`date == "2026-03-07"`, true},
+		{`true || sender == ""`, true},
+		{`false && sender == ""`, false},
+	}
+	for _, tt := range tests {
+		expr, err := CompileRuleExpr(tt.condition)
+		if err != nil {
+			t.Errorf("CompileRuleExpr(%s): %v", tt.condition, err)
+			continue
+		}
+		if expr.String() != tt.condition {
+			t.Errorf("String() = %q, want %q", expr.String(), tt.condition)
+		}
+		got, err := expr.Match(vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.condition, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestRuleExprInvalid(t *testing.T) {
+	for _, condition := range []string{
+		``,
+		`sender`,                     // not a boolean
+		`hour + 1`,                   // not a boolean
+		`recipient == "+386"`,        // unknown variable
+		`hour startsWith "1"`,        // string operator on a number
+		`hour > "08:00"`,             // number compared with a string
+		`content matches "("`,        // invalid pattern
+		`sender == "+386" &&`,        // incomplete
+		`(sender == "+386"`,          // unbalanced parenthesis
+		`weekday in ["sat", "sun"`,   // unterminated list
+		`sender == "+386`,            // unterminated string
+		`shout(content) == "ALARM!"`, // unknown function
+	} {
+		if _, err := CompileRuleExpr(condition); err == nil {
+			t.Errorf("CompileRuleExpr(%s) succeeded, want an error", condition)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Inbound rule actions
+const (
+	RuleActionReply   = "reply"   // send the message back to the sender
+	RuleActionForward = "forward" // send the received SMS on to the target number
+	RuleActionWebhook = "webhook" // post the received SMS to the target URL
+)
+
+// ruleReplyCooldown is how long a rule waits before replying to the same
+// number again, so two auto-responders can't keep answering each other
+const ruleReplyCooldown = time.Hour
+
+// ruleActionTimeout limits sending or posting for one rule
+const ruleActionTimeout = 5 * time.Minute
+
+// InboundRule routes or answers received SMS whose condition matches
+type InboundRule struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Condition string    `json:"condition"` // see RuleExpr
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`  // number of forward, URL of webhook
+	Message   string    `json:"message,omitempty"` // text of reply
+	Stop      bool      `json:"stop"`              // skip later rules when this one matches
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InboundRuleRequest defines an inbound rule
+type InboundRuleRequest struct {
+	Name      string `json:"name" binding:"required"`
+	Condition string `json:"condition" binding:"required"`
+	Action    string `json:"action" binding:"required"`
+	Target    string `json:"target"`
+	Message   string `json:"message"`
+	Stop      bool   `json:"stop"`
+}
+
+// InboundRules applies the inbound rules to received SMS
+type InboundRules struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	replied map[string]time.Time // last reply per rule and number
+}
+
+// NewInboundRules creates the rule engine
+func NewInboundRules() *InboundRules {
+	return &InboundRules{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		replied: make(map[string]time.Time),
+	}
+}
+
+// validate checks a rule request, normalizing its target number
+func (req *InboundRuleRequest) validate() error {
+	if _, err := CompileRuleExpr(req.Condition); err != nil {
+		return fmt.Errorf("invalid condition: %w", err)
+	}
+
+	switch req.Action {
+	case RuleActionReply:
+		if req.Message == "" {
+			return fmt.Errorf("reply needs a message")
+		}
+	case RuleActionForward:
+		number, err := NormalizeNumber(req.Target)
+		if err != nil {
+			return fmt.Errorf("invalid target number: %w", err)
+		}
+		req.Target = number
+	case RuleActionWebhook:
+		if u, err := url.Parse(req.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid target URL, expected http(s)://host/path")
+		}
+	default:
+		return fmt.Errorf("unknown action %q (use reply, forward or webhook)", req.Action)
+	}
+	return nil
+}
+
+// ruleVars are the variables of a received SMS available to rule conditions
+func ruleVars(msg ReceivedSMS) RuleVars {
+	local := msg.Timestamp.Local()
+	return RuleVars{
+		Sender:  msg.Number,
+		Content: msg.Content,
+		Device:  msg.DeviceNumber,
+		Hour:    local.Hour(),
+		Minute:  local.Minute(),
+		Weekday: strings.ToLower(local.Weekday().String()[:3]),
+		Date:    local.Format("2006-01-02"),
+		Time:    local.Format("15:04"),
+	}
+}
+
+// CreateInboundRule stores a rule and returns its ID
+func (d *Database) CreateInboundRule(r *InboundRule) (int64, error) {
+	var id int64
+	err := d.db.QueryRow(`
+		INSERT INTO inbound_rules (name, condition, action, target, message, stop)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, r.Name, r.Condition, r.Action, r.Target, r.Message, r.Stop).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save rule: %w", err)
+	}
+
+	return id, nil
+}
+
+// inboundRuleColumns are the inbound_rules columns read by scanInboundRule
+const inboundRuleColumns = `id, name, condition, action, target, message, stop, created_at`
+
+// scanInboundRule reads a rule selected with inboundRuleColumns
+func scanInboundRule(row interface{ Scan(...any) error }) (InboundRule, error) {
+	var r InboundRule
+	var createdAtStr string
+
+	if err := row.Scan(&r.ID, &r.Name, &r.Condition, &r.Action, &r.Target, &r.Message, &r.Stop, &createdAtStr); err != nil {
+		return r, err
+	}
+	r.CreatedAt = parseTimestamp(createdAtStr)
+
+	return r, nil
+}
+
+// GetInboundRule retrieves a rule, returning nil if it does not exist
+func (d *Database) GetInboundRule(id int64) (*InboundRule, error) {
+	r, err := scanInboundRule(d.db.QueryRow(`SELECT `+inboundRuleColumns+` FROM inbound_rules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rule: %w", err)
+	}
+
+	return &r, nil
+}
+
+// ListInboundRules retrieves all rules in the order they are applied
+func (d *Database) ListInboundRules() ([]InboundRule, error) {
+	rows, err := d.db.Query(`SELECT ` + inboundRuleColumns + ` FROM inbound_rules ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []InboundRule{}
+	for rows.Next() {
+		r, err := scanInboundRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		rules = append(rules, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return rules, nil
+}
+
+// DeleteInboundRule removes a rule, reporting whether it existed
+func (d *Database) DeleteInboundRule(id int64) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM inbound_rules WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete rule: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// applyInboundRules runs the actions of the rules matching a received SMS, in
+// order until a matching rule with stop set. Loopback checks and SMS from
+// muted numbers are skipped.
+func (app *App) applyInboundRules(event Event) {
+	msg := event.Data.(ReceivedSMS)
+	if app.loopback.IsLoopback(msg) {
+		return
+	}
+	if muted, err := app.db.IsMuted(msg.Number); err != nil || muted {
+		return
+	}
+	if app.blocklist.IsBlocked(app.db, msg.Number) {
+		return
+	}
+
+	rules, err := app.db.ListInboundRules()
+	if err != nil {
+		log.Printf("Rules: %v", err)
+		return
+	}
+
+	vars := ruleVars(msg)
+	for _, rule := range rules {
+		expr, err := CompileRuleExpr(rule.Condition)
+		if err != nil {
+			log.Printf("Rule %d (%s): %v", rule.ID, rule.Name, err)
+			continue
+		}
+		matched, err := expr.Match(vars)
+		if err != nil {
+			log.Printf("Rule %d (%s): %v", rule.ID, rule.Name, err)
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		log.Printf("Rule %d (%s) matched SMS %d from %s, %s", rule.ID, rule.Name, msg.ID, msg.Number, rule.Action)
+		go app.runRuleAction(rule, msg)
+		if rule.Stop {
+			return
+		}
+	}
+}
+
+// runRuleAction replies to, forwards or posts a received SMS for a matching rule
+func (app *App) runRuleAction(rule InboundRule, msg ReceivedSMS) {
+	ctx, cancel := context.WithTimeout(context.Background(), ruleActionTimeout)
+	defer cancel()
+
+	keyID := fmt.Sprintf("rule:%d", rule.ID)
+	var err error
+	switch rule.Action {
+	case RuleActionReply:
+		if !app.rules.mayReply(rule.ID, msg.Number) {
+			log.Printf("Rule %d (%s): already replied to %s within %s", rule.ID, rule.Name, msg.Number, ruleReplyCooldown)
+			return
+		}
+		// Nobody can confirm an automatic reply to a premium number
+		if err := app.specialNumbers.Check(msg.Number, false); err != nil {
+			log.Printf("Rule %d (%s): not replying: %v", rule.ID, rule.Name, err)
+			return
+		}
+		_, err = app.deliverSMS(ctx, keyID, msg.Number, rule.Message, SendOptions{})
+
+	case RuleActionForward:
+		_, err = app.deliverSMS(ctx, keyID, rule.Target, fmt.Sprintf("%s: %s", msg.Number, msg.Content), SendOptions{})
+
+	case RuleActionWebhook:
+		err = app.rules.post(ctx, rule.Target, gin.H{
+			"event": EventMessageReceived,
+			"rule":  gin.H{"id": rule.ID, "name": rule.Name},
+			"data":  receivedEvent(msg),
+		})
+	}
+
+	if err != nil {
+		log.Printf("Rule %d (%s): %s failed: %v", rule.ID, rule.Name, rule.Action, err)
+	}
+}
+
+// mayReply records a reply of a rule to a number, reporting false if the rule
+// already replied to it within the cooldown
+func (r *InboundRules) mayReply(ruleID int64, number string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, at := range r.replied {
+		if now.Sub(at) >= ruleReplyCooldown {
+			delete(r.replied, key)
+		}
+	}
+
+	key := fmt.Sprintf("%d/%s", ruleID, number)
+	if _, ok := r.replied[key]; ok {
+		return false
+	}
+	r.replied[key] = now
+	return true
+}
+
+// post sends a JSON payload to a rule's webhook URL
+func (r *InboundRules) post(ctx context.Context, target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return nil
+}
+
+// inboundRuleFromParam loads the rule named by the id path parameter,
+// writing an error response and returning nil if it cannot
+func (app *App) inboundRuleFromParam(c *gin.Context) *InboundRule {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid rule ID"))
+		return nil
+	}
+
+	r, err := app.db.GetInboundRule(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get rule: %v", err))
+		return nil
+	}
+	if r == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Rule %d not found", id))
+		return nil
+	}
+
+	return r
+}
+
+// createInboundRule defines an inbound rule
+func (app *App) createInboundRule(c *gin.Context) {
+	var req InboundRuleRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid rule: %v", err))
+		return
+	}
+
+	r := &InboundRule{
+		Name:      req.Name,
+		Condition: req.Condition,
+		Action:    req.Action,
+		Target:    req.Target,
+		Message:   req.Message,
+		Stop:      req.Stop,
+	}
+	id, err := app.db.CreateInboundRule(r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to create rule: %v", err))
+		return
+	}
+
+	r, err = app.db.GetInboundRule(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get rule: %v", err))
+		return
+	}
+
+	log.Printf("Created rule %d (%s): %s when %s", id, r.Name, r.Action, r.Condition)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": "success",
+		"rule":   r,
+	})
+}
+
+// listInboundRules returns the inbound rules in the order they are applied
+func (app *App) listInboundRules(c *gin.Context) {
+	rules, err := app.db.ListInboundRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list rules: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"rules":  rules,
+	})
+}
+
+// getInboundRule returns an inbound rule
+func (app *App) getInboundRule(c *gin.Context) {
+	r := app.inboundRuleFromParam(c)
+	if r == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"rule":   r,
+	})
+}
+
+// deleteInboundRule removes an inbound rule
+func (app *App) deleteInboundRule(c *gin.Context) {
+	r := app.inboundRuleFromParam(c)
+	if r == nil {
+		return
+	}
+
+	if _, err := app.db.DeleteInboundRule(r.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete rule: %v", err))
+		return
+	}
+
+	log.Printf("Deleted rule %d (%s)", r.ID, r.Name)
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Message types a saved search selects from
+const (
+	SearchReceived = "received"
+	SearchSent     = "sent"
+)
+
+// searchNamePattern restricts saved search names to URL-safe identifiers
+var searchNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// searchStatuses lists the statuses a saved search can filter by, per message type
+var searchStatuses = map[string][]string{
+	SearchReceived: {"acked", "unacked"},
+	SearchSent:     {"success", "error", "cancelled", "simulated", "aggregated", "duplicate", "queued", "sending", "unknown"},
+}
+
+// SavedSearch is a named filter over received or sent SMS. Empty fields match
+// every message.
+type SavedSearch struct {
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`               // received (default) or sent
+	Numbers  []string   `json:"numbers,omitempty"`  // peers, matched in any spelling
+	Keywords []string   `json:"keywords,omitempty"` // content contains any of them, case-insensitive
+	Since    string     `json:"since,omitempty"`    // relative window, e.g. "24h" or "7d"
+	From     *time.Time `json:"from,omitempty"`     // absolute window start
+	To       *time.Time `json:"to,omitempty"`       // absolute window end, exclusive
+	Status   string     `json:"status,omitempty"`   // acked or unacked for received, the send status for sent
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks a saved search and fills in defaults
+func (s *SavedSearch) Validate() error {
+	if !searchNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("invalid name %q (1-64 letters, digits, '-' or '_')", s.Name)
+	}
+
+	if s.Type == "" {
+		s.Type = SearchReceived
+	}
+	statuses, ok := searchStatuses[s.Type]
+	if !ok {
+		return fmt.Errorf("invalid type %q (must be received or sent)", s.Type)
+	}
+	if s.Status != "" && !slices.Contains(statuses, s.Status) {
+		return fmt.Errorf("invalid status %q for %s messages (must be one of %s)", s.Status, s.Type, strings.Join(statuses, ", "))
+	}
+
+	if s.Since != "" {
+		if s.From != nil || s.To != nil {
+			return fmt.Errorf("specify either since or from and to, not both")
+		}
+		since, err := parseInterval(s.Since)
+		if err != nil || since <= 0 {
+			return fmt.Errorf("invalid since %q", s.Since)
+		}
+	}
+	if s.From != nil && s.To != nil && !s.From.Before(*s.To) {
+		return fmt.Errorf("from must be before to")
+	}
+
+	for _, number := range s.Numbers {
+		if strings.TrimSpace(number) == "" {
+			return fmt.Errorf("numbers must not be empty")
+		}
+	}
+	for _, keyword := range s.Keywords {
+		if strings.TrimSpace(keyword) == "" {
+			return fmt.Errorf("keywords must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// window returns the time window of the search at now; zero times are open ends
+func (s *SavedSearch) window(now time.Time) (from, to time.Time) {
+	if s.Since != "" {
+		since, _ := parseInterval(s.Since)
+		return now.Add(-since), time.Time{}
+	}
+	if s.From != nil {
+		from = *s.From
+	}
+	if s.To != nil {
+		to = *s.To
+	}
+	return from, to
+}
+
+// inWindow reports whether t lies in [from, to)
+func inWindow(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// where returns the WHERE clause and arguments for the numbers, keywords and
+// status of the search. The time window is checked on the scanned messages.
+func (s *SavedSearch) where(sql dialect) (string, []any) {
+	var conditions []string
+	var args []any
+
+	if len(s.Numbers) > 0 {
+		placeholders := make([]string, len(s.Numbers))
+		for i, number := range s.Numbers {
+			placeholders[i] = "?"
+			args = append(args, ConversationID(number))
+		}
+		conditions = append(conditions, `conversation_id IN (`+strings.Join(placeholders, ", ")+`)`)
+	}
+
+	if len(s.Keywords) > 0 {
+		likes := make([]string, len(s.Keywords))
+		for i, keyword := range s.Keywords {
+			likes[i] = `content ` + sql.like() + ` '%' || ? || '%'`
+			args = append(args, keyword)
+		}
+		conditions = append(conditions, `(`+strings.Join(likes, " OR ")+`)`)
+	}
+
+	switch {
+	case s.Status == "acked":
+		conditions = append(conditions, `acked_at IS NOT NULL`)
+	case s.Status == "unacked":
+		conditions = append(conditions, `acked_at IS NULL`)
+	case s.Status != "":
+		conditions = append(conditions, `status = ?`)
+		args = append(args, s.Status)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// SaveSearch stores a new saved search, reporting false if the name is taken
+func (d *Database) SaveSearch(s *SavedSearch) (bool, error) {
+	definition, err := json.Marshal(s)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode search: %w", err)
+	}
+
+	res, err := d.db.Exec(`INSERT INTO saved_searches (name, definition, created_at) VALUES (?, ?, ?) ON CONFLICT(name) DO NOTHING`,
+		s.Name, string(definition), s.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return false, fmt.Errorf("failed to save search: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GetSearch retrieves a saved search, returning nil if it does not exist
+func (d *Database) GetSearch(name string) (*SavedSearch, error) {
+	var definition string
+	err := d.db.QueryRow(`SELECT definition FROM saved_searches WHERE name = ?`, name).Scan(&definition)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query search: %w", err)
+	}
+
+	var s SavedSearch
+	if err := json.Unmarshal([]byte(definition), &s); err != nil {
+		return nil, fmt.Errorf("failed to decode search %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// ListSearches returns the saved searches ordered by name
+func (d *Database) ListSearches() ([]SavedSearch, error) {
+	rows, err := d.db.Query(`SELECT name, definition FROM saved_searches ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query searches: %w", err)
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		var s SavedSearch
+		if err := json.Unmarshal([]byte(definition), &s); err != nil {
+			return nil, fmt.Errorf("failed to decode search %s: %w", name, err)
+		}
+		searches = append(searches, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return searches, nil
+}
+
+// DeleteSearch removes a saved search, reporting whether it existed
+func (d *Database) DeleteSearch(name string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM saved_searches WHERE name = ?`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete search: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// EachReceivedMatch calls fn for each received SMS matching a search,
+// newest first or, with oldestFirst, in the order they were stored
+func (d *Database) EachReceivedMatch(s *SavedSearch, now time.Time, oldestFirst bool, fn func(ReceivedSMS) error) error {
+	where, args := s.where(d.dialect())
+	order := ` ORDER BY timestamp DESC`
+	if oldestFirst {
+		order = ` ORDER BY id`
+	}
+
+	rows, err := d.db.Query(`SELECT `+d.receivedSMSColumns()+` FROM received_sms`+where+order, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query SMS: %w", err)
+	}
+	defer rows.Close()
+
+	// Timestamps are compared here rather than in SQL since the driver
+	// stores them in a format that doesn't sort like RFC3339
+	from, to := s.window(now)
+	for rows.Next() {
+		msg, err := scanReceivedSMS(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if !inWindow(msg.Timestamp, from, to) {
+			continue
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	return nil
+}
+
+// EachSentMatch calls fn for each sent SMS matching a search, newest first
+func (d *Database) EachSentMatch(s *SavedSearch, now time.Time, fn func(SentSMS) error) error {
+	where, args := s.where(d.dialect())
+	rows, err := d.db.Query(`
+		SELECT `+sentSMSColumns+`
+		FROM sent_sms`+where+`
+		ORDER BY created_at DESC, id DESC
+	`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query sent SMS: %w", err)
+	}
+	defer rows.Close()
+
+	from, to := s.window(now)
+	for rows.Next() {
+		msg, err := scanSentSMS(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if !inWindow(msg.CreatedAt, from, to) {
+			continue
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	return nil
+}
+
+// createSearch saves a named filter
+func (app *App) createSearch(c *gin.Context) {
+	var s SavedSearch
+	if !bindStrictJSON(c, &s) {
+		return
+	}
+	if err := s.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid search: %v", err))
+		return
+	}
+	s.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	created, err := app.db.SaveSearch(&s)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to save search: %v", err))
+		return
+	}
+	if !created {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Search %s already exists", s.Name))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status": "success",
+		"search": s,
+	})
+}
+
+// listSearches returns the saved searches
+func (app *App) listSearches(c *gin.Context) {
+	searches, err := app.db.ListSearches()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list searches: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"searches": searches,
+	})
+}
+
+// getSearch returns a saved search
+func (app *App) getSearch(c *gin.Context) {
+	s, ok := app.loadSearch(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"search": s,
+	})
+}
+
+// deleteSearch removes a saved search
+func (app *App) deleteSearch(c *gin.Context) {
+	name := c.Param("name")
+
+	deleted, err := app.db.DeleteSearch(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete search: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Search %s not found", name))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// loadSearch retrieves the saved search named in the URL, writing an error
+// response if there is none
+func (app *App) loadSearch(c *gin.Context) (*SavedSearch, bool) {
+	name := c.Param("name")
+
+	s, err := app.db.GetSearch(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get search: %v", err))
+		return nil, false
+	}
+	if s == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Search %s not found", name))
+		return nil, false
+	}
+	return s, true
+}
+
+// runSearch returns the messages matching a saved search, newest first
+func (app *App) runSearch(c *gin.Context) {
+	s, ok := app.loadSearch(c)
+	if !ok {
+		return
+	}
+
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	// Matches are counted in full and only the requested page is kept
+	total := 0
+	page := func() bool {
+		total++
+		return total > offset && total <= offset+limit
+	}
+
+	var messages any
+	var err error
+	now := time.Now()
+	if s.Type == SearchSent {
+		list := []SentSMS{}
+		err = app.db.EachSentMatch(s, now, func(msg SentSMS) error {
+			if page() {
+				list = append(list, msg)
+			}
+			return nil
+		})
+		messages = list
+	} else {
+		list := []ReceivedSMS{}
+		err = app.db.EachReceivedMatch(s, now, false, func(msg ReceivedSMS) error {
+			if page() {
+				list = append(list, msg)
+			}
+			return nil
+		})
+		messages = list
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"search":   s.Name,
+		"type":     s.Type,
+		"total":    total,
+		"messages": messages,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultClient is used for all Vault requests
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// GetSecret resolves a secret by name from, in order of precedence:
+//   - the NAME environment variable
+//   - a file referenced by NAME_FILE (e.g. Docker secrets)
+//   - a HashiCorp Vault KV entry referenced by NAME_VAULT as "path#field"
+//
+// It returns an empty string when the secret is not configured anywhere.
+func GetSecret(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if ref := os.Getenv(name + "_VAULT"); ref != "" {
+		value, err := readVaultSecret(ref)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s from Vault: %w", name, err)
+		}
+		return value, nil
+	}
+
+	return "", nil
+}
+
+// readVaultSecret reads a field from a Vault KV secret given as "path#field".
+// Both KV v1 and KV v2 (path including "data/") response layouts are supported.
+func readVaultSecret(ref string) (string, error) {
+	path, field, found := strings.Cut(ref, "#")
+	if !found || path == "" || field == "" {
+		return "", fmt.Errorf("invalid Vault reference %q, expected path#field", ref)
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	// The Vault token may itself come from a file
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if tokenFile := os.Getenv("VAULT_TOKEN_FILE"); tokenFile != "" {
+			data, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return "", fmt.Errorf("failed to read VAULT_TOKEN_FILE: %w", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("VAULT_TOKEN is not set")
+	}
+
+	url := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	data := body.Data
+	// KV v2 nests the secret under data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %q not found in %s", field, path)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Self-test step results
+const (
+	SelfTestPass = "pass"
+	SelfTestFail = "fail"
+	SelfTestSkip = "skip"
+)
+
+// selfTestProbeTimeout is how long ping and version wait for a reply
+const selfTestProbeTimeout = 5 * time.Second
+
+// SelfTestSettings configures the optional self-test steps
+type SelfTestSettings struct {
+	Number         string        // the SIM's own number, for the send and receive steps
+	USSDCode       string        // code for the USSD step, e.g. *100#
+	ReceiveTimeout time.Duration // how long to wait for the SMS sent to self
+}
+
+// SelfTestStep is the result of one self-test step
+type SelfTestStep struct {
+	Name     string
+	Status   string
+	Detail   string
+	Duration time.Duration
+}
+
+// LoadSelfTestSettings reads self-test settings from environment variables
+func LoadSelfTestSettings() (SelfTestSettings, error) {
+	settings := SelfTestSettings{
+		Number:         os.Getenv("SELFTEST_NUMBER"),
+		USSDCode:       os.Getenv("SELFTEST_USSD_CODE"),
+		ReceiveTimeout: 2 * time.Minute,
+	}
+
+	if settings.Number != "" {
+		number, err := NormalizeNumber(settings.Number)
+		if err != nil {
+			return settings, fmt.Errorf("SELFTEST_NUMBER: %w", err)
+		}
+		settings.Number = number
+	}
+
+	if value := os.Getenv("SELFTEST_RECEIVE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 10*time.Second || timeout > 30*time.Minute {
+			return settings, fmt.Errorf("SELFTEST_RECEIVE_TIMEOUT: invalid duration %q (10s to 30m)", value)
+		}
+		settings.ReceiveTimeout = timeout
+	}
+
+	return settings, nil
+}
+
+// runSelfTest runs the self-test against the Arduino (-selftest), prints the
+// report and returns an error if a step failed
+func runSelfTest() error {
+	settings, err := LoadSelfTestSettings()
+	if err != nil {
+		return err
+	}
+	gsm, err := LoadGSMSettings()
+	if err != nil {
+		return err
+	}
+
+	portName, err := DevicePort()
+	if err != nil {
+		return err
+	}
+
+	// Messages arriving during the test are stored as usual, since the
+	// sketch deletes them from the SIM once reported
+	db, err := NewDatabase(DatabasePath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	received := make(chan ReceivedSMS, 16)
+	events := NewEventBus()
+	events.Subscribe(logEvent, EventDeviceConnected, EventDeviceDisconnected, EventGSMState)
+	events.Subscribe(func(event Event) {
+		select {
+		case received <- event.Data.(ReceivedSMS):
+		default:
+		}
+	}, EventMessageReceived)
+	conn, err := NewArduinoConnection(portName, db, gsm, events, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	steps := selfTestSteps(conn, gsm, settings, received)
+
+	fmt.Printf("Self-test of the Arduino on %s\n\n", portName)
+	failed := 0
+	for _, step := range steps {
+		fmt.Printf("%-4s  %-8s  %8s  %s\n", strings.ToUpper(step.Status), step.Name, step.Duration.Round(time.Millisecond), step.Detail)
+		if step.Status == SelfTestFail {
+			failed++
+		}
+	}
+	fmt.Println()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d steps failed", failed, len(steps))
+	}
+	fmt.Println("Self-test passed")
+	return nil
+}
+
+// selfTestSteps runs the self-test steps in order. Steps that depend on an
+// earlier one are skipped when it failed.
+func selfTestSteps(conn *ArduinoConnection, gsm GSMSettings, settings SelfTestSettings, received <-chan ReceivedSMS) []SelfTestStep {
+	var steps []SelfTestStep
+	run := func(name string, test func() (string, error)) bool {
+		started := time.Now()
+		detail, err := test()
+		step := SelfTestStep{Name: name, Status: SelfTestPass, Detail: detail, Duration: time.Since(started)}
+		if err != nil {
+			step.Status = SelfTestFail
+			step.Detail = err.Error()
+		}
+		steps = append(steps, step)
+		return err == nil
+	}
+	skip := func(name, reason string) {
+		steps = append(steps, SelfTestStep{Name: name, Status: SelfTestSkip, Detail: reason})
+	}
+
+	run("ping", func() (string, error) {
+		rtt, err := conn.Ping(selfTestProbeTimeout)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("round trip %s", rtt.Round(time.Millisecond)), nil
+	})
+
+	run("version", func() (string, error) {
+		version, err := conn.SketchVersion(selfTestProbeTimeout)
+		if err != nil {
+			return "", err
+		}
+		if version != sketchProtocolVersion {
+			return "", fmt.Errorf("sketch reports protocol version %d, expected %d", version, sketchProtocolVersion)
+		}
+		return fmt.Sprintf("protocol version %d", version), nil
+	})
+
+	gsmReady := run("wakeup", func() (string, error) {
+		if err := conn.EnsureGSMReady(gsm.ReadyTimeout); err != nil {
+			return "", err
+		}
+		return "GSM connected", nil
+	})
+
+	switch {
+	case settings.Number == "":
+		skip("send", "SELFTEST_NUMBER not set")
+		skip("receive", "SELFTEST_NUMBER not set")
+	case !gsmReady:
+		skip("send", "GSM not ready")
+		skip("receive", "GSM not ready")
+	default:
+		nonce := make([]byte, 4)
+		rand.Read(nonce)
+		content := "Self-test " + hex.EncodeToString(nonce)
+
+		sent := run("send", func() (string, error) {
+			if err := conn.SendSMS(settings.Number, content, SendOptions{}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("sent %q to %s", content, settings.Number), nil
+		})
+
+		if !sent {
+			skip("receive", "send failed")
+			break
+		}
+		run("receive", func() (string, error) {
+			// The sketch only checks for SMS while GSM is connected, and
+			// disconnects it when idle unless it is always on
+			wakeup := time.NewTicker(30 * time.Second)
+			defer wakeup.Stop()
+
+			timeout := time.After(settings.ReceiveTimeout)
+			for {
+				select {
+				case msg := <-received:
+					if strings.Contains(msg.Content, content) {
+						return fmt.Sprintf("received from %s", msg.Number), nil
+					}
+				case <-wakeup.C:
+					conn.Wakeup()
+				case <-timeout:
+					return "", fmt.Errorf("%q not received within %s", content, settings.ReceiveTimeout)
+				}
+			}
+		})
+	}
+
+	switch {
+	case settings.USSDCode == "":
+		skip("ussd", "SELFTEST_USSD_CODE not set")
+	case !gsmReady:
+		skip("ussd", "GSM not ready")
+	default:
+		run("ussd", func() (string, error) {
+			return conn.USSD(settings.USSDCode, time.Minute)
+		})
+	}
+
+	return steps
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotConnected is returned when a send is attempted without a device connection
+var ErrNotConnected = errors.New("not connected to Arduino device")
+
+// SendOptions holds optional per-message send settings
+type SendOptions struct {
+	Class    *int   `json:"class,omitempty"`     // SMS message class 0-3, 0 = flash SMS
+	SenderID string `json:"sender_id,omitempty"` // Alphanumeric sender ID
+	Template string `json:"template,omitempty"`  // Template the content was produced from, for statistics
+	Campaign string `json:"campaign,omitempty"`  // Campaign the send belongs to, for statistics
+	Group    string `json:"group,omitempty"`     // Number group the send rotates across, see numbergroups.go
+	RetryOf  int64  `json:"retry_of,omitempty"`  // Failed sent SMS this send retries, see sentretry.go
+
+	TemplateVersion int `json:"template_version,omitempty"` // Approved version of Template the content is, see templates.go
+
+	Raw            *SerialExchange `json:"-"` // If set, filled with the raw serial lines of the send, see rawserial.go
+	SentID         int64           `json:"-"` // sent_sms record of the send, if already saved, e.g. by an async send
+	ConfirmSpecial bool            `json:"-"` // Client confirmed a send to a short code or premium number, see specialnumbers.go
+}
+
+// GetSenderIDAllowlist returns the sender IDs clients may use, from environment variable
+func GetSenderIDAllowlist() []string {
+	return splitList(os.Getenv("SENDER_ID_ALLOWLIST"))
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// validateSenderID checks that a sender ID is a valid alphanumeric originator
+// (1-11 letters, digits or spaces, at least one letter) and is allowlisted
+func (app *App) validateSenderID(id string) error {
+	if len(id) == 0 || len(id) > 11 {
+		return apiErrorf(CodeInvalidSenderID, "Invalid sender ID (1-11 characters)")
+	}
+
+	hasLetter := false
+	for _, r := range id {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z':
+			hasLetter = true
+		case r >= '0' && r <= '9', r == ' ':
+		default:
+			return apiErrorf(CodeInvalidSenderID, "Invalid sender ID (only letters, digits and spaces allowed)")
+		}
+	}
+	if !hasLetter {
+		return apiErrorf(CodeInvalidSenderID, "Invalid sender ID (must contain a letter)")
+	}
+
+	for _, allowed := range app.senderIDs {
+		if id == allowed {
+			return nil
+		}
+	}
+
+	return apiErrorf(CodeInvalidSenderID, "Sender ID %q is not allowed", id)
+}
+
+// validateSMS checks the number, content and options of an outbound SMS
+func (app *App) validateSMS(number, content string, opts SendOptions) error {
+	// Validate phone number
+	if err := app.numberValidation.Check(number); err != nil {
+		return err
+	}
+
+	// Validate content
+	if len(content) == 0 {
+		return apiErrorf(CodeInvalidContent, "SMS content cannot be empty")
+	}
+
+	// Validate message class
+	if opts.Class != nil && (*opts.Class < 0 || *opts.Class > 3) {
+		return apiErrorf(CodeInvalidRequest, "Invalid message class (must be 0-3)")
+	}
+
+	// Validate sender ID
+	if opts.SenderID != "" {
+		if err := app.validateSenderID(opts.SenderID); err != nil {
+			return err
+		}
+	}
+
+	// Validate statistics labels
+	if err := validateLabels(opts); err != nil {
+		return err
+	}
+
+	// Require approved template text
+	if err := app.validateTemplateVersion(content, opts); err != nil {
+		return err
+	}
+
+	// Validate number group
+	if opts.Group != "" && (app.routing == nil || app.routing.Group(opts.Group) == nil) {
+		return apiErrorf(CodeInvalidRequest, "Unknown number group %q", opts.Group)
+	}
+
+	// Apply the policy for short codes and premium-rate numbers
+	if err := app.specialNumbers.Check(number, opts.ConfirmSpecial); err != nil {
+		return err
+	}
+
+	// Refuse numbers on the block list
+	entry, err := app.blocklist.Check(app.db, number)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return apiErrorf(CodeNumberBlocked, "Number %s is blocked by %s block list entry", number, entry.Source)
+	}
+
+	return nil
+}
+
+// deliverSMS queues an SMS, waits for the dispatcher to send it and records the
+// outcome in the database. If ctx ends before the message is sent it is cancelled.
+// Identical messages within the dedup window are collapsed into one send, and
+// bursts to one number are collapsed into a digest SMS. Sends over the queue
+// limit or the daily quota of keyID fail with a ThrottleError.
+// It returns the ID of the sent_sms record, or 0 if none was saved.
+func (app *App) deliverSMS(ctx context.Context, keyID, number, content string, opts SendOptions) (int64, error) {
+	number = cleanNumber(number)
+	if err := app.checkSendLimits(keyID); err != nil {
+		return 0, err
+	}
+	if app.dedup != nil {
+		return app.deliverDeduplicated(ctx, keyID, number, content, opts)
+	}
+	return app.deliverAggregated(ctx, keyID, number, content, opts)
+}
+
+// deliverSMSNow sends an SMS through the queue without deduplication. Nothing
+// is sent while the service is in read-only or maintenance mode.
+func (app *App) deliverSMSNow(ctx context.Context, keyID, number, content string, opts SendOptions) (int64, error) {
+	if mode := app.runMode.Get(); mode != RunModeNormal {
+		return 0, apiErrorf(runModeErrorCode(mode), "Service is in %s mode", mode)
+	}
+
+	number = cleanNumber(number)
+	// In test mode, numbers outside the allowlist are only simulated
+	if !app.testMode.Allows(number) {
+		log.Printf("[TEST MODE] Simulating SMS to %s: %s", number, content)
+		id, err := app.db.recordSentSMS(opts.SentID, number, content, "simulated", "", "", opts)
+		if err != nil {
+			log.Printf("Failed to save sent SMS to database: %v", err)
+		}
+		app.events.Publish(EventMessageSent, SentEvent{ID: id, Number: number, Content: content, Status: "simulated", KeyID: keyID})
+		return id, nil
+	}
+
+	// Check if connected
+	if !app.smsConn.IsConnected() && (app.routing == nil || !app.routing.IsConnected()) {
+		return 0, ErrNotConnected
+	}
+
+	if app.rawSerial != nil {
+		opts.Raw = &SerialExchange{}
+	}
+
+	// Record the send as queued before queuing it, so that one interrupted
+	// by a crash is found on the next start. The dispatcher marks it sending.
+	// It is saved with its outcome instead if the database can't be written.
+	sentID := opts.SentID
+	if sentID == 0 {
+		var err error
+		sentID, err = app.db.insertSentSMS(number, content, "queued", "", "", opts, time.Now())
+		if err != nil {
+			log.Printf("Failed to save sent SMS to database: %v", err)
+		}
+		opts.SentID = sentID
+	}
+
+	// Queue SMS and wait for the dispatcher to send it
+	item := app.queue.Enqueue(keyID, number, content, opts)
+
+	var err error
+	select {
+	case err = <-item.result:
+	case <-ctx.Done():
+		// Caller went away; drop the message if it has not been sent yet
+		if app.queue.Cancel(item.ID) {
+			log.Printf("Client disconnected, cancelled queued SMS %d", item.ID)
+		}
+		err = <-item.result
+	}
+
+	return app.recordSendOutcome(keyID, number, content, opts, err)
+}
+
+// recordSendOutcome saves the outcome of a queued send to the sent_sms record
+// in opts.SentID, or a new one, and announces it. It returns the ID of the
+// record and err.
+func (app *App) recordSendOutcome(keyID, number, content string, opts SendOptions, err error) (int64, error) {
+	sentID := opts.SentID
+	if errors.Is(err, ErrSendCancelled) {
+		id, _ := app.db.recordSentSMS(sentID, number, content, "cancelled", err.Error(), "", opts)
+		return id, err
+	}
+
+	// Attribute the attempt to the caller's API key
+	if usageErr := app.db.RecordKeyUsage(keyID, err == nil, CountSegments(content)); usageErr != nil {
+		log.Printf("Failed to record key usage: %v", usageErr)
+	}
+
+	if err != nil {
+		// Save failed SMS to database and try the fallback channels
+		id, saveErr := app.db.recordSentSMS(sentID, number, content, "error", err.Error(), ClassifyError(err), opts)
+		if saveErr != nil {
+			log.Printf("Failed to save sent SMS to database: %v", saveErr)
+		} else {
+			app.saveSentSerialPayload(id, opts.Raw)
+			if len(app.fallbacks) > 0 {
+				go app.sendFallback(id, number, content)
+			}
+		}
+		app.events.Publish(EventMessageFailed, SentEvent{ID: id, Number: number, Content: content, Status: "error", Error: err.Error(), ErrorClass: ClassifyError(err), KeyID: keyID})
+		return id, err
+	}
+
+	// Save successful SMS to database
+	id, saveErr := app.db.recordSentSMS(sentID, number, content, "success", "", "", opts)
+	if saveErr != nil {
+		log.Printf("Failed to save sent SMS to database: %v", saveErr)
+	} else {
+		app.saveSentSerialPayload(id, opts.Raw)
+	}
+	app.events.Publish(EventMessageSent, SentEvent{ID: id, Number: number, Content: content, Status: "success", KeyID: keyID})
+
+	return id, nil
+}
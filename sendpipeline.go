@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Backoff after the Arduino reports it can't queue another send
+const (
+	minBusyBackoff = time.Second
+	maxBusyBackoff = 30 * time.Second
+)
+
+// registerSend allocates a sequence number for a send and the channel its result is delivered on
+func (a *ArduinoConnection) registerSend() (int, chan SerialResponse) {
+	a.gsmMu.Lock()
+	defer a.gsmMu.Unlock()
+
+	a.sendSeq++
+	result := make(chan SerialResponse, 1)
+	a.sendPending[a.sendSeq] = result
+	return a.sendSeq, result
+}
+
+// takeSendResult returns the result channel of a send, or nil if the send
+// isn't pending. Unless keep is set the send is no longer pending afterwards.
+// Sketches without sequence numbers report seq 0, which is matched to the
+// oldest pending send.
+func (a *ArduinoConnection) takeSendResult(seq int, keep bool) chan SerialResponse {
+	a.gsmMu.Lock()
+	defer a.gsmMu.Unlock()
+
+	if seq == 0 {
+		for pending := range a.sendPending {
+			if seq == 0 || pending < seq {
+				seq = pending
+			}
+		}
+	}
+
+	result := a.sendPending[seq]
+	if !keep {
+		delete(a.sendPending, seq)
+	}
+	return result
+}
+
+// waitWhileBusy blocks until the backoff after a busy signal has passed
+func (a *ArduinoConnection) waitWhileBusy() {
+	a.gsmMu.RLock()
+	wait := time.Until(a.busyUntil)
+	a.gsmMu.RUnlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// backOffBusy delays further sends, doubling the backoff on each busy signal in a row
+func (a *ArduinoConnection) backOffBusy() {
+	a.gsmMu.Lock()
+	defer a.gsmMu.Unlock()
+
+	if a.busyBackoff == 0 {
+		a.busyBackoff = minBusyBackoff
+	} else if a.busyBackoff < maxBusyBackoff {
+		a.busyBackoff = min(a.busyBackoff*2, maxBusyBackoff)
+	}
+	if until := time.Now().Add(a.busyBackoff); until.After(a.busyUntil) {
+		a.busyUntil = until
+	}
+	log.Printf("Arduino busy, backing off sends for %v", a.busyBackoff)
+}
+
+// clearBusy resets the backoff once the Arduino accepts sends again
+func (a *ArduinoConnection) clearBusy() {
+	a.gsmMu.Lock()
+	a.busyBackoff = 0
+	a.gsmMu.Unlock()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// retrySentSMS sends a failed SMS again as a new sent SMS linked to the
+// failed one by its retry_of
+func (app *App) retrySentSMS(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	msg, err := app.db.GetSentSMSByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+	if msg == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+	if msg.Status != "error" {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Message %d has status %s, only failed sends can be retried", id, msg.Status))
+		return
+	}
+
+	// The original send passed the special number policy, confirmed if needed,
+	// but the block list may have changed since
+	opts := SendOptions{Template: msg.Template, TemplateVersion: msg.TemplateVersion, Campaign: msg.Campaign,
+		RetryOf: int64(msg.ID), ConfirmSpecial: true}
+	if err := app.validateSMS(msg.Number, msg.Content, opts); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
+		return
+	}
+
+	// Sent right away: an operator's retry is not deduplicated or aggregated
+	retryID, err := app.deliverSMSNow(c.Request.Context(), keyIDFromContext(c), msg.Number, msg.Content, opts)
+	if err != nil {
+		log.Printf("Retry of SMS %d to %s failed: %v", msg.ID, msg.Number, err)
+		status, resp := sendErrorResponse(c, err)
+		resp.ID = retryID
+		c.JSON(status, resp)
+		return
+	}
+
+	log.Printf("Retried SMS %d to %s as SMS %d", msg.ID, msg.Number, retryID)
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("SMS %d retried as SMS %d", msg.ID, retryID),
+		ID:      retryID,
+	})
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.bug.st/serial"
@@ -15,9 +18,15 @@ import (
 
 // SerialCommand represents a command to send to Arduino
 type SerialCommand struct {
-	Cmd     string `json:"cmd"`
-	Number  string `json:"number,omitempty"`
-	Content string `json:"content,omitempty"`
+	Cmd      string `json:"cmd"`
+	Number   string `json:"number,omitempty"`
+	Content  string `json:"content,omitempty"`
+	Class    *int   `json:"class,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+	Seq      int    `json:"seq,omitempty"` // Matches a send to its result
+	Protocol string `json:"protocol,omitempty"`
 }
 
 // SerialResponse represents a response from Arduino
@@ -29,23 +38,74 @@ type SerialResponse struct {
 	Content string `json:"content,omitempty"`
 	Time    string `json:"timestamp,omitempty"`
 	GSM     string `json:"gsm,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Seq     int    `json:"seq,omitempty"`
+
+	Protocol string `json:"protocol,omitempty"` // Protocol confirmed by a hello event
+	Version  int    `json:"version,omitempty"`  // Sketch protocol version, reported when ready
+
+	// Modem status event fields
+	RSSI         *int   `json:"rssi,omitempty"`
+	Registration string `json:"registration,omitempty"`
+	SIM          string `json:"sim,omitempty"`
+
+	Raw string `json:"-"` // The line the response was parsed from
+}
+
+// ModemStatus holds the last signal, registration and SIM state reported by the modem
+type ModemStatus struct {
+	RSSI         *int      `json:"rssi_dbm"`         // signal strength, nil if unknown
+	Registration string    `json:"registration"`     // home, roaming, searching, denied, not_registered or unknown
+	SIM          string    `json:"sim"`              // ready, locked, absent or unknown
+	Number       string    `json:"number,omitempty"` // the SIM's own number, if stored on the SIM
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
+// modemStatusInterval is how often the modem status is polled while GSM is connected
+const modemStatusInterval = time.Minute
+
 // ArduinoConnection manages the serial connection to Arduino
 type ArduinoConnection struct {
-	port       serial.Port
-	portName   string
-	mu         sync.Mutex
-	db         *Database
-	connected  bool
-	stopChan   chan bool
-	onReceived func(number, content string, timestamp time.Time)
+	port      serial.Port
+	portName  string
+	mu        sync.Mutex
+	db        *Database
+	connected bool
+	stopChan  chan bool
+	events    *EventBus
+	monitor   *SerialMonitor
+	gsm       GSMSettings
 
 	gsmReady   bool
 	gsmMu      sync.RWMutex
 	gsmWaiters []chan bool
+
+	ussdMu     sync.Mutex // serializes USSD sessions
+	ussdResult chan SerialResponse
+
+	sendSlots   chan struct{}               // limits sends in flight to the pipeline depth
+	sendSeq     int                         // guarded by gsmMu
+	sendPending map[int]chan SerialResponse // results awaited by seq, guarded by gsmMu
+	busyUntil   time.Time                   // no sends before this after a busy signal, guarded by gsmMu
+	busyBackoff time.Duration               // guarded by gsmMu
+
+	flashMu sync.Mutex // held while flashing, see flash.go
+
+	timeMu     sync.Mutex // serializes network time requests
+	timeResult chan SerialResponse
+
+	probeMu     sync.Mutex // serializes ping and version requests
+	probeResult chan SerialResponse
+
+	writes chan serialWrite // commands for the writer goroutine, see serialwriter.go
+	cbor   atomic.Bool      // commands are sent as CBOR frames, see cbor.go
+
+	modemStatus ModemStatus // guarded by gsmMu
 }
 
+// sendResultTimeout is how long to wait for the modem to report a send result
+const sendResultTimeout = 3*time.Minute + 30*time.Second
+
 // DiscoverArduino attempts to find the Arduino device on available serial ports
 func DiscoverArduino() (string, error) {
 	ports, err := serial.GetPortsList()
@@ -57,6 +117,12 @@ func DiscoverArduino() (string, error) {
 		return "", fmt.Errorf("no serial ports found")
 	}
 
+	// On Windows only USB ports are probed, see discovery_windows.go
+	ports = discoveryCandidates(ports)
+	if len(ports) == 0 {
+		return "", fmt.Errorf("no USB serial ports found")
+	}
+
 	// Common Arduino port patterns
 	arduinoPatterns := []string{
 		"/dev/ttyACM",  // Linux Arduino
@@ -91,6 +157,46 @@ func DiscoverArduino() (string, error) {
 	return "", fmt.Errorf("no Arduino device found on available ports: %v", ports)
 }
 
+// DevicePort returns the serial port set by DEVICE_MODE, discovering it in
+// auto mode. It fails in mock mode, for commands that need a real device.
+func DevicePort() (string, error) {
+	switch mode := GetDeviceMode(); mode {
+	case "mock":
+		return "", fmt.Errorf("DEVICE_MODE is mock; an Arduino is required")
+	case "auto":
+		return DiscoverArduino()
+	default:
+		return mode, nil
+	}
+}
+
+// OpenDevice connects to the device set by DEVICE_MODE: the mock connection,
+// the discovered Arduino in auto mode or the Arduino on the given port
+func OpenDevice(mode string, db *Database, gsm GSMSettings, events *EventBus, monitor *SerialMonitor) (SMSConnection, error) {
+	if mode == "mock" {
+		log.Println("Using mock serial connection")
+		return NewMockSerialConnection("/dev/ttyACM0"), nil
+	}
+
+	portName := mode
+	if mode == "auto" {
+		log.Println("Auto-discovering Arduino device...")
+		discoveredPort, err := DiscoverArduino()
+		if err != nil {
+			return nil, fmt.Errorf("Arduino discovery failed: %w", err)
+		}
+		portName = discoveredPort
+	}
+
+	arduinoConn, err := NewArduinoConnection(portName, db, gsm, events, monitor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Arduino on %s: %w", portName, err)
+	}
+	log.Printf("Successfully connected to Arduino on %s", portName)
+
+	return arduinoConn, nil
+}
+
 // testSerialPort attempts to open and test a serial port
 func testSerialPort(portName string) bool {
 	mode := &serial.Mode{
@@ -129,8 +235,10 @@ func testSerialPort(portName string) bool {
 	return true
 }
 
-// NewArduinoConnection creates a new connection to Arduino
-func NewArduinoConnection(portName string, db *Database) (*ArduinoConnection, error) {
+// NewArduinoConnection creates a new connection to Arduino.
+// Received SMS, connection and GSM state changes are published on events.
+// monitor, if not nil, counts the lines read and parse failures.
+func NewArduinoConnection(portName string, db *Database, gsm GSMSettings, events *EventBus, monitor *SerialMonitor) (*ArduinoConnection, error) {
 	mode := &serial.Mode{
 		BaudRate: 115200,
 		DataBits: 8,
@@ -156,76 +264,148 @@ func NewArduinoConnection(portName string, db *Database) (*ArduinoConnection, er
 		db:        db,
 		connected: true,
 		stopChan:  make(chan bool),
+		events:    events,
+		monitor:   monitor,
+		gsm:       gsm,
+		writes:    make(chan serialWrite, serialWriteQueueSize),
+
+		sendSlots:   make(chan struct{}, gsm.SendPipeline),
+		sendPending: make(map[int]chan SerialResponse),
 	}
 
-	// Wait for Arduino to initialize
-	time.Sleep(2 * time.Second)
+	// Opening the port resets the Arduino; wait for it to initialize
+	time.Sleep(gsm.OpenDelay)
 
-	// Start reading incoming messages
-	go conn.readLoop()
+	// Start reading incoming messages and writing commands
+	go conn.supervise("readLoop", true, conn.readLoop)
+	go conn.supervise("writeLoop", true, conn.writeLoop)
 
 	// Start periodic wakeup to check for received SMS
 	go conn.periodicWakeup()
 
-	log.Printf("Connected to Arduino on %s", portName)
+	// Start polling signal and registration state for metrics
+	go conn.pollModemStatus()
+
+	// The Arduino may still be starting; it reports ready and is set up again then
+	go conn.setup()
+
+	events.Publish(EventDeviceConnected, DeviceConnectionEvent{Port: portName})
 
 	return conn, nil
 }
 
-// readLoop continuously reads from the serial port
+// readLoop continuously reads from the serial port. The Arduino sends JSON
+// lines, and CBOR frames once that protocol is negotiated (see cbor.go).
 func (a *ArduinoConnection) readLoop() {
 	buf := make([]byte, 256)
 	var lineBuf []byte
+	discarding := false      // skipping the rest of an oversized line
+	var frameSince time.Time // when the incomplete frame at the start of lineBuf was first seen
 
 	for {
 		select {
 		case <-a.stopChan:
 			return
 		default:
-			n, err := a.port.Read(buf)
+			n, err := a.currentPort().Read(buf)
 			if err != nil {
 				if !strings.Contains(err.Error(), "timeout") {
-					if a.connected {
+					if a.IsConnected() {
 						log.Printf("Error reading from serial: %v", err)
+						a.handleDisconnect(err)
+					} else {
+						// The port is closed, e.g. while flashing
+						time.Sleep(100 * time.Millisecond)
 					}
 				}
 				continue
 			}
-			if n == 0 {
-				// Timeout with no data — this is normal, just loop
-				continue
-			}
 
+			// Timeouts with no data are normal; they still expire incomplete frames
 			lineBuf = append(lineBuf, buf[:n]...)
 
-			// Process complete lines
-			for {
-				idx := bytes.IndexByte(lineBuf, '\n')
-				if idx < 0 {
+			// Process complete frames and lines
+			for len(lineBuf) > 0 {
+				if lineBuf[0] == cborFrameStart {
+					discarding = false
+					if len(lineBuf) >= 3 {
+						length := int(binary.BigEndian.Uint16(lineBuf[1:3]))
+						if length > maxSerialLineLength {
+							// Corrupted header; resynchronize at the next byte
+							log.Printf("Discarding serial frame of %d bytes", length)
+							a.monitor.RecordOversized()
+							lineBuf = lineBuf[1:]
+							continue
+						}
+						if len(lineBuf) >= 3+length {
+							payload := lineBuf[3 : 3+length]
+							lineBuf = lineBuf[3+length:]
+							frameSince = time.Time{}
+							a.handleFrame(payload)
+							continue
+						}
+					}
+
+					// Wait for the rest of the frame, unless it never arrives
+					if frameSince.IsZero() {
+						frameSince = time.Now()
+					} else if time.Since(frameSince) > serialFrameTimeout {
+						log.Printf("Discarding incomplete serial frame")
+						a.monitor.RecordParseFailure()
+						lineBuf = lineBuf[1:]
+						frameSince = time.Time{}
+						continue
+					}
 					break
 				}
-				line := strings.TrimSpace(string(lineBuf[:idx]))
-				lineBuf = lineBuf[idx+1:]
 
+				// A line ends at a newline, or early where a frame starts
+				end := bytes.IndexByte(lineBuf, '\n')
+				next := end + 1
+				if start := bytes.IndexByte(lineBuf, cborFrameStart); start >= 0 && (end < 0 || start < end) {
+					end, next = start, start
+				}
+				if end < 0 {
+					break
+				}
+				line := strings.TrimSpace(string(lineBuf[:end]))
+				lineBuf = lineBuf[next:]
+
+				// The end of an oversized line resynchronizes the stream
+				if discarding {
+					discarding = false
+					continue
+				}
 				if line == "" {
 					continue
 				}
 				a.handleResponse(line)
 			}
+
+			// A lost newline would otherwise grow the buffer without bound;
+			// drop the partial line and skip to the next newline
+			if len(lineBuf) > maxSerialLineLength && lineBuf[0] != cborFrameStart {
+				if !discarding {
+					log.Printf("Discarding serial line longer than %d bytes", maxSerialLineLength)
+					a.monitor.RecordOversized()
+					discarding = true
+				}
+				lineBuf = lineBuf[:0]
+			}
 		}
 	}
 }
 
 // periodicWakeup wakes GSM once per hour to check for received SMS
 func (a *ArduinoConnection) periodicWakeup() {
-	ticker := time.NewTicker(1 * time.Hour)
+	ticker := clock.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-a.stopChan:
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			if !a.IsGSMReady() {
 				log.Println("Periodic wakeup: connecting GSM to check for received SMS")
 				if err := a.Wakeup(); err != nil {
@@ -236,20 +416,69 @@ func (a *ArduinoConnection) periodicWakeup() {
 	}
 }
 
+// pollModemStatus requests the modem status every modemStatusInterval. GSM is
+// not woken up for it, so the status is only refreshed while GSM is connected.
+func (a *ArduinoConnection) pollModemStatus() {
+	ticker := clock.NewTicker(modemStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stopChan:
+			return
+		case <-ticker.C():
+			if !a.IsGSMReady() {
+				continue
+			}
+			if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: "modem"}); err != nil {
+				log.Printf("Failed to request modem status: %v", err)
+			}
+		}
+	}
+}
+
+// OwnNumber returns the SIM's own number, as configured with OWN_NUMBER or
+// else as reported by the modem, and where it came from (configured or sim).
+// It returns empty strings while the number is unknown.
+func (a *ArduinoConnection) OwnNumber() (string, string) {
+	if a.gsm.OwnNumber != "" {
+		return a.gsm.OwnNumber, OwnNumberConfigured
+	}
+
+	if number := a.ModemStatus().Number; number != "" {
+		if normalized, err := NormalizeNumber(number); err == nil {
+			return normalized, OwnNumberSIM
+		}
+		return number, OwnNumberSIM
+	}
+
+	return "", ""
+}
+
+// ModemStatus returns the last modem status reported by the Arduino
+func (a *ArduinoConnection) ModemStatus() ModemStatus {
+	a.gsmMu.RLock()
+	defer a.gsmMu.RUnlock()
+	return a.modemStatus
+}
+
+// SerialStats returns the counters of lines read from the Arduino
+func (a *ArduinoConnection) SerialStats() SerialStats {
+	return a.monitor.Stats()
+}
+
 // updateGSMState updates the GSM ready state and notifies waiters
 func (a *ArduinoConnection) updateGSMState(state string) {
 	a.gsmMu.Lock()
-	defer a.gsmMu.Unlock()
 
 	wasReady := a.gsmReady
 	a.gsmReady = (state == "connected")
 
 	if a.gsmReady == wasReady {
+		a.gsmMu.Unlock()
 		return
 	}
 
-	log.Printf("GSM state changed: %s", state)
-
 	if a.gsmReady {
 		// Notify all waiters
 		for _, ch := range a.gsmWaiters {
@@ -260,6 +489,11 @@ func (a *ArduinoConnection) updateGSMState(state string) {
 		}
 		a.gsmWaiters = nil
 	}
+	ready := a.gsmReady
+	a.gsmMu.Unlock()
+
+	// Published outside the lock so sinks can read the connection state
+	a.events.Publish(EventGSMState, GSMStateEvent{Port: a.portName, State: state, Ready: ready})
 }
 
 // IsGSMReady returns whether the GSM module is connected
@@ -291,15 +525,7 @@ func (a *ArduinoConnection) WaitForGSM(timeout time.Duration) bool {
 
 // Wakeup sends a wakeup command to the Arduino
 func (a *ArduinoConnection) Wakeup() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if !a.connected {
-		return fmt.Errorf("not connected to Arduino")
-	}
-
-	_, err := a.port.Write([]byte("{\"cmd\":\"wakeup\"}\n"))
-	if err != nil {
+	if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: "wakeup"}); err != nil {
 		return fmt.Errorf("failed to send wakeup command: %w", err)
 	}
 
@@ -307,6 +533,20 @@ func (a *ArduinoConnection) Wakeup() error {
 	return nil
 }
 
+// setup negotiates the serial protocol and sets the power mode of the Arduino
+func (a *ArduinoConnection) setup() {
+	a.negotiateProtocol()
+	a.setPowerMode()
+}
+
+// setPowerMode tells the Arduino the configured wake strategy. The sketch
+// forgets it on restart, so it is sent again whenever the Arduino is ready.
+func (a *ArduinoConnection) setPowerMode() {
+	if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: "power", Mode: a.gsm.WakeStrategy}); err != nil {
+		log.Printf("Failed to set GSM power mode: %v", err)
+	}
+}
+
 // EnsureGSMReady wakes GSM if needed and waits for it to become ready
 func (a *ArduinoConnection) EnsureGSMReady(timeout time.Duration) error {
 	if a.IsGSMReady() {
@@ -329,10 +569,23 @@ func (a *ArduinoConnection) handleResponse(line string) {
 	var response SerialResponse
 
 	err := json.Unmarshal([]byte(line), &response)
+	recovered := false
 	if err != nil {
-		log.Printf("Failed to parse Arduino response: %s (error: %v)", line, err)
-		return
+		// Noise (e.g. from a reset) may precede a response on the same line;
+		// retry from the first brace
+		response = SerialResponse{}
+		if idx := strings.IndexByte(line, '{'); idx > 0 && json.Unmarshal([]byte(line[idx:]), &response) == nil {
+			log.Printf("Recovered Arduino response after skipping %d bytes: %q", idx, line[:idx])
+			line = line[idx:]
+			recovered = true
+		} else {
+			log.Printf("Failed to parse Arduino response: %s (error: %v)", line, err)
+			a.monitor.RecordParseFailure()
+			return
+		}
 	}
+	a.monitor.RecordLine(recovered)
+	response.Raw = line
 
 	// Update GSM state from every response
 	if response.GSM != "" {
@@ -345,13 +598,78 @@ func (a *ArduinoConnection) handleResponse(line string) {
 		// Already handled above via GSM field
 		log.Printf("GSM state event: %s", response.GSM)
 
+	case response.Event == "ussd":
+		a.gsmMu.Lock()
+		result := a.ussdResult
+		a.ussdResult = nil
+		a.gsmMu.Unlock()
+
+		if result != nil {
+			result <- response
+		} else {
+			log.Printf("Unexpected USSD response: %s", response.Message)
+		}
+
+	case response.Event == "sent":
+		// A busy send is written again and stays pending
+		result := a.takeSendResult(response.Seq, response.Status == "busy")
+
+		if result != nil {
+			result <- response
+		} else {
+			log.Printf("Unexpected send result: %s", response.Message)
+		}
+
+	case response.Event == "time":
+		a.gsmMu.Lock()
+		result := a.timeResult
+		a.timeResult = nil
+		a.gsmMu.Unlock()
+
+		if result != nil {
+			result <- response
+		} else {
+			log.Printf("Unexpected network time: %s", response.Message)
+		}
+
+	case response.Event == "modem":
+		a.gsmMu.Lock()
+		// The number can't be read while GSM is disconnected; keep the last one
+		number := response.Number
+		if number == "" && response.SIM != "absent" {
+			number = a.modemStatus.Number
+		}
+		a.modemStatus = ModemStatus{
+			RSSI:         response.RSSI,
+			Registration: response.Registration,
+			SIM:          response.SIM,
+			Number:       number,
+			UpdatedAt:    time.Now().UTC(),
+		}
+		a.gsmMu.Unlock()
+
 	case response.Event == "received":
 		// Received SMS from Arduino
 		log.Printf("Received SMS from %s: %s", response.Number, response.Content)
 		a.handleReceivedSMS(response)
 
 	case response.Status == "ready":
-		log.Printf("Arduino ready: %s", response.Message)
+		log.Printf("Arduino ready: %s (protocol version %d)", response.Message, response.Version)
+		if response.Version != sketchProtocolVersion {
+			log.Printf("Arduino sketch reports protocol version %d, expected %d; flash the bundled sketch to update it", response.Version, sketchProtocolVersion)
+		}
+		// A restarted sketch is back on JSON
+		a.cbor.Store(false)
+		go a.setup()
+
+	case response.Event == "version":
+		if !a.deliverProbe(response) {
+			log.Printf("Arduino protocol version: %d", response.Version)
+		}
+
+	case response.Event == "hello":
+		a.cbor.Store(response.Protocol == SerialProtocolCBOR)
+		log.Printf("Serial protocol: %s", response.Protocol)
 
 	case response.Status == "info":
 		log.Printf("Arduino info: %s", response.Message)
@@ -360,7 +678,9 @@ func (a *ArduinoConnection) handleResponse(line string) {
 		log.Printf("Arduino error: %s", response.Message)
 
 	case response.Status == "ok":
-		log.Printf("Arduino response: %s", response.Message)
+		if response.Message != "pong" || !a.deliverProbe(response) {
+			log.Printf("Arduino response: %s", response.Message)
+		}
 
 	default:
 		log.Printf("Unknown Arduino message: %s", line)
@@ -369,89 +689,227 @@ func (a *ArduinoConnection) handleResponse(line string) {
 
 // handleReceivedSMS processes a received SMS and stores it in the database
 func (a *ArduinoConnection) handleReceivedSMS(response SerialResponse) {
-	// Parse timestamp or use current time
-	timestamp := time.Now()
+	// The Arduino has no clock, so messages are stamped with the (network
+	// corrected) time of arrival
+	timestamp := clockNow()
+
+	msg := ReceivedSMS{
+		Number:    response.Number,
+		Content:   response.Content,
+		Timestamp: timestamp,
+		CreatedAt: timestamp.UTC(),
+
+		ConversationID: ConversationID(response.Number),
+		NumberClass:    ClassifyNumber(response.Number),
+		Encoding:       DetectEncoding(response.Content),
+		Raw:            response.Raw,
+	}
 
 	// Store in database
 	if a.db != nil {
-		err := a.db.SaveReceivedSMS(response.Number, response.Content, timestamp)
+		msg.DeviceNumber, _ = a.OwnNumber()
+		id, err := a.db.SaveReceivedSMS(response.Number, response.Content, msg.DeviceNumber, timestamp)
 		if err != nil {
 			log.Printf("Failed to save received SMS: %v", err)
 		} else {
+			msg.ID = int(id)
 			log.Printf("Saved SMS from %s to database", response.Number)
 		}
 	}
 
-	// Call callback if set
-	if a.onReceived != nil {
-		a.onReceived(response.Number, response.Content, timestamp)
-	}
+	a.events.Publish(EventMessageReceived, msg)
 }
 
-// SendSMS sends an SMS via the Arduino
-func (a *ArduinoConnection) SendSMS(number, content string) error {
+// SendSMS sends an SMS via the Arduino and waits for the modem's result.
+// Up to the pipeline depth of sends may be in flight at once; each is
+// matched to its result by sequence number. A send the Arduino reports
+// busy is written again after a backoff.
+func (a *ArduinoConnection) SendSMS(number, content string, opts SendOptions) error {
 	// Ensure GSM is ready before sending
-	if err := a.EnsureGSMReady(30 * time.Second); err != nil {
+	if err := a.EnsureGSMReady(a.gsm.ReadyTimeout); err != nil {
 		return fmt.Errorf("GSM not ready: %w", err)
 	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.sendSlots <- struct{}{}
+	defer func() { <-a.sendSlots }()
 
-	if !a.connected {
-		return fmt.Errorf("not connected to Arduino")
-	}
+	seq, result := a.registerSend()
+	defer a.takeSendResult(seq, false)
 
 	cmd := SerialCommand{
 		Cmd:     "send",
 		Number:  number,
 		Content: content,
+		Class:   opts.Class,
+		Sender:  opts.SenderID,
+		Seq:     seq,
 	}
 
-	data, err := json.Marshal(cmd)
-	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
-	}
+	// The modem may take up to 3 minutes to confirm submission to the
+	// network, for this and for each send the Arduino queued before it
+	timeout := sendResultTimeout * time.Duration(cap(a.sendSlots))
+	deadline := time.After(timeout)
 
-	// Add newline terminator
-	data = append(data, '\n')
+	for {
+		a.waitWhileBusy()
 
-	// Write to serial port
-	_, err = a.port.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write to serial port: %w", err)
+		line, err := a.writeCommand(context.Background(), cmd)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Sent command to Arduino: %s", line)
+		if opts.Raw != nil {
+			opts.Raw.Command = line
+		}
+
+		select {
+		case response := <-result:
+			if response.Status == "busy" {
+				a.backOffBusy()
+				continue
+			}
+			a.clearBusy()
+
+			if opts.Raw != nil {
+				opts.Raw.Result = response.Raw
+			}
+			if response.Status == "error" {
+				return &ModemError{Message: response.Message, Code: response.Code}
+			}
+			return nil
+		case <-deadline:
+			return fmt.Errorf("no send result within %v", timeout)
+		}
 	}
+}
 
-	log.Printf("Sent command to Arduino: %s", string(data))
+// USSD runs a USSD code (e.g. "*100#" for a balance check) and returns the network's reply
+func (a *ArduinoConnection) USSD(code string, timeout time.Duration) (string, error) {
+	if err := a.EnsureGSMReady(a.gsm.ReadyTimeout); err != nil {
+		return "", fmt.Errorf("GSM not ready: %w", err)
+	}
 
-	// Wait a bit for Arduino to process
-	time.Sleep(100 * time.Millisecond)
+	a.ussdMu.Lock()
+	defer a.ussdMu.Unlock()
 
-	return nil
+	result := make(chan SerialResponse, 1)
+	a.gsmMu.Lock()
+	a.ussdResult = result
+	a.gsmMu.Unlock()
+
+	defer func() {
+		a.gsmMu.Lock()
+		a.ussdResult = nil
+		a.gsmMu.Unlock()
+	}()
+
+	if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: "ussd", Code: code}); err != nil {
+		return "", err
+	}
+
+	log.Printf("Sent USSD %s to Arduino", code)
+
+	select {
+	case response := <-result:
+		if response.Status == "error" {
+			return "", fmt.Errorf("USSD failed: %s", response.Message)
+		}
+		return response.Message, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("no USSD response within %v", timeout)
+	}
 }
 
-// Ping sends a ping command to Arduino
-func (a *ArduinoConnection) Ping() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// NetworkTime reads the modem clock, which the modem sets from the network's time
+func (a *ArduinoConnection) NetworkTime(timeout time.Duration) (time.Time, error) {
+	a.timeMu.Lock()
+	defer a.timeMu.Unlock()
 
-	cmd := SerialCommand{
-		Cmd: "ping",
+	result := make(chan SerialResponse, 1)
+	a.gsmMu.Lock()
+	a.timeResult = result
+	a.gsmMu.Unlock()
+
+	defer func() {
+		a.gsmMu.Lock()
+		a.timeResult = nil
+		a.gsmMu.Unlock()
+	}()
+
+	if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: "time"}); err != nil {
+		return time.Time{}, err
 	}
 
-	data, err := json.Marshal(cmd)
-	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
+	select {
+	case response := <-result:
+		if response.Status == "error" {
+			return time.Time{}, fmt.Errorf("network time failed: %s", response.Message)
+		}
+		return parseModemClock(response.Message)
+	case <-time.After(timeout):
+		return time.Time{}, fmt.Errorf("no network time within %v", timeout)
 	}
+}
 
-	data = append(data, '\n')
+// Ping sends a ping command to Arduino and returns the round trip time
+func (a *ArduinoConnection) Ping(timeout time.Duration) (time.Duration, error) {
+	started := time.Now()
+	if _, err := a.probe("ping", timeout); err != nil {
+		return 0, err
+	}
+	return time.Since(started), nil
+}
 
-	_, err = a.port.Write(data)
+// SketchVersion asks the sketch for its protocol version
+func (a *ArduinoConnection) SketchVersion(timeout time.Duration) (int, error) {
+	response, err := a.probe("version", timeout)
 	if err != nil {
-		return fmt.Errorf("failed to write to serial port: %w", err)
+		return 0, err
 	}
+	return response.Version, nil
+}
 
-	return nil
+// probe writes a ping or version command and waits for its reply
+func (a *ArduinoConnection) probe(cmd string, timeout time.Duration) (SerialResponse, error) {
+	a.probeMu.Lock()
+	defer a.probeMu.Unlock()
+
+	result := make(chan SerialResponse, 1)
+	a.gsmMu.Lock()
+	a.probeResult = result
+	a.gsmMu.Unlock()
+
+	defer func() {
+		a.gsmMu.Lock()
+		a.probeResult = nil
+		a.gsmMu.Unlock()
+	}()
+
+	if _, err := a.writeCommand(context.Background(), SerialCommand{Cmd: cmd}); err != nil {
+		return SerialResponse{}, err
+	}
+
+	select {
+	case response := <-result:
+		return response, nil
+	case <-time.After(timeout):
+		return SerialResponse{}, fmt.Errorf("no reply to %s within %v", cmd, timeout)
+	}
+}
+
+// deliverProbe passes a ping or version reply to the waiting probe, if any
+func (a *ArduinoConnection) deliverProbe(response SerialResponse) bool {
+	a.gsmMu.Lock()
+	result := a.probeResult
+	a.probeResult = nil
+	a.gsmMu.Unlock()
+
+	if result == nil {
+		return false
+	}
+	result <- response
+	return true
 }
 
 // Close closes the serial connection
@@ -469,6 +927,13 @@ func (a *ArduinoConnection) Close() error {
 	return nil
 }
 
+// currentPort returns the serial port, which is replaced when reopened after flashing
+func (a *ArduinoConnection) currentPort() serial.Port {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.port
+}
+
 // IsConnected returns the connection status
 func (a *ArduinoConnection) IsConnected() bool {
 	a.mu.Lock()
@@ -487,12 +952,51 @@ func NewMockSerialConnection(port string) *MockSerialConnection {
 }
 
 // SendSMS simulates sending SMS
-func (m *MockSerialConnection) SendSMS(number, content string) error {
-	log.Printf("[MOCK] Sending SMS to %s: %s", number, content)
+func (m *MockSerialConnection) SendSMS(number, content string, opts SendOptions) error {
+	if opts.Class != nil {
+		log.Printf("[MOCK] Sending class %d SMS to %s: %s", *opts.Class, number, content)
+	} else {
+		log.Printf("[MOCK] Sending SMS to %s: %s", number, content)
+	}
+	if opts.SenderID != "" {
+		log.Printf("[MOCK] Using sender ID %s", opts.SenderID)
+	}
+	if opts.Raw != nil {
+		data, _ := json.Marshal(SerialCommand{Cmd: "send", Number: number, Content: content, Class: opts.Class, Sender: opts.SenderID})
+		opts.Raw.Command = string(data)
+		opts.Raw.Result = fmt.Sprintf(`{"event":"sent","status":"ok","message":"SMS sent to %s"}`, number)
+	}
 	time.Sleep(100 * time.Millisecond)
 	return nil
 }
 
+// USSD simulates a balance check
+func (m *MockSerialConnection) USSD(code string, timeout time.Duration) (string, error) {
+	log.Printf("[MOCK] USSD %s", code)
+	return "Your balance is 10.00 EUR", nil
+}
+
+// ModemStatus returns a fixed, healthy modem status
+func (m *MockSerialConnection) ModemStatus() ModemStatus {
+	rssi := -71
+	return ModemStatus{RSSI: &rssi, Registration: "home", SIM: "ready", UpdatedAt: time.Now().UTC()}
+}
+
+// OwnNumber is unknown for mock
+func (m *MockSerialConnection) OwnNumber() (string, string) {
+	return "", ""
+}
+
+// SerialStats returns no line counters for mock
+func (m *MockSerialConnection) SerialStats() SerialStats {
+	return SerialStats{}
+}
+
+// NetworkTime returns the clock for mock
+func (m *MockSerialConnection) NetworkTime(timeout time.Duration) (time.Time, error) {
+	return clock.Now(), nil
+}
+
 // Close closes the mock connection
 func (m *MockSerialConnection) Close() error {
 	return nil
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Serial line limits. Lines longer than maxSerialLineLength can't be valid
+// responses (the sketch buffers at most a few hundred bytes per command) and
+// usually mean the newline was lost to noise.
+const (
+	maxSerialLineLength = 4096
+	corruptionWindow    = 10 * time.Minute
+	corruptionMinFailed = 3 // failures needed in a window before its rate counts
+)
+
+// SerialStats counts the lines read from the Arduino since startup
+type SerialStats struct {
+	Lines         int64 `json:"lines"`
+	ParseFailures int64 `json:"parse_failures"` // lines that were not a valid response
+	Oversized     int64 `json:"oversized"`      // lines discarded for exceeding the length limit
+	Recovered     int64 `json:"recovered"`      // responses parsed after skipping leading garbage
+}
+
+// CorruptionEvent reports a corruption window whose failure rate exceeded the threshold
+type CorruptionEvent struct {
+	Lines     int     `json:"lines"`
+	Failures  int     `json:"failures"`
+	Rate      float64 `json:"rate"`
+	Threshold float64 `json:"threshold"`
+	Window    string  `json:"window"`
+}
+
+// SerialMonitor counts serial lines and parse failures, and reports when
+// the share of corrupted lines in a window exceeds a threshold
+type SerialMonitor struct {
+	threshold    float64
+	onCorruption func(event CorruptionEvent)
+
+	mu             sync.Mutex
+	stats          SerialStats
+	windowStart    time.Time
+	windowLines    int
+	windowFailures int
+}
+
+// LoadSerialCorruptionThreshold reads the share of corrupted serial lines
+// that triggers a corruption event from environment variable (default 0.1)
+func LoadSerialCorruptionThreshold() (float64, error) {
+	value := os.Getenv("SERIAL_CORRUPTION_THRESHOLD")
+	if value == "" {
+		return 0.1, nil
+	}
+
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		return 0, fmt.Errorf("SERIAL_CORRUPTION_THRESHOLD: invalid value %q (use a fraction between 0 and 1)", value)
+	}
+
+	return threshold, nil
+}
+
+// NewSerialMonitor creates a monitor. onCorruption, if not nil, is called
+// for each window whose failure rate reaches the threshold.
+func NewSerialMonitor(threshold float64, onCorruption func(event CorruptionEvent)) *SerialMonitor {
+	return &SerialMonitor{
+		threshold:    threshold,
+		onCorruption: onCorruption,
+		windowStart:  time.Now(),
+	}
+}
+
+// Stats returns the line counters
+func (m *SerialMonitor) Stats() SerialStats {
+	if m == nil {
+		return SerialStats{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// RecordLine counts a parsed line; recovered marks one parsed after skipping garbage
+func (m *SerialMonitor) RecordLine(recovered bool) {
+	m.record(func(s *SerialStats) {
+		if recovered {
+			s.Recovered++
+		}
+	}, false)
+}
+
+// RecordParseFailure counts a line that was not a valid response
+func (m *SerialMonitor) RecordParseFailure() {
+	m.record(func(s *SerialStats) { s.ParseFailures++ }, true)
+}
+
+// RecordOversized counts a line discarded for exceeding the length limit
+func (m *SerialMonitor) RecordOversized() {
+	m.record(func(s *SerialStats) { s.Oversized++ }, true)
+}
+
+// record updates the counters and closes the window once it has elapsed
+func (m *SerialMonitor) record(update func(s *SerialStats), failed bool) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.stats.Lines++
+	update(&m.stats)
+	m.windowLines++
+	if failed {
+		m.windowFailures++
+	}
+
+	var event *CorruptionEvent
+	if time.Since(m.windowStart) >= corruptionWindow {
+		rate := float64(m.windowFailures) / float64(m.windowLines)
+		if m.windowFailures >= corruptionMinFailed && rate >= m.threshold {
+			event = &CorruptionEvent{
+				Lines:     m.windowLines,
+				Failures:  m.windowFailures,
+				Rate:      rate,
+				Threshold: m.threshold,
+				Window:    time.Since(m.windowStart).Round(time.Second).String(),
+			}
+		}
+		m.windowStart = time.Now()
+		m.windowLines = 0
+		m.windowFailures = 0
+	}
+	m.mu.Unlock()
+
+	if event != nil {
+		log.Printf("Serial corruption: %d of %d lines in the last %s were corrupted (%.0f%%)",
+			event.Failures, event.Lines, event.Window, event.Rate*100)
+		if m.onCorruption != nil {
+			m.onCorruption(*event)
+		}
+	}
+}
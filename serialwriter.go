@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Serial write queue limits
+const (
+	serialWriteQueueSize = 16
+	serialWriteTimeout   = 10 * time.Second // to queue and write one command
+)
+
+// serialWrite is a command line waiting for the writer goroutine
+type serialWrite struct {
+	ctx  context.Context
+	data []byte
+	done chan error
+}
+
+// writeLoop is the only goroutine that writes to the serial port, so
+// commands are never interleaved. Commands whose caller gave up while they
+// were queued are dropped without being written.
+func (a *ArduinoConnection) writeLoop() {
+	for {
+		select {
+		case <-a.stopChan:
+			return
+		case w := <-a.writes:
+			if err := w.ctx.Err(); err != nil {
+				w.done <- err
+				continue
+			}
+			_, err := a.currentPort().Write(w.data)
+			w.done <- err
+		}
+	}
+}
+
+// writeCommand queues a command for the writer goroutine and waits until it
+// is written. It fails if ctx is cancelled or the command isn't written
+// within serialWriteTimeout. It returns the command as a JSON line without
+// newline, also when it was written as a CBOR frame.
+func (a *ArduinoConnection) writeCommand(ctx context.Context, cmd SerialCommand) (string, error) {
+	if !a.IsConnected() {
+		return "", ErrNotConnected
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal command: %w", err)
+	}
+	line := string(data)
+	data = append(data, '\n')
+
+	if a.cbor.Load() {
+		if data, err = encodeCBORFrame(cmd); err != nil {
+			return "", fmt.Errorf("failed to encode command: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, serialWriteTimeout)
+	defer cancel()
+
+	w := serialWrite{ctx: ctx, data: data, done: make(chan error, 1)}
+
+	select {
+	case a.writes <- w:
+	case <-ctx.Done():
+		return "", fmt.Errorf("serial write queue is full: %w", ctx.Err())
+	case <-a.stopChan:
+		// Nothing was written, so the command may safely be retried
+		return "", ErrNotConnected
+	}
+
+	select {
+	case err := <-w.done:
+		if err != nil {
+			return "", fmt.Errorf("failed to write to serial port: %w", err)
+		}
+		return line, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("%s command not written: %w", cmd.Cmd, ctx.Err())
+	case <-a.stopChan:
+		return "", fmt.Errorf("not connected to Arduino")
+	}
+}
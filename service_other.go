@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// errNotWindows is returned by the service commands on other platforms
+var errNotWindows = errors.New("Windows services are only supported on Windows; use systemd or another service manager here")
+
+// installService is only supported on Windows
+func installService(port int) error {
+	return errNotWindows
+}
+
+// uninstallService is only supported on Windows
+func uninstallService() error {
+	return errNotWindows
+}
+
+// isWindowsService reports false on other platforms
+func isWindowsService() bool {
+	return false
+}
+
+// runWindowsService is only supported on Windows
+func runWindowsService(port int) error {
+	return errNotWindows
+}
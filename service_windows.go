@@ -0,0 +1,161 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the server is installed under
+const serviceName = "ArduinoSmsServer"
+
+// serviceLogFile is written next to the executable, since services have no console
+const serviceLogFile = "arduinoSmsServer.log"
+
+// installService registers the running executable as an automatically started
+// Windows service that is restarted when it fails
+func installService(port int) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Arduino SMS Server",
+		Description: "HTTP API for sending and receiving SMS through an Arduino GSM board",
+		StartType:   mgr.StartAutomatic,
+	}, "-port", strconv.Itoa(port))
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	// Restart after failures, e.g. log.Fatalf on a configuration error that
+	// was fixed in the meantime
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		log.Printf("Failed to set service recovery actions: %v", err)
+	}
+
+	log.Printf("Installed service %s running %s on port %d", serviceName, exe, port)
+	return nil
+}
+
+// uninstallService removes the Windows service
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+
+	log.Printf("Removed service %s", serviceName)
+	return nil
+}
+
+// isWindowsService reports whether the process was started by the service manager
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runWindowsService runs the server under the service manager. Services start
+// in the system directory, so the database, locales and log file are kept
+// next to the executable.
+func runWindowsService(port int) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	dir := filepath.Dir(exe)
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("failed to change to %s: %w", dir, err)
+	}
+
+	logFile, err := os.OpenFile(serviceLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+	log.SetOutput(logFile)
+	gin.DefaultWriter = logFile
+	gin.DefaultErrorWriter = logFile
+
+	return svc.Run(serviceName, &smsService{port: port})
+}
+
+// smsService handles service manager requests
+type smsService struct {
+	port int
+}
+
+// Execute runs the server and stops it when the service manager asks
+func (s *smsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(s.port, stop)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Server stopped: %v", err)
+				return false, 1
+			}
+			return false, 0
+
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second).Milliseconds())}
+				close(stop)
+				if err := <-done; err != nil {
+					log.Printf("Server stopped: %v", err)
+				}
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceWatchInterval is how often new modem status reports are checked
+const serviceWatchInterval = 15 * time.Second
+
+// ServiceWatchSettings configures detection of sudden service loss
+type ServiceWatchSettings struct {
+	RSSIFloor int // signal at or below this (dBm) counts as no signal
+	RSSIDrop  int // drop in dB between two reports that counts as sudden
+
+	mu       sync.Mutex
+	last     ModemStatus   // last report with a known registration state
+	current  *ServiceLoss  // ongoing service loss, nil while registered
+	recent   []ServiceLoss // most recent first
+	lastSeen time.Time     // UpdatedAt of the last report checked
+}
+
+// ServiceLoss is a loss of network registration seen in the modem reports
+type ServiceLoss struct {
+	SuspectedJamming bool       `json:"suspected_jamming"` // signal vanished together with the registration
+	RSSIBefore       *int       `json:"rssi_before_dbm"`
+	RSSIAfter        *int       `json:"rssi_after_dbm"`
+	Registration     string     `json:"registration"` // state after the loss
+	StartedAt        time.Time  `json:"started_at"`
+	RestoredAt       *time.Time `json:"restored_at,omitempty"`
+}
+
+// serviceLossHistory is how many service losses are kept for /admin/service
+const serviceLossHistory = 20
+
+// LoadServiceWatchSettings reads service loss detection settings from
+// environment variables. It returns nil unless SERVICE_WATCH is true.
+func LoadServiceWatchSettings() (*ServiceWatchSettings, error) {
+	if os.Getenv("SERVICE_WATCH") != "true" {
+		return nil, nil
+	}
+
+	settings := &ServiceWatchSettings{RSSIFloor: -105, RSSIDrop: 20}
+
+	if value := os.Getenv("SERVICE_WATCH_RSSI_FLOOR"); value != "" {
+		floor, err := strconv.Atoi(value)
+		if err != nil || floor < -113 || floor > -51 {
+			return nil, fmt.Errorf("SERVICE_WATCH_RSSI_FLOOR: invalid signal strength %q (-113 to -51 dBm)", value)
+		}
+		settings.RSSIFloor = floor
+	}
+
+	if value := os.Getenv("SERVICE_WATCH_RSSI_DROP"); value != "" {
+		drop, err := strconv.Atoi(value)
+		if err != nil || drop < 1 {
+			return nil, fmt.Errorf("SERVICE_WATCH_RSSI_DROP: invalid drop %q (in dB, at least 1)", value)
+		}
+		settings.RSSIDrop = drop
+	}
+
+	return settings, nil
+}
+
+// isRegistered reports whether a registration state means network service
+func isRegistered(registration string) bool {
+	return registration == "home" || registration == "roaming"
+}
+
+// Observe checks a modem status report against the previous one. It returns
+// the service loss that started or ended with this report, if any, and
+// whether it was restored.
+func (s *ServiceWatchSettings) Observe(status ModemStatus) (*ServiceLoss, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Each report is checked once. The modem is powered down while GSM is
+	// disconnected and then reports an unknown registration.
+	if !status.UpdatedAt.After(s.lastSeen) {
+		return nil, false
+	}
+	s.lastSeen = status.UpdatedAt
+	if status.Registration == "unknown" || status.Registration == "" {
+		return nil, false
+	}
+
+	previous := s.last
+	s.last = status
+
+	if isRegistered(status.Registration) {
+		if s.current == nil {
+			return nil, false
+		}
+		restored := *s.current
+		at := status.UpdatedAt
+		restored.RestoredAt = &at
+		s.recent[0] = restored
+		s.current = nil
+		return &restored, true
+	}
+
+	if s.current != nil || !isRegistered(previous.Registration) {
+		return nil, false
+	}
+
+	loss := ServiceLoss{
+		SuspectedJamming: s.signalVanished(previous.RSSI, status.RSSI),
+		RSSIBefore:       previous.RSSI,
+		RSSIAfter:        status.RSSI,
+		Registration:     status.Registration,
+		StartedAt:        status.UpdatedAt,
+	}
+	s.current = &loss
+	s.recent = append([]ServiceLoss{loss}, s.recent...)
+	if len(s.recent) > serviceLossHistory {
+		s.recent = s.recent[:serviceLossHistory]
+	}
+
+	return &loss, false
+}
+
+// signalVanished reports whether the signal went from usable to nothing, or
+// dropped by at least RSSIDrop, between two reports
+func (s *ServiceWatchSettings) signalVanished(before, after *int) bool {
+	if before == nil || *before <= s.RSSIFloor {
+		return false
+	}
+	return after == nil || *after <= s.RSSIFloor || *before-*after >= s.RSSIDrop
+}
+
+// Current returns the ongoing service loss, or nil
+func (s *ServiceWatchSettings) Current() *ServiceLoss {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil
+	}
+	loss := *s.current
+	return &loss
+}
+
+// Recent returns the most recent service losses, newest first
+func (s *ServiceWatchSettings) Recent() []ServiceLoss {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ServiceLoss{}, s.recent...)
+}
+
+// runServiceWatchJob checks new modem status reports for service loss and
+// alerts when it starts and ends
+func (app *App) runServiceWatchJob() {
+	ticker := clock.NewTicker(serviceWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		loss, restored := app.serviceWatch.Observe(app.smsConn.ModemStatus())
+		if loss == nil {
+			continue
+		}
+
+		if restored {
+			log.Printf("Network service restored after %s", loss.RestoredAt.Sub(loss.StartedAt).Round(time.Second))
+			app.events.Publish(EventServiceRestored, loss)
+			continue
+		}
+
+		title := "Network service lost"
+		if loss.SuspectedJamming {
+			title = "Possible jamming: signal and network service lost"
+		}
+		log.Printf("%s (registration %s)", title, loss.Registration)
+
+		// SMS can't get through, so this is also alerted through the fallback channels
+		app.events.Publish(EventServiceLost, loss)
+	}
+}
+
+// serviceLossEvent is the webhook payload of a service loss
+func serviceLossEvent(loss *ServiceLoss) gin.H {
+	event := gin.H{
+		"suspected_jamming": loss.SuspectedJamming,
+		"registration":      loss.Registration,
+		"started_at":        loss.StartedAt,
+	}
+	if loss.RSSIBefore != nil {
+		event["rssi_before_dbm"] = *loss.RSSIBefore
+	}
+	if loss.RSSIAfter != nil {
+		event["rssi_after_dbm"] = *loss.RSSIAfter
+	}
+	if loss.RestoredAt != nil {
+		event["restored_at"] = *loss.RestoredAt
+	}
+	return event
+}
+
+// getServiceWatch returns the ongoing and recent service losses
+func (app *App) getServiceWatch(c *gin.Context) {
+	if app.serviceWatch == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"enabled": false,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"enabled":    true,
+		"rssi_floor": app.serviceWatch.RSSIFloor,
+		"rssi_drop":  app.serviceWatch.RSSIDrop,
+		"current":    app.serviceWatch.Current(),
+		"recent":     app.serviceWatch.Recent(),
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clock is the time source of the time-driven jobs, e.g. the digest and
+// maintenance schedules, retention, the periodic checks and on-call rotations.
+// It is the system clock unless SIMULATED_CLOCK is set in mock mode.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a Clock at intervals, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// clock is the Clock used by the jobs, replaced by a SimulatedClock on startup
+var clock Clock = systemClock{}
+
+// systemClock is the Clock of the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+
+// systemTicker adapts time.Ticker to Ticker
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// SimulatedClock is a Clock that stands still until it is advanced, so tests
+// can run time-driven jobs deterministically. Timers and tickers due within an
+// advance fire in order, each at its own time; like time.Ticker, a ticker
+// whose reader falls behind drops ticks.
+type SimulatedClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*simulatedTimer
+}
+
+// simulatedTimer is a pending After or ticker of a SimulatedClock
+type simulatedTimer struct {
+	clock  *SimulatedClock
+	at     time.Time
+	period time.Duration // zero for After
+	c      chan time.Time
+}
+
+// NewSimulatedClock creates a simulated clock standing at start
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start}
+}
+
+// LoadSimulatedClock reads SIMULATED_CLOCK and SIMULATED_CLOCK_START (RFC
+// 3339, default now) from environment variables. It returns nil if
+// SIMULATED_CLOCK is not enabled, and fails outside mock mode so a real
+// device never runs on simulated time.
+func LoadSimulatedClock(deviceMode string) (*SimulatedClock, error) {
+	if os.Getenv("SIMULATED_CLOCK") != "true" {
+		return nil, nil
+	}
+	if deviceMode != "mock" {
+		return nil, fmt.Errorf("SIMULATED_CLOCK requires DEVICE_MODE=mock")
+	}
+
+	start := time.Now()
+	if value := os.Getenv("SIMULATED_CLOCK_START"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("SIMULATED_CLOCK_START: invalid time %q, expected RFC 3339", value)
+		}
+		start = t
+	}
+
+	return NewSimulatedClock(start), nil
+}
+
+// Now returns the simulated time
+func (s *SimulatedClock) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// After returns a channel receiving the simulated time once it has advanced by d
+func (s *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	return s.add(d, 0).c
+}
+
+// NewTicker returns a ticker firing each time the simulated time advances by d
+func (s *SimulatedClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for SimulatedClock.NewTicker")
+	}
+	return s.add(d, d)
+}
+
+// add schedules a timer d from now
+func (s *SimulatedClock) add(d, period time.Duration) *simulatedTimer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := &simulatedTimer{clock: s, at: s.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- s.now
+		return t
+	}
+	s.timers = append(s.timers, t)
+	return t
+}
+
+// Advance moves the simulated time forward by d, firing the timers and
+// tickers due on the way, and returns the new time. The jobs woken by them
+// run in the background.
+func (s *SimulatedClock) Advance(d time.Duration) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s.now.Add(d)
+	for {
+		sort.SliceStable(s.timers, func(i, j int) bool { return s.timers[i].at.Before(s.timers[j].at) })
+		if len(s.timers) == 0 || s.timers[0].at.After(target) {
+			break
+		}
+
+		t := s.timers[0]
+		s.now = t.at
+		select {
+		case t.c <- t.at:
+		default:
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			s.timers = s.timers[1:]
+		}
+	}
+	s.now = target
+
+	return s.now
+}
+
+// C returns the channel of a ticker
+func (t *simulatedTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops a ticker
+func (t *simulatedTimer) Stop() {
+	s := t.clock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, other := range s.timers {
+		if other == t {
+			s.timers = append(s.timers[:i], s.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// ClockAdvanceRequest advances the simulated clock by a duration ("90m",
+// "2d") or to a time
+type ClockAdvanceRequest struct {
+	By string     `json:"by"`
+	To *time.Time `json:"to"`
+}
+
+// advanceClock advances the simulated clock
+func (app *App) advanceClock(c *gin.Context) {
+	var req ClockAdvanceRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	now := app.simClock.Now()
+	var d time.Duration
+	switch {
+	case req.By != "" && req.To != nil:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Specify either by or to"))
+		return
+	case req.By != "":
+		var err error
+		d, err = parseInterval(req.By)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid duration %q", req.By))
+			return
+		}
+	case req.To != nil:
+		d = req.To.Sub(now)
+		if d < 0 {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "The simulated clock can't go back, it is %s", now.Format(time.RFC3339)))
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Missing required field: by or to"))
+		return
+	}
+
+	now = app.simClock.Advance(d)
+	log.Printf("Simulated clock advanced by %s to %s", d, now.Format(time.RFC3339))
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"now":    now,
+	})
+}
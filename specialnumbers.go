@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Policies for sending to short codes and premium-rate numbers
+const (
+	SpecialPolicyAllow   = "allow"   // send without further notice
+	SpecialPolicyWarn    = "warn"    // send, but log and return a warning
+	SpecialPolicyBlock   = "block"   // refuse to send
+	SpecialPolicyConfirm = "confirm" // send only with "confirm_special": true
+)
+
+// SpecialNumberPolicies decide how sends to short codes and premium-rate
+// numbers, which may be charged extra or start subscriptions, are handled
+type SpecialNumberPolicies struct {
+	ShortCode string
+	Premium   string
+}
+
+// LoadSpecialNumberPolicies reads SHORT_CODE_POLICY (default block) and
+// PREMIUM_POLICY (default warn) from environment variables. SHORT_CODE_POLICY
+// alone decides whether short codes may be sent to; NUMBER_SHORT_CODES only
+// narrows which ones.
+func LoadSpecialNumberPolicies() (*SpecialNumberPolicies, error) {
+	p := &SpecialNumberPolicies{ShortCode: SpecialPolicyBlock, Premium: SpecialPolicyWarn}
+
+	for _, setting := range []struct {
+		name   string
+		policy *string
+	}{
+		{"SHORT_CODE_POLICY", &p.ShortCode},
+		{"PREMIUM_POLICY", &p.Premium},
+	} {
+		switch value := os.Getenv(setting.name); value {
+		case "":
+		case SpecialPolicyAllow, SpecialPolicyWarn, SpecialPolicyBlock, SpecialPolicyConfirm:
+			*setting.policy = value
+		default:
+			return nil, fmt.Errorf("%s: unknown policy %q (use allow, warn, block or confirm)", setting.name, value)
+		}
+	}
+
+	return p, nil
+}
+
+// String describes the policies for the startup log
+func (p *SpecialNumberPolicies) String() string {
+	return fmt.Sprintf("short codes %s, premium-rate numbers %s", p.ShortCode, p.Premium)
+}
+
+// ClassifyNumber returns NumberTypeShortCode or NumberTypePremium for short
+// codes and premium-rate numbers, or an empty string for any other number.
+// Premium ranges are known for the countries in numberPlans.
+func ClassifyNumber(number string) string {
+	if isShortCode(number) {
+		return NumberTypeShortCode
+	}
+	if e164, err := NormalizeNumber(number); err == nil && LookupNumberType(e164) == NumberTypePremium {
+		return NumberTypePremium
+	}
+	return ""
+}
+
+// policy returns the policy for a number class, allow for ordinary numbers
+func (p *SpecialNumberPolicies) policy(class string) string {
+	switch class {
+	case NumberTypeShortCode:
+		return p.ShortCode
+	case NumberTypePremium:
+		return p.Premium
+	}
+	return SpecialPolicyAllow
+}
+
+// describeNumberClass names the class of a number in messages
+func describeNumberClass(class, number string) string {
+	if class == NumberTypeShortCode {
+		return "short code " + number
+	}
+	return "premium-rate number " + number
+}
+
+// Check applies the policy for a number's class to a send; confirmed is set
+// if the client passed "confirm_special": true
+func (p *SpecialNumberPolicies) Check(number string, confirmed bool) error {
+	class := ClassifyNumber(number)
+	switch p.policy(class) {
+	case SpecialPolicyBlock:
+		return apiErrorf(CodeNumberBlocked, "Sending to %s is not allowed", describeNumberClass(class, number))
+	case SpecialPolicyConfirm:
+		if !confirmed {
+			return apiErrorf(CodeConfirmationRequired, "Sending to %s requires \"confirm_special\": true", describeNumberClass(class, number))
+		}
+	case SpecialPolicyWarn:
+		log.Printf("Warning: sending to %s", describeNumberClass(class, number))
+	}
+	return nil
+}
+
+// Warning returns the warning in locale for a send to number under the warn
+// policy, or an empty string
+func (p *SpecialNumberPolicies) Warning(locale, number string) string {
+	class := ClassifyNumber(number)
+	if p.policy(class) != SpecialPolicyWarn {
+		return ""
+	}
+	if class == NumberTypeShortCode {
+		return T(locale, "%s is a short code, which may be charged extra", number)
+	}
+	return T(locale, "%s is a premium-rate number, which may be charged extra", number)
+}
+
+// backfillNumberClasses tags the received and sent SMS stored before number
+// classes were recorded
+func (d *Database) backfillNumberClasses() error {
+	for _, table := range []string{"received_sms", "sent_sms"} {
+		rows, err := d.db.Query(fmt.Sprintf("SELECT DISTINCT number FROM %s WHERE number_class IS NULL", table))
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %w", table, err)
+		}
+
+		var numbers []string
+		for rows.Next() {
+			var number string
+			if err := rows.Scan(&number); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			numbers = append(numbers, number)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+
+		for _, number := range numbers {
+			if _, err := d.db.Exec(fmt.Sprintf("UPDATE %s SET number_class = ? WHERE number = ? AND number_class IS NULL", table),
+				ClassifyNumber(number), number); err != nil {
+				return fmt.Errorf("failed to update %s: %w", table, err)
+			}
+		}
+	}
+
+	return nil
+}
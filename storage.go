@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storageCheckInterval is how often the database size and free disk space are checked
+const storageCheckInterval = 10 * time.Minute
+
+// storageHistory is how long database size samples are kept to estimate growth
+const storageHistory = 7 * 24 * time.Hour
+
+// StorageMonitor watches the size of the database and the free space of the
+// disk it is on, so that small flash storage doesn't fill up unnoticed
+type StorageMonitor struct {
+	MaxDBSize int64         // database size that counts as too large, 0 for no limit
+	MinFree   int64         // free space that counts as too little, 0 for no limit
+	Retention time.Duration // age of messages deleted when a limit is crossed, 0 to keep them
+
+	mu      sync.Mutex
+	samples []storageSample // oldest first
+	low     bool            // a limit was crossed at the last check
+}
+
+// storageSample is the database size at a check
+type storageSample struct {
+	At   time.Time
+	Size int64
+}
+
+// StorageStatus is the database size and disk space reported by /stats
+type StorageStatus struct {
+	DBSize        int64    `json:"db_size"` // database file and WAL in bytes
+	FreeSpace     int64    `json:"free_space"`
+	TotalSpace    int64    `json:"total_space"`
+	GrowthPerDay  *int64   `json:"growth_per_day,omitempty"`  // database growth in bytes per day
+	DaysUntilFull *float64 `json:"days_until_full,omitempty"` // at that growth, until the free space is used up
+	MaxDBSize     int64    `json:"max_db_size,omitempty"`
+	MinFreeSpace  int64    `json:"min_free_space,omitempty"`
+	Problems      []string `json:"problems,omitempty"` // limits crossed
+	Error         string   `json:"error,omitempty"`    // free space could not be read
+}
+
+// LoadStorageMonitor reads storage limits from environment variables:
+// STORAGE_MAX_DB_SIZE, STORAGE_MIN_FREE (sizes such as "500MB") and
+// STORAGE_RETENTION (an interval such as "90d"). The sizes are always
+// monitored; the limits are optional.
+func LoadStorageMonitor() (*StorageMonitor, error) {
+	monitor := &StorageMonitor{}
+
+	for name, dest := range map[string]*int64{
+		"STORAGE_MAX_DB_SIZE": &monitor.MaxDBSize,
+		"STORAGE_MIN_FREE":    &monitor.MinFree,
+	} {
+		if value := os.Getenv(name); value != "" {
+			size, err := parseByteSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			*dest = size
+		}
+	}
+
+	if value := os.Getenv("STORAGE_RETENTION"); value != "" {
+		retention, err := parseInterval(value)
+		if err != nil {
+			return nil, fmt.Errorf("STORAGE_RETENTION: %w", err)
+		}
+		if retention < 24*time.Hour {
+			return nil, fmt.Errorf("STORAGE_RETENTION must be at least 1d")
+		}
+		if monitor.MaxDBSize == 0 && monitor.MinFree == 0 {
+			return nil, fmt.Errorf("STORAGE_RETENTION needs STORAGE_MAX_DB_SIZE or STORAGE_MIN_FREE")
+		}
+		monitor.Retention = retention
+	}
+
+	return monitor, nil
+}
+
+// parseByteSize parses a size in bytes with an optional KB, MB or GB suffix
+// (powers of 1024)
+func parseByteSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if rest, found := strings.CutSuffix(number, unit.suffix); found {
+			number, multiplier = strings.TrimSpace(rest), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 500MB)", value)
+	}
+	return n * multiplier, nil
+}
+
+// formatByteSize formats a size in bytes for logs and alerts, e.g. "1.5 GB"
+func formatByteSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	default:
+		return fmt.Sprintf("%d KB", size>>10)
+	}
+}
+
+// String describes the limits for the startup log
+func (m *StorageMonitor) String() string {
+	var limits []string
+	if m.MaxDBSize > 0 {
+		limits = append(limits, "database up to "+formatByteSize(m.MaxDBSize))
+	}
+	if m.MinFree > 0 {
+		limits = append(limits, "at least "+formatByteSize(m.MinFree)+" free")
+	}
+	if len(limits) == 0 {
+		return "no limits"
+	}
+	s := strings.Join(limits, ", ")
+	if m.Retention > 0 {
+		s += fmt.Sprintf(", deleting messages older than %s when crossed", m.Retention)
+	}
+	return s
+}
+
+// Status measures the database and the disk it is on and checks the limits
+func (m *StorageMonitor) Status(db *Database) StorageStatus {
+	status := StorageStatus{
+		DBSize:       db.Size() + fileSize(db.path+"-wal"),
+		MaxDBSize:    m.MaxDBSize,
+		MinFreeSpace: m.MinFree,
+	}
+
+	// The disk of a PostgreSQL server can't be seen from here
+	free, total, err := int64(0), int64(0), fmt.Errorf("free space is not measured on PostgreSQL")
+	if !db.postgres() {
+		free, total, err = diskSpace(filepath.Dir(db.path))
+	}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.FreeSpace, status.TotalSpace = free, total
+	}
+
+	if m.MaxDBSize > 0 && status.DBSize > m.MaxDBSize {
+		status.Problems = append(status.Problems, fmt.Sprintf("database is %s, above %s", formatByteSize(status.DBSize), formatByteSize(m.MaxDBSize)))
+	}
+	if m.MinFree > 0 && err == nil && status.FreeSpace < m.MinFree {
+		status.Problems = append(status.Problems, fmt.Sprintf("%s free, below %s", formatByteSize(status.FreeSpace), formatByteSize(m.MinFree)))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := len(m.samples); n > 1 {
+		first, last := m.samples[0], m.samples[n-1]
+		if elapsed := last.At.Sub(first.At); elapsed >= time.Hour {
+			growth := int64(float64(last.Size-first.Size) / elapsed.Hours() * 24)
+			status.GrowthPerDay = &growth
+			if growth > 0 && err == nil {
+				days := float64(status.FreeSpace) / float64(growth)
+				status.DaysUntilFull = &days
+			}
+		}
+	}
+
+	return status
+}
+
+// record adds a database size sample, dropping those older than storageHistory
+func (m *StorageMonitor) record(at time.Time, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples = append(m.samples, storageSample{At: at, Size: size})
+	for len(m.samples) > 0 && at.Sub(m.samples[0].At) > storageHistory {
+		m.samples = m.samples[1:]
+	}
+}
+
+// Check measures the storage and returns the status, and whether a limit
+// was crossed since the last check
+func (m *StorageMonitor) Check(db *Database, now time.Time) (StorageStatus, bool) {
+	m.record(now, db.Size()+fileSize(db.path+"-wal"))
+	status := m.Status(db)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	crossed := len(status.Problems) > 0 && !m.low
+	if m.low && len(status.Problems) == 0 {
+		log.Printf("Storage back within limits: database %s, %s free", formatByteSize(status.DBSize), formatByteSize(status.FreeSpace))
+	}
+	m.low = len(status.Problems) > 0
+	return status, crossed
+}
+
+// applyRetention deletes the messages older than Retention and vacuums the
+// database if there is room to rebuild it
+func (app *App) applyRetention(status StorageStatus) {
+	m := app.storage
+	if m.Retention == 0 {
+		return
+	}
+
+	cutoff := clock.Now().Add(-m.Retention)
+	filter := MessagePurgeFilter{To: &cutoff}
+	received, err := app.db.PurgeReceivedSMS(filter)
+	if err != nil {
+		log.Printf("Storage retention: %v", err)
+		return
+	}
+	sent, err := app.db.PurgeSentSMS(filter)
+	if err != nil {
+		log.Printf("Storage retention: %v", err)
+		return
+	}
+	if received == 0 && sent == 0 {
+		return
+	}
+	log.Printf("Storage retention: deleted %d received and %d sent SMS older than %s", received, sent, m.Retention)
+
+	// Vacuuming writes a copy of the database; without room for it the
+	// freed pages are reused by new messages instead
+	if status.Error == "" && status.FreeSpace > status.DBSize {
+		if err := app.db.Vacuum(); err != nil {
+			log.Printf("Storage retention: %v", err)
+		}
+	}
+}
+
+// runStorageJob checks the storage limits, alerting and applying the
+// retention when they are crossed
+func (app *App) runStorageJob() {
+	ticker := clock.NewTicker(storageCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		status, crossed := app.storage.Check(app.db, clock.Now())
+		if len(status.Problems) > 0 {
+			if crossed {
+				log.Printf("Storage low: %s", strings.Join(status.Problems, "; "))
+				app.events.Publish(EventStorageLow, &status)
+			}
+			app.applyRetention(status)
+		}
+
+		<-ticker.C()
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stormDigestMaxLength limits digest SMS to three concatenated GSM-7 segments
+const stormDigestMaxLength = 3 * 153
+
+// StormAggregator collapses bursts of messages to the same number into a
+// single digest SMS
+type StormAggregator struct {
+	Threshold int           // messages per window sent individually
+	Window    time.Duration // burst window, and how long a digest collects messages
+
+	mu      sync.Mutex
+	recent  map[string][]time.Time // submission times per number within the window
+	batches map[string]*stormBatch // digests being collected per number
+}
+
+// stormBatch collects the messages of one digest
+type stormBatch struct {
+	ids      []int64
+	contents []string
+}
+
+// LoadStormAggregator reads alert storm settings from environment variables.
+// It returns nil if ALERT_STORM_THRESHOLD is not set.
+func LoadStormAggregator() (*StormAggregator, error) {
+	thresholdStr := os.Getenv("ALERT_STORM_THRESHOLD")
+	if thresholdStr == "" {
+		return nil, nil
+	}
+
+	threshold, err := strconv.Atoi(thresholdStr)
+	if err != nil || threshold < 1 {
+		return nil, fmt.Errorf("ALERT_STORM_THRESHOLD: invalid message count %q", thresholdStr)
+	}
+
+	window := 5 * time.Minute
+	if value := os.Getenv("ALERT_STORM_WINDOW"); value != "" {
+		window, err = time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("ALERT_STORM_WINDOW: invalid duration %q", value)
+		}
+	}
+
+	return &StormAggregator{
+		Threshold: threshold,
+		Window:    window,
+		recent:    make(map[string][]time.Time),
+		batches:   make(map[string]*stormBatch),
+	}, nil
+}
+
+// String returns the settings in a human readable form
+func (s *StormAggregator) String() string {
+	return fmt.Sprintf("more than %d messages per %s", s.Threshold, s.Window)
+}
+
+// record counts a submission to number and reports whether a digest should
+// collect it. It returns a new batch if one has to be started.
+func (s *StormAggregator) record(number string) (bool, *stormBatch) {
+	now := time.Now()
+
+	times := s.recent[number]
+	for len(times) > 0 && now.Sub(times[0]) >= s.Window {
+		times = times[1:]
+	}
+	times = append(times, now)
+	s.recent[number] = times
+
+	// Drop numbers that have been quiet for a whole window
+	for other, otherTimes := range s.recent {
+		if now.Sub(otherTimes[len(otherTimes)-1]) >= s.Window {
+			delete(s.recent, other)
+		}
+	}
+
+	if s.batches[number] != nil {
+		return true, nil
+	}
+	if len(times) <= s.Threshold {
+		return false, nil
+	}
+
+	batch := &stormBatch{}
+	s.batches[number] = batch
+	return true, batch
+}
+
+// take removes and returns the batch of a number
+func (s *StormAggregator) take(number string) *stormBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := s.batches[number]
+	delete(s.batches, number)
+	return batch
+}
+
+// erase forgets the submissions to the number with the given conversation ID
+// and drops its pending digest, whose messages are erased from the database.
+// It returns the number of digested messages dropped.
+func (s *StormAggregator) erase(conversationID string) int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	erased := 0
+	for number := range s.recent {
+		if ConversationID(number) == conversationID {
+			delete(s.recent, number)
+		}
+	}
+	for number, batch := range s.batches {
+		if ConversationID(number) == conversationID {
+			erased += len(batch.contents)
+			delete(s.batches, number)
+		}
+	}
+	return erased
+}
+
+// stormDigest joins the messages of a batch into one SMS
+func stormDigest(contents []string) string {
+	if len(contents) == 1 {
+		return contents[0]
+	}
+
+	digest := fmt.Sprintf("%d alerts: %s", len(contents), strings.Join(contents, " | "))
+	if runes := []rune(digest); len(runes) > stormDigestMaxLength {
+		digest = string(runes[:stormDigestMaxLength-3]) + "..."
+	}
+	return digest
+}
+
+// deliverAggregated sends an SMS, or adds it to the number's digest while
+// more than the storm threshold of messages are submitted within the window.
+// Aggregated messages are stored with status aggregated and return at once.
+func (app *App) deliverAggregated(ctx context.Context, keyID, number, content string, opts SendOptions) (int64, error) {
+	if app.storm == nil {
+		return app.deliverSMSNow(ctx, keyID, number, content, opts)
+	}
+
+	app.storm.mu.Lock()
+	aggregate, newBatch := app.storm.record(number)
+	if !aggregate {
+		app.storm.mu.Unlock()
+		return app.deliverSMSNow(ctx, keyID, number, content, opts)
+	}
+
+	// Saved under the lock so that the batch cannot be flushed in between
+	// A journaled message is still sent in the digest, but not linked to it
+	id, err := app.db.recordSentSMS(opts.SentID, number, content, "aggregated", "", "", opts)
+	if errors.Is(err, ErrJournaled) {
+		log.Printf("Failed to save sent SMS to database: %v", err)
+		err = nil
+	}
+	if err == nil {
+		batch := app.storm.batches[number]
+		if id != 0 {
+			batch.ids = append(batch.ids, id)
+		}
+		batch.contents = append(batch.contents, content)
+	}
+	app.storm.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if newBatch != nil {
+		log.Printf("Alert storm to %s, collecting messages into a digest for %s", number, app.storm.Window)
+		time.AfterFunc(app.storm.Window, func() { app.flushStormDigest(number) })
+	}
+	return id, nil
+}
+
+// flushStormDigest sends the collected messages of a number as one SMS and
+// links them to the digest's sent_sms record
+func (app *App) flushStormDigest(number string) {
+	batch := app.storm.take(number)
+	if batch == nil || len(batch.contents) == 0 {
+		return
+	}
+
+	digestID, err := app.deliverSMSNow(context.Background(), "alert-storm", number, stormDigest(batch.contents), SendOptions{})
+	if err != nil {
+		log.Printf("Failed to send alert digest to %s: %v", number, err)
+	} else {
+		log.Printf("Sent digest of %d alerts to %s", len(batch.contents), number)
+	}
+
+	if digestID != 0 && len(batch.ids) > 0 {
+		if err := app.db.LinkAggregatedSMS(batch.ids, digestID); err != nil {
+			log.Printf("Failed to link aggregated SMS: %v", err)
+		}
+	}
+}
+
+// LinkAggregatedSMS points aggregated messages at the digest SMS they were sent in
+func (d *Database) LinkAggregatedSMS(ids []int64, digestID int64) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE sent_sms SET digest_id = ? WHERE id = ?`, digestID, id); err != nil {
+			return fmt.Errorf("failed to update sent SMS: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
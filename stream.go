@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonListStream writes a list response one item at a time instead of
+// buffering the whole payload. The output has the same shape as the
+// buffered list responses: {"status":"success","total":N,"messages":[...],"count":n}.
+type jsonListStream struct {
+	c       *gin.Context
+	total   int
+	count   int
+	started bool
+}
+
+// newJSONListStream creates a streamed list response
+func newJSONListStream(c *gin.Context, total int) *jsonListStream {
+	return &jsonListStream{c: c, total: total}
+}
+
+// begin writes the response headers and the opening of the JSON document
+func (s *jsonListStream) begin() {
+	s.started = true
+	s.c.Header("Content-Type", "application/json; charset=utf-8")
+	s.c.Status(http.StatusOK)
+	fmt.Fprintf(s.c.Writer, `{"status":"success","total":%d,"messages":[`, s.total)
+}
+
+// Write encodes one item into the response
+func (s *jsonListStream) Write(item interface{}) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode item: %w", err)
+	}
+
+	if !s.started {
+		s.begin()
+	}
+	if s.count > 0 {
+		data = append([]byte{','}, data...)
+	}
+	s.count++
+
+	_, err = s.c.Writer.Write(data)
+	return err
+}
+
+// Finish completes the response. If err is set before anything was written a
+// regular error response is sent; after streaming started the document is left
+// unterminated so clients can tell the listing is incomplete.
+func (s *jsonListStream) Finish(err error) {
+	if err != nil {
+		if !s.started {
+			s.c.JSON(http.StatusInternalServerError, errorResponse(s.c, CodeInternalError, "Failed to retrieve messages: %v", err))
+			return
+		}
+		log.Printf("Streaming response aborted after %d items: %v", s.count, err)
+		return
+	}
+
+	if !s.started {
+		s.begin()
+	}
+	fmt.Fprintf(s.c.Writer, `],"count":%d}`, s.count)
+}
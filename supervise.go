@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Backoff between restarts of a serial goroutine that keeps failing. A
+// goroutine that ran for supervisorResetAfter restarts without delay.
+const (
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = 30 * time.Second
+	supervisorResetAfter = time.Minute
+)
+
+// supervise runs a goroutine of the connection and restarts it when it panics,
+// so that a bad line from the Arduino doesn't stop inbound processing for
+// good. Loops that run until the connection is closed, like readLoop, are
+// also restarted when they return early; others, like reconnectLoop, are done
+// when they return. Panics and unexpected exits are logged and recorded in the
+// device event log.
+func (a *ArduinoConnection) supervise(name string, untilStop bool, loop func()) {
+	backoff := supervisorMinBackoff
+	for {
+		started := time.Now()
+		panicked := runRecovered(name, loop)
+
+		select {
+		case <-a.stopChan:
+			return
+		default:
+		}
+
+		switch {
+		case panicked != "":
+			a.recordDeviceEvent(DeviceEventGoroutinePanic, fmt.Sprintf("%s: %s", name, panicked))
+		case untilStop:
+			log.Printf("Supervisor: %s exited unexpectedly", name)
+			a.recordDeviceEvent(DeviceEventGoroutineExited, name)
+		default:
+			return
+		}
+
+		if time.Since(started) >= supervisorResetAfter {
+			backoff = supervisorMinBackoff
+		}
+		log.Printf("Supervisor: restarting %s in %s", name, backoff)
+		select {
+		case <-a.stopChan:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, supervisorMaxBackoff)
+	}
+}
+
+// runRecovered runs fn, returning the panic value as a string if it panicked
+func runRecovered(name string, fn func()) (panicked string) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = fmt.Sprint(r)
+			if panicked == "" {
+				panicked = "panic"
+			}
+			log.Printf("Supervisor: %s panicked: %v\n%s", name, r, debug.Stack())
+			go errorReporter.ReportPanic(r, panicFrames(0), map[string]string{"goroutine": name})
+		}
+	}()
+	fn()
+	return ""
+}
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Survey question types
+const (
+	QuestionText   = "text"   // any non-empty answer
+	QuestionNumber = "number" // a number
+	QuestionChoice = "choice" // one of the choices, by text or position
+	QuestionYesNo  = "yes_no" // yes or no
+)
+
+// Survey run statuses
+const (
+	SurveyRunActive    = "active"    // waiting for an answer
+	SurveyRunCompleted = "completed" // every question answered
+	SurveyRunExpired   = "expired"   // no answer within the timeout
+	SurveyRunCancelled = "cancelled"
+	SurveyRunFailed    = "failed" // a question could not be sent
+)
+
+// defaultSurveyTimeout is how long a run waits for each answer unless the survey sets a timeout
+const defaultSurveyTimeout = 24 * time.Hour
+
+// surveyCheckInterval is how often active runs are checked for expiry
+const surveyCheckInterval = time.Minute
+
+// Surveys serializes state changes of running surveys
+type Surveys struct {
+	mu sync.Mutex
+}
+
+// SurveyQuestion is one question of a survey
+type SurveyQuestion struct {
+	Text    string   `json:"text"`
+	Type    string   `json:"type"`
+	Choices []string `json:"choices,omitempty"`
+}
+
+// Survey is a sequence of questions sent to a number one at a time
+type Survey struct {
+	ID             int64            `json:"id"`
+	Name           string           `json:"name"`
+	Intro          string           `json:"intro,omitempty"` // sent with the first question
+	Outro          string           `json:"outro,omitempty"` // sent after the last answer
+	Questions      []SurveyQuestion `json:"questions"`
+	TimeoutSeconds int              `json:"timeout_seconds"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// SurveyRequest defines a survey
+type SurveyRequest struct {
+	Name      string           `json:"name" binding:"required"`
+	Intro     string           `json:"intro"`
+	Outro     string           `json:"outro"`
+	Questions []SurveyQuestion `json:"questions" binding:"required"`
+	Timeout   string           `json:"timeout"` // wait per answer, e.g. "24h"
+}
+
+// SurveyRun is a survey being answered by one number
+type SurveyRun struct {
+	ID              int64          `json:"id"`
+	SurveyID        int64          `json:"survey_id"`
+	Number          string         `json:"number"`
+	Status          string         `json:"status"`
+	CurrentQuestion int            `json:"current_question"`
+	Error           string         `json:"error,omitempty"`
+	StartedBy       string         `json:"started_by"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	CompletedAt     *time.Time     `json:"completed_at,omitempty"`
+	Answers         []SurveyAnswer `json:"answers"`
+
+	lastReceivedID int // replies are received SMS with a greater ID
+}
+
+// SurveyAnswer is a validated answer to a question
+type SurveyAnswer struct {
+	Question      int       `json:"question"`
+	Answer        string    `json:"answer"`
+	ReceivedSMSID int       `json:"received_sms_id"`
+	AnsweredAt    time.Time `json:"answered_at"`
+}
+
+// SurveyStartRequest starts a survey for a number
+type SurveyStartRequest struct {
+	Number string `json:"number" binding:"required"`
+}
+
+// validate checks that a question can be asked and answered
+func (q SurveyQuestion) validate() error {
+	if strings.TrimSpace(q.Text) == "" {
+		return fmt.Errorf("question text is empty")
+	}
+
+	switch q.Type {
+	case QuestionText, QuestionNumber, QuestionYesNo:
+		if len(q.Choices) > 0 {
+			return fmt.Errorf("choices are only allowed for %s questions", QuestionChoice)
+		}
+	case QuestionChoice:
+		if len(q.Choices) < 2 {
+			return fmt.Errorf("%s questions need at least 2 choices", QuestionChoice)
+		}
+	default:
+		return fmt.Errorf("invalid question type %q (use text, number, choice or yes_no)", q.Type)
+	}
+
+	return nil
+}
+
+// format renders a question as SMS text, listing the choices of choice questions
+func (q SurveyQuestion) format(locale string) string {
+	switch q.Type {
+	case QuestionChoice:
+		lines := []string{q.Text}
+		for i, choice := range q.Choices {
+			lines = append(lines, fmt.Sprintf("%d) %s", i+1, choice))
+		}
+		return strings.Join(lines, "\n")
+	case QuestionYesNo:
+		return q.Text + " " + T(locale, "(yes/no)")
+	}
+	return q.Text
+}
+
+// parseAnswer validates a reply and returns the answer to store. Yes/no
+// answers are stored as "yes" or "no" in any locale.
+func (q SurveyQuestion) parseAnswer(reply, locale string) (string, bool) {
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		return "", false
+	}
+
+	switch q.Type {
+	case QuestionNumber:
+		if _, err := strconv.ParseFloat(strings.Replace(reply, ",", ".", 1), 64); err != nil {
+			return "", false
+		}
+		return strings.Replace(reply, ",", ".", 1), true
+
+	case QuestionChoice:
+		if n, err := strconv.Atoi(strings.TrimSuffix(reply, ")")); err == nil && n >= 1 && n <= len(q.Choices) {
+			return q.Choices[n-1], true
+		}
+		for _, choice := range q.Choices {
+			if strings.EqualFold(reply, choice) {
+				return choice, true
+			}
+		}
+		return "", false
+
+	case QuestionYesNo:
+		// Accept English and localized words and their first letters
+		reply = strings.ToLower(reply)
+		for _, word := range []string{"yes", "no"} {
+			localized := strings.ToLower(T(locale, word))
+			if reply == word || reply == word[:1] || reply == localized || reply == localized[:1] {
+				return word, true
+			}
+		}
+		return "", false
+	}
+
+	return reply, true
+}
+
+// retryText asks for the answer again after an invalid reply
+func (q SurveyQuestion) retryText(locale string) string {
+	var hint string
+	switch q.Type {
+	case QuestionNumber:
+		hint = T(locale, "Please answer with a number.")
+	case QuestionChoice:
+		hint = T(locale, "Please answer with one of the numbers.")
+	case QuestionYesNo:
+		hint = T(locale, "Please answer yes or no.")
+	default:
+		hint = T(locale, "Please answer the question.")
+	}
+	return hint + "\n" + q.format(locale)
+}
+
+// CreateSurvey stores a survey and returns its ID
+func (d *Database) CreateSurvey(s *Survey) (int64, error) {
+	questions, err := json.Marshal(s.Questions)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode questions: %w", err)
+	}
+
+	var id int64
+	err = d.db.QueryRow(`
+		INSERT INTO surveys (name, intro, outro, questions, timeout_seconds)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id
+	`, s.Name, s.Intro, s.Outro, string(questions), s.TimeoutSeconds).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save survey: %w", err)
+	}
+
+	return id, nil
+}
+
+// surveyColumns are the surveys columns read by scanSurvey
+const surveyColumns = `id, name, intro, outro, questions, timeout_seconds, created_at`
+
+// scanSurvey reads a survey selected with surveyColumns
+func scanSurvey(row interface{ Scan(...any) error }) (Survey, error) {
+	var s Survey
+	var questions, createdAtStr string
+
+	if err := row.Scan(&s.ID, &s.Name, &s.Intro, &s.Outro, &questions, &s.TimeoutSeconds, &createdAtStr); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal([]byte(questions), &s.Questions); err != nil {
+		return s, fmt.Errorf("invalid questions of survey %d: %w", s.ID, err)
+	}
+	s.CreatedAt = parseTimestamp(createdAtStr)
+
+	return s, nil
+}
+
+// GetSurvey retrieves a survey, returning nil if it does not exist
+func (d *Database) GetSurvey(id int64) (*Survey, error) {
+	s, err := scanSurvey(d.db.QueryRow(`SELECT `+surveyColumns+` FROM surveys WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query survey: %w", err)
+	}
+
+	return &s, nil
+}
+
+// ListSurveys retrieves all surveys
+func (d *Database) ListSurveys() ([]Survey, error) {
+	rows, err := d.db.Query(`SELECT ` + surveyColumns + ` FROM surveys ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query surveys: %w", err)
+	}
+	defer rows.Close()
+
+	surveys := []Survey{}
+	for rows.Next() {
+		s, err := scanSurvey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		surveys = append(surveys, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return surveys, nil
+}
+
+// DeleteSurvey removes a survey with its runs and answers, reporting whether it existed
+func (d *Database) DeleteSurvey(id int64) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM survey_answers WHERE run_id IN (SELECT id FROM survey_runs WHERE survey_id = ?)`, id); err != nil {
+		return false, fmt.Errorf("failed to delete survey answers: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM survey_runs WHERE survey_id = ?`, id); err != nil {
+		return false, fmt.Errorf("failed to delete survey runs: %w", err)
+	}
+	res, err := tx.Exec(`DELETE FROM surveys WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete survey: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CreateSurveyRun starts a run of a survey for a number and returns its ID.
+// Only SMS received after lastReceivedID count as answers.
+func (d *Database) CreateSurveyRun(surveyID int64, number, startedBy string, lastReceivedID int) (int64, error) {
+	now := clock.Now().UTC().Format(sqliteTimeFormat)
+	var id int64
+	err := d.db.QueryRow(`
+		INSERT INTO survey_runs (survey_id, number, conversation_id, status, last_received_id, started_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, surveyID, number, ConversationID(number), SurveyRunActive, lastReceivedID, startedBy, now, now).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save survey run: %w", err)
+	}
+
+	return id, nil
+}
+
+// surveyRunColumns are the survey_runs columns read by scanSurveyRun
+const surveyRunColumns = `id, survey_id, number, status, current_question, COALESCE(error, ''), last_received_id,
+	started_by, created_at, updated_at, COALESCE(completed_at, '')`
+
+// scanSurveyRun reads a survey run selected with surveyRunColumns
+func scanSurveyRun(row interface{ Scan(...any) error }) (SurveyRun, error) {
+	var r SurveyRun
+	var createdAtStr, updatedAtStr, completedAtStr string
+
+	err := row.Scan(&r.ID, &r.SurveyID, &r.Number, &r.Status, &r.CurrentQuestion, &r.Error, &r.lastReceivedID,
+		&r.StartedBy, &createdAtStr, &updatedAtStr, &completedAtStr)
+	if err != nil {
+		return r, err
+	}
+
+	r.CreatedAt = parseTimestamp(createdAtStr)
+	r.UpdatedAt = parseTimestamp(updatedAtStr)
+	if completedAtStr != "" {
+		completedAt := parseTimestamp(completedAtStr)
+		r.CompletedAt = &completedAt
+	}
+
+	return r, nil
+}
+
+// GetSurveyRun retrieves a run with its answers, returning nil if it does not exist
+func (d *Database) GetSurveyRun(id int64) (*SurveyRun, error) {
+	r, err := scanSurveyRun(d.db.QueryRow(`SELECT `+surveyRunColumns+` FROM survey_runs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query survey run: %w", err)
+	}
+
+	if r.Answers, err = d.getSurveyAnswers(id); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// ListSurveyRuns retrieves the runs of a survey with their answers, oldest
+// first. An empty status lists all runs and a limit of 0 lists every run.
+func (d *Database) ListSurveyRuns(surveyID int64, status string, limit, offset int) ([]SurveyRun, error) {
+	if limit == 0 {
+		limit = -1
+	}
+
+	rows, err := d.db.Query(`
+		SELECT `+surveyRunColumns+`
+		FROM survey_runs
+		WHERE survey_id = ? AND (? = '' OR status = ?)
+		ORDER BY id
+		LIMIT ? OFFSET ?
+	`, surveyID, status, status, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query survey runs: %w", err)
+	}
+
+	runs := []SurveyRun{}
+	for rows.Next() {
+		r, err := scanSurveyRun(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		runs = append(runs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for i := range runs {
+		if runs[i].Answers, err = d.getSurveyAnswers(runs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return runs, nil
+}
+
+// ActiveSurveyRunFor returns the ID of the active run of a number, or 0 if there is none
+func (d *Database) ActiveSurveyRunFor(number string) (int64, error) {
+	var id int64
+	err := d.db.QueryRow(`SELECT id FROM survey_runs WHERE conversation_id = ? AND status = ?`,
+		ConversationID(number), SurveyRunActive).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query survey runs: %w", err)
+	}
+
+	return id, nil
+}
+
+// ListActiveSurveyRunIDs returns the IDs of runs waiting for an answer
+func (d *Database) ListActiveSurveyRunIDs() ([]int64, error) {
+	rows, err := d.db.Query(`SELECT id FROM survey_runs WHERE status = ? ORDER BY id`, SurveyRunActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query survey runs: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// getSurveyAnswers retrieves the answers of a run in question order
+func (d *Database) getSurveyAnswers(runID int64) ([]SurveyAnswer, error) {
+	rows, err := d.db.Query(`
+		SELECT question, answer, received_sms_id, created_at
+		FROM survey_answers
+		WHERE run_id = ?
+		ORDER BY question
+	`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query survey answers: %w", err)
+	}
+	defer rows.Close()
+
+	answers := []SurveyAnswer{}
+	for rows.Next() {
+		var a SurveyAnswer
+		var createdAtStr string
+
+		if err := rows.Scan(&a.Question, &a.Answer, &a.ReceivedSMSID, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		a.AnsweredAt = parseTimestamp(createdAtStr)
+		answers = append(answers, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return answers, nil
+}
+
+// SaveSurveyAnswer records an answer and moves the run to the next question
+func (d *Database) SaveSurveyAnswer(runID int64, question int, answer string, receivedSMSID int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO survey_answers (run_id, question, answer, received_sms_id)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(run_id, question) DO UPDATE SET
+			answer = excluded.answer, received_sms_id = excluded.received_sms_id, created_at = `+d.dialect().now()+`
+	`, runID, question, answer, receivedSMSID); err != nil {
+		return fmt.Errorf("failed to save survey answer: %w", err)
+	}
+	if _, err := tx.Exec(`
+		UPDATE survey_runs SET current_question = ?, last_received_id = ?, updated_at = ?
+		WHERE id = ?
+	`, question+1, receivedSMSID, clock.Now().UTC().Format(sqliteTimeFormat), runID); err != nil {
+		return fmt.Errorf("failed to update survey run: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// SkipSurveyReply marks a reply as handled without recording an answer
+func (d *Database) SkipSurveyReply(runID int64, receivedSMSID int) error {
+	_, err := d.db.Exec(`UPDATE survey_runs SET last_received_id = ?, updated_at = ? WHERE id = ?`,
+		receivedSMSID, clock.Now().UTC().Format(sqliteTimeFormat), runID)
+	if err != nil {
+		return fmt.Errorf("failed to update survey run: %w", err)
+	}
+
+	return nil
+}
+
+// SetSurveyRunStatus finishes a run, recording errMsg for failed runs
+func (d *Database) SetSurveyRunStatus(id int64, status, errMsg string) error {
+	now := clock.Now().UTC().Format(sqliteTimeFormat)
+	var completedAt any
+	if status == SurveyRunCompleted {
+		completedAt = now
+	}
+
+	_, err := d.db.Exec(`
+		UPDATE survey_runs SET status = ?, error = ?, completed_at = ?, updated_at = ?
+		WHERE id = ?
+	`, status, errMsg, completedAt, now, id)
+	if err != nil {
+		return fmt.Errorf("failed to update survey run: %w", err)
+	}
+
+	return nil
+}
+
+// sendSurveyText sends a question or closing message of a run. Survey
+// messages bypass deduplication and alert storm digests, so repeated
+// questions are always delivered. A failed send fails the run.
+func (app *App) sendSurveyText(r *SurveyRun, content string) error {
+	if _, err := app.deliverSMSNow(context.Background(), r.StartedBy, r.Number, content, SendOptions{}); err != nil {
+		log.Printf("Survey run %d: failed to send to %s: %v", r.ID, r.Number, err)
+		return app.db.SetSurveyRunStatus(r.ID, SurveyRunFailed, err.Error())
+	}
+
+	return nil
+}
+
+// advanceSurveyRun processes the replies to an active run in order: valid
+// answers are stored and followed by the next question, invalid ones by the
+// question again. Runs without an answer within the timeout expire. Must be
+// called with the surveys lock held.
+func (app *App) advanceSurveyRun(id int64) error {
+	for {
+		r, err := app.db.GetSurveyRun(id)
+		if err != nil || r == nil || r.Status != SurveyRunActive {
+			return err
+		}
+
+		s, err := app.db.GetSurvey(r.SurveyID)
+		if err != nil {
+			return err
+		}
+		if s == nil || r.CurrentQuestion >= len(s.Questions) {
+			return app.db.SetSurveyRunStatus(id, SurveyRunCancelled, "")
+		}
+
+		reply, err := app.db.GetReplyAfter(r.Number, r.lastReceivedID)
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			if clock.Now().Sub(r.UpdatedAt) >= time.Duration(s.TimeoutSeconds)*time.Second {
+				log.Printf("Survey run %d expired without an answer from %s", id, r.Number)
+				return app.db.SetSurveyRunStatus(id, SurveyRunExpired, "")
+			}
+			return nil
+		}
+
+		question := s.Questions[r.CurrentQuestion]
+		answer, ok := question.parseAnswer(reply.Content, app.locale)
+		if !ok {
+			if err := app.db.SkipSurveyReply(id, reply.ID); err != nil {
+				return err
+			}
+			if err := app.sendSurveyText(r, question.retryText(app.locale)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := app.db.SaveSurveyAnswer(id, r.CurrentQuestion, answer, reply.ID); err != nil {
+			return err
+		}
+
+		next := r.CurrentQuestion + 1
+		if next < len(s.Questions) {
+			if err := app.sendSurveyText(r, s.Questions[next].format(app.locale)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Printf("Survey run %d completed by %s", id, r.Number)
+		if err := app.db.SetSurveyRunStatus(id, SurveyRunCompleted, ""); err != nil {
+			return err
+		}
+		if s.Outro != "" {
+			if _, err := app.deliverSMSNow(context.Background(), r.StartedBy, r.Number, s.Outro, SendOptions{}); err != nil {
+				log.Printf("Survey run %d: failed to send closing message to %s: %v", id, r.Number, err)
+			}
+		}
+		return nil
+	}
+}
+
+// advanceSurveyRuns advances every active run
+func (app *App) advanceSurveyRuns() {
+	ids, err := app.db.ListActiveSurveyRunIDs()
+	if err != nil {
+		log.Printf("Surveys: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		app.surveys.mu.Lock()
+		if err := app.advanceSurveyRun(id); err != nil {
+			log.Printf("Survey run %d: %v", id, err)
+		}
+		app.surveys.mu.Unlock()
+	}
+}
+
+// runSurveyJob advances active runs whenever an SMS is received, and
+// periodically to expire runs nobody answers
+func (app *App) runSurveyJob() {
+	ticker := clock.NewTicker(surveyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// Subscribe before advancing so a reply saved in between is not missed
+		wait := app.receivedNotifier.Wait()
+		app.advanceSurveyRuns()
+
+		select {
+		case <-wait:
+		case <-ticker.C():
+		}
+	}
+}
+
+// surveyFromParam loads the survey named by the id path parameter, writing
+// an error response and returning nil if it cannot
+func (app *App) surveyFromParam(c *gin.Context) *Survey {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid survey ID"))
+		return nil
+	}
+
+	s, err := app.db.GetSurvey(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get survey: %v", err))
+		return nil
+	}
+	if s == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Survey %d not found", id))
+		return nil
+	}
+
+	return s
+}
+
+// createSurvey defines a survey
+func (app *App) createSurvey(c *gin.Context) {
+	var req SurveyRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	if len(req.Questions) == 0 {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "A survey needs at least one question"))
+		return
+	}
+	for i, question := range req.Questions {
+		if err := question.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid question %d: %v", i+1, err))
+			return
+		}
+	}
+
+	timeout := defaultSurveyTimeout
+	if req.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(req.Timeout)
+		if err != nil || timeout < time.Minute {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid timeout %q (minimum 1m)", req.Timeout))
+			return
+		}
+	}
+
+	s := &Survey{
+		Name:           req.Name,
+		Intro:          req.Intro,
+		Outro:          req.Outro,
+		Questions:      req.Questions,
+		TimeoutSeconds: int(timeout.Seconds()),
+	}
+	id, err := app.db.CreateSurvey(s)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to create survey: %v", err))
+		return
+	}
+
+	s, err = app.db.GetSurvey(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get survey: %v", err))
+		return
+	}
+
+	log.Printf("Created survey %d (%s) with %d questions", id, s.Name, len(s.Questions))
+	c.JSON(http.StatusCreated, gin.H{
+		"status": "success",
+		"survey": s,
+	})
+}
+
+// listSurveys returns all surveys
+func (app *App) listSurveys(c *gin.Context) {
+	surveys, err := app.db.ListSurveys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list surveys: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"surveys": surveys,
+	})
+}
+
+// getSurvey returns a survey
+func (app *App) getSurvey(c *gin.Context) {
+	s := app.surveyFromParam(c)
+	if s == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"survey": s,
+	})
+}
+
+// deleteSurvey removes a survey with its runs and results
+func (app *App) deleteSurvey(c *gin.Context) {
+	s := app.surveyFromParam(c)
+	if s == nil {
+		return
+	}
+
+	app.surveys.mu.Lock()
+	_, err := app.db.DeleteSurvey(s.ID)
+	app.surveys.mu.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete survey: %v", err))
+		return
+	}
+
+	log.Printf("Deleted survey %d (%s)", s.ID, s.Name)
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// startSurvey sends the first question of a survey to a number. A number
+// answers one survey at a time.
+func (app *App) startSurvey(c *gin.Context) {
+	s := app.surveyFromParam(c)
+	if s == nil {
+		return
+	}
+
+	var req SurveyStartRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+
+	number := app.resolveTarget(req.Number)
+	first := s.Questions[0].format(app.locale)
+	if s.Intro != "" {
+		first = s.Intro + "\n\n" + first
+	}
+	if err := app.validateSMS(number, first, SendOptions{}); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
+		return
+	}
+
+	app.surveys.mu.Lock()
+	defer app.surveys.mu.Unlock()
+
+	active, err := app.db.ActiveSurveyRunFor(number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to start survey: %v", err))
+		return
+	}
+	if active != 0 {
+		resp := errorResponse(c, CodeConflict, "%s is already answering a survey", number)
+		resp.Details = gin.H{"run_id": active}
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+
+	// Only messages received after this point count as answers
+	version, err := app.db.GetTableVersion("received_sms")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to start survey: %v", err))
+		return
+	}
+
+	id, err := app.db.CreateSurveyRun(s.ID, number, keyIDFromContext(c), version.MaxID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to start survey: %v", err))
+		return
+	}
+
+	r, err := app.db.GetSurveyRun(id)
+	if err == nil {
+		err = app.sendSurveyText(r, first)
+	}
+	if err == nil {
+		r, err = app.db.GetSurveyRun(id)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to start survey: %v", err))
+		return
+	}
+	if r.Status == SurveyRunFailed {
+		c.JSON(http.StatusBadGateway, errorResponse(c, CodeSendFailed, "Failed to send SMS: %v", r.Error))
+		return
+	}
+
+	log.Printf("Started survey %d (%s) for %s as run %d", s.ID, s.Name, number, id)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": "success",
+		"run":    r,
+	})
+}
+
+// cancelSurveyRun stops an active run without notifying the number
+func (app *App) cancelSurveyRun(c *gin.Context) {
+	s := app.surveyFromParam(c)
+	if s == nil {
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid survey run ID"))
+		return
+	}
+
+	app.surveys.mu.Lock()
+	defer app.surveys.mu.Unlock()
+
+	r, err := app.db.GetSurveyRun(runID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get survey run: %v", err))
+		return
+	}
+	if r == nil || r.SurveyID != s.ID {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Survey run %d not found", runID))
+		return
+	}
+	if r.Status != SurveyRunActive {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Survey run %d is %s", r.ID, r.Status))
+		return
+	}
+
+	if err := app.db.SetSurveyRunStatus(r.ID, SurveyRunCancelled, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to cancel survey run: %v", err))
+		return
+	}
+	log.Printf("Survey run %d cancelled by %s", r.ID, keyIDFromContext(c))
+
+	r.Status = SurveyRunCancelled
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"run":    r,
+	})
+}
+
+// getSurveyResults returns the runs of a survey with their answers as JSON,
+// or every run as CSV (format=csv) with one column per question
+func (app *App) getSurveyResults(c *gin.Context) {
+	s := app.surveyFromParam(c)
+	if s == nil {
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", SurveyRunActive, SurveyRunCompleted, SurveyRunExpired, SurveyRunCancelled, SurveyRunFailed:
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid status %q", status))
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		runs, err := app.db.ListSurveyRuns(s.ID, status, 0, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list survey runs: %v", err))
+			return
+		}
+
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=survey-%d.csv", s.ID))
+
+		w := csv.NewWriter(c.Writer)
+		header := []string{"run_id", "number", "status", "started_at", "completed_at"}
+		for _, question := range s.Questions {
+			header = append(header, question.Text)
+		}
+		w.Write(header)
+
+		for _, r := range runs {
+			completedAt := ""
+			if r.CompletedAt != nil {
+				completedAt = r.CompletedAt.Format(time.RFC3339)
+			}
+			row := []string{strconv.FormatInt(r.ID, 10), r.Number, r.Status, r.CreatedAt.Format(time.RFC3339), completedAt}
+			answers := make([]string, len(s.Questions))
+			for _, a := range r.Answers {
+				if a.Question < len(answers) {
+					answers[a.Question] = a.Answer
+				}
+			}
+			w.Write(append(row, answers...))
+		}
+
+		w.Flush()
+		return
+	}
+
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	runs, err := app.db.ListSurveyRuns(s.ID, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list survey runs: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"survey": s,
+		"count":  len(runs),
+		"runs":   runs,
+	})
+}
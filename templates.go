@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// templateNamePattern restricts template names to URL-safe identifiers
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// TemplateVersion is one immutable text of a message template, with its
+// translations. Versions are numbered from 1 per template; a send references
+// one by template name and version, and must use its text.
+type TemplateVersion struct {
+	Template     string            `json:"template"`
+	Version      int               `json:"version"`
+	Content      string            `json:"content"`                // default text
+	Translations map[string]string `json:"translations,omitempty"` // text by language, see contacts.go
+	Approved     bool              `json:"approved"`
+	ApprovedBy   string            `json:"approved_by,omitempty"`
+	ApprovedAt   *time.Time        `json:"approved_at,omitempty"`
+	CreatedBy    string            `json:"created_by"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Sent         int               `json:"sent"` // sends recorded under the version
+}
+
+// TemplateVersionRequest represents a request to add a template version
+type TemplateVersionRequest struct {
+	Content      string            `json:"content"`
+	Translations map[string]string `json:"translations,omitempty"`
+}
+
+// Translate returns the text of the version in a language: the translation
+// for the language, else for its base language ("de" for "de-at"), else the
+// default text
+func (v *TemplateVersion) Translate(language string) string {
+	if text, ok := v.Translations[language]; ok {
+		return text
+	}
+	if base, _, found := strings.Cut(language, "-"); found {
+		if text, ok := v.Translations[base]; ok {
+			return text
+		}
+	}
+	return v.Content
+}
+
+// hasText reports whether content is the default text or a translation of the version
+func (v *TemplateVersion) hasText(content string) bool {
+	if content == v.Content {
+		return true
+	}
+	for _, text := range v.Translations {
+		if content == text {
+			return true
+		}
+	}
+	return false
+}
+
+// templateVersionColumns are the template_versions columns read by scanTemplateVersion
+const templateVersionColumns = `t.template, t.version, t.content, t.approved_by IS NOT NULL, COALESCE(t.approved_by, ''),
+	COALESCE(t.approved_at, ''), t.created_by, t.created_at,
+	(SELECT COUNT(*) FROM sent_sms s WHERE s.template = t.template AND s.template_version = t.version)`
+
+// scanTemplateVersion reads a version selected with templateVersionColumns
+func scanTemplateVersion(row interface{ Scan(...any) error }) (TemplateVersion, error) {
+	var v TemplateVersion
+	var approvedAtStr, createdAtStr string
+	if err := row.Scan(&v.Template, &v.Version, &v.Content, &v.Approved, &v.ApprovedBy, &approvedAtStr, &v.CreatedBy,
+		&createdAtStr, &v.Sent); err != nil {
+		return v, err
+	}
+	if approvedAtStr != "" {
+		approvedAt := parseTimestamp(approvedAtStr)
+		v.ApprovedAt = &approvedAt
+	}
+	v.CreatedAt = parseTimestamp(createdAtStr)
+	return v, nil
+}
+
+// AddTemplateVersion stores a new, unapproved version of a template with its
+// translations, creating the template with version 1
+func (d *Database) AddTemplateVersion(template, content string, translations map[string]string, createdBy string) (*TemplateVersion, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM template_versions WHERE template = ?`, template).Scan(&version); err != nil {
+		return nil, fmt.Errorf("failed to query template versions: %w", err)
+	}
+
+	if _, err := tx.Exec(`INSERT INTO template_versions (template, version, content, created_by, created_at) VALUES (?, ?, ?, ?, ?)`,
+		template, version, content, createdBy, time.Now().UTC().Format(sqliteTimeFormat)); err != nil {
+		return nil, fmt.Errorf("failed to save template version: %w", err)
+	}
+	for language, text := range translations {
+		if _, err := tx.Exec(`INSERT INTO template_translations (template, version, language, content) VALUES (?, ?, ?, ?)`,
+			template, version, language, text); err != nil {
+			return nil, fmt.Errorf("failed to save template translation: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit template version: %w", err)
+	}
+
+	return d.GetTemplateVersion(template, version)
+}
+
+// GetTemplateVersion retrieves a template version, returning nil if it does not exist
+func (d *Database) GetTemplateVersion(template string, version int) (*TemplateVersion, error) {
+	v, err := scanTemplateVersion(d.db.QueryRow(`
+		SELECT `+templateVersionColumns+`
+		FROM template_versions t
+		WHERE t.template = ? AND t.version = ?
+	`, template, version))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query template version: %w", err)
+	}
+
+	versions := []TemplateVersion{v}
+	if err := d.loadTemplateTranslations(template, versions); err != nil {
+		return nil, err
+	}
+	return &versions[0], nil
+}
+
+// ListTemplateVersions retrieves the versions of a template, or of every
+// template if template is empty, oldest first
+func (d *Database) ListTemplateVersions(template string) ([]TemplateVersion, error) {
+	query := `SELECT ` + templateVersionColumns + ` FROM template_versions t`
+	var args []any
+	if template != "" {
+		query += ` WHERE t.template = ?`
+		args = append(args, template)
+	}
+	query += ` ORDER BY t.template, t.version`
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query template versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []TemplateVersion{}
+	for rows.Next() {
+		v, err := scanTemplateVersion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if err := d.loadTemplateTranslations(template, versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// loadTemplateTranslations fills in the translations of versions of a
+// template, or of every template if template is empty
+func (d *Database) loadTemplateTranslations(template string, versions []TemplateVersion) error {
+	query := `SELECT template, version, language, content FROM template_translations`
+	var args []any
+	if template != "" {
+		query += ` WHERE template = ?`
+		args = append(args, template)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query template translations: %w", err)
+	}
+	defer rows.Close()
+
+	type versionKey struct {
+		template string
+		version  int
+	}
+	byVersion := make(map[versionKey]*TemplateVersion, len(versions))
+	for i := range versions {
+		byVersion[versionKey{versions[i].Template, versions[i].Version}] = &versions[i]
+	}
+
+	for rows.Next() {
+		var key versionKey
+		var language, text string
+		if err := rows.Scan(&key.template, &key.version, &language, &text); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if v := byVersion[key]; v != nil {
+			if v.Translations == nil {
+				v.Translations = make(map[string]string)
+			}
+			v.Translations[language] = text
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return nil
+}
+
+// ApproveTemplateVersion marks a version approved, reporting whether it was
+// unapproved before. Approval can't be revoked: retire a version by adding a
+// new one.
+func (d *Database) ApproveTemplateVersion(template string, version int, approvedBy string) (bool, error) {
+	res, err := d.db.Exec(`UPDATE template_versions SET approved_by = ?, approved_at = ? WHERE template = ? AND version = ? AND approved_by IS NULL`,
+		approvedBy, time.Now().UTC().Format(sqliteTimeFormat), template, version)
+	if err != nil {
+		return false, fmt.Errorf("failed to approve template version: %w", err)
+	}
+
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// validateTemplateVersion checks that a send referencing a template version
+// uses its approved text, the default or a translation. With TEMPLATE_APPROVAL=true campaign sends must
+// reference one.
+func (app *App) validateTemplateVersion(content string, opts SendOptions) error {
+	if opts.TemplateVersion == 0 {
+		if app.templateApproval && opts.Campaign != "" {
+			return apiErrorf(CodeTemplateNotApproved, "Campaign sends must reference an approved template version")
+		}
+		return nil
+	}
+
+	if opts.Template == "" {
+		return apiErrorf(CodeInvalidRequest, "template_version requires a template")
+	}
+	v, err := app.db.GetTemplateVersion(opts.Template, opts.TemplateVersion)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return apiErrorf(CodeInvalidRequest, "Template %s has no version %d", opts.Template, opts.TemplateVersion)
+	}
+	if !v.Approved {
+		return apiErrorf(CodeTemplateNotApproved, "Version %d of template %s is not approved", v.Version, v.Template)
+	}
+	if !v.hasText(content) {
+		return apiErrorf(CodeTemplateNotApproved, "Content differs from version %d of template %s", v.Version, v.Template)
+	}
+	return nil
+}
+
+// localizeTemplate returns the text of the template version a validated send
+// references in the language of the recipient's contact, or content if the
+// send references none or the recipient has no language
+func (app *App) localizeTemplate(number, content string, opts SendOptions) string {
+	if opts.TemplateVersion == 0 {
+		return content
+	}
+
+	contact, err := app.db.GetContact(number)
+	if err != nil {
+		log.Printf("Failed to get contact language of %s: %v", number, err)
+		return content
+	}
+	if contact == nil || contact.Language == "" {
+		return content
+	}
+
+	v, err := app.db.GetTemplateVersion(opts.Template, opts.TemplateVersion)
+	if err != nil || v == nil {
+		log.Printf("Failed to get version %d of template %s: %v", opts.TemplateVersion, opts.Template, err)
+		return content
+	}
+	return v.Translate(contact.Language)
+}
+
+// listTemplates returns every version of every template
+func (app *App) listTemplates(c *gin.Context) {
+	versions, err := app.db.ListTemplateVersions("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list templates: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"versions": versions,
+	})
+}
+
+// getTemplate returns the versions of a template
+func (app *App) getTemplate(c *gin.Context) {
+	name := c.Param("name")
+
+	versions, err := app.db.ListTemplateVersions(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list templates: %v", err))
+		return
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Template %s not found", name))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"template": name,
+		"versions": versions,
+	})
+}
+
+// addTemplateVersion stores a new version of a template, waiting for approval
+func (app *App) addTemplateVersion(c *gin.Context) {
+	name := c.Param("name")
+	if !templateNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid template name %q (1-64 letters, digits, '-' or '_')", name))
+		return
+	}
+
+	var req TemplateVersionRequest
+	if !bindStrictJSON(c, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidContent, "Template content cannot be empty"))
+		return
+	}
+	translations := make(map[string]string, len(req.Translations))
+	for language, text := range req.Translations {
+		normalized, err := normalizeLanguage(language)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid translation: %v", err))
+			return
+		}
+		if _, ok := translations[normalized]; ok {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Duplicate translation for %s", normalized))
+			return
+		}
+		if strings.TrimSpace(text) == "" {
+			c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidContent, "Translation for %s cannot be empty", normalized))
+			return
+		}
+		translations[normalized] = text
+	}
+
+	v, err := app.db.AddTemplateVersion(name, req.Content, translations, keyIDFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to save template: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status":  "success",
+		"version": v,
+	})
+}
+
+// approveTemplateVersion approves a template version for sending
+func (app *App) approveTemplateVersion(c *gin.Context) {
+	name := c.Param("name")
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid template version"))
+		return
+	}
+
+	v, err := app.db.GetTemplateVersion(name, version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get template: %v", err))
+		return
+	}
+	if v == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Template %s has no version %d", name, version))
+		return
+	}
+
+	approved, err := app.db.ApproveTemplateVersion(name, version, keyIDFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to approve template: %v", err))
+		return
+	}
+	if !approved {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Version %d of template %s is already approved", version, name))
+		return
+	}
+
+	if v, err = app.db.GetTemplateVersion(name, version); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get template: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"version": v,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// TenantScopes limit the events that API keys receive over WebSocket and
+// webhooks to their own messages and routing targets. Keys without a scope
+// receive every event.
+type TenantScopes struct {
+	scopes map[string]*EventScope // by API key (token subject)
+	router *Router
+}
+
+// LoadTenantScopes reads TENANT_SCOPES, e.g. "shop=bulk;helpdesk=support,a1":
+// API keys followed by the number groups and devices whose received SMS they
+// get. Without routing the only device is primary. It returns nil if the
+// variable is not set.
+func LoadTenantScopes(router *Router) (*TenantScopes, error) {
+	value := strings.TrimSpace(os.Getenv("TENANT_SCOPES"))
+	if value == "" {
+		return nil, nil
+	}
+
+	t := &TenantScopes{scopes: make(map[string]*EventScope), router: router}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		keyID, targets, found := strings.Cut(entry, "=")
+		keyID = strings.TrimSpace(keyID)
+		if !found || keyID == "" {
+			return nil, fmt.Errorf("TENANT_SCOPES: invalid entry %q (expected key=group,device)", entry)
+		}
+		if t.scopes[keyID] != nil {
+			return nil, fmt.Errorf("TENANT_SCOPES: duplicate key %q", keyID)
+		}
+
+		scope := &EventScope{KeyID: keyID, Devices: make(map[string]bool), device: t.deviceOf}
+		for _, target := range splitList(targets) {
+			devices, err := t.resolve(target)
+			if err != nil {
+				return nil, fmt.Errorf("TENANT_SCOPES: %w", err)
+			}
+			for _, device := range devices {
+				scope.Devices[device] = true
+			}
+		}
+		t.scopes[keyID] = scope
+	}
+
+	return t, nil
+}
+
+// resolve returns the devices of a routing target, a number group or a device
+func (t *TenantScopes) resolve(target string) ([]string, error) {
+	if t.router == nil {
+		if target == routingPrimary {
+			return []string{routingPrimary}, nil
+		}
+		return nil, fmt.Errorf("unknown routing target %q (only %s without routing)", target, routingPrimary)
+	}
+
+	if group := t.router.Group(target); group != nil {
+		devices := make([]string, 0, len(group.Devices))
+		for _, device := range group.Devices {
+			devices = append(devices, device.Name)
+		}
+		return devices, nil
+	}
+	if device := t.router.Device(target); device != nil {
+		return []string{device.Name}, nil
+	}
+	return nil, fmt.Errorf("unknown routing target %q", target)
+}
+
+// deviceOf returns the device that received an SMS, found by the SIM's own
+// number, or an empty string if it is unknown
+func (t *TenantScopes) deviceOf(ownNumber string) string {
+	if t.router == nil {
+		return routingPrimary
+	}
+	if ownNumber == "" {
+		return ""
+	}
+	for _, device := range t.router.Devices {
+		if device.Conn == nil {
+			continue
+		}
+		if number, _ := device.Conn.OwnNumber(); number == ownNumber {
+			return device.Name
+		}
+	}
+	return ""
+}
+
+// Scope returns the scope of an API key, or nil if the key receives every
+// event. It returns nil on nil scopes, i.e. when TENANT_SCOPES is not set.
+func (t *TenantScopes) Scope(keyID string) *EventScope {
+	if t == nil || keyID == "" {
+		return nil
+	}
+	return t.scopes[keyID]
+}
+
+// String describes the scopes for the startup log
+func (t *TenantScopes) String() string {
+	keys := make([]string, 0, len(t.scopes))
+	for keyID, scope := range t.scopes {
+		devices := make([]string, 0, len(scope.Devices))
+		for device := range scope.Devices {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		keys = append(keys, fmt.Sprintf("%s (%s)", keyID, strings.Join(devices, ", ")))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "; ")
+}
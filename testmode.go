@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// TestMode restricts real sends to allowlisted numbers, so staging environments
+// can run against real hardware. Sends to all other numbers are simulated.
+type TestMode struct {
+	allowlist []string
+}
+
+// LoadTestMode reads test mode settings from environment variables.
+// It returns nil if TEST_MODE is not enabled.
+func LoadTestMode() *TestMode {
+	switch strings.ToLower(os.Getenv("TEST_MODE")) {
+	case "1", "true", "yes", "on":
+	default:
+		return nil
+	}
+
+	return &TestMode{allowlist: splitList(os.Getenv("TEST_MODE_ALLOWLIST"))}
+}
+
+// Allows returns whether an SMS to number is really sent. Allowlist entries
+// ending in "*" match a number prefix. A nil TestMode allows every number.
+func (t *TestMode) Allows(number string) bool {
+	if t == nil {
+		return true
+	}
+
+	for _, entry := range t.allowlist {
+		if prefix, found := strings.CutSuffix(entry, "*"); found {
+			if strings.HasPrefix(number, prefix) {
+				return true
+			}
+		} else if number == entry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Thread statuses
+const (
+	ThreadOpen   = "open"
+	ThreadClosed = "closed"
+)
+
+// Thread is a support conversation with one number
+type Thread struct {
+	ID           int        `json:"id"`
+	Number       string     `json:"number"`
+	Status       string     `json:"status"`
+	MessageCount int        `json:"message_count"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	ClosedAt     *time.Time `json:"closed_at,omitempty"`
+}
+
+// ThreadMessage is a received or sent message in a thread
+type ThreadMessage struct {
+	ID        int       `json:"id"`
+	Direction string    `json:"direction"` // in or out
+	Content   string    `json:"content"`
+	Status    string    `json:"status,omitempty"` // send status of outbound messages
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ThreadReplyRequest represents a reply to a thread
+type ThreadReplyRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// threadColumns are the columns selected for a Thread
+const threadColumns = `
+	t.id, t.number, t.status, t.created_at, t.updated_at, COALESCE(t.closed_at, ''),
+	(SELECT COUNT(*) FROM received_sms WHERE thread_id = t.id) +
+	(SELECT COUNT(*) FROM sent_sms WHERE thread_id = t.id)
+`
+
+// scanThread scans a row selected with threadColumns
+func scanThread(row interface{ Scan(...interface{}) error }) (Thread, error) {
+	var thread Thread
+	var createdAtStr, updatedAtStr, closedAtStr string
+
+	err := row.Scan(&thread.ID, &thread.Number, &thread.Status, &createdAtStr, &updatedAtStr, &closedAtStr, &thread.MessageCount)
+	if err != nil {
+		return thread, err
+	}
+
+	thread.CreatedAt = parseTimestamp(createdAtStr)
+	thread.UpdatedAt = parseTimestamp(updatedAtStr)
+	if closedAtStr != "" {
+		closedAt := parseTimestamp(closedAtStr)
+		thread.ClosedAt = &closedAt
+	}
+
+	return thread, nil
+}
+
+// AddToThread links a received SMS to the open thread for its number,
+// opening a new thread if there is none. It returns the thread ID and
+// whether a new thread was opened.
+func (d *Database) AddToThread(msg ReceivedSMS) (int64, bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	opened := false
+
+	var threadID int64
+	err = tx.QueryRow(`SELECT id FROM threads WHERE number = ? AND status = ? ORDER BY id DESC LIMIT 1`, msg.Number, ThreadOpen).Scan(&threadID)
+	if err == sql.ErrNoRows {
+		err := tx.QueryRow(`INSERT INTO threads (number, status) VALUES (?, ?) RETURNING id`, msg.Number, ThreadOpen).Scan(&threadID)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to open thread: %w", err)
+		}
+		opened = true
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to query threads: %w", err)
+	}
+
+	if _, err := tx.Exec(`UPDATE received_sms SET thread_id = ? WHERE id = ?`, threadID, msg.ID); err != nil {
+		return 0, false, fmt.Errorf("failed to link SMS to thread: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE threads SET updated_at = `+d.dialect().now()+` WHERE id = ?`, threadID); err != nil {
+		return 0, false, fmt.Errorf("failed to update thread: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit thread update: %w", err)
+	}
+
+	return threadID, opened, nil
+}
+
+// AddReplyToThread links a sent SMS to a thread
+func (d *Database) AddReplyToThread(threadID int, sentID int64) error {
+	if _, err := d.db.Exec(`UPDATE sent_sms SET thread_id = ? WHERE id = ?`, threadID, sentID); err != nil {
+		return fmt.Errorf("failed to link SMS to thread: %w", err)
+	}
+	if _, err := d.db.Exec(`UPDATE threads SET updated_at = `+d.dialect().now()+` WHERE id = ?`, threadID); err != nil {
+		return fmt.Errorf("failed to update thread: %w", err)
+	}
+	return nil
+}
+
+// GetThread retrieves a thread by ID, returning nil if it does not exist
+func (d *Database) GetThread(id int) (*Thread, error) {
+	row := d.db.QueryRow(`SELECT `+threadColumns+` FROM threads t WHERE t.id = ?`, id)
+
+	thread, err := scanThread(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query thread: %w", err)
+	}
+
+	return &thread, nil
+}
+
+// ListThreads retrieves threads with a status ("" for all), most recently active first
+func (d *Database) ListThreads(status string, limit, offset int) ([]Thread, error) {
+	rows, err := d.db.Query(`
+		SELECT `+threadColumns+`
+		FROM threads t
+		WHERE ? = '' OR t.status = ?
+		ORDER BY t.updated_at DESC, t.id DESC
+		LIMIT ? OFFSET ?
+	`, status, status, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query threads: %w", err)
+	}
+	defer rows.Close()
+
+	threads := []Thread{}
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		threads = append(threads, thread)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return threads, nil
+}
+
+// GetThreadMessages retrieves the received and sent messages of a thread, oldest first
+func (d *Database) GetThreadMessages(threadID int) ([]ThreadMessage, error) {
+	rows, err := d.db.Query(`
+		SELECT id, 'in', content, '', created_at FROM received_sms WHERE thread_id = ?
+		UNION ALL
+		SELECT id, 'out', content, status, created_at FROM sent_sms WHERE thread_id = ?
+		ORDER BY 5, 2
+	`, threadID, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query thread messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []ThreadMessage{}
+	for rows.Next() {
+		var msg ThreadMessage
+		var createdAtStr string
+
+		if err := rows.Scan(&msg.ID, &msg.Direction, &msg.Content, &msg.Status, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		msg.CreatedAt = parseTimestamp(createdAtStr)
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return messages, nil
+}
+
+// CloseThread closes an open thread, reporting whether it was open
+func (d *Database) CloseThread(id int) (bool, error) {
+	res, err := d.db.Exec(`
+		UPDATE threads
+		SET status = ?, closed_at = `+d.dialect().now()+`, updated_at = `+d.dialect().now()+`
+		WHERE id = ? AND status = ?
+	`, ThreadClosed, id, ThreadOpen)
+	if err != nil {
+		return false, fmt.Errorf("failed to close thread: %w", err)
+	}
+
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// threadFromParam loads the thread named by the :id parameter, writing an
+// error response and returning nil if it can't be found
+func (app *App) threadFromParam(c *gin.Context) *Thread {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid thread ID"))
+		return nil
+	}
+
+	thread, err := app.db.GetThread(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get thread: %v", err))
+		return nil
+	}
+	if thread == nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Thread %d not found", id))
+		return nil
+	}
+
+	return thread
+}
+
+// listThreads returns threads filtered by status (open, closed or all; default open)
+func (app *App) listThreads(c *gin.Context) {
+	status := c.DefaultQuery("status", ThreadOpen)
+	switch status {
+	case ThreadOpen, ThreadClosed:
+	case "all":
+		status = ""
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid 'status' parameter, expected open, closed or all"))
+		return
+	}
+
+	limit := 50
+	offset := 0
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100 // Cap at 100
+			}
+		}
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	threads, err := app.db.ListThreads(status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list threads: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"count":   len(threads),
+		"threads": threads,
+	})
+}
+
+// getThread returns a thread with its messages
+func (app *App) getThread(c *gin.Context) {
+	thread := app.threadFromParam(c)
+	if thread == nil {
+		return
+	}
+
+	messages, err := app.db.GetThreadMessages(thread.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to get thread messages: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"thread":   thread,
+		"messages": messages,
+	})
+}
+
+// replyToThread sends an SMS to the thread's number and links it to the thread
+func (app *App) replyToThread(c *gin.Context) {
+	thread := app.threadFromParam(c)
+	if thread == nil {
+		return
+	}
+
+	if thread.Status != ThreadOpen {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Thread %d is closed", thread.ID))
+		return
+	}
+
+	var req ThreadReplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid request: %v", err))
+		return
+	}
+
+	if err := app.validateSMS(thread.Number, req.Content, SendOptions{}); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, errorCode(err, CodeInvalidRequest), "%v", err))
+		return
+	}
+
+	id, err := app.deliverSMS(c.Request.Context(), keyIDFromContext(c), thread.Number, req.Content, SendOptions{})
+
+	// Failed attempts are linked too so the thread shows them
+	if id != 0 {
+		if linkErr := app.db.AddReplyToThread(thread.ID, id); linkErr != nil {
+			log.Printf("Failed to link reply to thread %d: %v", thread.ID, linkErr)
+		}
+	}
+
+	if err != nil {
+		c.JSON(sendErrorResponse(c, err))
+		return
+	}
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("Reply sent to %s", thread.Number),
+	})
+}
+
+// closeThread closes a thread; the next message from its number opens a new one
+func (app *App) closeThread(c *gin.Context) {
+	thread := app.threadFromParam(c)
+	if thread == nil {
+		return
+	}
+
+	closed, err := app.db.CloseThread(thread.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to close thread: %v", err))
+		return
+	}
+	if !closed {
+		c.JSON(http.StatusConflict, errorResponse(c, CodeConflict, "Thread %d is already closed", thread.ID))
+		return
+	}
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("Thread %d closed", thread.ID),
+	})
+}
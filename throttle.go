@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons a request is throttled, returned in the error details and counted
+// per day in throttle_rejections
+const (
+	ThrottleRate      = "rate"       // per-client rate limit, see ratelimit.go
+	ThrottleQuota     = "quota"      // daily send quota of the client
+	ThrottleQueueFull = "queue_full" // send queue is full
+)
+
+// throttleReasons lists the reasons in the order they are reported
+var throttleReasons = []string{ThrottleRate, ThrottleQuota, ThrottleQueueFull}
+
+// throttleStatsDays is how many days of rejections /stats reports
+const throttleStatsDays = 30
+
+// ThrottleSettings limit the sends accepted beyond the rate limit
+type ThrottleSettings struct {
+	DailyQuota int // sends per client and UTC day, 0 = unlimited
+	QueueLimit int // messages waiting in the send queue, 0 = unlimited
+}
+
+// LoadThrottleSettings reads SEND_DAILY_QUOTA and SEND_QUEUE_LIMIT from
+// environment variables. It returns nil if neither is set.
+func LoadThrottleSettings() (*ThrottleSettings, error) {
+	s := &ThrottleSettings{}
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"SEND_DAILY_QUOTA", &s.DailyQuota},
+		{"SEND_QUEUE_LIMIT", &s.QueueLimit},
+	} {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s %q (must be a positive number)", setting.name, value)
+		}
+		*setting.value = n
+	}
+
+	if s.DailyQuota == 0 && s.QueueLimit == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// String describes the limits for the startup log
+func (s *ThrottleSettings) String() string {
+	quota, queue := "unlimited", "unlimited"
+	if s.DailyQuota > 0 {
+		quota = fmt.Sprintf("%d/day", s.DailyQuota)
+	}
+	if s.QueueLimit > 0 {
+		queue = strconv.Itoa(s.QueueLimit)
+	}
+	return fmt.Sprintf("daily quota %s, queue limit %s", quota, queue)
+}
+
+// ThrottleError rejects a send over a limit, with the reason and how long
+// until the client may retry
+type ThrottleError struct {
+	*APIError
+	Reason     string
+	RetryAfter time.Duration
+}
+
+// Unwrap returns the APIError, so errorCode finds the code
+func (e *ThrottleError) Unwrap() error {
+	return e.APIError
+}
+
+// retryAfterSeconds returns RetryAfter in whole seconds, at least 1
+func (e *ThrottleError) retryAfterSeconds() int {
+	return max(1, int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// throttled creates a ThrottleError and counts the rejection
+func (app *App) throttled(reason string, retryAfter time.Duration, code, format string, args ...any) *ThrottleError {
+	if err := app.db.RecordThrottle(reason); err != nil {
+		log.Printf("Failed to record throttled request: %v", err)
+	}
+	return &ThrottleError{APIError: apiErrorf(code, format, args...), Reason: reason, RetryAfter: retryAfter}
+}
+
+// throttledResponse sets the Retry-After header and returns 429 Too Many
+// Requests with the reason in the error details
+func throttledResponse(c *gin.Context, err *ThrottleError) (int, SMSResponse) {
+	seconds := err.retryAfterSeconds()
+	c.Header("Retry-After", strconv.Itoa(seconds))
+
+	resp := errorResponse(c, err.Code, err.format, err.args...)
+	resp.Details = gin.H{"reason": err.Reason, "retry_after": seconds}
+	return http.StatusTooManyRequests, resp
+}
+
+// rejectThrottled aborts a request with the response of a ThrottleError
+func rejectThrottled(c *gin.Context, err *ThrottleError) {
+	c.AbortWithStatusJSON(throttledResponse(c, err))
+}
+
+// checkSendLimits rejects a send while the queue is full or once the sender
+// used up its daily quota. deliverSMS checks it, so every send path counts.
+func (app *App) checkSendLimits(keyID string) *ThrottleError {
+	if app.throttle == nil {
+		return nil
+	}
+
+	if limit := app.throttle.QueueLimit; limit > 0 {
+		if full, wait := app.queue.Overflow(limit); full {
+			return app.throttled(ThrottleQueueFull, wait, CodeQueueFull, "Send queue is full (limit %d), retry later", limit)
+		}
+	}
+
+	if quota := app.throttle.DailyQuota; quota > 0 {
+		now := time.Now().UTC()
+		today := now.Format(dayFormat)
+		usage, err := app.db.GetKeyUsage(keyID, today, today)
+		if err != nil {
+			log.Printf("Failed to check send quota: %v", err)
+		} else if len(usage) > 0 && usage[0].Sent+usage[0].Failed >= quota {
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			return app.throttled(ThrottleQuota, midnight.Sub(now), CodeQuotaExceeded, "Daily quota of %d sends used up", quota)
+		}
+	}
+
+	return nil
+}
+
+// sendThrottle returns middleware that checks the send limits before the
+// request is handled, so that async sends are rejected with 429 too
+func (app *App) sendThrottle() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := app.checkSendLimits(keyIDFromContext(c)); err != nil {
+			rejectThrottled(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// ThrottleDay counts the requests throttled on one day by reason
+type ThrottleDay struct {
+	Day       string `json:"day"`
+	Rate      int    `json:"rate"`
+	Quota     int    `json:"quota"`
+	QueueFull int    `json:"queue_full"`
+}
+
+// ThrottleStats summarizes throttled requests for capacity planning
+type ThrottleStats struct {
+	Total map[string]int `json:"total"` // all time, by reason
+	Days  []ThrottleDay  `json:"days"`  // recent days with rejections, newest first
+}
+
+// RecordThrottle counts a throttled request in today's counters
+func (d *Database) RecordThrottle(reason string) error {
+	_, err := d.db.Exec(`
+		INSERT INTO throttle_rejections (day, reason, count) VALUES (?, ?, 1)
+		ON CONFLICT(day, reason) DO UPDATE SET count = throttle_rejections.count + 1
+	`, time.Now().UTC().Format(dayFormat), reason)
+	if err != nil {
+		return fmt.Errorf("failed to record throttled request: %w", err)
+	}
+	return nil
+}
+
+// GetThrottleStats returns the all-time totals and the daily counts since a day
+func (d *Database) GetThrottleStats(since string) (*ThrottleStats, error) {
+	rows, err := d.db.Query(`SELECT day, reason, count FROM throttle_rejections ORDER BY day DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query throttled requests: %w", err)
+	}
+	defer rows.Close()
+
+	stats := &ThrottleStats{Total: make(map[string]int, len(throttleReasons)), Days: []ThrottleDay{}}
+	for _, reason := range throttleReasons {
+		stats.Total[reason] = 0
+	}
+
+	for rows.Next() {
+		var day, reason string
+		var count int
+		if err := rows.Scan(&day, &reason, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		stats.Total[reason] += count
+		if day < since {
+			continue
+		}
+
+		if n := len(stats.Days); n == 0 || stats.Days[n-1].Day != day {
+			stats.Days = append(stats.Days, ThrottleDay{Day: day})
+		}
+		entry := &stats.Days[len(stats.Days)-1]
+		switch reason {
+		case ThrottleRate:
+			entry.Rate += count
+		case ThrottleQuota:
+			entry.Quota += count
+		case ThrottleQueueFull:
+			entry.QueueFull += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// newTestServer starts the API in test mode, without authentication, after
+// configure adjusted the app
+func newTestServer(t *testing.T, configure func(app *App)) *httptest.Server {
+	t.Setenv("TEST_MODE", "true")
+
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "sms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	modules, err := LoadModules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberValidation, err := LoadNumberValidation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	specialNumbers, err := LoadSpecialNumberPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{
+		db:               db,
+		runMode:          NewRunModeState(RunModeNormal),
+		numberValidation: numberValidation,
+		specialNumbers:   specialNumbers,
+		events:           NewEventBus(),
+		wsHub:            NewWSHub(),
+		testMode:         LoadTestMode(),
+		maxBodyBytes:     GetMaxBodyBytes(),
+		locale:           defaultLocale,
+		modules:          modules,
+	}
+	configure(app)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	app.setupRoutes(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSendQuotaOnEveryEntryPoint(t *testing.T) {
+	server := newTestServer(t, func(app *App) {
+		app.throttle = &ThrottleSettings{DailyQuota: 1}
+		if err := app.db.RecordKeyUsage("anonymous", true, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+	testSendThrottled(t, server, CodeQuotaExceeded)
+}
+
+func TestSendRateLimitOnEveryEntryPoint(t *testing.T) {
+	server := newTestServer(t, func(app *App) {
+		// One token per hour, already taken by the test client
+		app.sendLimit = NewRateLimiter(1.0/3600, 1)
+		app.sendLimit.Allow("ip:127.0.0.1")
+	})
+	testSendThrottled(t, server, CodeRateLimited)
+}
+
+// testSendThrottled checks that a send through each entry point is rejected
+// with code
+func testSendThrottled(t *testing.T, server *httptest.Server, code string) {
+	const number = "+38640123456"
+
+	t.Run("send", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/v1/send", "application/json", strings.NewReader(`{"number":"`+number+`","content":"hi"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body SMSResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || body.Code != code {
+			t.Errorf("got %d %q, want 429 %q", resp.StatusCode, body.Code, code)
+		}
+	})
+
+	t.Run("notify", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/v1/notify?" + url.Values{"to": {number}, "message": {"hi"}}.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("got %d with Retry-After %q, want 429", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	})
+
+	t.Run("rpc", func(t *testing.T) {
+		req := `{"jsonrpc":"2.0","id":1,"method":"sms.send","params":{"number":"` + number + `","content":"hi"}}`
+		resp, err := http.Post(server.URL+"/v1/rpc", "application/json", strings.NewReader(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Error *struct {
+				Code int `json:"code"`
+				Data struct {
+					Code string `json:"code"`
+				} `json:"data"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error == nil || body.Error.Code != rpcThrottled || body.Error.Data.Code != code {
+			t.Errorf("got error %+v, want %d %q", body.Error, rpcThrottled, code)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws"
+		conn, err := websocket.Dial(wsURL, "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if err := websocket.JSON.Send(conn, wsCommand{ID: json.RawMessage("1"), Type: "send", Number: number, Content: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		var msg wsMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Status != "error" || msg.Code != code {
+			t.Errorf("got %s %q, want error %q", msg.Status, msg.Code, code)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadAllRequest limits POST /received/read-all to the messages a consumer
+// has seen, so that messages received meanwhile stay unread
+type ReadAllRequest struct {
+	MaxID int `json:"max_id,omitempty"` // mark messages up to this ID, 0 = all
+}
+
+// MarkReceivedSMSRead marks a received SMS read, reporting whether it exists
+func (d *Database) MarkReceivedSMSRead(id int) (bool, error) {
+	res, err := d.db.Exec(`UPDATE received_sms SET read = 1 WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark SMS read: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// MarkAllReceivedSMSRead marks the unread received SMS up to maxID read, or
+// all of them if maxID is 0, and returns how many it marked
+func (d *Database) MarkAllReceivedSMSRead(maxID int) (int64, error) {
+	query := `UPDATE received_sms SET read = 1 WHERE read = 0`
+	var args []any
+	if maxID > 0 {
+		query += ` AND id <= ?`
+		args = append(args, maxID)
+	}
+
+	res, err := d.db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark SMS read: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// markReceivedSMSRead marks a received SMS read. Marking a read message
+// again succeeds.
+func (app *App) markReceivedSMSRead(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid message ID"))
+		return
+	}
+
+	found, err := app.db.MarkReceivedSMSRead(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to mark message read: %v", err))
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Message %d not found", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// markAllReceivedSMSRead marks the unread received SMS read
+func (app *App) markAllReceivedSMSRead(c *gin.Context) {
+	var req ReadAllRequest
+	if c.Request.ContentLength != 0 && !bindStrictJSON(c, &req) {
+		return
+	}
+	if req.MaxID < 0 {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid max_id"))
+		return
+	}
+
+	marked, err := app.db.MarkAllReceivedSMSRead(req.MaxID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to mark messages read: %v", err))
+		return
+	}
+
+	if marked > 0 {
+		log.Printf("Marked %d received SMS read", marked)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"marked": marked,
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dayFormat is the layout of the day column in key_usage
+const dayFormat = "2006-01-02"
+
+// KeyUsage represents send statistics for an API key on one day
+type KeyUsage struct {
+	Day      string `json:"day"`
+	Sent     int    `json:"sent"`
+	Failed   int    `json:"failed"`
+	Segments int    `json:"segments"`
+}
+
+// RecordKeyUsage adds a send attempt to the daily usage counters of an API key.
+// Segments are only counted for successful sends.
+func (d *Database) RecordKeyUsage(keyID string, success bool, segments int) error {
+	sent, failed := 0, 1
+	if success {
+		sent, failed = 1, 0
+	} else {
+		segments = 0
+	}
+
+	query := `
+		INSERT INTO key_usage (key_id, day, sent, failed, segments) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(key_id, day) DO UPDATE SET
+			sent = key_usage.sent + excluded.sent,
+			failed = key_usage.failed + excluded.failed,
+			segments = key_usage.segments + excluded.segments
+	`
+
+	_, err := d.db.Exec(query, keyID, time.Now().UTC().Format(dayFormat), sent, failed, segments)
+	if err != nil {
+		return fmt.Errorf("failed to record key usage: %w", err)
+	}
+
+	return nil
+}
+
+// GetKeyUsage retrieves the daily usage of an API key between two days (inclusive)
+func (d *Database) GetKeyUsage(keyID, from, to string) ([]KeyUsage, error) {
+	query := `
+		SELECT day, sent, failed, segments
+		FROM key_usage
+		WHERE key_id = ? AND day >= ? AND day <= ?
+		ORDER BY day ASC
+	`
+
+	rows, err := d.db.Query(query, keyID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key usage: %w", err)
+	}
+	defer rows.Close()
+
+	var usage []KeyUsage
+
+	for rows.Next() {
+		var u KeyUsage
+		if err := rows.Scan(&u.Day, &u.Sent, &u.Failed, &u.Segments); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		usage = append(usage, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return usage, nil
+}
+
+// getKeyUsage returns daily send statistics for an API key.
+// The range defaults to the last 30 days and can be set with from/to (YYYY-MM-DD).
+func (app *App) getKeyUsage(c *gin.Context) {
+	keyID := c.Param("id")
+
+	now := time.Now().UTC()
+	from := now.AddDate(0, 0, -29).Format(dayFormat)
+	to := now.Format(dayFormat)
+
+	for param, target := range map[string]*string{"from": &from, "to": &to} {
+		if value := c.Query(param); value != "" {
+			if _, err := time.Parse(dayFormat, value); err != nil {
+				c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid '%s' parameter, expected YYYY-MM-DD", param))
+				return
+			}
+			*target = value
+		}
+	}
+
+	days, err := app.db.GetKeyUsage(keyID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve usage: %v", err))
+		return
+	}
+
+	var total KeyUsage
+	for _, day := range days {
+		total.Sent += day.Sent
+		total.Failed += day.Failed
+		total.Segments += day.Segments
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"key_id":   keyID,
+		"from":     from,
+		"to":       to,
+		"sent":     total.Sent,
+		"failed":   total.Failed,
+		"segments": total.Segments,
+		"days":     days,
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhook payload formats
+const (
+	WebhookFormatDefault = "default" // {"event": ..., "data": {...}}
+	WebhookFormatSimple  = "simple"  // flat fields and a plain string timestamp, e.g. for Node-RED
+)
+
+// simpleTimestampFormat is the timestamp layout of simple payloads
+const simpleTimestampFormat = "2006-01-02 15:04:05"
+
+// Webhook represents a registered webhook
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Format    string    `json:"format"`
+	KeyID     string    `json:"key_id,omitempty"` // API key whose scope limits the events, see tenants.go
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookRequest represents a request to register a webhook
+type WebhookRequest struct {
+	URL    string `json:"url" binding:"required"`
+	Format string `json:"format"`
+	KeyID  string `json:"key_id"`
+}
+
+// SimpleMessage is the flat representation of a received SMS used by simple
+// webhook payloads and the Node-RED pull endpoint
+type SimpleMessage struct {
+	Event     string `json:"event,omitempty"`
+	ID        int    `json:"id,omitempty"`
+	Number    string `json:"number"`
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+	Unix      int64  `json:"unix"`
+}
+
+// newSimpleMessage builds the flat representation of a received SMS
+func newSimpleMessage(event string, msg ReceivedSMS) SimpleMessage {
+	return SimpleMessage{
+		Event:     event,
+		ID:        msg.ID,
+		Number:    msg.Number,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp.Local().Format(simpleTimestampFormat),
+		Unix:      msg.Timestamp.Unix(),
+	}
+}
+
+// CreateWebhook registers a webhook
+func (d *Database) CreateWebhook(url, format, keyID string) (*Webhook, error) {
+	var id int
+	err := d.db.QueryRow(`INSERT INTO webhooks (url, format, key_id) VALUES (?, ?, ?) RETURNING id`, url, format, nullIfEmpty(keyID)).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save webhook: %w", err)
+	}
+
+	return d.GetWebhook(id)
+}
+
+// GetWebhook retrieves a webhook by ID, returning nil if it does not exist
+func (d *Database) GetWebhook(id int) (*Webhook, error) {
+	var hook Webhook
+	var createdAtStr string
+
+	err := d.db.QueryRow(`SELECT id, url, format, COALESCE(key_id, ''), created_at FROM webhooks WHERE id = ?`, id).
+		Scan(&hook.ID, &hook.URL, &hook.Format, &hook.KeyID, &createdAtStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook: %w", err)
+	}
+
+	hook.CreatedAt = parseTimestamp(createdAtStr)
+
+	return &hook, nil
+}
+
+// ListWebhooks retrieves all registered webhooks
+func (d *Database) ListWebhooks() ([]Webhook, error) {
+	rows, err := d.db.Query(`SELECT id, url, format, COALESCE(key_id, ''), created_at FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		var createdAtStr string
+
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.Format, &hook.KeyID, &createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		hook.CreatedAt = parseTimestamp(createdAtStr)
+		hooks = append(hooks, hook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook, reporting whether it existed
+func (d *Database) DeleteWebhook(id int) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// WebhookDispatcher posts events to the registered webhooks
+type WebhookDispatcher struct {
+	db      *Database
+	tenants *TenantScopes
+	client  *http.Client
+}
+
+// NewWebhookDispatcher creates a dispatcher for the webhooks stored in db.
+// Webhooks of a scoped API key only get the events in its scope.
+func NewWebhookDispatcher(db *Database, tenants *TenantScopes) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:      db,
+		tenants: tenants,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// inScope reports whether an event is in the scope of a webhook's API key
+func (w *WebhookDispatcher) inScope(hook Webhook, event Event) bool {
+	return w.tenants.Scope(hook.KeyID).Allows(event)
+}
+
+// DispatchReceived posts a message.received event to every webhook in its
+// configured format. It does nothing on a nil dispatcher, i.e. when the
+// webhooks module is disabled.
+func (w *WebhookDispatcher) DispatchReceived(msg ReceivedSMS) {
+	w.dispatch(EventMessageReceived, msg, receivedEvent(msg))
+}
+
+// DispatchEscalated posts a message.escalated event for a received SMS that
+// is still unacknowledged
+func (w *WebhookDispatcher) DispatchEscalated(msg ReceivedSMS) {
+	w.dispatch(EventMessageEscalated, msg, escalatedEvent(msg))
+}
+
+// DispatchDeviceEvent posts an event about the device, e.g. device.service_lost,
+// to every webhook. Simple payloads carry the event name among the data's fields.
+func (w *WebhookDispatcher) DispatchDeviceEvent(event string, data gin.H) {
+	if w == nil {
+		return
+	}
+	hooks, err := w.db.ListWebhooks()
+	if err != nil {
+		log.Printf("Webhooks: %v", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !w.inScope(hook, Event{Type: event, Data: data}) {
+			continue
+		}
+		payload := gin.H{"event": event, "data": data}
+		if hook.Format == WebhookFormatSimple {
+			payload = gin.H{"event": event}
+			for k, v := range data {
+				payload[k] = v
+			}
+		}
+		go w.post(hook, payload)
+	}
+}
+
+// HandleEvent posts message.received, message.escalated and service loss
+// events from the event bus
+func (w *WebhookDispatcher) HandleEvent(event Event) {
+	switch event.Type {
+	case EventMessageReceived:
+		w.DispatchReceived(event.Data.(ReceivedSMS))
+	case EventMessageEscalated:
+		w.DispatchEscalated(event.Data.(ReceivedSMS))
+	case EventServiceLost, EventServiceRestored:
+		w.DispatchDeviceEvent(event.Type, serviceLossEvent(event.Data.(*ServiceLoss)))
+	}
+}
+
+// dispatch posts an event about a received SMS to every webhook in its
+// configured format, with data as the payload of the default format
+func (w *WebhookDispatcher) dispatch(event string, msg ReceivedSMS, data gin.H) {
+	if w == nil {
+		return
+	}
+	hooks, err := w.db.ListWebhooks()
+	if err != nil {
+		log.Printf("Webhooks: %v", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !w.inScope(hook, Event{Type: event, Data: msg}) {
+			continue
+		}
+		go w.post(hook, webhookPayload(hook, event, msg, data))
+	}
+}
+
+// webhookPayload builds the payload of an event in the webhook's configured format
+func webhookPayload(hook Webhook, event string, msg ReceivedSMS, data gin.H) interface{} {
+	if hook.Format == WebhookFormatSimple {
+		return newSimpleMessage(event, msg)
+	}
+	return gin.H{
+		"event": event,
+		"data":  data,
+	}
+}
+
+// post delivers one payload to a webhook, logging and returning any failure
+func (w *WebhookDispatcher) post(hook Webhook, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Webhook %d: failed to encode payload: %v", hook.ID, err)
+		return err
+	}
+
+	resp, err := w.client.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Webhook %d: failed to post to %s: %v", hook.ID, hook.URL, err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook %d: %s returned %s", hook.ID, hook.URL, resp.Status)
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// listWebhooks returns the registered webhooks
+func (app *App) listWebhooks(c *gin.Context) {
+	hooks, err := app.db.ListWebhooks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to list webhooks: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"webhooks": hooks,
+	})
+}
+
+// createWebhook registers a webhook
+func (app *App) createWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid request: %v", err))
+		return
+	}
+
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid webhook URL, expected http(s)://host/path"))
+		return
+	}
+
+	if req.Format == "" {
+		req.Format = WebhookFormatDefault
+	}
+	if req.Format != WebhookFormatDefault && req.Format != WebhookFormatSimple {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid format %q, expected %s or %s", req.Format, WebhookFormatDefault, WebhookFormatSimple))
+		return
+	}
+
+	if req.KeyID != "" && app.tenants.Scope(req.KeyID) == nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "API key %q has no tenant scope, see TENANT_SCOPES", req.KeyID))
+		return
+	}
+
+	hook, err := app.db.CreateWebhook(req.URL, req.Format, req.KeyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to create webhook: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status":  "success",
+		"webhook": hook,
+	})
+}
+
+// deleteWebhook removes a webhook
+func (app *App) deleteWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid webhook ID"))
+		return
+	}
+
+	deleted, err := app.db.DeleteWebhook(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to delete webhook: %v", err))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, errorResponse(c, CodeNotFound, "Webhook %d not found", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, SMSResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("Webhook %d deleted", id),
+	})
+}
+
+// noderedReceived returns received SMS newer than since_id, oldest first, as a
+// bare array of flat messages that Node-RED flows can use without a change node
+func (app *App) noderedReceived(c *gin.Context) {
+	sinceID, err := strconv.Atoi(c.DefaultQuery("since_id", "0"))
+	if err != nil || sinceID < 0 {
+		c.JSON(http.StatusBadRequest, errorResponse(c, CodeInvalidRequest, "Invalid 'since_id' parameter"))
+		return
+	}
+
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+			if limit > 100 {
+				limit = 100 // Cap at 100
+			}
+		}
+	}
+
+	messages, err := app.db.GetReceivedSMSSince(sinceID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, CodeInternalError, "Failed to retrieve messages: %v", err))
+		return
+	}
+
+	result := make([]SimpleMessage, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, newSimpleMessage("", msg))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// wsCommand represents a command sent by a WebSocket client.
+// ID is echoed back in the response for correlation.
+type wsCommand struct {
+	ID       json.RawMessage `json:"id"`
+	Type     string          `json:"type"`
+	Number   string          `json:"number,omitempty"`
+	Content  string          `json:"content,omitempty"`
+	Class    *int            `json:"class,omitempty"`
+	SenderID string          `json:"sender_id,omitempty"`
+	Template string          `json:"template,omitempty"`
+	Campaign string          `json:"campaign,omitempty"`
+	Group    string          `json:"group,omitempty"`
+
+	TemplateVersion int  `json:"template_version,omitempty"`
+	ConfirmSpecial  bool `json:"confirm_special,omitempty"`
+}
+
+// wsMessage represents a message sent to a WebSocket client: either a
+// response to a command or an event pushed by the server
+type wsMessage struct {
+	Type    string          `json:"type"` // response or event
+	ID      json.RawMessage `json:"id,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Status  string          `json:"status,omitempty"`
+	Code    string          `json:"code,omitempty"` // error code, see SMSResponse
+	Message string          `json:"message,omitempty"`
+	Data    interface{}     `json:"data,omitempty"`
+}
+
+// A WebSocket client gets wsSendBuffer messages queued for it, each written
+// within wsWriteTimeout. A client that falls further behind is disconnected.
+const (
+	wsSendBuffer   = 64
+	wsWriteTimeout = 10 * time.Second
+)
+
+// errWSClientGone is returned when sending to a disconnected client
+var errWSClientGone = errors.New("client disconnected")
+
+// wsClient is a connected WebSocket client. Messages are written by its own
+// writer goroutine, so a stalled client never blocks the event bus.
+type wsClient struct {
+	conn      *websocket.Conn
+	out       chan wsMessage
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWSClient creates a client and starts its writer
+func newWSClient(conn *websocket.Conn) *wsClient {
+	w := &wsClient{conn: conn, out: make(chan wsMessage, wsSendBuffer), done: make(chan struct{})}
+	go w.writeLoop()
+	return w
+}
+
+// send queues a message for the client without blocking; safe for concurrent
+// use. A client whose queue is full is disconnected.
+func (w *wsClient) send(msg wsMessage) error {
+	select {
+	case <-w.done:
+		return errWSClientGone
+	default:
+	}
+
+	select {
+	case w.out <- msg:
+		return nil
+	default:
+		log.Printf("WebSocket: client not reading, %d messages queued; disconnecting", wsSendBuffer)
+		w.close()
+		return errWSClientGone
+	}
+}
+
+// writeLoop writes the queued messages until the client is closed
+func (w *wsClient) writeLoop() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case msg := <-w.out:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := websocket.JSON.Send(w.conn, msg); err != nil {
+				log.Printf("WebSocket: failed to write %s: %v", msg.Type, err)
+				w.close()
+				return
+			}
+		}
+	}
+}
+
+// close disconnects the client, which also ends its read loop
+func (w *wsClient) close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.conn.Close()
+	})
+}
+
+// WSHub tracks WebSocket clients. Each client allowed to read messages
+// subscribes to the event bus itself, within its API key's scope.
+type WSHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+}
+
+// NewWSHub creates an empty hub
+func NewWSHub() *WSHub {
+	return &WSHub{clients: make(map[*wsClient]struct{})}
+}
+
+// add registers a client
+func (h *WSHub) add(client *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[client] = struct{}{}
+}
+
+// remove unregisters a client
+func (h *WSHub) remove(client *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+// handleEvent queues an event from the event bus for the client
+func (w *wsClient) handleEvent(event Event) {
+	msg := wsMessage{Type: "event", Event: event.Type, Data: event.Data}
+	switch event.Type {
+	case EventMessageReceived:
+		msg.Data = receivedEvent(event.Data.(ReceivedSMS))
+	case EventMessageEscalated:
+		msg.Data = escalatedEvent(event.Data.(ReceivedSMS))
+	}
+
+	w.send(msg)
+}
+
+// handleWebSocket upgrades the connection, pushes events to the client and
+// executes commands it sends
+func (app *App) handleWebSocket(c *gin.Context) {
+	server := websocket.Server{
+		// Clients are authenticated by token, so any origin is accepted
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			client := newWSClient(conn)
+			defer client.close()
+
+			app.wsHub.add(client)
+			defer app.wsHub.remove(client)
+
+			// Clients allowed to read messages get the events in their key's scope
+			if app.hasRole(c, RoleRead) {
+				unsubscribe := app.events.SubscribeScoped(app.tenants.Scope(keyIDFromContext(c)), client.handleEvent)
+				defer unsubscribe()
+			}
+
+			// Cancelled when the client disconnects so pending sends are dropped
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			for {
+				var cmd wsCommand
+				if err := websocket.JSON.Receive(conn, &cmd); err != nil {
+					var syntaxErr *json.SyntaxError
+					if errors.As(err, &syntaxErr) {
+						client.send(wsMessage{Type: "response", Status: "error", Code: CodeInvalidRequest, Message: "Invalid JSON"})
+						continue
+					}
+					return
+				}
+
+				// Commands run concurrently; responses are matched by ID
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp := app.executeWSCommand(ctx, c, cmd)
+					resp.Type = "response"
+					resp.ID = cmd.ID
+					if err := client.send(resp); err != nil {
+						log.Printf("WebSocket: failed to send response: %v", err)
+					}
+				}()
+			}
+		},
+	}
+
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// executeWSCommand runs a single WebSocket command
+func (app *App) executeWSCommand(ctx context.Context, c *gin.Context, cmd wsCommand) wsMessage {
+	locale := localeFromContext(c)
+	required := map[string]string{
+		"send":         RoleSend,
+		"status":       RoleRead,
+		"wakeup":       RoleAdmin,
+		"queue.pause":  RoleAdmin,
+		"queue.resume": RoleAdmin,
+	}
+
+	if cmd.Type == "ping" {
+		return wsMessage{Status: "success", Message: "pong"}
+	}
+
+	role, ok := required[cmd.Type]
+	if !ok {
+		return wsMessage{Status: "error", Code: CodeInvalidRequest, Message: T(locale, "Unknown command type %q", cmd.Type)}
+	}
+	if !app.hasRole(c, role) {
+		return wsMessage{Status: "error", Code: CodeForbidden, Message: T(locale, "Token lacks required role %s", role)}
+	}
+
+	switch cmd.Type {
+	case "send":
+		opts := SendOptions{Class: cmd.Class, SenderID: cmd.SenderID, Template: cmd.Template, Campaign: cmd.Campaign, Group: cmd.Group,
+			TemplateVersion: cmd.TemplateVersion, ConfirmSpecial: cmd.ConfirmSpecial}
+		number := app.resolveTarget(cmd.Number)
+		if err := app.validateSMS(number, cmd.Content, opts); err != nil {
+			return wsMessage{Status: "error", Code: errorCode(err, CodeInvalidRequest), Message: errorMessage(err, locale)}
+		}
+		cmd.Content = app.localizeTemplate(number, cmd.Content, opts)
+		if app.runMode.Get() != RunModeNormal {
+			return wsMessage{Status: "error", Code: runModeErrorCode(app.runMode.Get()), Message: T(locale, "Service is in %s mode", app.runMode.Get())}
+		}
+
+		err := app.allowSend(c)
+		if err == nil {
+			_, err = app.deliverSMS(ctx, keyIDFromContext(c), number, cmd.Content, opts)
+		}
+		var throttleErr *ThrottleError
+		switch {
+		case errors.As(err, &throttleErr):
+			return wsMessage{Status: "error", Code: throttleErr.Code, Message: throttleErr.Localize(locale), Data: gin.H{"reason": throttleErr.Reason, "retry_after": throttleErr.retryAfterSeconds()}}
+		case errors.Is(err, ErrNotConnected):
+			return wsMessage{Status: "error", Code: CodeDeviceNotConnected, Message: T(locale, "Not connected to Arduino device")}
+		case err != nil:
+			return wsMessage{Status: "error", Code: sendErrorCode(err), Message: T(locale, "Failed to send SMS: %v", err), Data: gin.H{"error_class": ClassifyError(err)}}
+		}
+		return wsMessage{Status: "success", Message: fmt.Sprintf("SMS sent to %s", number)}
+
+	case "status":
+		return wsMessage{Status: "success", Data: app.deviceStatus()}
+
+	case "wakeup":
+		if err := app.smsConn.Wakeup(); err != nil {
+			return wsMessage{Status: "error", Code: CodeInternalError, Message: T(locale, "Failed to send wakeup: %v", err)}
+		}
+		return wsMessage{Status: "success", Message: "GSM wakeup initiated"}
+
+	case "queue.pause":
+		app.queue.Pause()
+		log.Println("Send queue paused")
+		return wsMessage{Status: "success", Message: "Queue paused"}
+
+	case "queue.resume":
+		app.queue.Resume()
+		log.Println("Send queue resumed")
+		return wsMessage{Status: "success", Message: "Queue resumed"}
+	}
+
+	return wsMessage{Status: "error", Code: CodeInvalidRequest, Message: T(locale, "Unknown command type %q", cmd.Type)}
+}
+
+// receivedEvent builds the payload of a message.received event
+func receivedEvent(msg ReceivedSMS) gin.H {
+	return gin.H{
+		"id":        msg.ID,
+		"number":    msg.Number,
+		"content":   msg.Content,
+		"timestamp": msg.Timestamp,
+
+		"conversation_id": msg.ConversationID,
+		"number_class":    msg.NumberClass,
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketSendErrorLocalized(t *testing.T) {
+	server := newTestServer(t, func(app *App) {})
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws?lang=de"
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, wsCommand{ID: json.RawMessage("1"), Type: "send", Number: "+38640123456"}); err != nil {
+		t.Fatal(err)
+	}
+	var msg wsMessage
+	if err := websocket.JSON.Receive(conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Code != CodeInvalidContent || msg.Message != "Der SMS-Inhalt darf nicht leer sein" {
+		t.Errorf("got %s %q, want %s in German", msg.Code, msg.Message, CodeInvalidContent)
+	}
+}